@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -17,12 +18,35 @@ import (
 
 var (
 	serverURL            string
+	adminToken           string
 	entityID             string
 	acsURL               string
 	acsBinding           string
 	outputFormat         string
 	attributeMappingFile string
 	nameidFormat         string
+	nameidFormats        []string
+	updateACSBinding     string
+	sloURL               string
+	sloBinding           string
+	allowIdPInitiated    bool
+	metadataFile         string
+	metadataURL          string
+	metadataRefresh      time.Duration
+	metadataCertFile     string
+	encryptionCertFile   string
+	encryptionAlgorithm  string
+	signingCertFiles     []string
+	requireSigned        bool
+	signatureAlgorithm   string
+	signingMode          string
+	clearMapping         bool
+	accessPolicyFile     string
+	clearAccessPolicy    bool
+	filterEntityID       string
+	filterACSBinding     string
+	limit                int
+	offset               int
 )
 
 func main() {
@@ -39,29 +63,114 @@ func main() {
 		RunE:  runAdd,
 	}
 
-	// Add flags
-	addCmd.Flags().StringVar(&serverURL, "server", "http://localhost:8082", "Base URL of the Identity SAML Provider server")
-	addCmd.Flags().StringVarP(&entityID, "entity-id", "e", "", "Entity ID (unique identifier) of the service provider (required, must be a valid URL)")
-	addCmd.Flags().StringVarP(&acsURL, "acs-url", "a", "", "Assertion Consumer Service (ACS) URL (required, must be a valid URL)")
-	addCmd.Flags().StringVarP(&acsBinding, "acs-binding", "b", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST", "ACS binding type (optional, defaults to HTTP-POST)")
-	addCmd.Flags().StringVar(&outputFormat, "output", "human", "Output format: 'human' for human-readable or 'json' for JSON")
-	addCmd.Flags().StringVar(&attributeMappingFile, "attribute-mapping-file", "", "Path to a JSON file containing the attribute mapping configuration")
-	addCmd.Flags().StringVar(&nameidFormat, "nameid-format", "", "NameID format for this SP (e.g., 'persistent', 'transient', 'emailAddress')")
-
-	// Mark required flags
-	addCmd.MarkFlagRequired("entity-id")
-	addCmd.MarkFlagRequired("acs-url")
+	// Global flags
+	rootCmd.PersistentFlags().StringVar(&serverURL, "server", "http://localhost:8082", "Base URL of the Identity SAML Provider server")
+	rootCmd.PersistentFlags().StringVar(&adminToken, "token", "", "Bearer token for the admin API (defaults to $SAML_PROVIDER_ADMIN_TOKEN)")
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output", "human", "Output format: 'human' for human-readable or 'json' for JSON")
 
 	// Add validation for output format
-	addCmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		if outputFormat != "human" && outputFormat != "json" {
 			return fmt.Errorf("invalid output format: %q (must be 'human' or 'json')", outputFormat)
 		}
+		if adminToken == "" {
+			adminToken = os.Getenv("SAML_PROVIDER_ADMIN_TOKEN")
+		}
 		return nil
 	}
 
+	// Add flags
+	addCmd.Flags().StringVarP(&entityID, "entity-id", "e", "", "Entity ID (unique identifier) of the service provider (required unless metadata is given, must be a valid URL)")
+	addCmd.Flags().StringVarP(&acsURL, "acs-url", "a", "", "Assertion Consumer Service (ACS) URL (required unless metadata is given, must be a valid URL)")
+	addCmd.Flags().StringVarP(&acsBinding, "acs-binding", "b", "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST", "ACS binding type (optional, defaults to HTTP-POST)")
+	addCmd.Flags().StringVar(&sloURL, "slo-url", "", "Single Logout Service URL (optional, must be a valid URL)")
+	addCmd.Flags().StringVar(&sloBinding, "slo-binding", "", "Single Logout Service binding type (optional, defaults to HTTP-Redirect)")
+	addCmd.Flags().BoolVar(&allowIdPInitiated, "allow-idp-initiated", false, "Allow IdP-initiated SSO (unsolicited responses) to this service provider")
+	addCmd.Flags().StringVar(&attributeMappingFile, "attribute-mapping-file", "", "Path to a JSON file containing the attribute mapping configuration")
+	addCmd.Flags().StringVar(&nameidFormat, "nameid-format", "", "NameID format for this SP (e.g., 'persistent', 'transient', 'emailAddress')")
+	addCmd.Flags().StringSliceVar(&nameidFormats, "nameid-formats", nil, "NameID formats this SP may be issued, comma-separated (default: every supported format)")
+	addCmd.Flags().StringVar(&accessPolicyFile, "access-policy-file", "", "Path to a JSON file containing the access policy of the service provider")
+	addCmd.Flags().StringVar(&metadataFile, "metadata-file", "", "Path to an SP metadata XML document to import")
+	addCmd.Flags().StringVar(&metadataURL, "metadata-url", "", "URL the server should fetch the SP metadata XML document from")
+	addCmd.Flags().DurationVar(&metadataRefresh, "metadata-refresh-interval", 0, "How often the server re-fetches --metadata-url (e.g. 24h, 0 disables refreshing)")
+	addCmd.Flags().StringVar(&metadataCertFile, "metadata-signing-cert-file", "", "Path to a PEM certificate the metadata document must be signed with")
+	addCmd.Flags().StringVar(&encryptionCertFile, "encryption-cert-file", "", "Path to a PEM certificate assertions for this SP are encrypted to")
+	addCmd.Flags().StringVar(&encryptionAlgorithm, "encryption-algorithm", "", "XML Encryption block cipher URI for assertions (e.g. http://www.w3.org/2009/xmlenc11#aes128-gcm)")
+	addCmd.Flags().StringArrayVar(&signingCertFiles, "signing-cert-file", nil, "Path to a PEM certificate requests from this SP are signed with (repeatable)")
+	addCmd.Flags().BoolVar(&requireSigned, "require-signed-requests", false, "Reject unsigned AuthnRequests and LogoutRequests from this service provider")
+	addCmd.Flags().StringVar(&signingMode, "signing-mode", "", "Sign the response, the assertion or both (default both)")
+	addCmd.Flags().StringVar(&signatureAlgorithm, "signature-algorithm", "", "XML Signature method URI for responses and assertions (e.g. http://www.w3.org/2000/09/xmldsig#rsa-sha1 for legacy SPs)")
+	addCmd.MarkFlagsMutuallyExclusive("metadata-file", "metadata-url")
+	addCmd.MarkFlagsMutuallyExclusive("metadata-file", "acs-url")
+	addCmd.MarkFlagsMutuallyExclusive("metadata-url", "acs-url")
+	addCmd.MarkFlagsMutuallyExclusive("metadata-file", "slo-url")
+	addCmd.MarkFlagsMutuallyExclusive("metadata-url", "slo-url")
+
 	rootCmd.AddCommand(addCmd)
 
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List registered SAML service providers",
+		RunE:  runList,
+	}
+	listCmd.Flags().StringVar(&filterEntityID, "entity-id", "", "Only list service providers whose entity ID contains this value")
+	listCmd.Flags().StringVar(&filterACSBinding, "acs-binding", "", "Only list service providers using this ACS binding")
+	listCmd.Flags().IntVar(&limit, "limit", 50, "Maximum number of service providers to return")
+	listCmd.Flags().IntVar(&offset, "offset", 0, "Number of service providers to skip")
+	rootCmd.AddCommand(listCmd)
+
+	getCmd := &cobra.Command{
+		Use:   "get",
+		Short: "Show a registered SAML service provider",
+		RunE:  runGet,
+	}
+	getCmd.Flags().StringVarP(&entityID, "entity-id", "e", "", "Entity ID of the service provider (required)")
+	getCmd.MarkFlagRequired("entity-id")
+	rootCmd.AddCommand(getCmd)
+
+	updateCmd := &cobra.Command{
+		Use:   "update",
+		Short: "Update a registered SAML service provider",
+		Long:  "Update selected fields of a registered SAML service provider. Fields whose flags are not set are left unchanged.",
+		RunE:  runUpdate,
+	}
+	updateCmd.Flags().StringVarP(&entityID, "entity-id", "e", "", "Entity ID of the service provider (required)")
+	updateCmd.Flags().StringVarP(&acsURL, "acs-url", "a", "", "New Assertion Consumer Service (ACS) URL")
+	updateCmd.Flags().StringVarP(&updateACSBinding, "acs-binding", "b", "", "New ACS binding type")
+	updateCmd.Flags().StringVar(&sloURL, "slo-url", "", "New Single Logout Service URL (empty removes it)")
+	updateCmd.Flags().StringVar(&sloBinding, "slo-binding", "", "New Single Logout Service binding type")
+	updateCmd.Flags().BoolVar(&allowIdPInitiated, "allow-idp-initiated", false, "Allow or disallow IdP-initiated SSO to this service provider")
+	updateCmd.Flags().StringVar(&attributeMappingFile, "attribute-mapping-file", "", "Path to a JSON file containing the new attribute mapping configuration")
+	updateCmd.Flags().StringVar(&nameidFormat, "nameid-format", "", "Replace the attribute mapping with one that only sets this NameID format")
+	updateCmd.Flags().BoolVar(&clearMapping, "clear-attribute-mapping", false, "Remove the attribute mapping from the service provider")
+	updateCmd.Flags().StringSliceVar(&nameidFormats, "nameid-formats", nil, "Replace the NameID formats this SP may be issued (empty allows every supported format)")
+	updateCmd.Flags().StringVar(&accessPolicyFile, "access-policy-file", "", "Path to a JSON file containing the new access policy")
+	updateCmd.Flags().BoolVar(&clearAccessPolicy, "clear-access-policy", false, "Remove the access policy, allowing every authenticated user")
+	updateCmd.Flags().StringVar(&metadataFile, "metadata-file", "", "Path to an SP metadata XML document to import")
+	updateCmd.Flags().StringVar(&metadataURL, "metadata-url", "", "URL the server should fetch the SP metadata XML document from")
+	updateCmd.Flags().DurationVar(&metadataRefresh, "metadata-refresh-interval", 0, "How often the server re-fetches --metadata-url (e.g. 24h, 0 disables refreshing)")
+	updateCmd.Flags().StringVar(&metadataCertFile, "metadata-signing-cert-file", "", "Path to a PEM certificate the metadata document must be signed with")
+	updateCmd.Flags().StringVar(&encryptionCertFile, "encryption-cert-file", "", "Path to a PEM certificate assertions for this SP are encrypted to (empty stops encrypting)")
+	updateCmd.Flags().StringVar(&encryptionAlgorithm, "encryption-algorithm", "", "New XML Encryption block cipher URI for assertions (empty uses the metadata or default)")
+	updateCmd.Flags().StringArrayVar(&signingCertFiles, "signing-cert-file", nil, "Path to a PEM certificate requests from this SP are signed with; replaces the registered ones (repeatable, empty clears them)")
+	updateCmd.Flags().BoolVar(&requireSigned, "require-signed-requests", false, "Require or stop requiring signed requests from this service provider")
+	updateCmd.Flags().StringVar(&signingMode, "signing-mode", "", "New signing mode: response, assertion or both")
+	updateCmd.Flags().StringVar(&signatureAlgorithm, "signature-algorithm", "", "New XML Signature method URI for responses and assertions (empty uses the server default)")
+	updateCmd.MarkFlagsMutuallyExclusive("metadata-file", "metadata-url")
+	updateCmd.MarkFlagRequired("entity-id")
+	updateCmd.MarkFlagsMutuallyExclusive("attribute-mapping-file", "nameid-format", "clear-attribute-mapping")
+	updateCmd.MarkFlagsMutuallyExclusive("access-policy-file", "clear-access-policy")
+	rootCmd.AddCommand(updateCmd)
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Delete a registered SAML service provider",
+		RunE:  runDelete,
+	}
+	deleteCmd.Flags().StringVarP(&entityID, "entity-id", "e", "", "Entity ID of the service provider (required)")
+	deleteCmd.MarkFlagRequired("entity-id")
+	rootCmd.AddCommand(deleteCmd)
+
 	versionCmd := &cobra.Command{
 		Use:   "version",
 		Short: "Print version",
@@ -78,49 +187,411 @@ func main() {
 }
 
 func runAdd(cmd *cobra.Command, args []string) error {
-	// Ensure server URL doesn't have trailing slash
-	serverURL = strings.TrimSuffix(serverURL, "/")
+	// Prepare request body
+	requestBody := map[string]interface{}{}
+	if entityID != "" {
+		requestBody["entity_id"] = entityID
+	}
 
-	endpoint := serverURL + "/admin/service-providers"
+	metadataGiven, err := addMetadata(cmd, requestBody)
+	if err != nil {
+		return err
+	}
+	if !metadataGiven {
+		if entityID == "" || acsURL == "" {
+			return fmt.Errorf("--entity-id and --acs-url are required unless --metadata-file or --metadata-url is set")
+		}
+		requestBody["acs_url"] = acsURL
+		requestBody["acs_binding"] = acsBinding
+		if sloURL != "" {
+			requestBody["slo_url"] = sloURL
+		}
+		if sloBinding != "" {
+			requestBody["slo_binding"] = sloBinding
+		}
+	}
 
-	// Prepare request body
-	requestBody := map[string]interface{}{
-		"entity_id":   entityID,
-		"acs_url":     acsURL,
-		"acs_binding": acsBinding,
+	if allowIdPInitiated {
+		requestBody["allow_idp_initiated"] = true
+	}
+	if len(nameidFormats) > 0 {
+		requestBody["nameid_formats"] = nameidFormats
+	}
+	if err := addEncryption(cmd, requestBody); err != nil {
+		return err
+	}
+	if err := addRequestSigning(cmd, requestBody); err != nil {
+		return err
 	}
 
+	mapping, err := loadAttributeMapping()
+	if err != nil {
+		return err
+	}
+	if mapping != nil {
+		requestBody["attribute_mapping"] = mapping
+	}
+	policy, err := loadAccessPolicy()
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		requestBody["access_policy"] = policy
+	}
+
+	var response map[string]interface{}
+	if err := doRequest(http.MethodPost, "", requestBody, &response); err != nil {
+		return err
+	}
+
+	// Entity ID and ACS come from the metadata document when one was imported
+	var sp provider.ServiceProvider
+	registeredID, _ := response["entity_id"].(string)
+	if err := doRequest(http.MethodGet, "/"+url.PathEscape(registeredID), nil, &sp); err != nil {
+		return err
+	}
+
+	// Print output based on format
+	if outputFormat == "json" {
+		// Build JSON response
+		jsonOutput := map[string]interface{}{
+			"success":     true,
+			"entity_id":   sp.EntityID,
+			"acs_url":     sp.ACSURL,
+			"acs_binding": sp.ACSBinding,
+			"response":    response,
+		}
+		return printJSON(jsonOutput)
+	}
+
+	// Human-readable output
+	fmt.Printf("✓ Service provider registered successfully!\n")
+	fmt.Printf("  Entity ID: %s\n", sp.EntityID)
+	fmt.Printf("  ACS URL: %s\n", sp.ACSURL)
+	fmt.Printf("  ACS Binding: %s\n", sp.ACSBinding)
+	if sp.SLOURL != "" {
+		fmt.Printf("  SLO URL: %s (%s)\n", sp.SLOURL, sp.SLOBinding)
+	}
+	if sp.MetadataXML != "" {
+		fmt.Printf("  Metadata: imported\n")
+	}
+	if sp.AllowIdPInitiated {
+		fmt.Printf("  IdP-initiated SSO: allowed\n")
+	}
+	if sp.EncryptionCert != "" {
+		fmt.Printf("  Assertion Encryption: %s\n", encryptionAlgorithmName(sp.EncryptionAlgorithm))
+	}
+	if len(sp.SigningCerts) > 0 {
+		fmt.Printf("  Signing Certificates: %d\n", len(sp.SigningCerts))
+	}
+	if sp.RequireSignedRequests {
+		fmt.Printf("  Signed Requests: required\n")
+	}
+	if sp.SignatureAlgorithm != "" {
+		fmt.Printf("  Signature Algorithm: %s\n", sp.SignatureAlgorithm)
+	}
+	if sp.SigningMode != "" {
+		fmt.Printf("  Signing Mode: %s\n", sp.SigningMode)
+	}
+	if len(sp.NameIDFormats) > 0 {
+		fmt.Printf("  Allowed NameID Formats: %s\n", strings.Join(sp.NameIDFormats, ", "))
+	}
+	if sp.AccessPolicy != nil {
+		printAccessPolicy(sp.AccessPolicy)
+	}
+
+	return nil
+}
+
+func runList(cmd *cobra.Command, args []string) error {
+	query := url.Values{}
+	if filterEntityID != "" {
+		query.Set("entity_id", filterEntityID)
+	}
+	if filterACSBinding != "" {
+		query.Set("acs_binding", filterACSBinding)
+	}
+	query.Set("limit", fmt.Sprint(limit))
+	query.Set("offset", fmt.Sprint(offset))
+
+	var response struct {
+		ServiceProviders []provider.ServiceProvider `json:"service_providers"`
+		Total            int                        `json:"total"`
+		Limit            int                        `json:"limit"`
+		Offset           int                        `json:"offset"`
+	}
+	if err := doRequest(http.MethodGet, "?"+query.Encode(), nil, &response); err != nil {
+		return err
+	}
+
+	if outputFormat == "json" {
+		return printJSON(response)
+	}
+
+	fmt.Printf("Showing %d of %d service provider(s)\n", len(response.ServiceProviders), response.Total)
+	for i := range response.ServiceProviders {
+		fmt.Println()
+		printServiceProvider(&response.ServiceProviders[i])
+	}
+	return nil
+}
+
+func runGet(cmd *cobra.Command, args []string) error {
+	var sp provider.ServiceProvider
+	if err := doRequest(http.MethodGet, "/"+url.PathEscape(entityID), nil, &sp); err != nil {
+		return err
+	}
+
+	if outputFormat == "json" {
+		return printJSON(sp)
+	}
+	printServiceProvider(&sp)
+	return nil
+}
+
+func runUpdate(cmd *cobra.Command, args []string) error {
+	requestBody := map[string]interface{}{}
+	if cmd.Flags().Changed("acs-url") {
+		requestBody["acs_url"] = acsURL
+	}
+	if cmd.Flags().Changed("acs-binding") {
+		requestBody["acs_binding"] = updateACSBinding
+	}
+	if cmd.Flags().Changed("slo-url") {
+		requestBody["slo_url"] = sloURL
+	}
+	if cmd.Flags().Changed("slo-binding") {
+		requestBody["slo_binding"] = sloBinding
+	}
+	if cmd.Flags().Changed("allow-idp-initiated") {
+		requestBody["allow_idp_initiated"] = allowIdPInitiated
+	}
+	if cmd.Flags().Changed("nameid-formats") {
+		requestBody["nameid_formats"] = append([]string{}, nameidFormats...)
+	}
+	if err := addEncryption(cmd, requestBody); err != nil {
+		return err
+	}
+	if err := addRequestSigning(cmd, requestBody); err != nil {
+		return err
+	}
+	if _, err := addMetadata(cmd, requestBody); err != nil {
+		return err
+	}
+	if clearMapping {
+		requestBody["attribute_mapping"] = nil
+	} else {
+		mapping, err := loadAttributeMapping()
+		if err != nil {
+			return err
+		}
+		if mapping != nil {
+			requestBody["attribute_mapping"] = mapping
+		}
+	}
+	if clearAccessPolicy {
+		requestBody["access_policy"] = nil
+	} else {
+		policy, err := loadAccessPolicy()
+		if err != nil {
+			return err
+		}
+		if policy != nil {
+			requestBody["access_policy"] = policy
+		}
+	}
+	if len(requestBody) == 0 {
+		return fmt.Errorf("nothing to update: set at least one field flag")
+	}
+
+	var sp provider.ServiceProvider
+	if err := doRequest(http.MethodPatch, "/"+url.PathEscape(entityID), requestBody, &sp); err != nil {
+		return err
+	}
+
+	if outputFormat == "json" {
+		return printJSON(sp)
+	}
+	fmt.Printf("✓ Service provider updated successfully!\n")
+	printServiceProvider(&sp)
+	return nil
+}
+
+func runDelete(cmd *cobra.Command, args []string) error {
+	if err := doRequest(http.MethodDelete, "/"+url.PathEscape(entityID), nil, nil); err != nil {
+		return err
+	}
+
+	if outputFormat == "json" {
+		return printJSON(map[string]interface{}{
+			"success":   true,
+			"entity_id": entityID,
+		})
+	}
+	fmt.Printf("✓ Service provider deleted successfully!\n")
+	fmt.Printf("  Entity ID: %s\n", entityID)
+	return nil
+}
+
+// addEncryption sets encryption_cert and encryption_algorithm in requestBody
+// from the --encryption-cert-file and --encryption-algorithm flags when they
+// are changed. An empty --encryption-cert-file clears the certificate.
+func addEncryption(cmd *cobra.Command, requestBody map[string]interface{}) error {
+	if cmd.Flags().Changed("encryption-cert-file") {
+		requestBody["encryption_cert"] = ""
+		if encryptionCertFile != "" {
+			data, err := os.ReadFile(encryptionCertFile)
+			if err != nil {
+				return fmt.Errorf("failed to read encryption certificate %q: %w", encryptionCertFile, err)
+			}
+			requestBody["encryption_cert"] = string(data)
+		}
+	}
+	if cmd.Flags().Changed("encryption-algorithm") {
+		requestBody["encryption_algorithm"] = encryptionAlgorithm
+	}
+	return nil
+}
+
+// addRequestSigning sets signing_certs, require_signed_requests,
+// signature_algorithm and signing_mode in requestBody from the
+// --signing-cert-file, --require-signed-requests, --signature-algorithm and
+// --signing-mode flags when they are changed. Empty --signing-cert-file
+// values are skipped, so a single empty value clears the certificates.
+func addRequestSigning(cmd *cobra.Command, requestBody map[string]interface{}) error {
+	if cmd.Flags().Changed("signing-cert-file") {
+		certs := []string{}
+		for _, path := range signingCertFiles {
+			if path == "" {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read signing certificate %q: %w", path, err)
+			}
+			certs = append(certs, string(data))
+		}
+		requestBody["signing_certs"] = certs
+	}
+	if cmd.Flags().Changed("require-signed-requests") {
+		requestBody["require_signed_requests"] = requireSigned
+	}
+	if cmd.Flags().Changed("signature-algorithm") {
+		requestBody["signature_algorithm"] = signatureAlgorithm
+	}
+	if cmd.Flags().Changed("signing-mode") {
+		requestBody["signing_mode"] = signingMode
+	}
+	return nil
+}
+
+func encryptionAlgorithmName(algorithm string) string {
+	if algorithm == "" {
+		return "enabled"
+	}
+	return "enabled (" + algorithm + ")"
+}
+
+// addMetadata sets metadata_xml or metadata_url in requestBody from the
+// --metadata-file or --metadata-url flags, reporting whether either was set.
+// The refresh interval and signing certificate flags are added when changed.
+func addMetadata(cmd *cobra.Command, requestBody map[string]interface{}) (bool, error) {
+	if cmd.Flags().Changed("metadata-refresh-interval") {
+		requestBody["metadata_refresh_interval_seconds"] = int(metadataRefresh.Seconds())
+	}
+	if metadataCertFile != "" {
+		data, err := os.ReadFile(metadataCertFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to read metadata signing certificate %q: %w", metadataCertFile, err)
+		}
+		requestBody["metadata_signing_cert"] = string(data)
+	}
+
+	if metadataFile != "" {
+		data, err := os.ReadFile(metadataFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to read metadata file %q: %w", metadataFile, err)
+		}
+		requestBody["metadata_xml"] = string(data)
+		return true, nil
+	}
+	if metadataURL != "" {
+		requestBody["metadata_url"] = metadataURL
+		return true, nil
+	}
+	return false, nil
+}
+
+// loadAttributeMapping builds the attribute mapping from the
+// --attribute-mapping-file or --nameid-format flags, returning nil if neither
+// is set.
+func loadAttributeMapping() (interface{}, error) {
 	// Load attribute mapping from file if provided
 	if attributeMappingFile != "" {
 		data, err := os.ReadFile(attributeMappingFile)
 		if err != nil {
-			return fmt.Errorf("failed to read attribute mapping file %q: %w", attributeMappingFile, err)
+			return nil, fmt.Errorf("failed to read attribute mapping file %q: %w", attributeMappingFile, err)
 		}
 		var mapping provider.AttributeMapping
 		if err := json.Unmarshal(data, &mapping); err != nil {
-			return fmt.Errorf("failed to parse attribute mapping JSON from %q: %w", attributeMappingFile, err)
+			return nil, fmt.Errorf("failed to parse attribute mapping JSON from %q: %w", attributeMappingFile, err)
 		}
-		requestBody["attribute_mapping"] = mapping
-	} else if nameidFormat != "" {
+		return mapping, nil
+	}
+	if nameidFormat != "" {
 		// If only nameid-format is provided without a full mapping file,
 		// create a minimal attribute mapping
-		requestBody["attribute_mapping"] = map[string]interface{}{
+		return map[string]interface{}{
 			"nameid_format": nameidFormat,
-		}
+		}, nil
 	}
+	return nil, nil
+}
 
-	jsonData, err := json.Marshal(requestBody)
+// loadAccessPolicy reads the access policy from the --access-policy-file
+// flag, returning nil if it is not set.
+func loadAccessPolicy() (*provider.AccessPolicy, error) {
+	if accessPolicyFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(accessPolicyFile)
 	if err != nil {
-		return fmt.Errorf("failed to marshal request body: %w", err)
+		return nil, fmt.Errorf("failed to read access policy file %q: %w", accessPolicyFile, err)
+	}
+	var policy provider.AccessPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse access policy JSON from %q: %w", accessPolicyFile, err)
+	}
+	return &policy, nil
+}
+
+// doRequest sends a request to the service provider admin API. path is
+// appended to the /admin/service-providers endpoint. When out is non-nil, the
+// JSON response body is decoded into it.
+func doRequest(method, path string, requestBody interface{}, out interface{}) error {
+	// Ensure server URL doesn't have trailing slash
+	endpoint := strings.TrimSuffix(serverURL, "/") + "/admin/service-providers" + path
+
+	var reqBody io.Reader
+	if requestBody != nil {
+		jsonData, err := json.Marshal(requestBody)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request body: %w", err)
+		}
+		reqBody = bytes.NewBuffer(jsonData)
 	}
 
 	// Create HTTP request
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest(method, endpoint, reqBody)
 	if err != nil {
 		return fmt.Errorf("failed to create HTTP request: %w", err)
 	}
-
-	req.Header.Set("Content-Type", "application/json")
+	if requestBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
 
 	// Send request with timeout
 	client := &http.Client{
@@ -139,38 +610,91 @@ func runAdd(cmd *cobra.Command, args []string) error {
 	}
 
 	// Check status code first
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return fmt.Errorf("server returned error (status %d): %s", resp.StatusCode, string(body))
 	}
 
 	// Parse response only on success
-	var response map[string]interface{}
-	if err := json.Unmarshal(body, &response); err != nil {
-		return fmt.Errorf("server returned success status but response was not valid JSON: %w", err)
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return fmt.Errorf("server returned success status but response was not valid JSON: %w", err)
+		}
 	}
+	return nil
+}
 
-	// Print output based on format
-	if outputFormat == "json" {
-		// Build JSON response
-		jsonOutput := map[string]interface{}{
-			"success":     true,
-			"entity_id":   entityID,
-			"acs_url":     acsURL,
-			"acs_binding": acsBinding,
-			"response":    response,
+func printJSON(v interface{}) error {
+	jsonBytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON output: %w", err)
+	}
+	fmt.Println(string(jsonBytes))
+	return nil
+}
+
+func printServiceProvider(sp *provider.ServiceProvider) {
+	fmt.Printf("  Entity ID: %s\n", sp.EntityID)
+	fmt.Printf("  ACS URL: %s\n", sp.ACSURL)
+	fmt.Printf("  ACS Binding: %s\n", sp.ACSBinding)
+	if sp.SLOURL != "" {
+		fmt.Printf("  SLO URL: %s (%s)\n", sp.SLOURL, sp.SLOBinding)
+	}
+	if sp.MetadataURL != "" {
+		fmt.Printf("  Metadata URL: %s\n", sp.MetadataURL)
+		if sp.MetadataRefreshIntervalSeconds > 0 {
+			fmt.Printf("  Metadata Refresh: every %s\n", time.Duration(sp.MetadataRefreshIntervalSeconds)*time.Second)
 		}
-		jsonBytes, err := json.MarshalIndent(jsonOutput, "", "  ")
-		if err != nil {
-			return fmt.Errorf("failed to marshal JSON output: %w", err)
+		if sp.MetadataLastSuccessAt != nil {
+			fmt.Printf("  Metadata Last Refreshed: %s\n", sp.MetadataLastSuccessAt.Format(time.RFC3339))
 		}
-		fmt.Println(string(jsonBytes))
-	} else {
-		// Human-readable output
-		fmt.Printf("✓ Service provider registered successfully!\n")
-		fmt.Printf("  Entity ID: %s\n", entityID)
-		fmt.Printf("  ACS URL: %s\n", acsURL)
-		fmt.Printf("  ACS Binding: %s\n", acsBinding)
+		if sp.MetadataRefreshError != "" {
+			fmt.Printf("  Metadata Refresh Error: %s\n", sp.MetadataRefreshError)
+		}
+	} else if sp.MetadataXML != "" {
+		fmt.Printf("  Metadata: imported\n")
+	}
+	if sp.AllowIdPInitiated {
+		fmt.Printf("  IdP-initiated SSO: allowed\n")
+	}
+	if sp.EncryptionCert != "" {
+		fmt.Printf("  Assertion Encryption: %s\n", encryptionAlgorithmName(sp.EncryptionAlgorithm))
+	}
+	if len(sp.SigningCerts) > 0 {
+		fmt.Printf("  Signing Certificates: %d\n", len(sp.SigningCerts))
 	}
+	if sp.RequireSignedRequests {
+		fmt.Printf("  Signed Requests: required\n")
+	}
+	if sp.SignatureAlgorithm != "" {
+		fmt.Printf("  Signature Algorithm: %s\n", sp.SignatureAlgorithm)
+	}
+	if sp.SigningMode != "" {
+		fmt.Printf("  Signing Mode: %s\n", sp.SigningMode)
+	}
+	if sp.AttributeMapping != nil && sp.AttributeMapping.NameIDFormat != "" {
+		fmt.Printf("  NameID Format: %s\n", sp.AttributeMapping.NameIDFormat)
+	}
+	if len(sp.NameIDFormats) > 0 {
+		fmt.Printf("  Allowed NameID Formats: %s\n", strings.Join(sp.NameIDFormats, ", "))
+	}
+	if sp.AccessPolicy != nil {
+		printAccessPolicy(sp.AccessPolicy)
+	}
+	fmt.Printf("  Updated: %s\n", sp.UpdatedAt.Format(time.RFC3339))
+}
 
-	return nil
+func printAccessPolicy(policy *provider.AccessPolicy) {
+	fmt.Printf("  Access Policy:\n")
+	if len(policy.AllowedGroups) > 0 {
+		fmt.Printf("    Allowed Groups: %s\n", strings.Join(policy.AllowedGroups, ", "))
+	}
+	if len(policy.DeniedGroups) > 0 {
+		fmt.Printf("    Denied Groups: %s\n", strings.Join(policy.DeniedGroups, ", "))
+	}
+	for claim, values := range policy.RequiredClaims {
+		fmt.Printf("    Required Claim %s: %s\n", claim, strings.Join(values, ", "))
+	}
+	if len(policy.AllowedEmailDomains) > 0 {
+		fmt.Printf("    Allowed Email Domains: %s\n", strings.Join(policy.AllowedEmailDomains, ", "))
+	}
 }
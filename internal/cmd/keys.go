@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/canonical/identity-saml-provider/internal/provider"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var keysGracePeriod time.Duration
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the SAML signing keyring",
+	Long: `Manage the SAML signing keyring.
+
+Keys are published in the IdP metadata ahead of their activation time, sign
+messages from their activation until the next key activates or they are
+retired, and stay published for a grace period after that. While no key is
+active, the key pair configured with SAML_PROVIDER_CERT_PATH and
+SAML_PROVIDER_KEY_PATH is used.
+
+Private keys are stored encrypted with the secret in
+SAML_PROVIDER_SIGNING_KEY_ENCRYPTION_KEY, which must be the same for these
+commands and the server.`,
+}
+
+func init() {
+	keysCmd.PersistentFlags().StringVar(&dsn, "dsn", "", "PostgreSQL DSN connection string")
+	_ = keysCmd.MarkPersistentFlagRequired("dsn")
+	keysCmd.PersistentFlags().DurationVar(&keysGracePeriod, "grace-period", 168*time.Hour,
+		"How long retired keys stay published (match SAML_PROVIDER_SIGNING_KEY_GRACE_PERIOD)")
+
+	keysListCmd.Flags().StringVarP(&format, "format", "f", "text", "Output format (text or json)")
+
+	keysAddCmd.Flags().String("cert-file", "", "Path to the PEM certificate (required)")
+	keysAddCmd.Flags().String("key-file", "", "Path to the PEM private key (required)")
+	keysAddCmd.Flags().String("activate-at", "", "Activation time, RFC 3339 or a duration from now such as 72h (required)")
+	_ = keysAddCmd.MarkFlagRequired("cert-file")
+	_ = keysAddCmd.MarkFlagRequired("key-file")
+	_ = keysAddCmd.MarkFlagRequired("activate-at")
+
+	keysActivateCmd.Flags().String("at", "", "Activation time, RFC 3339 or a duration from now (default: now)")
+
+	keysDeleteCmd.Flags().Bool("force", false, "Delete the key even if it is still published")
+
+	keysCmd.AddCommand(keysListCmd)
+	keysCmd.AddCommand(keysAddCmd)
+	keysCmd.AddCommand(keysActivateCmd)
+	keysCmd.AddCommand(keysRetireCmd)
+	keysCmd.AddCommand(keysDeleteCmd)
+	keysCmd.AddCommand(keysEncryptCmd)
+
+	rootCmd.AddCommand(keysCmd)
+}
+
+// openProviderDB opens the database given with --dsn for the commands that
+// manage provider state directly.
+func openProviderDB(cmd *cobra.Command) (*provider.Database, func(), error) {
+	db, err := openMigrateDB(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return provider.NewDatabase(db, zap.NewNop().Sugar()), func() { db.Close() }, nil
+}
+
+// parseKeyTime parses an RFC 3339 time or a duration relative to now.
+func parseKeyTime(value string, now time.Time) (time.Time, error) {
+	if value == "" || value == "now" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected RFC 3339 or a duration", value)
+}
+
+// signingKeyEncryptionKey returns the secret private keys are encrypted with.
+func signingKeyEncryptionKey() (string, error) {
+	secret := os.Getenv("SAML_PROVIDER_SIGNING_KEY_ENCRYPTION_KEY")
+	if secret == "" {
+		return "", errors.New("SAML_PROVIDER_SIGNING_KEY_ENCRYPTION_KEY must be set to store signing keys")
+	}
+	return secret, nil
+}
+
+// findSigningKey returns the key with the given ID from the keyring.
+func findSigningKey(keys []*provider.SigningKey, id string) (*provider.SigningKey, error) {
+	for _, key := range keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("signing key %q not found", id)
+}
+
+// signingKeyEntry is a key of the keyring as listed by keys list.
+type signingKeyEntry struct {
+	*provider.SigningKey
+	State    provider.SigningKeyState `json:"state"`
+	Subject  string                   `json:"subject"`
+	NotAfter time.Time                `json:"not_after"`
+}
+
+// --- keys list ---
+
+var keysListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List the signing keys and their state",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if format != "text" && format != "json" {
+			return fmt.Errorf("unsupported output format: %q", format)
+		}
+
+		db, closeDB, err := openProviderDB(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		keys, err := db.ListSigningKeys()
+		if err != nil {
+			return err
+		}
+		states := provider.SigningKeyStates(keys, time.Now(), keysGracePeriod)
+
+		entries := make([]signingKeyEntry, 0, len(keys))
+		for _, key := range keys {
+			entry := signingKeyEntry{SigningKey: key, State: states[key.ID]}
+			if block, _ := pem.Decode([]byte(key.Certificate)); block != nil {
+				if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+					entry.Subject = cert.Subject.String()
+					entry.NotAfter = cert.NotAfter
+				}
+			}
+			entries = append(entries, entry)
+		}
+
+		out := cmd.OutOrStdout()
+		if format == "json" {
+			encoder := json.NewEncoder(out)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(entries)
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATE\tACTIVATE AT\tRETIRED AT\tCERT EXPIRES")
+		for _, entry := range entries {
+			retiredAt := "-"
+			if entry.RetiredAt != nil {
+				retiredAt = entry.RetiredAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", entry.ID, entry.State,
+				entry.ActivateAt.Format(time.RFC3339), retiredAt, entry.NotAfter.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	},
+}
+
+// --- keys add ---
+
+var keysAddCmd = &cobra.Command{
+	Use:          "add <id>",
+	Short:        "Add a signing key, published now and active from --activate-at",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id := args[0]
+		certFile, _ := cmd.Flags().GetString("cert-file")
+		keyFile, _ := cmd.Flags().GetString("key-file")
+		activateAtValue, _ := cmd.Flags().GetString("activate-at")
+
+		activateAt, err := parseKeyTime(activateAtValue, time.Now())
+		if err != nil {
+			return err
+		}
+		certPEM, err := os.ReadFile(certFile)
+		if err != nil {
+			return fmt.Errorf("failed to read certificate: %w", err)
+		}
+		keyPEM, err := os.ReadFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read private key: %w", err)
+		}
+		cert, _, err := provider.ParseSigningKeyPair(certPEM, keyPEM)
+		if err != nil {
+			return fmt.Errorf("invalid key pair: %w", err)
+		}
+		if !cert.NotAfter.After(activateAt) {
+			return fmt.Errorf("certificate expires at %s, before the key activates", cert.NotAfter.Format(time.RFC3339))
+		}
+		secret, err := signingKeyEncryptionKey()
+		if err != nil {
+			return err
+		}
+		encryptedKey, err := provider.EncryptSigningKey(secret, id, keyPEM)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt private key: %w", err)
+		}
+
+		db, closeDB, err := openProviderDB(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		key := &provider.SigningKey{
+			ID:          id,
+			Certificate: string(certPEM),
+			PrivateKey:  encryptedKey,
+			ActivateAt:  activateAt.UTC(),
+		}
+		if err := db.SaveSigningKey(key); err != nil {
+			return fmt.Errorf("failed to save signing key: %w", err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Signing key %s added, active from %s\n", id, key.ActivateAt.Format(time.RFC3339))
+		return nil
+	},
+}
+
+// --- keys activate ---
+
+var keysActivateCmd = &cobra.Command{
+	Use:          "activate <id>",
+	Short:        "Reschedule the activation of a signing key",
+	Long:         "Reschedule the activation of a signing key, now or at --at. A retired key is reinstated.",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		at, _ := cmd.Flags().GetString("at")
+		activateAt, err := parseKeyTime(at, time.Now())
+		if err != nil {
+			return err
+		}
+		return updateSigningKeySchedule(cmd, args[0], func(key *provider.SigningKey) {
+			key.ActivateAt = activateAt.UTC()
+			key.RetiredAt = nil
+		}, "Signing key %s active from %s\n", activateAt)
+	},
+}
+
+// --- keys retire ---
+
+var keysRetireCmd = &cobra.Command{
+	Use:   "retire <id>",
+	Short: "Retire a signing key now",
+	Long: `Retire a signing key now. It stops signing and stays published for the grace
+period. If it was the active key, the most recently activated key that is not
+retired signs again, or the configured key pair when there is none.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		retiredAt := time.Now().UTC()
+		return updateSigningKeySchedule(cmd, args[0], func(key *provider.SigningKey) {
+			key.RetiredAt = &retiredAt
+		}, "Signing key %s retired at %s\n", retiredAt)
+	},
+}
+
+func updateSigningKeySchedule(cmd *cobra.Command, id string, update func(*provider.SigningKey), message string, at time.Time) error {
+	db, closeDB, err := openProviderDB(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeDB()
+
+	keys, err := db.ListSigningKeys()
+	if err != nil {
+		return err
+	}
+	key, err := findSigningKey(keys, id)
+	if err != nil {
+		return err
+	}
+	update(key)
+	if err := db.UpdateSigningKeySchedule(key.ID, key.ActivateAt, key.RetiredAt); err != nil {
+		return fmt.Errorf("failed to update signing key: %w", err)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), message, id, at.Format(time.RFC3339))
+	return nil
+}
+
+// --- keys delete ---
+
+var keysDeleteCmd = &cobra.Command{
+	Use:          "delete <id>",
+	Short:        "Delete a signing key that is no longer published",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+
+		db, closeDB, err := openProviderDB(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		keys, err := db.ListSigningKeys()
+		if err != nil {
+			return err
+		}
+		if _, err := findSigningKey(keys, args[0]); err != nil {
+			return err
+		}
+		state := provider.SigningKeyStates(keys, time.Now(), keysGracePeriod)[args[0]]
+		if state != provider.SigningKeyStateExpired && !force {
+			return fmt.Errorf("signing key %s is %s; retire it and wait for the grace period, or use --force", args[0], state)
+		}
+
+		if err := db.DeleteSigningKey(args[0]); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("signing key %q not found", args[0])
+			}
+			return fmt.Errorf("failed to delete signing key: %w", err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Signing key %s deleted\n", args[0])
+		return nil
+	},
+}
+
+// --- keys encrypt ---
+
+var keysEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt the private keys stored in plaintext",
+	Long: `Encrypt the private keys stored in plaintext by earlier versions with the
+secret in SAML_PROVIDER_SIGNING_KEY_ENCRYPTION_KEY. The server does not load a
+keyring that holds plaintext private keys.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		secret, err := signingKeyEncryptionKey()
+		if err != nil {
+			return err
+		}
+
+		db, closeDB, err := openProviderDB(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		keys, err := db.ListSigningKeys()
+		if err != nil {
+			return err
+		}
+		encrypted := 0
+		for _, key := range keys {
+			if provider.IsSigningKeyEncrypted(key) {
+				continue
+			}
+			if _, _, err := provider.ParseSigningKeyPair([]byte(key.Certificate), []byte(key.PrivateKey)); err != nil {
+				return fmt.Errorf("invalid signing key %q: %w", key.ID, err)
+			}
+			privateKey, err := provider.EncryptSigningKey(secret, key.ID, []byte(key.PrivateKey))
+			if err != nil {
+				return fmt.Errorf("failed to encrypt private key: %w", err)
+			}
+			if err := db.UpdateSigningKeyPrivateKey(key.ID, privateKey); err != nil {
+				return fmt.Errorf("failed to update signing key %q: %w", key.ID, err)
+			}
+			encrypted++
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%d signing keys encrypted\n", encrypted)
+		return nil
+	},
+}
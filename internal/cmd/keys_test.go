@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeysSubcommands(t *testing.T) {
+	expected := map[string]bool{
+		"list":     false,
+		"add":      false,
+		"activate": false,
+		"retire":   false,
+		"delete":   false,
+		"encrypt":  false,
+	}
+
+	for _, sub := range keysCmd.Commands() {
+		if _, ok := expected[sub.Name()]; ok {
+			expected[sub.Name()] = true
+		}
+	}
+
+	for name, found := range expected {
+		if !found {
+			t.Errorf("expected subcommand %q not found on keys command", name)
+		}
+	}
+}
+
+func TestParseKeyTime(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{value: "", want: now},
+		{value: "now", want: now},
+		{value: "72h", want: now.Add(72 * time.Hour)},
+		{value: "2026-02-01T00:00:00Z", want: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{value: "next week", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseKeyTime(tt.value, now)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseKeyTime(%q): expected an error", tt.value)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseKeyTime(%q) = %v, %v; want %v", tt.value, got, err, tt.want)
+		}
+	}
+}
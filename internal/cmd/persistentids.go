@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/canonical/identity-saml-provider/internal/provider"
+	"github.com/spf13/cobra"
+)
+
+var persistentIDsCmd = &cobra.Command{
+	Use:   "persistent-ids",
+	Short: "Look up and revoke persistent NameIDs",
+	Long: `Look up and revoke persistent NameIDs.
+
+Each service provider that uses the persistent NameID format knows a subject
+by its own opaque identifier. A revoked identifier is never issued again: the
+subject gets a new one at their next login to the service provider.`,
+}
+
+func init() {
+	persistentIDsCmd.PersistentFlags().StringVar(&dsn, "dsn", "", "PostgreSQL DSN connection string")
+	_ = persistentIDsCmd.MarkPersistentFlagRequired("dsn")
+
+	persistentIDsListCmd.Flags().StringVarP(&format, "format", "f", "text", "Output format (text or json)")
+	persistentIDsListCmd.Flags().String("id", "", "Only the given persistent NameID")
+	persistentIDsListCmd.Flags().String("entity-id", "", "Only the identifiers issued to this service provider")
+	persistentIDsListCmd.Flags().String("subject", "", "Only the identifiers of this OIDC subject")
+
+	persistentIDsCmd.AddCommand(persistentIDsListCmd)
+	persistentIDsCmd.AddCommand(persistentIDsRevokeCmd)
+
+	rootCmd.AddCommand(persistentIDsCmd)
+}
+
+// --- persistent-ids list ---
+
+var persistentIDsListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List persistent NameIDs, revoked ones included",
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if format != "text" && format != "json" {
+			return fmt.Errorf("unsupported output format: %q", format)
+		}
+		var filter provider.PersistentIDFilter
+		filter.ID, _ = cmd.Flags().GetString("id")
+		filter.EntityID, _ = cmd.Flags().GetString("entity-id")
+		filter.Subject, _ = cmd.Flags().GetString("subject")
+
+		db, closeDB, err := openProviderDB(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		ids, err := db.ListPersistentIDs(filter)
+		if err != nil {
+			return err
+		}
+
+		out := cmd.OutOrStdout()
+		if format == "json" {
+			if ids == nil {
+				ids = []*provider.PersistentID{}
+			}
+			encoder := json.NewEncoder(out)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(ids)
+		}
+
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tENTITY ID\tSUBJECT\tCREATED AT\tREVOKED AT")
+		for _, id := range ids {
+			revokedAt := "-"
+			if id.RevokedAt != nil {
+				revokedAt = id.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", id.ID, id.EntityID, id.Subject,
+				id.CreatedAt.Format(time.RFC3339), revokedAt)
+		}
+		return tw.Flush()
+	},
+}
+
+// --- persistent-ids revoke ---
+
+var persistentIDsRevokeCmd = &cobra.Command{
+	Use:          "revoke <id>",
+	Short:        "Revoke a persistent NameID",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		db, closeDB, err := openProviderDB(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		if err := db.RevokePersistentID(args[0]); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("persistent ID %q not found or already revoked", args[0])
+			}
+			return fmt.Errorf("failed to revoke persistent ID: %w", err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Persistent ID %s revoked\n", args[0])
+		return nil
+	},
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import "testing"
+
+func TestPersistentIDsSubcommands(t *testing.T) {
+	expected := map[string]bool{
+		"list":   false,
+		"revoke": false,
+	}
+
+	for _, sub := range persistentIDsCmd.Commands() {
+		if _, ok := expected[sub.Name()]; ok {
+			expected[sub.Name()] = true
+		}
+	}
+
+	for name, found := range expected {
+		if !found {
+			t.Errorf("expected subcommand %q not found on persistent-ids command", name)
+		}
+	}
+}
@@ -108,5 +108,20 @@ func runServe() {
 	// -------------------------------------------------------------------------
 	server.SetupRoutes()
 
+	// Periodically purge expired pending AuthnRequests
+	go server.RunPendingRequestPurger(ctx)
+
+	// Periodically delete expired sessions, one replica at a time
+	go server.RunSessionReaper(ctx)
+
+	// Periodically re-fetch SP metadata registered with a metadata URL
+	go server.RunMetadataRefresher(ctx)
+
+	// Periodically reload the signing keyring managed with the keys subcommand
+	go server.RunKeyringRefresher(ctx)
+
+	// Reload the configured key pair when it is renewed or on SIGHUP
+	go server.RunCertificateReloader(ctx)
+
 	logger.Fatalw("Server error", "error", server.Start())
 }
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/canonical/identity-saml-provider/internal/provider"
+	"github.com/spf13/cobra"
+)
+
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Manage SAML sessions",
+}
+
+func init() {
+	sessionsCmd.PersistentFlags().StringVar(&dsn, "dsn", "", "PostgreSQL DSN connection string")
+	_ = sessionsCmd.MarkPersistentFlagRequired("dsn")
+
+	sessionsPurgeCmd.Flags().Int("batch-size", provider.DefaultSessionReapBatchSize, "Number of expired sessions deleted per statement")
+
+	sessionsCmd.AddCommand(sessionsPurgeCmd)
+
+	rootCmd.AddCommand(sessionsCmd)
+}
+
+// --- sessions purge ---
+
+var sessionsPurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Delete expired sessions",
+	Long: `Delete expired sessions once, the same way the reaper in serve does. Nothing
+is deleted while a replica is already purging.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		batchSize, _ := cmd.Flags().GetInt("batch-size")
+		if batchSize <= 0 {
+			return fmt.Errorf("invalid batch size %d", batchSize)
+		}
+
+		db, closeDB, err := openProviderDB(cmd)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		purged, locked, err := db.PurgeExpiredSessions(cmd.Context(), batchSize)
+		if err != nil {
+			return fmt.Errorf("failed to purge expired sessions: %w", err)
+		}
+		if !locked {
+			fmt.Fprintln(cmd.OutOrStdout(), "Another process is purging expired sessions, nothing done")
+			return nil
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Purged %d expired sessions\n", purged)
+		return nil
+	},
+}
@@ -0,0 +1,12 @@
+package cmd
+
+import "testing"
+
+func TestSessionsSubcommands(t *testing.T) {
+	for _, sub := range sessionsCmd.Commands() {
+		if sub.Name() == "purge" {
+			return
+		}
+	}
+	t.Error("expected subcommand \"purge\" not found on sessions command")
+}
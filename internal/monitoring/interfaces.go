@@ -4,4 +4,11 @@ type MonitorInterface interface {
 	GetService() string
 	SetResponseTimeMetric(map[string]string, float64) error
 	SetDependencyAvailability(map[string]string, float64) error
+	SetMetadataRefreshStatus(map[string]string, float64) error
+	SetMetadataLastSuccess(map[string]string, float64) error
+	SetKeyPairReloadStatus(map[string]string, float64) error
+	SetSessionReapDuration(map[string]string, float64) error
+	AddSessionsReaped(map[string]string, float64) error
+	AddOIDCStateRejection(map[string]string, float64) error
+	AddAccessDenial(map[string]string, float64) error
 }
@@ -25,3 +25,31 @@ func (m *NoopMonitor) SetResponseTimeMetric(map[string]string, float64) error {
 func (m *NoopMonitor) SetDependencyAvailability(map[string]string, float64) error {
 	return nil
 }
+
+func (m *NoopMonitor) SetMetadataRefreshStatus(map[string]string, float64) error {
+	return nil
+}
+
+func (m *NoopMonitor) SetMetadataLastSuccess(map[string]string, float64) error {
+	return nil
+}
+
+func (m *NoopMonitor) SetKeyPairReloadStatus(map[string]string, float64) error {
+	return nil
+}
+
+func (m *NoopMonitor) SetSessionReapDuration(map[string]string, float64) error {
+	return nil
+}
+
+func (m *NoopMonitor) AddSessionsReaped(map[string]string, float64) error {
+	return nil
+}
+
+func (m *NoopMonitor) AddOIDCStateRejection(map[string]string, float64) error {
+	return nil
+}
+
+func (m *NoopMonitor) AddAccessDenial(map[string]string, float64) error {
+	return nil
+}
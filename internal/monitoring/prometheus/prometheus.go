@@ -13,6 +13,13 @@ type Monitor struct {
 
 	responseTime           *prometheus.HistogramVec
 	dependencyAvailability *prometheus.GaugeVec
+	metadataRefreshStatus  *prometheus.GaugeVec
+	metadataLastSuccess    *prometheus.GaugeVec
+	keyPairReloadStatus    *prometheus.GaugeVec
+	sessionReapDuration    *prometheus.HistogramVec
+	sessionsReaped         *prometheus.CounterVec
+	oidcStateRejections    *prometheus.CounterVec
+	accessDenials          *prometheus.CounterVec
 
 	logger *zap.SugaredLogger
 }
@@ -41,8 +48,70 @@ func (m *Monitor) SetDependencyAvailability(tags map[string]string, value float6
 	return nil
 }
 
+func (m *Monitor) SetMetadataRefreshStatus(tags map[string]string, value float64) error {
+	if m.metadataRefreshStatus == nil {
+		return fmt.Errorf("metric not instantiated")
+	}
+
+	m.metadataRefreshStatus.With(tags).Set(value)
+	return nil
+}
+
+func (m *Monitor) SetMetadataLastSuccess(tags map[string]string, value float64) error {
+	if m.metadataLastSuccess == nil {
+		return fmt.Errorf("metric not instantiated")
+	}
+
+	m.metadataLastSuccess.With(tags).Set(value)
+	return nil
+}
+
+func (m *Monitor) SetKeyPairReloadStatus(tags map[string]string, value float64) error {
+	if m.keyPairReloadStatus == nil {
+		return fmt.Errorf("metric not instantiated")
+	}
+
+	m.keyPairReloadStatus.With(tags).Set(value)
+	return nil
+}
+
+func (m *Monitor) SetSessionReapDuration(tags map[string]string, value float64) error {
+	if m.sessionReapDuration == nil {
+		return fmt.Errorf("metric not instantiated")
+	}
+
+	m.sessionReapDuration.With(tags).Observe(value)
+	return nil
+}
+
+func (m *Monitor) AddSessionsReaped(tags map[string]string, value float64) error {
+	if m.sessionsReaped == nil {
+		return fmt.Errorf("metric not instantiated")
+	}
+
+	m.sessionsReaped.With(tags).Add(value)
+	return nil
+}
+
+func (m *Monitor) AddOIDCStateRejection(tags map[string]string, value float64) error {
+	if m.oidcStateRejections == nil {
+		return fmt.Errorf("metric not instantiated")
+	}
+
+	m.oidcStateRejections.With(tags).Add(value)
+	return nil
+}
+
+func (m *Monitor) AddAccessDenial(tags map[string]string, value float64) error {
+	if m.accessDenials == nil {
+		return fmt.Errorf("metric not instantiated")
+	}
+
+	m.accessDenials.With(tags).Add(value)
+	return nil
+}
+
 func (m *Monitor) registerHistograms() {
-	histograms := make([]*prometheus.HistogramVec, 0)
 	labels := map[string]string{"service": m.service}
 
 	m.responseTime = prometheus.NewHistogramVec(
@@ -54,10 +123,24 @@ func (m *Monitor) registerHistograms() {
 		[]string{"route", "status"},
 	)
 
-	histograms = append(histograms, m.responseTime)
+	m.sessionReapDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:        "saml_session_reap_duration_seconds",
+			Help:        "Duration of the runs of the expired session reaper",
+			ConstLabels: labels,
+		},
+		[]string{},
+	)
+
+	// Each entry points at the field holding the histogram so an already
+	// registered collector can be swapped in.
+	histograms := []**prometheus.HistogramVec{
+		&m.responseTime,
+		&m.sessionReapDuration,
+	}
 
 	for _, histogram := range histograms {
-		err := prometheus.Register(histogram)
+		err := prometheus.Register(*histogram)
 
 		switch err.(type) {
 		case nil:
@@ -66,21 +149,79 @@ func (m *Monitor) registerHistograms() {
 			regErr := err.(prometheus.AlreadyRegisteredError)
 			existingHistogram, ok := regErr.ExistingCollector.(*prometheus.HistogramVec)
 			if !ok {
-				m.logger.Errorw("existing collector is not a histogram vec", "metric", histogram)
-				return
+				m.logger.Errorw("existing collector is not a histogram vec", "metric", *histogram)
+				continue
 			}
 
-			m.responseTime = existingHistogram
-			m.logger.Debugw("metric already registered, reusing existing collector", "metric", histogram)
-			return
+			*histogram = existingHistogram
+			m.logger.Debugw("metric already registered, reusing existing collector", "metric", existingHistogram)
 		default:
-			m.logger.Errorw("metric could not be registered", "metric", histogram, "error", err)
+			m.logger.Errorw("metric could not be registered", "metric", *histogram, "error", err)
+		}
+	}
+}
+
+func (m *Monitor) registerCounters() {
+	labels := map[string]string{"service": m.service}
+
+	m.sessionsReaped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "saml_sessions_reaped_total",
+			Help:        "Number of expired sessions deleted by the session reaper",
+			ConstLabels: labels,
+		},
+		[]string{},
+	)
+
+	m.oidcStateRejections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "saml_oidc_state_rejected_total",
+			Help:        "Number of OIDC callbacks rejected because of an invalid, expired or unbound state",
+			ConstLabels: labels,
+		},
+		[]string{"reason"},
+	)
+
+	m.accessDenials = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:        "saml_access_denied_total",
+			Help:        "Number of logins denied by the access policy of a service provider",
+			ConstLabels: labels,
+		},
+		[]string{"entity_id"},
+	)
+
+	// Each entry points at the field holding the counter so an already
+	// registered collector can be swapped in.
+	counters := []**prometheus.CounterVec{
+		&m.sessionsReaped,
+		&m.oidcStateRejections,
+		&m.accessDenials,
+	}
+
+	for _, counter := range counters {
+		err := prometheus.Register(*counter)
+
+		switch err.(type) {
+		case nil:
+			continue
+		case prometheus.AlreadyRegisteredError:
+			regErr := err.(prometheus.AlreadyRegisteredError)
+			existingCounter, ok := regErr.ExistingCollector.(*prometheus.CounterVec)
+			if !ok {
+				m.logger.Errorw("existing collector is not a counter vec", "metric", *counter)
+				continue
+			}
+
+			*counter = existingCounter
+			m.logger.Debugw("metric already registered, reusing existing collector", "metric", existingCounter)
+		default:
+			m.logger.Errorw("metric could not be registered", "metric", *counter, "error", err)
 		}
 	}
 }
 
 func (m *Monitor) registerGauges() {
-	gauges := make([]*prometheus.GaugeVec, 0)
 	labels := map[string]string{"service": m.service}
 
 	m.dependencyAvailability = prometheus.NewGaugeVec(
@@ -92,10 +233,44 @@ func (m *Monitor) registerGauges() {
 		[]string{"component"},
 	)
 
-	gauges = append(gauges, m.dependencyAvailability)
+	m.metadataRefreshStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "sp_metadata_refresh_success",
+			Help:        "Whether the last refresh of a service provider's metadata URL succeeded (1) or failed (0)",
+			ConstLabels: labels,
+		},
+		[]string{"entity_id"},
+	)
+
+	m.metadataLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "sp_metadata_last_success_timestamp_seconds",
+			Help:        "Unix time of the last successful refresh of a service provider's metadata URL",
+			ConstLabels: labels,
+		},
+		[]string{"entity_id"},
+	)
+
+	m.keyPairReloadStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:        "saml_key_pair_reload_success",
+			Help:        "Whether the last reload of the configured SAML key pair succeeded (1) or was rejected (0)",
+			ConstLabels: labels,
+		},
+		[]string{"trigger"},
+	)
+
+	// Each entry points at the field holding the gauge so an already
+	// registered collector can be swapped in.
+	gauges := []**prometheus.GaugeVec{
+		&m.dependencyAvailability,
+		&m.metadataRefreshStatus,
+		&m.metadataLastSuccess,
+		&m.keyPairReloadStatus,
+	}
 
 	for _, gauge := range gauges {
-		err := prometheus.Register(gauge)
+		err := prometheus.Register(*gauge)
 
 		switch err.(type) {
 		case nil:
@@ -104,15 +279,14 @@ func (m *Monitor) registerGauges() {
 			regErr := err.(prometheus.AlreadyRegisteredError)
 			existingGauge, ok := regErr.ExistingCollector.(*prometheus.GaugeVec)
 			if !ok {
-				m.logger.Errorw("existing collector is not a gauge vec", "metric", gauge)
-				return
+				m.logger.Errorw("existing collector is not a gauge vec", "metric", *gauge)
+				continue
 			}
 
-			m.dependencyAvailability = existingGauge
-			m.logger.Debugw("metric already registered, reusing existing collector", "metric", gauge)
-			return
+			*gauge = existingGauge
+			m.logger.Debugw("metric already registered, reusing existing collector", "metric", existingGauge)
 		default:
-			m.logger.Errorw("metric could not be registered", "metric", gauge, "error", err)
+			m.logger.Errorw("metric could not be registered", "metric", *gauge, "error", err)
 		}
 	}
 }
@@ -123,5 +297,6 @@ func NewMonitor(service string, logger *zap.SugaredLogger) *Monitor {
 	m.logger = logger
 	m.registerHistograms()
 	m.registerGauges()
+	m.registerCounters()
 	return m
 }
@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/crewjam/saml"
+)
+
+// AccessPolicy restricts which authenticated users may sign in to a service
+// provider. A user must meet every condition that is set.
+type AccessPolicy struct {
+	// AllowedGroups admits only members of at least one of these groups.
+	AllowedGroups []string `json:"allowed_groups,omitempty"`
+	// DeniedGroups rejects members of any of these groups, even when they
+	// are in an allowed group.
+	DeniedGroups []string `json:"denied_groups,omitempty"`
+	// RequiredClaims maps an ID Token claim to the values accepted for it.
+	// The claim must have one of them, or contain one if it is a list.
+	RequiredClaims map[string][]string `json:"required_claims,omitempty"`
+	// AllowedEmailDomains admits only users whose email address is in one of
+	// these domains. Subdomains are not included.
+	AllowedEmailDomains []string `json:"allowed_email_domains,omitempty"`
+}
+
+// validate checks that every condition of the policy can be met.
+func (p *AccessPolicy) validate() error {
+	for _, group := range append(slices.Clone(p.AllowedGroups), p.DeniedGroups...) {
+		if group == "" {
+			return errors.New("groups must not be empty")
+		}
+	}
+	for claim, values := range p.RequiredClaims {
+		if claim == "" {
+			return errors.New("required_claims names must not be empty")
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("required_claims %q must list at least one value", claim)
+		}
+	}
+	for _, domain := range p.AllowedEmailDomains {
+		if domain == "" || strings.Contains(domain, "@") {
+			return fmt.Errorf("invalid email domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// check returns why the user of session, with the ID Token claims rawClaims,
+// is denied access, or nil if the policy admits them.
+func (p *AccessPolicy) check(session *saml.Session, rawClaims map[string]interface{}) error {
+	for _, group := range session.Groups {
+		if slices.Contains(p.DeniedGroups, group) {
+			return fmt.Errorf("member of denied group %q", group)
+		}
+	}
+	if len(p.AllowedGroups) > 0 && !slices.ContainsFunc(session.Groups, func(group string) bool {
+		return slices.Contains(p.AllowedGroups, group)
+	}) {
+		return errors.New("not a member of an allowed group")
+	}
+
+	for claim, accepted := range p.RequiredClaims {
+		if !slices.ContainsFunc(claimValues(rawClaims[claim]), func(value string) bool {
+			return slices.Contains(accepted, value)
+		}) {
+			return fmt.Errorf("claim %q does not have a required value", claim)
+		}
+	}
+
+	if len(p.AllowedEmailDomains) > 0 {
+		_, domain, _ := strings.Cut(session.UserEmail, "@")
+		if !slices.ContainsFunc(p.AllowedEmailDomains, func(allowed string) bool {
+			return strings.EqualFold(allowed, domain)
+		}) {
+			return fmt.Errorf("email domain %q is not allowed", domain)
+		}
+	}
+	return nil
+}
+
+// claimValues returns the values of a claim as strings: its elements if it
+// is a list, otherwise the claim itself.
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// checkAccessPolicy enforces the access policy of the service provider req
+// is for. A denied user is audit-logged and the service provider receives a
+// RequestDenied Response. It returns false when no assertion may be issued.
+func (s *Server) checkAccessPolicy(w http.ResponseWriter, req *saml.IdpAuthnRequest, session *saml.Session, rawClaims map[string]interface{}) bool {
+	if req.Request.Issuer == nil || req.Request.Issuer.Value == "" {
+		return true
+	}
+	entityID := req.Request.Issuer.Value
+	policy, err := s.db.GetAccessPolicy(entityID)
+	if err != nil {
+		// Fail closed rather than admit users the policy may deny
+		s.logger.Errorw("Error retrieving access policy", "entityID", entityID, "error", err)
+		s.respondSAMLError(w, req, "")
+		return false
+	}
+	if policy == nil {
+		return true
+	}
+	if err := policy.check(session, rawClaims); err != nil {
+		s.logger.Warnw("Access denied by service provider access policy",
+			"entityID", entityID,
+			"requestID", req.Request.ID,
+			"subject", session.UserName,
+			"email", session.UserEmail,
+			"reason", err.Error(),
+		)
+		_ = s.monitor.AddAccessDenial(map[string]string{"entity_id": entityID}, 1)
+		s.respondSAMLError(w, req, saml.StatusRequestDenied)
+		return false
+	}
+	return true
+}
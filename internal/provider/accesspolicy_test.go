@@ -0,0 +1,132 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/crewjam/saml"
+)
+
+func TestAccessPolicy_Check(t *testing.T) {
+	session := &saml.Session{UserEmail: "alice@Example.com", Groups: []string{"staff", "contractors"}}
+	rawClaims := map[string]interface{}{
+		"email_verified": true,
+		"department":     "engineering",
+		"roles":          []interface{}{"viewer", "editor"},
+	}
+
+	tests := []struct {
+		name    string
+		policy  AccessPolicy
+		allowed bool
+	}{
+		{"empty policy", AccessPolicy{}, true},
+		{"allowed group", AccessPolicy{AllowedGroups: []string{"admins", "staff"}}, true},
+		{"no allowed group", AccessPolicy{AllowedGroups: []string{"admins"}}, false},
+		{"denied group wins", AccessPolicy{AllowedGroups: []string{"staff"}, DeniedGroups: []string{"contractors"}}, false},
+		{"required claim", AccessPolicy{RequiredClaims: map[string][]string{"department": {"engineering", "sales"}}}, true},
+		{"required boolean claim", AccessPolicy{RequiredClaims: map[string][]string{"email_verified": {"true"}}}, true},
+		{"required list claim", AccessPolicy{RequiredClaims: map[string][]string{"roles": {"editor"}}}, true},
+		{"wrong claim value", AccessPolicy{RequiredClaims: map[string][]string{"department": {"sales"}}}, false},
+		{"missing claim", AccessPolicy{RequiredClaims: map[string][]string{"tenant": {"acme"}}}, false},
+		{"email domain", AccessPolicy{AllowedEmailDomains: []string{"example.com"}}, true},
+		{"other email domain", AccessPolicy{AllowedEmailDomains: []string{"sub.example.com"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.check(session, rawClaims)
+			if (err == nil) != tt.allowed {
+				t.Errorf("Expected allowed=%v, got %v", tt.allowed, err)
+			}
+		})
+	}
+}
+
+func TestValidateServiceProvider_AccessPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  AccessPolicy
+		wantErr bool
+	}{
+		{"valid", AccessPolicy{AllowedGroups: []string{"staff"}, RequiredClaims: map[string][]string{"department": {"engineering"}},
+			AllowedEmailDomains: []string{"example.com"}}, false},
+		{"empty group", AccessPolicy{DeniedGroups: []string{""}}, true},
+		{"claim without values", AccessPolicy{RequiredClaims: map[string][]string{"department": {}}}, true},
+		{"email address as domain", AccessPolicy{AllowedEmailDomains: []string{"user@example.com"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs", AccessPolicy: &tt.policy}
+			if err := validateServiceProvider(sp); (err != nil) != tt.wantErr {
+				t.Errorf("Expected error: %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSessionProviderAdapter_GetSession_AccessDenied(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	setupTestIdP(t, server)
+	monitor := &testMockMonitor{}
+	server.monitor = monitor
+
+	sp := &ServiceProvider{EntityID: "https://restricted-sp.example.com", ACSURL: "https://restricted-sp.example.com/acs",
+		ACSBinding: saml.HTTPPostBinding, AccessPolicy: &AccessPolicy{AllowedGroups: []string{"admins"}}}
+	if err := server.db.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteServiceProvider(sp.EntityID) })
+
+	sessionToken := "access-policy-session"
+	session := &saml.Session{
+		ID:         sessionIDFromToken(sessionToken),
+		CreateTime: time.Now(),
+		ExpireTime: time.Now().Add(10 * time.Minute),
+		Index:      newSAMLID(),
+		NameID:     "user@example.com",
+		UserEmail:  "user@example.com",
+		Groups:     []string{"staff"},
+	}
+	if err := server.db.SaveSession(session, nil); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteSession(session.ID) })
+
+	descriptor, _ := sp.EntityDescriptor()
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	r := httptest.NewRequest(http.MethodGet, "/saml/sso", nil)
+	r.AddCookie(&http.Cookie{Name: "saml_session", Value: sessionToken})
+	req := &saml.IdpAuthnRequest{IDP: server.identityProvider(), HTTPRequest: r, Request: *testAuthnRequest(server, sp.EntityID),
+		Now: saml.TimeNow(), ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs}
+
+	rec := httptest.NewRecorder()
+	adapter := &sessionProviderAdapter{server: server}
+	if adapter.GetSession(rec, r, req) != nil {
+		t.Fatal("Expected the user outside the allowed groups to be denied")
+	}
+	response, _ := postedSAMLResponse(t, rec.Body.String())
+	if status := response.Status.StatusCode; status.StatusCode == nil || status.StatusCode.Value != saml.StatusRequestDenied {
+		t.Errorf("Expected a RequestDenied status, got %+v", status)
+	}
+	if len(monitor.accessDenials) != 1 || monitor.accessDenials[0] != sp.EntityID {
+		t.Errorf("Expected the denial to be counted for %s, got %v", sp.EntityID, monitor.accessDenials)
+	}
+
+	sp.AccessPolicy.AllowedGroups = append(sp.AccessPolicy.AllowedGroups, "staff")
+	if err := server.db.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	if adapter.GetSession(httptest.NewRecorder(), r, req) == nil {
+		t.Error("Expected a member of an allowed group to get a session")
+	}
+}
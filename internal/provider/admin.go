@@ -0,0 +1,687 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultServiceProviderPageSize = 50
+	maxServiceProviderPageSize     = 500
+)
+
+// Error codes used in adminError responses.
+const (
+	adminErrInvalidRequest = "invalid_request"
+	adminErrNotFound       = "not_found"
+	adminErrInternal       = "internal_error"
+)
+
+// adminError is the JSON error body returned by every admin endpoint.
+type adminError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// serviceProviderRequest is the body accepted when creating or replacing a
+// service provider.
+type serviceProviderRequest struct {
+	EntityID         string            `json:"entity_id"`
+	ACSURL           string            `json:"acs_url"`
+	ACSBinding       string            `json:"acs_binding"`
+	AttributeMapping *AttributeMapping `json:"attribute_mapping,omitempty"`
+	AccessPolicy     *AccessPolicy     `json:"access_policy,omitempty"`
+	NameIDFormats    []string          `json:"nameid_formats,omitempty"`
+	SLOURL           string            `json:"slo_url,omitempty"`
+	SLOBinding       string            `json:"slo_binding,omitempty"`
+	MetadataXML      string            `json:"metadata_xml,omitempty"`
+	MetadataURL      string            `json:"metadata_url,omitempty"`
+
+	MetadataRefreshIntervalSeconds int    `json:"metadata_refresh_interval_seconds,omitempty"`
+	MetadataSigningCert            string `json:"metadata_signing_cert,omitempty"`
+
+	// AllowIdPInitiated opts the SP in to IdP-initiated SSO.
+	AllowIdPInitiated bool `json:"allow_idp_initiated,omitempty"`
+
+	EncryptionCert      string `json:"encryption_cert,omitempty"`
+	EncryptionAlgorithm string `json:"encryption_algorithm,omitempty"`
+
+	SigningCerts          []string `json:"signing_certs,omitempty"`
+	RequireSignedRequests bool     `json:"require_signed_requests,omitempty"`
+
+	SignatureAlgorithm string `json:"signature_algorithm,omitempty"`
+	SigningMode        string `json:"signing_mode,omitempty"`
+}
+
+// serviceProviderPatch is the body accepted for partial updates. Absent fields
+// are left unchanged; an explicit null attribute_mapping or access_policy
+// clears it.
+type serviceProviderPatch struct {
+	ACSURL           *string         `json:"acs_url"`
+	ACSBinding       *string         `json:"acs_binding"`
+	AttributeMapping json.RawMessage `json:"attribute_mapping"`
+	AccessPolicy     json.RawMessage `json:"access_policy"`
+	NameIDFormats    *[]string       `json:"nameid_formats"`
+	SLOURL           *string         `json:"slo_url"`
+	SLOBinding       *string         `json:"slo_binding"`
+	MetadataXML      *string         `json:"metadata_xml"`
+	MetadataURL      *string         `json:"metadata_url"`
+
+	MetadataRefreshIntervalSeconds *int    `json:"metadata_refresh_interval_seconds"`
+	MetadataSigningCert            *string `json:"metadata_signing_cert"`
+
+	AllowIdPInitiated *bool `json:"allow_idp_initiated"`
+
+	EncryptionCert      *string `json:"encryption_cert"`
+	EncryptionAlgorithm *string `json:"encryption_algorithm"`
+
+	SigningCerts          *[]string `json:"signing_certs"`
+	RequireSignedRequests *bool     `json:"require_signed_requests"`
+
+	SignatureAlgorithm *string `json:"signature_algorithm"`
+	SigningMode        *string `json:"signing_mode"`
+}
+
+type serviceProviderList struct {
+	ServiceProviders []*ServiceProvider `json:"service_providers"`
+	Total            int                `json:"total"`
+	Limit            int                `json:"limit"`
+	Offset           int                `json:"offset"`
+}
+
+func (s *Server) writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Errorw("Failed to encode JSON response", "error", err)
+	}
+}
+
+func (s *Server) writeAdminError(w http.ResponseWriter, status int, code, message string) {
+	s.writeAdminJSON(w, status, adminError{Error: code, Message: message})
+}
+
+// validateServiceProvider checks the fields of a service provider registration
+// and applies the default ACS and SLO bindings when none is set.
+func validateServiceProvider(sp *ServiceProvider) error {
+	if sp.EntityID == "" || sp.ACSURL == "" {
+		return errors.New("missing required fields: entity_id and acs_url are required")
+	}
+
+	acsURL, err := url.Parse(sp.ACSURL)
+	if err != nil || acsURL.Scheme == "" || acsURL.Host == "" {
+		return errors.New("invalid acs_url: must be a valid URL with scheme and host")
+	}
+	if acsURL.Scheme != "http" && acsURL.Scheme != "https" {
+		return errors.New("invalid acs_url: scheme must be http or https")
+	}
+
+	validBindings := map[string]bool{
+		saml.HTTPPostBinding:     true,
+		saml.HTTPRedirectBinding: true,
+	}
+	if sp.ACSBinding == "" {
+		// Apply default binding when not provided
+		sp.ACSBinding = saml.HTTPPostBinding
+	} else if !validBindings[sp.ACSBinding] {
+		return errors.New("invalid acs_binding value")
+	}
+
+	if sp.SLOURL != "" {
+		sloURL, err := url.Parse(sp.SLOURL)
+		if err != nil || sloURL.Host == "" || (sloURL.Scheme != "http" && sloURL.Scheme != "https") {
+			return errors.New("invalid slo_url: must be an http or https URL")
+		}
+		if sp.SLOBinding == "" {
+			sp.SLOBinding = saml.HTTPRedirectBinding
+		} else if !validBindings[sp.SLOBinding] {
+			return errors.New("invalid slo_binding value")
+		}
+	} else if sp.SLOBinding != "" {
+		return errors.New("slo_binding requires slo_url")
+	}
+
+	if sp.MetadataRefreshIntervalSeconds < 0 {
+		return errors.New("invalid metadata_refresh_interval_seconds: must not be negative")
+	}
+	if sp.MetadataRefreshIntervalSeconds > 0 {
+		if sp.MetadataURL == "" {
+			return errors.New("metadata_refresh_interval_seconds requires metadata_url")
+		}
+		if time.Duration(sp.MetadataRefreshIntervalSeconds)*time.Second < minMetadataRefreshInterval {
+			return fmt.Errorf("invalid metadata_refresh_interval_seconds: must be at least %d", int(minMetadataRefreshInterval.Seconds()))
+		}
+	}
+	if sp.MetadataSigningCert != "" {
+		if _, err := parseCertificatePEM(sp.MetadataSigningCert); err != nil {
+			return fmt.Errorf("invalid metadata_signing_cert: %v", err)
+		}
+	}
+	if sp.EncryptionCert != "" {
+		if err := validateEncryptionCert(sp.EncryptionCert); err != nil {
+			return fmt.Errorf("invalid encryption_cert: %v", err)
+		}
+	}
+	if sp.EncryptionAlgorithm != "" {
+		if _, ok := encryptionAlgorithms[sp.EncryptionAlgorithm]; !ok {
+			return errors.New("invalid encryption_algorithm value")
+		}
+	}
+	for _, certPEM := range sp.SigningCerts {
+		if _, err := parseCertificatePEM(certPEM); err != nil {
+			return fmt.Errorf("invalid signing_certs: %v", err)
+		}
+	}
+	if sp.RequireSignedRequests && len(sp.SigningCerts) == 0 && sp.MetadataXML == "" {
+		return errors.New("require_signed_requests requires signing_certs or SP metadata")
+	}
+	if sp.SignatureAlgorithm != "" {
+		if err := validateSignatureMethod(sp.SignatureAlgorithm); err != nil {
+			return errors.New("invalid signature_algorithm value")
+		}
+	}
+	if sp.SigningMode != "" {
+		if err := validateSigningMode(sp.SigningMode); err != nil {
+			return errors.New("invalid signing_mode value: must be response, assertion or both")
+		}
+	}
+	if sp.AccessPolicy != nil {
+		if err := sp.AccessPolicy.validate(); err != nil {
+			return fmt.Errorf("invalid access_policy: %v", err)
+		}
+	}
+	if sp.AttributeMapping != nil {
+		if err := sp.AttributeMapping.validate(); err != nil {
+			return fmt.Errorf("invalid attribute_mapping: %v", err)
+		}
+	}
+	for i, format := range sp.NameIDFormats {
+		urn, err := parseNameIDFormat(format)
+		if err != nil {
+			return fmt.Errorf("invalid nameid_formats: %v", err)
+		}
+		sp.NameIDFormats[i] = urn
+	}
+	if sp.AttributeMapping != nil && sp.AttributeMapping.NameIDFormat != "" && len(sp.NameIDFormats) > 0 &&
+		!slices.Contains(sp.NameIDFormats, nameIDFormatToURN(sp.AttributeMapping.NameIDFormat)) {
+		return errors.New("invalid attribute_mapping: nameid_format must be one of nameid_formats")
+	}
+
+	return nil
+}
+
+// entityIDParam returns the entity ID from the request path. Entity IDs are
+// usually URLs, so clients must percent-encode them into a single path segment.
+func entityIDParam(r *http.Request) (string, error) {
+	entityID, err := url.PathUnescape(chi.URLParam(r, "entityID"))
+	if err != nil {
+		return "", fmt.Errorf("invalid entity ID in path: %w", err)
+	}
+	if entityID == "" {
+		return "", errors.New("missing entity ID in path")
+	}
+	return entityID, nil
+}
+
+// -------------------------------------------------------------------------
+// Service Provider Registration Handler
+// -------------------------------------------------------------------------
+func (s *Server) handleServiceProviderRegistration(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_service_provider_registration")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	// Parse the JSON request body
+	var req serviceProviderRequest
+
+	contentType := strings.ToLower(r.Header.Get("Content-Type"))
+	if isMetadataContentType(contentType) {
+		// Raw SP metadata upload
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxMetadataSize+1))
+		if err != nil || len(data) > maxMetadataSize {
+			s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "Failed to read metadata document")
+			return
+		}
+		req.MetadataXML = string(data)
+	} else if strings.Contains(contentType, "application/json") {
+		// Parse JSON request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "Failed to parse JSON request")
+			return
+		}
+	} else if strings.Contains(contentType, "application/x-www-form-urlencoded") || contentType == "" {
+		// Support form-encoded requests (default if no Content-Type)
+		if err := r.ParseForm(); err != nil {
+			s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "Failed to parse form request")
+			return
+		}
+		req.EntityID = r.FormValue("entity_id")
+		req.ACSURL = r.FormValue("acs_url")
+		req.ACSBinding = r.FormValue("acs_binding")
+		req.SLOURL = r.FormValue("slo_url")
+		req.SLOBinding = r.FormValue("slo_binding")
+		req.MetadataURL = r.FormValue("metadata_url")
+		req.MetadataSigningCert = r.FormValue("metadata_signing_cert")
+		if v := r.FormValue("metadata_refresh_interval_seconds"); v != "" {
+			seconds, err := strconv.Atoi(v)
+			if err != nil {
+				s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "invalid metadata_refresh_interval_seconds value")
+				return
+			}
+			req.MetadataRefreshIntervalSeconds = seconds
+		}
+		req.EncryptionCert = r.FormValue("encryption_cert")
+		req.EncryptionAlgorithm = r.FormValue("encryption_algorithm")
+		req.SigningCerts = r.PostForm["signing_certs"]
+		req.NameIDFormats = r.PostForm["nameid_formats"]
+		req.SignatureAlgorithm = r.FormValue("signature_algorithm")
+		req.SigningMode = r.FormValue("signing_mode")
+		if v := r.FormValue("require_signed_requests"); v != "" {
+			require, err := strconv.ParseBool(v)
+			if err != nil {
+				s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "invalid require_signed_requests value")
+				return
+			}
+			req.RequireSignedRequests = require
+		}
+		if v := r.FormValue("allow_idp_initiated"); v != "" {
+			allow, err := strconv.ParseBool(v)
+			if err != nil {
+				s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "invalid allow_idp_initiated value")
+				return
+			}
+			req.AllowIdPInitiated = allow
+		}
+		// attribute_mapping and access_policy are not supported in
+		// form-encoded requests
+	} else {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "Unsupported Content-Type")
+		return
+	}
+
+	sp := &ServiceProvider{
+		EntityID:         req.EntityID,
+		ACSURL:           req.ACSURL,
+		ACSBinding:       req.ACSBinding,
+		AttributeMapping: req.AttributeMapping,
+		AccessPolicy:     req.AccessPolicy,
+		NameIDFormats:    req.NameIDFormats,
+		SLOURL:           req.SLOURL,
+		SLOBinding:       req.SLOBinding,
+		MetadataXML:      req.MetadataXML,
+		MetadataURL:      req.MetadataURL,
+
+		AllowIdPInitiated:   req.AllowIdPInitiated,
+		EncryptionCert:      req.EncryptionCert,
+		EncryptionAlgorithm: req.EncryptionAlgorithm,
+
+		SigningCerts:          req.SigningCerts,
+		RequireSignedRequests: req.RequireSignedRequests,
+		SignatureAlgorithm:    req.SignatureAlgorithm,
+		SigningMode:           req.SigningMode,
+
+		MetadataRefreshIntervalSeconds: req.MetadataRefreshIntervalSeconds,
+		MetadataSigningCert:            req.MetadataSigningCert,
+	}
+	if err := s.resolveServiceProviderMetadata(r.Context(), sp); err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, err.Error())
+		return
+	}
+	if err := validateServiceProvider(sp); err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, err.Error())
+		return
+	}
+
+	// Save to database
+	if err := s.db.SaveServiceProvider(sp); err != nil {
+		s.logger.Errorw("Failed to save service provider", "error", err)
+		s.writeAdminError(w, http.StatusInternalServerError, adminErrInternal, "Failed to save service provider")
+		return
+	}
+
+	s.logger.Infow("Service provider registered successfully", "entityID", sp.EntityID,
+		"principal", adminPrincipalFromContext(r.Context()).Name())
+	s.writeAdminJSON(w, http.StatusCreated, map[string]string{
+		"status":    "success",
+		"message":   "Service provider registered",
+		"entity_id": sp.EntityID,
+	})
+}
+
+func (s *Server) handleListServiceProviders(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_list_service_providers")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	query := r.URL.Query()
+	filter := ServiceProviderFilter{
+		EntityIDContains: query.Get("entity_id"),
+		ACSBinding:       query.Get("acs_binding"),
+		Limit:            defaultServiceProviderPageSize,
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxServiceProviderPageSize {
+			s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest,
+				fmt.Sprintf("Invalid limit: must be an integer between 1 and %d", maxServiceProviderPageSize))
+			return
+		}
+		filter.Limit = limit
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "Invalid offset: must be a non-negative integer")
+			return
+		}
+		filter.Offset = offset
+	}
+
+	serviceProviders, total, err := s.db.ListServiceProviders(filter)
+	if err != nil {
+		s.logger.Errorw("Failed to list service providers", "error", err)
+		s.writeAdminError(w, http.StatusInternalServerError, adminErrInternal, "Failed to list service providers")
+		return
+	}
+
+	s.writeAdminJSON(w, http.StatusOK, serviceProviderList{
+		ServiceProviders: serviceProviders,
+		Total:            total,
+		Limit:            filter.Limit,
+		Offset:           filter.Offset,
+	})
+}
+
+func (s *Server) handleGetServiceProvider(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_get_service_provider")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	sp, ok := s.loadServiceProvider(w, r)
+	if !ok {
+		return
+	}
+
+	s.writeAdminJSON(w, http.StatusOK, sp)
+}
+
+func (s *Server) handleReplaceServiceProvider(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_replace_service_provider")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	existing, ok := s.loadServiceProvider(w, r)
+	if !ok {
+		return
+	}
+
+	var req serviceProviderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "Failed to parse JSON request")
+		return
+	}
+	if req.EntityID != "" && req.EntityID != existing.EntityID {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "entity_id in body does not match the path")
+		return
+	}
+
+	sp := &ServiceProvider{
+		EntityID:         existing.EntityID,
+		ACSURL:           req.ACSURL,
+		ACSBinding:       req.ACSBinding,
+		AttributeMapping: req.AttributeMapping,
+		AccessPolicy:     req.AccessPolicy,
+		NameIDFormats:    req.NameIDFormats,
+		SLOURL:           req.SLOURL,
+		SLOBinding:       req.SLOBinding,
+		MetadataXML:      req.MetadataXML,
+		MetadataURL:      req.MetadataURL,
+
+		AllowIdPInitiated:   req.AllowIdPInitiated,
+		EncryptionCert:      req.EncryptionCert,
+		EncryptionAlgorithm: req.EncryptionAlgorithm,
+
+		SigningCerts:          req.SigningCerts,
+		RequireSignedRequests: req.RequireSignedRequests,
+		SignatureAlgorithm:    req.SignatureAlgorithm,
+		SigningMode:           req.SigningMode,
+
+		MetadataRefreshIntervalSeconds: req.MetadataRefreshIntervalSeconds,
+		MetadataSigningCert:            req.MetadataSigningCert,
+	}
+	s.saveAndWriteServiceProvider(w, r, sp)
+}
+
+func (s *Server) handleUpdateServiceProvider(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_update_service_provider")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	sp, ok := s.loadServiceProvider(w, r)
+	if !ok {
+		return
+	}
+
+	var patch serviceProviderPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, "Failed to parse JSON request")
+		return
+	}
+	if err := patch.apply(sp); err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, err.Error())
+		return
+	}
+
+	s.saveAndWriteServiceProvider(w, r, sp)
+}
+
+func (s *Server) handleDeleteServiceProvider(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_delete_service_provider")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	entityID, err := entityIDParam(r)
+	if err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, err.Error())
+		return
+	}
+
+	if err := s.db.DeleteServiceProvider(entityID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			s.writeAdminError(w, http.StatusNotFound, adminErrNotFound, "Service provider not found")
+			return
+		}
+		s.logger.Errorw("Failed to delete service provider", "entityID", entityID, "error", err)
+		s.writeAdminError(w, http.StatusInternalServerError, adminErrInternal, "Failed to delete service provider")
+		return
+	}
+
+	s.logger.Infow("Service provider deleted successfully", "entityID", entityID,
+		"principal", adminPrincipalFromContext(r.Context()).Name())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadServiceProvider looks up the service provider named in the request path,
+// writing an error response and returning false if it cannot be loaded.
+func (s *Server) loadServiceProvider(w http.ResponseWriter, r *http.Request) (*ServiceProvider, bool) {
+	entityID, err := entityIDParam(r)
+	if err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, err.Error())
+		return nil, false
+	}
+
+	sp, err := s.db.GetServiceProviderRecord(entityID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			s.writeAdminError(w, http.StatusNotFound, adminErrNotFound, "Service provider not found")
+			return nil, false
+		}
+		s.logger.Errorw("Failed to retrieve service provider", "entityID", entityID, "error", err)
+		s.writeAdminError(w, http.StatusInternalServerError, adminErrInternal, "Failed to retrieve service provider")
+		return nil, false
+	}
+
+	return sp, true
+}
+
+// saveAndWriteServiceProvider validates and stores sp, then responds with the
+// stored registration.
+func (s *Server) saveAndWriteServiceProvider(w http.ResponseWriter, r *http.Request, sp *ServiceProvider) {
+	if err := s.resolveServiceProviderMetadata(r.Context(), sp); err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, err.Error())
+		return
+	}
+	if err := validateServiceProvider(sp); err != nil {
+		s.writeAdminError(w, http.StatusBadRequest, adminErrInvalidRequest, err.Error())
+		return
+	}
+
+	if err := s.db.SaveServiceProvider(sp); err != nil {
+		s.logger.Errorw("Failed to save service provider", "entityID", sp.EntityID, "error", err)
+		s.writeAdminError(w, http.StatusInternalServerError, adminErrInternal, "Failed to save service provider")
+		return
+	}
+
+	saved, err := s.db.GetServiceProviderRecord(sp.EntityID)
+	if err != nil {
+		s.logger.Errorw("Failed to retrieve saved service provider", "entityID", sp.EntityID, "error", err)
+		s.writeAdminError(w, http.StatusInternalServerError, adminErrInternal, "Failed to retrieve service provider")
+		return
+	}
+
+	s.logger.Infow("Service provider updated successfully", "entityID", sp.EntityID,
+		"principal", adminPrincipalFromContext(r.Context()).Name())
+	s.writeAdminJSON(w, http.StatusOK, saved)
+}
+
+// apply merges the fields present in the patch into sp.
+func (p *serviceProviderPatch) apply(sp *ServiceProvider) error {
+	if p.ACSURL != nil {
+		sp.ACSURL = *p.ACSURL
+	}
+	if p.ACSBinding != nil {
+		sp.ACSBinding = *p.ACSBinding
+	}
+	if len(p.AttributeMapping) > 0 {
+		if bytes.Equal(bytes.TrimSpace(p.AttributeMapping), []byte("null")) {
+			sp.AttributeMapping = nil
+		} else {
+			var mapping AttributeMapping
+			if err := json.Unmarshal(p.AttributeMapping, &mapping); err != nil {
+				return errors.New("invalid attribute_mapping")
+			}
+			sp.AttributeMapping = &mapping
+		}
+	}
+	if len(p.AccessPolicy) > 0 {
+		if bytes.Equal(bytes.TrimSpace(p.AccessPolicy), []byte("null")) {
+			sp.AccessPolicy = nil
+		} else {
+			var policy AccessPolicy
+			if err := json.Unmarshal(p.AccessPolicy, &policy); err != nil {
+				return errors.New("invalid access_policy")
+			}
+			sp.AccessPolicy = &policy
+		}
+	}
+	if p.NameIDFormats != nil {
+		sp.NameIDFormats = *p.NameIDFormats
+	}
+	if p.SLOURL != nil {
+		sp.SLOURL = *p.SLOURL
+		if *p.SLOURL == "" {
+			sp.SLOBinding = ""
+		}
+	}
+	if p.SLOBinding != nil {
+		sp.SLOBinding = *p.SLOBinding
+	}
+	if p.AllowIdPInitiated != nil {
+		sp.AllowIdPInitiated = *p.AllowIdPInitiated
+	}
+	if p.EncryptionCert != nil {
+		sp.EncryptionCert = *p.EncryptionCert
+	}
+	if p.EncryptionAlgorithm != nil {
+		sp.EncryptionAlgorithm = *p.EncryptionAlgorithm
+	}
+	if p.SigningCerts != nil {
+		sp.SigningCerts = *p.SigningCerts
+	}
+	if p.RequireSignedRequests != nil {
+		sp.RequireSignedRequests = *p.RequireSignedRequests
+	}
+	if p.SignatureAlgorithm != nil {
+		sp.SignatureAlgorithm = *p.SignatureAlgorithm
+	}
+	if p.SigningMode != nil {
+		sp.SigningMode = *p.SigningMode
+	}
+	if p.MetadataRefreshIntervalSeconds != nil {
+		sp.MetadataRefreshIntervalSeconds = *p.MetadataRefreshIntervalSeconds
+	}
+	if p.MetadataSigningCert != nil {
+		sp.MetadataSigningCert = *p.MetadataSigningCert
+	}
+	if p.MetadataURL != nil {
+		// Drop the stored document so it is fetched again from the new URL
+		sp.MetadataURL = *p.MetadataURL
+		sp.MetadataXML = ""
+	}
+	if p.MetadataXML != nil {
+		sp.MetadataXML = *p.MetadataXML
+		if p.MetadataURL == nil {
+			sp.MetadataURL = ""
+		}
+	}
+	return nil
+}
+
+// resolveServiceProviderMetadata fetches the metadata document from
+// MetadataURL when no document is set, then derives the entity ID and default
+// ACS and SLO endpoints from the document.
+func (s *Server) resolveServiceProviderMetadata(ctx context.Context, sp *ServiceProvider) error {
+	if sp.MetadataXML == "" && sp.MetadataURL != "" {
+		data, err := fetchServiceProviderMetadata(ctx, nil, sp.MetadataURL)
+		if err != nil {
+			return err
+		}
+		sp.MetadataXML = string(data)
+	}
+	if sp.MetadataXML == "" {
+		return nil
+	}
+
+	descriptor, validated, err := validateMetadataDocument(sp, []byte(sp.MetadataXML))
+	if err != nil {
+		return err
+	}
+
+	sp.MetadataXML = string(validated)
+	applyMetadataDescriptor(sp, descriptor)
+	return nil
+}
+
+func isMetadataContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.TrimSpace(mediaType) {
+	case "application/samlmetadata+xml", "application/xml", "text/xml":
+		return true
+	}
+	return false
+}
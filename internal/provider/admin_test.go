@@ -0,0 +1,351 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/crewjam/saml"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestValidateServiceProvider(t *testing.T) {
+	testCases := []struct {
+		name        string
+		sp          ServiceProvider
+		wantErr     bool
+		wantBinding string
+	}{
+		{
+			name:        "default binding",
+			sp:          ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs"},
+			wantBinding: saml.HTTPPostBinding,
+		},
+		{
+			name:        "redirect binding",
+			sp:          ServiceProvider{EntityID: "sp", ACSURL: "https://sp.example.com/acs", ACSBinding: saml.HTTPRedirectBinding},
+			wantBinding: saml.HTTPRedirectBinding,
+		},
+		{
+			name:    "missing acs url",
+			sp:      ServiceProvider{EntityID: "sp"},
+			wantErr: true,
+		},
+		{
+			name:    "relative acs url",
+			sp:      ServiceProvider{EntityID: "sp", ACSURL: "/acs"},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported scheme",
+			sp:      ServiceProvider{EntityID: "sp", ACSURL: "ftp://sp.example.com/acs"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown binding",
+			sp:      ServiceProvider{EntityID: "sp", ACSURL: "https://sp.example.com/acs", ACSBinding: "urn:invalid"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sp := tc.sp
+			err := validateServiceProvider(&sp)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if sp.ACSBinding != tc.wantBinding {
+				t.Errorf("Expected binding %q, got %q", tc.wantBinding, sp.ACSBinding)
+			}
+		})
+	}
+}
+
+func TestServiceProviderPatch_Apply(t *testing.T) {
+	original := func() *ServiceProvider {
+		return &ServiceProvider{
+			EntityID:         "https://sp.example.com",
+			ACSURL:           "https://sp.example.com/acs",
+			ACSBinding:       saml.HTTPPostBinding,
+			AttributeMapping: &AttributeMapping{NameIDFormat: "email"},
+		}
+	}
+
+	t.Run("absent fields are unchanged", func(t *testing.T) {
+		var patch serviceProviderPatch
+		if err := json.Unmarshal([]byte(`{"acs_url": "https://sp.example.com/new-acs"}`), &patch); err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+		sp := original()
+		if err := patch.apply(sp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sp.ACSURL != "https://sp.example.com/new-acs" {
+			t.Errorf("Expected ACS URL to be updated, got %q", sp.ACSURL)
+		}
+		if sp.ACSBinding != saml.HTTPPostBinding {
+			t.Errorf("Expected binding to be unchanged, got %q", sp.ACSBinding)
+		}
+		if sp.AttributeMapping == nil || sp.AttributeMapping.NameIDFormat != "email" {
+			t.Errorf("Expected attribute mapping to be unchanged, got %+v", sp.AttributeMapping)
+		}
+	})
+
+	t.Run("null clears attribute mapping", func(t *testing.T) {
+		var patch serviceProviderPatch
+		if err := json.Unmarshal([]byte(`{"attribute_mapping": null}`), &patch); err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+		sp := original()
+		if err := patch.apply(sp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sp.AttributeMapping != nil {
+			t.Errorf("Expected attribute mapping to be cleared, got %+v", sp.AttributeMapping)
+		}
+	})
+
+	t.Run("replaces attribute mapping", func(t *testing.T) {
+		var patch serviceProviderPatch
+		if err := json.Unmarshal([]byte(`{"attribute_mapping": {"nameid_format": "persistent"}}`), &patch); err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+		sp := original()
+		if err := patch.apply(sp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sp.AttributeMapping == nil || sp.AttributeMapping.NameIDFormat != "persistent" {
+			t.Errorf("Expected attribute mapping to be replaced, got %+v", sp.AttributeMapping)
+		}
+	})
+
+	t.Run("null clears access policy", func(t *testing.T) {
+		var patch serviceProviderPatch
+		if err := json.Unmarshal([]byte(`{"access_policy": null}`), &patch); err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+		sp := original()
+		sp.AccessPolicy = &AccessPolicy{AllowedGroups: []string{"staff"}}
+		if err := patch.apply(sp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sp.AccessPolicy != nil {
+			t.Errorf("Expected access policy to be cleared, got %+v", sp.AccessPolicy)
+		}
+	})
+
+	t.Run("replaces access policy", func(t *testing.T) {
+		var patch serviceProviderPatch
+		if err := json.Unmarshal([]byte(`{"access_policy": {"allowed_email_domains": ["example.com"]}}`), &patch); err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+		sp := original()
+		if err := patch.apply(sp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sp.AccessPolicy == nil || len(sp.AccessPolicy.AllowedEmailDomains) != 1 {
+			t.Errorf("Expected access policy to be set, got %+v", sp.AccessPolicy)
+		}
+		if sp.AttributeMapping == nil {
+			t.Error("Expected attribute mapping to be unchanged")
+		}
+	})
+
+	t.Run("replaces nameid formats", func(t *testing.T) {
+		var patch serviceProviderPatch
+		if err := json.Unmarshal([]byte(`{"nameid_formats": ["persistent"]}`), &patch); err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+		sp := original()
+		if err := patch.apply(sp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(sp.NameIDFormats) != 1 || sp.NameIDFormats[0] != "persistent" {
+			t.Errorf("Expected nameid formats to be set, got %v", sp.NameIDFormats)
+		}
+	})
+
+	t.Run("metadata url forces a refetch", func(t *testing.T) {
+		var patch serviceProviderPatch
+		if err := json.Unmarshal([]byte(`{"metadata_url": "https://sp.example.com/metadata"}`), &patch); err != nil {
+			t.Fatalf("Failed to decode patch: %v", err)
+		}
+		sp := original()
+		sp.MetadataXML = testSPMetadata
+		if err := patch.apply(sp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sp.MetadataURL != "https://sp.example.com/metadata" || sp.MetadataXML != "" {
+			t.Errorf("Expected new metadata URL and no stored document, got url=%q xml=%q", sp.MetadataURL, sp.MetadataXML)
+		}
+	})
+
+	t.Run("uploaded metadata clears the url", func(t *testing.T) {
+		patch := serviceProviderPatch{MetadataXML: &[]string{testSPMetadata}[0]}
+		sp := original()
+		sp.MetadataURL = "https://sp.example.com/metadata"
+		if err := patch.apply(sp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sp.MetadataURL != "" || sp.MetadataXML != testSPMetadata {
+			t.Errorf("Expected uploaded metadata without a URL, got url=%q", sp.MetadataURL)
+		}
+	})
+
+	t.Run("invalid attribute mapping", func(t *testing.T) {
+		patch := serviceProviderPatch{AttributeMapping: json.RawMessage(`"not-an-object"`)}
+		if err := patch.apply(original()); err == nil {
+			t.Fatal("Expected an error, got nil")
+		}
+	})
+}
+
+func TestEntityIDParam_DecodesPathSegment(t *testing.T) {
+	entityID := "https://sp.example.com/saml/metadata"
+
+	var got string
+	router := chi.NewRouter()
+	router.Get("/admin/service-providers/{entityID}", func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		got, err = entityIDParam(r)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/service-providers/"+url.PathEscape(entityID), nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got != entityID {
+		t.Errorf("Expected entity ID %q, got %q", entityID, got)
+	}
+}
+
+func TestHandleListServiceProviders_InvalidPagination(t *testing.T) {
+	server := setupTestServer(t)
+	server.adminAuth = &staticTokenAuthenticator{token: "test-admin-token"}
+	server.SetupRoutes()
+
+	for _, query := range []string{"limit=0", "limit=abc", "limit=100000", "offset=-1"} {
+		t.Run(query, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin/service-providers?"+query, nil)
+			req.Header.Set("Authorization", "Bearer test-admin-token")
+			rec := httptest.NewRecorder()
+
+			server.router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected JSON content type, got %q", ct)
+			}
+			var body adminError
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("Failed to decode error body: %v", err)
+			}
+			if body.Error != adminErrInvalidRequest || body.Message == "" {
+				t.Errorf("Unexpected error body: %+v", body)
+			}
+		})
+	}
+}
+
+func TestAdminServiceProviderLifecycle(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	server.adminAuth = &staticTokenAuthenticator{token: "test-admin-token"}
+	server.SetupRoutes()
+
+	entityID := "https://lifecycle.example.com/saml/metadata"
+	path := "/admin/service-providers/" + url.PathEscape(entityID)
+	t.Cleanup(func() {
+		_ = server.db.DeleteServiceProvider(entityID)
+	})
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer test-admin-token")
+		rec := httptest.NewRecorder()
+		server.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/admin/service-providers", `{"entity_id": "`+entityID+`", "acs_url": "https://lifecycle.example.com/acs"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Create: expected status %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	rec = do(http.MethodGet, path, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Get: expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var sp ServiceProvider
+	if err := json.NewDecoder(rec.Body).Decode(&sp); err != nil {
+		t.Fatalf("Failed to decode service provider: %v", err)
+	}
+	if sp.EntityID != entityID || sp.ACSBinding != saml.HTTPPostBinding {
+		t.Errorf("Unexpected service provider: %+v", sp)
+	}
+
+	rec = do(http.MethodGet, "/admin/service-providers?entity_id=lifecycle.example", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("List: expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var list serviceProviderList
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode list: %v", err)
+	}
+	if list.Total != 1 || len(list.ServiceProviders) != 1 {
+		t.Errorf("Expected 1 service provider, got total=%d len=%d", list.Total, len(list.ServiceProviders))
+	}
+
+	rec = do(http.MethodPatch, path, `{"acs_binding": "`+saml.HTTPRedirectBinding+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Patch: expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&sp); err != nil {
+		t.Fatalf("Failed to decode service provider: %v", err)
+	}
+	if sp.ACSBinding != saml.HTTPRedirectBinding || sp.ACSURL != "https://lifecycle.example.com/acs" {
+		t.Errorf("Unexpected patched service provider: %+v", sp)
+	}
+
+	rec = do(http.MethodPut, path, `{"entity_id": "https://other.example.com", "acs_url": "https://lifecycle.example.com/acs"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Put with mismatched entity_id: expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = do(http.MethodPut, path, `{"acs_url": "https://lifecycle.example.com/acs2"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Put: expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	rec = do(http.MethodDelete, path, "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Delete: expected status %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	rec = do(http.MethodGet, path, "")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Get after delete: expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
@@ -0,0 +1,319 @@
+package provider
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Admin API authentication modes.
+const (
+	AdminAuthModeIntrospection = "introspection"
+	AdminAuthModeJWT           = "jwt"
+	AdminAuthModeStatic        = "static"
+	AdminAuthModeNone          = "none"
+)
+
+// Error codes used in adminError responses for authentication failures.
+const (
+	adminErrUnauthorized = "unauthorized"
+	adminErrForbidden    = "forbidden"
+	adminErrUnavailable  = "unavailable"
+)
+
+var (
+	errAdminInvalidToken      = errors.New("invalid or inactive bearer token")
+	errAdminInsufficientScope = errors.New("token is missing a required scope")
+)
+
+// adminPrincipal identifies the caller of an admin API request.
+type adminPrincipal struct {
+	Subject    string
+	ClientID   string
+	AuthMethod string
+}
+
+// Name returns the identifier recorded for the principal.
+func (p *adminPrincipal) Name() string {
+	if p == nil {
+		return ""
+	}
+	if p.Subject != "" {
+		return p.Subject
+	}
+	return p.ClientID
+}
+
+// adminAuthenticator validates a bearer token presented to the admin API.
+type adminAuthenticator interface {
+	Authenticate(ctx context.Context, token string) (*adminPrincipal, error)
+}
+
+type adminPrincipalKey struct{}
+
+// adminPrincipalFromContext returns the principal attached by the admin auth
+// middleware, or nil if the request was not authenticated.
+func adminPrincipalFromContext(ctx context.Context) *adminPrincipal {
+	p, _ := ctx.Value(adminPrincipalKey{}).(*adminPrincipal)
+	return p
+}
+
+// newAdminAuthenticator builds the authenticator for the configured mode.
+// verifier is only used in JWT mode.
+func (s *Server) newAdminAuthenticator(verifier *oidc.IDTokenVerifier) (adminAuthenticator, error) {
+	switch s.config.AdminAuthMode {
+	case AdminAuthModeIntrospection:
+		if s.config.HydraAdminURL == "" {
+			return nil, errors.New("SAML_PROVIDER_HYDRA_ADMIN_URL is required for introspection admin auth")
+		}
+		return &introspectionAuthenticator{
+			endpoint:       strings.TrimSuffix(s.config.HydraAdminURL, "/") + "/admin/oauth2/introspect",
+			client:         s.hydraHTTPClient,
+			requiredScopes: s.config.AdminRequiredScopes,
+			server:         s,
+		}, nil
+	case AdminAuthModeJWT:
+		if verifier == nil {
+			return nil, errors.New("an OIDC verifier is required for JWT admin auth")
+		}
+		if len(s.config.AdminRequiredScopes) == 0 && s.config.AdminJWTAudience == "" {
+			// Otherwise any token Hydra signs, including end-user ID tokens, would be accepted
+			return nil, errors.New("JWT admin auth requires SAML_PROVIDER_ADMIN_REQUIRED_SCOPES or SAML_PROVIDER_ADMIN_JWT_AUDIENCE")
+		}
+		return &jwtAuthenticator{verifier: verifier, requiredScopes: s.config.AdminRequiredScopes}, nil
+	case AdminAuthModeStatic:
+		if s.config.AdminStaticToken == "" {
+			return nil, errors.New("SAML_PROVIDER_ADMIN_STATIC_TOKEN is required for static admin auth")
+		}
+		s.logger.Warn("Admin API is protected by a static token. Use introspection or jwt mode in production!")
+		return &staticTokenAuthenticator{token: s.config.AdminStaticToken}, nil
+	case AdminAuthModeNone:
+		s.logger.Warn("Admin API authentication is disabled. Do not use this setting in production!")
+		return anonymousAuthenticator{}, nil
+	default:
+		return nil, fmt.Errorf("unknown admin auth mode %q", s.config.AdminAuthMode)
+	}
+}
+
+// requireAdminAuth rejects admin API requests without a valid bearer token and
+// writes an audit log entry naming the principal behind every accepted call.
+func (s *Server) requireAdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminAuth == nil {
+			s.logger.Error("Admin API request rejected: admin authentication is not configured")
+			s.writeAdminError(w, http.StatusServiceUnavailable, adminErrUnavailable, "Admin authentication is not configured")
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			if _, anonymous := s.adminAuth.(anonymousAuthenticator); !anonymous {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				s.writeAdminError(w, http.StatusUnauthorized, adminErrUnauthorized, "Missing bearer token")
+				return
+			}
+		}
+
+		principal, err := s.adminAuth.Authenticate(r.Context(), token)
+		switch {
+		case err == nil:
+		case errors.Is(err, errAdminInsufficientScope):
+			s.logger.Warnw("Admin API request rejected", "method", r.Method, "path", r.URL.Path, "error", err)
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="admin", error="insufficient_scope", scope=%q`,
+				strings.Join(s.config.AdminRequiredScopes, " ")))
+			s.writeAdminError(w, http.StatusForbidden, adminErrForbidden, "Token is missing a required scope")
+			return
+		case errors.Is(err, errAdminInvalidToken):
+			s.logger.Warnw("Admin API request rejected", "method", r.Method, "path", r.URL.Path, "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin", error="invalid_token"`)
+			s.writeAdminError(w, http.StatusUnauthorized, adminErrUnauthorized, "Invalid bearer token")
+			return
+		default:
+			s.logger.Errorw("Failed to authenticate admin API request", "error", err)
+			s.writeAdminError(w, http.StatusServiceUnavailable, adminErrUnavailable, "Unable to validate bearer token")
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), adminPrincipalKey{}, principal)))
+
+		s.logger.Infow("Admin API request",
+			"principal", principal.Name(),
+			"client_id", principal.ClientID,
+			"auth_method", principal.AuthMethod,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", ww.Status(),
+		)
+	})
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// hasScopes reports whether granted contains every required scope.
+func hasScopes(granted, required []string) bool {
+	have := make(map[string]bool, len(granted))
+	for _, scope := range granted {
+		have[scope] = true
+	}
+	for _, scope := range required {
+		if !have[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// -------------------------------------------------------------------------
+// Hydra OAuth2 Token Introspection
+// -------------------------------------------------------------------------
+type introspectionAuthenticator struct {
+	endpoint       string
+	client         *http.Client
+	requiredScopes []string
+	server         *Server
+}
+
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Subject  string `json:"sub"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+	TokenUse string `json:"token_use"`
+}
+
+func (a *introspectionAuthenticator) Authenticate(ctx context.Context, token string) (*adminPrincipal, error) {
+	ctx, span := a.server.tracer.Start(ctx, "provider.introspect_admin_token")
+	defer span.End()
+
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create introspection request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	client := a.client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		_ = a.server.monitor.SetDependencyAvailability(map[string]string{"component": "hydra-admin"}, 0)
+		return nil, fmt.Errorf("failed to call introspection endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	_ = a.server.monitor.SetDependencyAvailability(map[string]string{"component": "hydra-admin"}, 1)
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned status %d", resp.StatusCode)
+	}
+
+	var result introspectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	if !result.Active {
+		return nil, errAdminInvalidToken
+	}
+	if result.TokenUse != "" && result.TokenUse != "access_token" {
+		return nil, errAdminInvalidToken
+	}
+	if !hasScopes(strings.Fields(result.Scope), a.requiredScopes) {
+		return nil, errAdminInsufficientScope
+	}
+
+	return &adminPrincipal{
+		Subject:    result.Subject,
+		ClientID:   result.ClientID,
+		AuthMethod: AdminAuthModeIntrospection,
+	}, nil
+}
+
+// -------------------------------------------------------------------------
+// JWT Access Tokens
+// -------------------------------------------------------------------------
+type jwtAuthenticator struct {
+	verifier       *oidc.IDTokenVerifier
+	requiredScopes []string
+}
+
+type jwtAccessTokenClaims struct {
+	ClientID string          `json:"client_id"`
+	Scp      json.RawMessage `json:"scp"`
+	Scope    string          `json:"scope"`
+}
+
+// scopes returns the granted scopes. Hydra issues them as a "scp" array;
+// the RFC 9068 "scope" string is also accepted.
+func (c *jwtAccessTokenClaims) scopes() []string {
+	var scp []string
+	if len(c.Scp) > 0 {
+		if err := json.Unmarshal(c.Scp, &scp); err != nil {
+			var single string
+			if json.Unmarshal(c.Scp, &single) == nil {
+				scp = strings.Fields(single)
+			}
+		}
+	}
+	return append(scp, strings.Fields(c.Scope)...)
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context, token string) (*adminPrincipal, error) {
+	verified, err := a.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errAdminInvalidToken, err)
+	}
+
+	var claims jwtAccessTokenClaims
+	if err := verified.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", errAdminInvalidToken, err)
+	}
+	if !hasScopes(claims.scopes(), a.requiredScopes) {
+		return nil, errAdminInsufficientScope
+	}
+
+	return &adminPrincipal{
+		Subject:    verified.Subject,
+		ClientID:   claims.ClientID,
+		AuthMethod: AdminAuthModeJWT,
+	}, nil
+}
+
+// -------------------------------------------------------------------------
+// Static Token (bootstrapping only)
+// -------------------------------------------------------------------------
+type staticTokenAuthenticator struct {
+	token string
+}
+
+func (a *staticTokenAuthenticator) Authenticate(_ context.Context, token string) (*adminPrincipal, error) {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return nil, errAdminInvalidToken
+	}
+	return &adminPrincipal{Subject: "static-token", AuthMethod: AdminAuthModeStatic}, nil
+}
+
+// anonymousAuthenticator accepts every request. It backs the "none" mode.
+type anonymousAuthenticator struct{}
+
+func (anonymousAuthenticator) Authenticate(context.Context, string) (*adminPrincipal, error) {
+	return &adminPrincipal{Subject: "anonymous", AuthMethod: AdminAuthModeNone}, nil
+}
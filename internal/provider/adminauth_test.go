@@ -0,0 +1,211 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newAdminAuthTestServer(t *testing.T, auth adminAuthenticator) (*Server, *principalRecorder) {
+	t.Helper()
+	server := setupTestServer(t)
+	server.config.AdminRequiredScopes = []string{"saml-provider:admin"}
+	server.adminAuth = auth
+
+	recorder := &principalRecorder{}
+	server.router.With(server.requireAdminAuth).Get("/admin/test", recorder.ServeHTTP)
+	return server, recorder
+}
+
+type principalRecorder struct {
+	principal *adminPrincipal
+}
+
+func (p *principalRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.principal = adminPrincipalFromContext(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func serveAdminTestRequest(server *Server, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/admin/test", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func assertAdminErrorCode(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("Expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+	var body adminError
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode error body: %v", err)
+	}
+	if body.Error != code {
+		t.Errorf("Expected error code %q, got %q", code, body.Error)
+	}
+}
+
+func TestRequireAdminAuth_StaticToken(t *testing.T) {
+	server, recorder := newAdminAuthTestServer(t, &staticTokenAuthenticator{token: "s3cret"})
+
+	rec := serveAdminTestRequest(server, "")
+	assertAdminErrorCode(t, rec, http.StatusUnauthorized, adminErrUnauthorized)
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("Expected WWW-Authenticate header on 401 response")
+	}
+
+	rec = serveAdminTestRequest(server, "Bearer wrong")
+	assertAdminErrorCode(t, rec, http.StatusUnauthorized, adminErrUnauthorized)
+
+	rec = serveAdminTestRequest(server, "Basic s3cret")
+	assertAdminErrorCode(t, rec, http.StatusUnauthorized, adminErrUnauthorized)
+
+	rec = serveAdminTestRequest(server, "Bearer s3cret")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if recorder.principal == nil || recorder.principal.Name() != "static-token" || recorder.principal.AuthMethod != AdminAuthModeStatic {
+		t.Errorf("Unexpected principal: %+v", recorder.principal)
+	}
+}
+
+func TestRequireAdminAuth_NotConfigured(t *testing.T) {
+	server, _ := newAdminAuthTestServer(t, nil)
+
+	rec := serveAdminTestRequest(server, "Bearer anything")
+	assertAdminErrorCode(t, rec, http.StatusServiceUnavailable, adminErrUnavailable)
+}
+
+func TestRequireAdminAuth_None(t *testing.T) {
+	server, recorder := newAdminAuthTestServer(t, anonymousAuthenticator{})
+
+	rec := serveAdminTestRequest(server, "")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if recorder.principal.Name() != "anonymous" {
+		t.Errorf("Expected anonymous principal, got %+v", recorder.principal)
+	}
+}
+
+func TestRequireAdminAuth_Introspection(t *testing.T) {
+	responses := map[string]introspectionResponse{
+		"admin-token": {Active: true, Subject: "ops-client", ClientID: "ops-client", Scope: "openid saml-provider:admin", TokenUse: "access_token"},
+		"read-token":  {Active: true, Subject: "reader", ClientID: "reader", Scope: "openid"},
+		"refresh":     {Active: true, Subject: "ops-client", Scope: "saml-provider:admin", TokenUse: "refresh_token"},
+		"revoked":     {Active: false},
+	}
+	hydraAdmin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/oauth2/introspect" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		token := r.FormValue("token")
+		if token == "broken" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(responses[token])
+	}))
+	t.Cleanup(hydraAdmin.Close)
+
+	server := setupTestServer(t)
+	server.config.AdminAuthMode = AdminAuthModeIntrospection
+	server.config.HydraAdminURL = hydraAdmin.URL + "/"
+	server.config.AdminRequiredScopes = []string{"saml-provider:admin"}
+	server.hydraHTTPClient = hydraAdmin.Client()
+	auth, err := server.newAdminAuthenticator(nil)
+	if err != nil {
+		t.Fatalf("newAdminAuthenticator failed: %v", err)
+	}
+	server.adminAuth = auth
+	recorder := &principalRecorder{}
+	server.router.With(server.requireAdminAuth).Get("/admin/test", recorder.ServeHTTP)
+
+	rec := serveAdminTestRequest(server, "Bearer admin-token")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	if recorder.principal.Name() != "ops-client" || recorder.principal.AuthMethod != AdminAuthModeIntrospection {
+		t.Errorf("Unexpected principal: %+v", recorder.principal)
+	}
+
+	assertAdminErrorCode(t, serveAdminTestRequest(server, "Bearer read-token"), http.StatusForbidden, adminErrForbidden)
+	assertAdminErrorCode(t, serveAdminTestRequest(server, "Bearer refresh"), http.StatusUnauthorized, adminErrUnauthorized)
+	assertAdminErrorCode(t, serveAdminTestRequest(server, "Bearer revoked"), http.StatusUnauthorized, adminErrUnauthorized)
+	assertAdminErrorCode(t, serveAdminTestRequest(server, "Bearer broken"), http.StatusServiceUnavailable, adminErrUnavailable)
+}
+
+func TestNewAdminAuthenticator_Validation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "introspection", config: Config{AdminAuthMode: AdminAuthModeIntrospection, HydraAdminURL: "http://hydra:4445"}},
+		{name: "introspection without admin url", config: Config{AdminAuthMode: AdminAuthModeIntrospection}, wantErr: true},
+		{name: "static", config: Config{AdminAuthMode: AdminAuthModeStatic, AdminStaticToken: "token"}},
+		{name: "static without token", config: Config{AdminAuthMode: AdminAuthModeStatic}, wantErr: true},
+		{name: "jwt without verifier", config: Config{AdminAuthMode: AdminAuthModeJWT, AdminRequiredScopes: []string{"admin"}}, wantErr: true},
+		{name: "none", config: Config{AdminAuthMode: AdminAuthModeNone}},
+		{name: "unknown", config: Config{AdminAuthMode: "basic"}, wantErr: true},
+		{name: "empty", config: Config{}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := setupTestServer(t)
+			server.config = tc.config
+			auth, err := server.newAdminAuthenticator(nil)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if auth == nil {
+				t.Fatal("Expected an authenticator, got nil")
+			}
+		})
+	}
+}
+
+func TestJWTAccessTokenClaims_Scopes(t *testing.T) {
+	testCases := []struct {
+		name   string
+		claims string
+		want   []string
+	}{
+		{name: "hydra scp array", claims: `{"scp": ["openid", "saml-provider:admin"]}`, want: []string{"openid", "saml-provider:admin"}},
+		{name: "scp string", claims: `{"scp": "openid saml-provider:admin"}`, want: []string{"openid", "saml-provider:admin"}},
+		{name: "scope string", claims: `{"scope": "saml-provider:admin"}`, want: []string{"saml-provider:admin"}},
+		{name: "none", claims: `{}`, want: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var claims jwtAccessTokenClaims
+			if err := json.Unmarshal([]byte(tc.claims), &claims); err != nil {
+				t.Fatalf("Failed to decode claims: %v", err)
+			}
+			got := claims.scopes()
+			if len(got) != len(tc.want) {
+				t.Fatalf("Expected scopes %v, got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("Expected scopes %v, got %v", tc.want, got)
+				}
+			}
+		})
+	}
+}
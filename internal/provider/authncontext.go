@@ -0,0 +1,157 @@
+package provider
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/crewjam/saml"
+)
+
+const (
+	// defaultAuthnContextClassRef is the AuthnContextClassRef of logins whose
+	// ID Token matches no AuthnContextMapping. It ranks below every mapped
+	// context.
+	defaultAuthnContextClassRef = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+
+	// unspecifiedAuthnContextClassRef asks for no particular context.
+	unspecifiedAuthnContextClassRef = "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified"
+)
+
+// AuthnContextMapping maps a SAML AuthnContextClassRef to the OIDC acr value
+// asked from Hydra for it. The value is matched against the acr and amr
+// claims of the ID Token to find the context of a login.
+type AuthnContextMapping struct {
+	ClassRef string
+	ACR      string
+}
+
+// AuthnContextMap is the table of AuthnContextMappings, ordered from the
+// weakest to the strongest context for the minimum, better and maximum
+// comparisons. It is configured as a comma-separated list of classRef=acr
+// pairs.
+type AuthnContextMap []AuthnContextMapping
+
+// Decode implements envconfig.Decoder.
+func (m *AuthnContextMap) Decode(value string) error {
+	var mappings AuthnContextMap
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		classRef, acr, ok := strings.Cut(pair, "=")
+		classRef, acr = strings.TrimSpace(classRef), strings.TrimSpace(acr)
+		if !ok || classRef == "" || acr == "" {
+			return fmt.Errorf("invalid authn context mapping %q: expected classRef=acr", pair)
+		}
+		mappings = append(mappings, AuthnContextMapping{ClassRef: classRef, ACR: acr})
+	}
+	*m = mappings
+	return nil
+}
+
+// rank returns the strength of classRef, and false for a context the table
+// does not know.
+func (m AuthnContextMap) rank(classRef string) (int, bool) {
+	for i, mapping := range m {
+		if mapping.ClassRef == classRef {
+			return i, true
+		}
+	}
+	if classRef == defaultAuthnContextClassRef {
+		return -1, true
+	}
+	return 0, false
+}
+
+// satisfies reports whether a login with classRef meets the requested
+// context, following the comparison rules of saml-core 3.3.2.2.1. A context
+// the table does not know is met by the default context for the exact
+// comparison and by every login for minimum.
+func (m AuthnContextMap) satisfies(requested *saml.RequestedAuthnContext, classRef string) bool {
+	if requested == nil || requested.AuthnContextClassRef == "" ||
+		requested.AuthnContextClassRef == unspecifiedAuthnContextClassRef {
+		return true
+	}
+	if classRef == requested.AuthnContextClassRef && requested.Comparison != "better" {
+		return true
+	}
+	want, wantOK := m.rank(requested.AuthnContextClassRef)
+	got, gotOK := m.rank(classRef)
+	if !wantOK {
+		switch requested.Comparison {
+		case "", "exact":
+			return classRef == defaultAuthnContextClassRef
+		case "minimum":
+			return gotOK
+		default:
+			return false
+		}
+	}
+	if !gotOK {
+		return false
+	}
+	switch requested.Comparison {
+	case "minimum":
+		return got >= want
+	case "better":
+		return got > want
+	case "maximum":
+		return got <= want
+	default:
+		return false
+	}
+}
+
+// acrValues returns the acr_values asked from Hydra for the requested
+// context: the values of the mapped contexts that meet it, weakest first, or
+// strongest first for the maximum comparison.
+func (m AuthnContextMap) acrValues(requested *saml.RequestedAuthnContext) []string {
+	if requested == nil || requested.AuthnContextClassRef == "" {
+		return nil
+	}
+	if _, known := m.rank(requested.AuthnContextClassRef); !known {
+		return nil
+	}
+	var values []string
+	for _, mapping := range m {
+		if m.satisfies(requested, mapping.ClassRef) && !slices.Contains(values, mapping.ACR) {
+			values = append(values, mapping.ACR)
+		}
+	}
+	if requested.Comparison == "maximum" {
+		slices.Reverse(values)
+	}
+	return values
+}
+
+// achievable reports whether any login can meet the requested context. Every
+// context is achievable while no table is configured.
+func (m AuthnContextMap) achievable(requested *saml.RequestedAuthnContext) bool {
+	if len(m) == 0 {
+		return true
+	}
+	return m.satisfies(requested, defaultAuthnContextClassRef) || len(m.acrValues(requested)) > 0
+}
+
+// classRefFor returns the AuthnContextClassRef of a login from the acr and
+// amr claims of its ID Token: the strongest mapped context whose value is the
+// acr or one of the amr values.
+func (m AuthnContextMap) classRefFor(rawClaims map[string]interface{}) string {
+	acr, _ := rawClaims["acr"].(string)
+	var amr []string
+	if values, ok := rawClaims["amr"].([]interface{}); ok {
+		for _, value := range values {
+			if s, ok := value.(string); ok {
+				amr = append(amr, s)
+			}
+		}
+	}
+	for i := len(m) - 1; i >= 0; i-- {
+		if (acr != "" && m[i].ACR == acr) || slices.Contains(amr, m[i].ACR) {
+			return m[i].ClassRef
+		}
+	}
+	return defaultAuthnContextClassRef
+}
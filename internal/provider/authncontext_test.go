@@ -0,0 +1,168 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/crewjam/saml"
+)
+
+const (
+	testMFAContext       = "urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorContract"
+	testSmartcardContext = "urn:oasis:names:tc:SAML:2.0:ac:classes:SmartcardPKI"
+)
+
+func testAuthnContextMap() AuthnContextMap {
+	return AuthnContextMap{
+		{ClassRef: defaultAuthnContextClassRef, ACR: "pwd"},
+		{ClassRef: testMFAContext, ACR: "mfa"},
+		{ClassRef: testSmartcardContext, ACR: "hwk"},
+	}
+}
+
+func TestAuthnContextMap_Decode(t *testing.T) {
+	var contexts AuthnContextMap
+	if err := contexts.Decode(" " + testMFAContext + "=mfa, " + testSmartcardContext + "=hwk "); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	want := AuthnContextMap{{ClassRef: testMFAContext, ACR: "mfa"}, {ClassRef: testSmartcardContext, ACR: "hwk"}}
+	if !reflect.DeepEqual(contexts, want) {
+		t.Errorf("Expected %v, got %v", want, contexts)
+	}
+
+	for _, value := range []string{testMFAContext, "=mfa", testMFAContext + "="} {
+		if err := contexts.Decode(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
+
+func TestAuthnContextMap_Satisfies(t *testing.T) {
+	contexts := testAuthnContextMap()
+	requested := func(comparison, classRef string) *saml.RequestedAuthnContext {
+		return &saml.RequestedAuthnContext{Comparison: comparison, AuthnContextClassRef: classRef}
+	}
+
+	tests := []struct {
+		name      string
+		requested *saml.RequestedAuthnContext
+		classRef  string
+		want      bool
+	}{
+		{"nothing requested", nil, defaultAuthnContextClassRef, true},
+		{"exact match", requested("exact", testMFAContext), testMFAContext, true},
+		{"exact stronger", requested("", testMFAContext), testSmartcardContext, false},
+		{"minimum stronger", requested("minimum", testMFAContext), testSmartcardContext, true},
+		{"minimum weaker", requested("minimum", testMFAContext), defaultAuthnContextClassRef, false},
+		{"better same", requested("better", testMFAContext), testMFAContext, false},
+		{"better stronger", requested("better", testMFAContext), testSmartcardContext, true},
+		{"maximum weaker", requested("maximum", testMFAContext), defaultAuthnContextClassRef, true},
+		{"maximum stronger", requested("maximum", testMFAContext), testSmartcardContext, false},
+		{"minimum unknown", requested("minimum", "urn:example:context"), testSmartcardContext, true},
+		{"exact unknown default", requested("exact", "urn:example:context"), defaultAuthnContextClassRef, true},
+		{"exact unknown stronger", requested("exact", "urn:example:context"), testMFAContext, false},
+		{"better unknown", requested("better", "urn:example:context"), testSmartcardContext, false},
+		{"unspecified", requested("exact", unspecifiedAuthnContextClassRef), defaultAuthnContextClassRef, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contexts.satisfies(tt.requested, tt.classRef); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAuthnContextMap_ACRValues(t *testing.T) {
+	contexts := testAuthnContextMap()
+
+	tests := []struct {
+		comparison string
+		want       []string
+	}{
+		{"exact", []string{"mfa"}},
+		{"minimum", []string{"mfa", "hwk"}},
+		{"better", []string{"hwk"}},
+		{"maximum", []string{"mfa", "pwd"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.comparison, func(t *testing.T) {
+			got := contexts.acrValues(&saml.RequestedAuthnContext{Comparison: tt.comparison, AuthnContextClassRef: testMFAContext})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if got := contexts.acrValues(&saml.RequestedAuthnContext{Comparison: "minimum", AuthnContextClassRef: "urn:example:context"}); got != nil {
+		t.Errorf("Expected no acr_values for an unknown context, got %v", got)
+	}
+}
+
+func TestAuthnContextMap_Achievable(t *testing.T) {
+	// Without a configured table, no request is refused
+	for _, classRef := range []string{testMFAContext, "urn:oasis:names:tc:SAML:2.0:ac:classes:Password", unspecifiedAuthnContextClassRef} {
+		for _, comparison := range []string{"", "minimum", "better", "maximum"} {
+			requested := &saml.RequestedAuthnContext{Comparison: comparison, AuthnContextClassRef: classRef}
+			if !AuthnContextMap(nil).achievable(requested) {
+				t.Errorf("Expected %s (%s) to be achievable without a table", classRef, comparison)
+			}
+		}
+	}
+
+	contexts := testAuthnContextMap()
+	if !contexts.achievable(&saml.RequestedAuthnContext{Comparison: "minimum", AuthnContextClassRef: "urn:example:context"}) {
+		t.Error("Expected an unknown minimum context to be achievable")
+	}
+	if contexts.achievable(&saml.RequestedAuthnContext{Comparison: "better", AuthnContextClassRef: testSmartcardContext}) {
+		t.Error("Expected a context better than the strongest to be unachievable")
+	}
+}
+
+func TestAuthnContextMap_ClassRefFor(t *testing.T) {
+	contexts := testAuthnContextMap()
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"no claims", nil, defaultAuthnContextClassRef},
+		{"acr", map[string]interface{}{"acr": "mfa"}, testMFAContext},
+		{"strongest amr", map[string]interface{}{"amr": []interface{}{"pwd", "hwk"}}, testSmartcardContext},
+		{"unmapped acr", map[string]interface{}{"acr": "0"}, defaultAuthnContextClassRef},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contexts.classRefFor(tt.claims); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSessionProviderAdapter_GetSession_UnachievableAuthnContext(t *testing.T) {
+	server := setupTestServer(t)
+	server.config.AuthnContextMap = testAuthnContextMap()
+	setupTestIdP(t, server)
+
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs", ACSBinding: saml.HTTPPostBinding}
+	descriptor, _ := sp.EntityDescriptor()
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	authnRequest := testAuthnRequest(server, sp.EntityID)
+	authnRequest.RequestedAuthnContext = &saml.RequestedAuthnContext{Comparison: "better", AuthnContextClassRef: testSmartcardContext}
+	req := &saml.IdpAuthnRequest{IDP: server.identityProvider(), HTTPRequest: httptest.NewRequest(http.MethodGet, "/saml/sso", nil),
+		Request: *authnRequest, Now: saml.TimeNow(), ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs}
+
+	rec := httptest.NewRecorder()
+	adapter := &sessionProviderAdapter{server: server}
+	if adapter.GetSession(rec, req.HTTPRequest, req) != nil {
+		t.Fatal("Expected no session")
+	}
+	response, _ := postedSAMLResponse(t, rec.Body.String())
+	if status := response.Status.StatusCode; status.StatusCode == nil || status.StatusCode.Value != saml.StatusNoAuthnContext {
+		t.Errorf("Expected a NoAuthnContext status, got %+v", status)
+	}
+}
@@ -0,0 +1,198 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+const (
+	// backChannelLogoutEvent is the event a logout token must carry, see
+	// OpenID Connect Back-Channel Logout 1.0 section 2.4.
+	backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+	// maxLogoutTokenAge bounds how long after it was issued a logout token
+	// without an exp claim is accepted.
+	maxLogoutTokenAge = 5 * time.Minute
+
+	// backChannelNotifyTimeout bounds the LogoutRequest sent to each session
+	// participant after a back-channel logout.
+	backChannelNotifyTimeout = 10 * time.Second
+)
+
+// logoutTokenClaims are the claims of an OIDC back-channel logout token that
+// the bridge uses.
+type logoutTokenClaims struct {
+	Subject  string                     `json:"sub"`
+	SID      string                     `json:"sid"`
+	IssuedAt int64                      `json:"iat"`
+	Expiry   int64                      `json:"exp"`
+	Events   map[string]json.RawMessage `json:"events"`
+	Nonce    *string                    `json:"nonce"`
+}
+
+// handleBackChannelLogout is the OIDC Back-Channel Logout endpoint. Hydra
+// calls it when the user's OIDC session ends; every SAML session created from
+// that OIDC session is deleted and its participants are sent a LogoutRequest.
+func (s *Server) handleBackChannelLogout(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_backchannel_logout")
+	defer span.End()
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if err := r.ParseForm(); err != nil {
+		writeBackChannelLogoutError(w, "invalid form body")
+		return
+	}
+	claims, err := s.verifyLogoutToken(ctx, r.PostForm.Get("logout_token"))
+	if err != nil {
+		s.logger.Warnw("Rejected back-channel logout token", "error", err)
+		writeBackChannelLogoutError(w, err.Error())
+		return
+	}
+
+	sessionIDs, err := s.db.FindOIDCSessionIDs(claims.SID, claims.Subject)
+	if err != nil {
+		http.Error(w, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	participants, err := s.deleteSessions(sessionIDs, "")
+	if err != nil {
+		http.Error(w, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Infow("Back-channel logout", "sid", claims.SID, "sub", claims.Subject,
+		"sessions", len(sessionIDs), "participants", len(participants))
+	w.WriteHeader(http.StatusOK)
+
+	// Hydra does not wait for the service providers, so they are notified
+	// after the response
+	if len(participants) > 0 {
+		go s.notifyParticipants(context.WithoutCancel(ctx), participants)
+	}
+}
+
+// verifyLogoutToken verifies the signature, issuer and audience of a logout
+// token and checks its claims as required by OpenID Connect Back-Channel
+// Logout 1.0 section 2.6.
+func (s *Server) verifyLogoutToken(ctx context.Context, rawToken string) (*logoutTokenClaims, error) {
+	if rawToken == "" {
+		return nil, errors.New("missing logout_token")
+	}
+
+	token, err := s.logoutTokenVerifier.Verify(s.withHydraHTTPClient(ctx), rawToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid logout_token: %w", err)
+	}
+	var claims logoutTokenClaims
+	if err := token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("invalid logout_token claims: %w", err)
+	}
+
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		return nil, errors.New("logout_token is missing the back-channel logout event")
+	}
+	if claims.Nonce != nil {
+		return nil, errors.New("logout_token must not contain a nonce")
+	}
+	if claims.SID == "" && claims.Subject == "" {
+		return nil, errors.New("logout_token must contain sid or sub")
+	}
+
+	now := time.Now()
+	if claims.Expiry != 0 {
+		if !now.Before(time.Unix(claims.Expiry, 0)) {
+			return nil, errors.New("logout_token expired")
+		}
+	} else if now.Sub(time.Unix(claims.IssuedAt, 0)) > maxLogoutTokenAge {
+		return nil, errors.New("logout_token expired")
+	}
+	return &claims, nil
+}
+
+func writeBackChannelLogoutError(w http.ResponseWriter, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":             "invalid_request",
+		"error_description": description,
+	})
+}
+
+// notifyParticipants sends a LogoutRequest to the SLO endpoint of each
+// participant directly from the server, as there is no browser to carry it.
+func (s *Server) notifyParticipants(ctx context.Context, participants []*SessionParticipant) {
+	client := &http.Client{Timeout: backChannelNotifyTimeout}
+	for _, participant := range participants {
+		descriptor, err := s.db.GetServiceProvider(participant.EntityID)
+		if err != nil {
+			s.logger.Warnw("Cannot notify unknown service provider of logout", "entityID", participant.EntityID, "error", err)
+			continue
+		}
+		slo := defaultSLO(descriptor)
+		if slo == nil {
+			continue
+		}
+		if err := s.notifyParticipant(ctx, client, participant, slo); err != nil {
+			s.logger.Warnw("Failed to notify service provider of logout", "entityID", participant.EntityID, "error", err)
+			continue
+		}
+		s.logger.Infow("Notified service provider of logout", "entityID", participant.EntityID)
+	}
+}
+
+// notifyParticipant sends a signed LogoutRequest for participant to slo using
+// its HTTP-POST or HTTP-Redirect binding.
+func (s *Server) notifyParticipant(ctx context.Context, client *http.Client, participant *SessionParticipant, slo *saml.Endpoint) error {
+	logoutRequest := s.newLogoutRequest(participant, slo.Location)
+
+	var req *http.Request
+	if slo.Binding == saml.HTTPPostBinding {
+		signature, err := s.signEnveloped(logoutRequest.Element())
+		if err != nil {
+			return err
+		}
+		logoutRequest.Signature = signature
+		doc := etree.NewDocument()
+		doc.SetRoot(logoutRequest.Element())
+		data, err := doc.WriteToBytes()
+		if err != nil {
+			return err
+		}
+		form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(data)}}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, slo.Location, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		location, err := s.signedRedirectURL("SAMLRequest", logoutRequest.Element(), slo.Location, "")
+		if err != nil {
+			return err
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("service provider returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package provider
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/crewjam/saml"
+)
+
+const testOIDCIssuer = "https://hydra.example.com"
+
+// setupTestLogoutTokenVerifier gives server a logout token verifier trusting a
+// new key, which is returned for signing test tokens.
+func setupTestLogoutTokenVerifier(t *testing.T, server *Server) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	server.logoutTokenVerifier = oidc.NewVerifier(testOIDCIssuer,
+		&oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&key.PublicKey}},
+		&oidc.Config{ClientID: server.config.ClientID, SkipExpiryCheck: true})
+	return key
+}
+
+// signTestJWT returns claims as an RS256 JWT signed with key.
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "logout+jwt"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Failed to marshal claims: %v", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign JWT: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testLogoutTokenClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    testOIDCIssuer,
+		"aud":    []string{"test-client"},
+		"iat":    time.Now().Unix(),
+		"jti":    "jti-1",
+		"sid":    "oidc-session",
+		"events": map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}},
+	}
+}
+
+func TestVerifyLogoutToken(t *testing.T) {
+	server := setupTestServer(t)
+	key := setupTestLogoutTokenVerifier(t, server)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	tests := []struct {
+		name    string
+		modify  func(claims map[string]interface{})
+		key     *rsa.PrivateKey
+		wantErr bool
+	}{
+		{name: "valid sid", modify: func(map[string]interface{}) {}},
+		{name: "valid sub only", modify: func(c map[string]interface{}) { delete(c, "sid"); c["sub"] = "user-1" }},
+		{name: "valid with exp", modify: func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(-time.Hour).Unix()
+			c["exp"] = time.Now().Add(time.Minute).Unix()
+		}},
+		{name: "missing event", modify: func(c map[string]interface{}) { c["events"] = map[string]interface{}{} }, wantErr: true},
+		{name: "nonce present", modify: func(c map[string]interface{}) { c["nonce"] = "n" }, wantErr: true},
+		{name: "no sid or sub", modify: func(c map[string]interface{}) { delete(c, "sid") }, wantErr: true},
+		{name: "too old", modify: func(c map[string]interface{}) { c["iat"] = time.Now().Add(-time.Hour).Unix() }, wantErr: true},
+		{name: "expired", modify: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, wantErr: true},
+		{name: "wrong audience", modify: func(c map[string]interface{}) { c["aud"] = "other-client" }, wantErr: true},
+		{name: "wrong issuer", modify: func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, wantErr: true},
+		{name: "wrong key", modify: func(map[string]interface{}) {}, key: otherKey, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := testLogoutTokenClaims()
+			tt.modify(claims)
+			signingKey := key
+			if tt.key != nil {
+				signingKey = tt.key
+			}
+
+			_, err := server.verifyLogoutToken(context.Background(), signTestJWT(t, signingKey, claims))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyLogoutToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandleBackChannelLogout_InvalidToken(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestLogoutTokenVerifier(t, server)
+
+	form := url.Values{"logout_token": {"not-a-jwt"}}
+	req := httptest.NewRequest(http.MethodPost, "/saml/backchannel-logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	server.handleBackChannelLogout(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] != "invalid_request" {
+		t.Errorf("Expected an invalid_request error, got %s", rec.Body.String())
+	}
+	if rec.Header().Get("Cache-Control") != "no-store" {
+		t.Error("Expected Cache-Control: no-store")
+	}
+}
+
+func TestNotifyParticipant(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	var received *http.Request
+	sp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		received = r
+	}))
+	defer sp.Close()
+
+	participant := &SessionParticipant{EntityID: "https://sp.example.com", NameID: "user@example.com", SessionIndex: "idx"}
+
+	t.Run("redirect", func(t *testing.T) {
+		slo := &saml.Endpoint{Binding: saml.HTTPRedirectBinding, Location: sp.URL + "/slo"}
+		if err := server.notifyParticipant(context.Background(), sp.Client(), participant, slo); err != nil {
+			t.Fatalf("notifyParticipant failed: %v", err)
+		}
+		if received.Method != http.MethodGet || received.Form.Get("Signature") == "" {
+			t.Fatalf("Expected a signed HTTP-Redirect request, got %s %s", received.Method, received.URL)
+		}
+		var logoutRequest saml.LogoutRequest
+		if err := xml.Unmarshal(inflateBase64(t, received.Form.Get("SAMLRequest")), &logoutRequest); err != nil {
+			t.Fatalf("Failed to parse LogoutRequest: %v", err)
+		}
+		if logoutRequest.NameID.Value != "user@example.com" {
+			t.Errorf("Unexpected NameID %q", logoutRequest.NameID.Value)
+		}
+	})
+
+	t.Run("post", func(t *testing.T) {
+		slo := &saml.Endpoint{Binding: saml.HTTPPostBinding, Location: sp.URL + "/slo"}
+		if err := server.notifyParticipant(context.Background(), sp.Client(), participant, slo); err != nil {
+			t.Fatalf("notifyParticipant failed: %v", err)
+		}
+		if received.Method != http.MethodPost {
+			t.Fatalf("Expected an HTTP-POST request, got %s", received.Method)
+		}
+		data, _ := base64.StdEncoding.DecodeString(received.PostForm.Get("SAMLRequest"))
+		var logoutRequest saml.LogoutRequest
+		if err := xml.Unmarshal(data, &logoutRequest); err != nil {
+			t.Fatalf("Failed to parse LogoutRequest: %v", err)
+		}
+		if logoutRequest.Signature == nil {
+			t.Error("Expected an enveloped signature")
+		}
+	})
+
+	t.Run("error status", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer failing.Close()
+		slo := &saml.Endpoint{Binding: saml.HTTPRedirectBinding, Location: failing.URL}
+		if err := server.notifyParticipant(context.Background(), failing.Client(), participant, slo); err == nil {
+			t.Error("Expected an error, got nil")
+		}
+	})
+}
+
+func TestHandleBackChannelLogout_DeletesSessions(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	key := setupTestLogoutTokenVerifier(t, server)
+
+	newSession := func(id, sid string) {
+		session := &saml.Session{ID: id, CreateTime: time.Now(), ExpireTime: time.Now().Add(time.Hour),
+			Index: id, NameID: "user@example.com", UserEmail: "user@example.com"}
+		if err := server.db.SaveSession(session, map[string]interface{}{"sid": sid, "sub": "bcl-user"}); err != nil {
+			t.Fatalf("SaveSession failed: %v", err)
+		}
+		t.Cleanup(func() { _ = server.db.DeleteSession(id) })
+	}
+	newSession("bcl-session-1", "bcl-sid-1")
+	newSession("bcl-session-2", "bcl-sid-2")
+
+	claims := testLogoutTokenClaims()
+	claims["sid"] = "bcl-sid-1"
+	form := url.Values{"logout_token": {signTestJWT(t, key, claims)}}
+	req := httptest.NewRequest(http.MethodPost, "/saml/backchannel-logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	server.handleBackChannelLogout(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if s, _ := server.db.GetSession("bcl-session-1"); s != nil {
+		t.Error("Expected the session of the logged out OIDC session to be deleted")
+	}
+	if s, _ := server.db.GetSession("bcl-session-2"); s == nil {
+		t.Error("Expected the other OIDC session to be kept")
+	}
+}
@@ -0,0 +1,117 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultCertReloadInterval = 30 * time.Second
+
+// keyPairFiles is the content of the configured certificate and key files as
+// last read.
+type keyPairFiles struct {
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// keyPairPaths returns the configured certificate and key paths.
+func (s *Server) keyPairPaths() (string, string) {
+	certPath := s.config.SAMLCertPath
+	keyPath := s.config.SAMLKeyPath
+	if certPath == "" {
+		certPath = ".local/certs/bridge.crt"
+	}
+	if keyPath == "" {
+		keyPath = ".local/certs/bridge.key"
+	}
+	return certPath, keyPath
+}
+
+// readKeyPairFiles reads the configured certificate and key files.
+func (s *Server) readKeyPairFiles() (keyPairFiles, error) {
+	certPath, keyPath := s.keyPairPaths()
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return keyPairFiles{}, fmt.Errorf("failed to read certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return keyPairFiles{}, fmt.Errorf("failed to read private key: %w", err)
+	}
+	return keyPairFiles{certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+// parseKeyPairFiles validates a key pair read from the configured files. Unlike
+// keys of the keyring, which can be scheduled ahead, it must be valid now.
+func parseKeyPairFiles(files keyPairFiles, now time.Time) (*signingKeyPair, error) {
+	cert, key, err := ParseSigningKeyPair(files.certPEM, files.keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("certificate is only valid from %s to %s",
+			cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	return &signingKeyPair{key: key, cert: cert}, nil
+}
+
+// RunCertificateReloader reloads the configured key pair when its files
+// change or the process receives SIGHUP, until ctx is cancelled. A key pair
+// that fails validation is rejected and the current one is kept.
+func (s *Server) RunCertificateReloader(ctx context.Context) {
+	interval := s.config.CertReloadInterval
+	if interval <= 0 {
+		interval = defaultCertReloadInterval
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.reloadKeyPair("sighup", true)
+		case <-ticker.C:
+			s.reloadKeyPair("watch", false)
+		}
+	}
+}
+
+// reloadKeyPair swaps in the key pair of the configured files. Unless force is
+// set, files whose content did not change since the last attempt are skipped,
+// so a rejected pair is reported once rather than on every check.
+func (s *Server) reloadKeyPair(trigger string, force bool) {
+	tags := map[string]string{"trigger": trigger}
+
+	files, err := s.readKeyPairFiles()
+	if err == nil && !force && bytes.Equal(files.certPEM, s.keyPairFiles.certPEM) && bytes.Equal(files.keyPEM, s.keyPairFiles.keyPEM) {
+		return
+	}
+
+	var pair *signingKeyPair
+	if err == nil {
+		s.keyPairFiles = files
+		pair, err = parseKeyPairFiles(files, time.Now())
+	}
+	if err != nil {
+		s.logger.Errorw("Rejected SAML key pair reload, keeping the current key pair", "trigger", trigger, "error", err)
+		_ = s.monitor.SetKeyPairReloadStatus(tags, 0)
+		return
+	}
+
+	s.keyring.setFallback(pair)
+	s.logger.Infow("Reloaded SAML key pair", "trigger", trigger, "subject", pair.cert.Subject.String(),
+		"notAfter", pair.cert.NotAfter, "activeKeyID", s.activeSigningKeyID())
+	_ = s.monitor.SetKeyPairReloadStatus(tags, 1)
+}
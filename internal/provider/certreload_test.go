@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestKeyPair writes a new RSA key pair to the configured paths and
+// returns its certificate.
+func writeTestKeyPair(t *testing.T, server *Server) *x509.Certificate {
+	t.Helper()
+	key, certPEM := testEncryptionKeyPair(t)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(server.config.SAMLCertPath, []byte(certPEM), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(server.config.SAMLKeyPath, keyPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	cert, _ := parseCertificatePEM(certPEM)
+	return cert
+}
+
+func TestReloadKeyPair(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	monitor := &testMockMonitor{}
+	server.monitor = monitor
+	dir := t.TempDir()
+	server.config.SAMLCertPath = filepath.Join(dir, "bridge.crt")
+	server.config.SAMLKeyPath = filepath.Join(dir, "bridge.key")
+
+	writeTestKeyPair(t, server)
+	files, _ := server.readKeyPairFiles()
+	pair, err := parseKeyPairFiles(files, time.Now())
+	if err != nil {
+		t.Fatalf("parseKeyPairFiles failed: %v", err)
+	}
+	server.keyPairFiles = files
+	server.keyring = newKeyring(pair, time.Hour)
+
+	// Unchanged files are not reloaded
+	server.reloadKeyPair("watch", false)
+	if len(monitor.keyPairReloads) != 0 {
+		t.Errorf("Expected unchanged files to be skipped, got %+v", monitor.keyPairReloads)
+	}
+
+	renewed := writeTestKeyPair(t, server)
+	server.reloadKeyPair("watch", false)
+	if got := server.identityProvider().Certificate; !got.Equal(renewed) {
+		t.Error("Expected the renewed certificate to be used")
+	}
+	if last := monitor.keyPairReloads[len(monitor.keyPairReloads)-1]; last.Value != 1 || last.Tags["trigger"] != "watch" {
+		t.Errorf("Expected a successful reload to be recorded, got %+v", last)
+	}
+
+	// A certificate that does not match the key is rejected
+	certPEM, _ := os.ReadFile(server.config.SAMLCertPath)
+	writeTestKeyPair(t, server)
+	if err := os.WriteFile(server.config.SAMLCertPath, certPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	server.reloadKeyPair("sighup", true)
+	if got := server.identityProvider().Certificate; !got.Equal(renewed) {
+		t.Error("Expected the current key pair to be kept after a rejected reload")
+	}
+	if last := monitor.keyPairReloads[len(monitor.keyPairReloads)-1]; last.Value != 0 || last.Tags["trigger"] != "sighup" {
+		t.Errorf("Expected a rejected reload to be recorded, got %+v", last)
+	}
+}
+
+func TestParseKeyPairFiles_Expired(t *testing.T) {
+	server := setupTestServer(t)
+	dir := t.TempDir()
+	server.config.SAMLCertPath = filepath.Join(dir, "bridge.crt")
+	server.config.SAMLKeyPath = filepath.Join(dir, "bridge.key")
+	cert := writeTestKeyPair(t, server)
+	files, _ := server.readKeyPairFiles()
+
+	if _, err := parseKeyPairFiles(files, cert.NotAfter.Add(time.Hour)); err == nil {
+		t.Error("Expected an error for an expired certificate")
+	}
+}
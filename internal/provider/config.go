@@ -1,5 +1,7 @@
 package provider
 
+import "time"
+
 // Config defines the configuration for the SAML provider
 type Config struct {
 	// Bridge Configuration
@@ -20,6 +22,17 @@ type Config struct {
 	ClientID                   string `envconfig:"SAML_PROVIDER_OIDC_CLIENT_ID" default:"service-bridge-client"`
 	ClientSecret               string `envconfig:"SAML_PROVIDER_OIDC_CLIENT_SECRET" default:"secret"`
 	RedirectURL                string `envconfig:"SAML_PROVIDER_OIDC_REDIRECT_URL" default:"http://localhost:8082/saml/callback"`
+	HydraAdminURL              string `envconfig:"SAML_PROVIDER_HYDRA_ADMIN_URL" default:"http://localhost:4445"`
+	// OIDCStateSecret signs the OAuth2 state. When empty, a key derived from
+	// ClientSecret is used.
+	OIDCStateSecret string `envconfig:"SAML_PROVIDER_OIDC_STATE_SECRET" default:""`
+
+	// Admin API Authentication
+	// AdminAuthMode is one of "introspection", "jwt", "static" or "none".
+	AdminAuthMode       string   `envconfig:"SAML_PROVIDER_ADMIN_AUTH_MODE" default:"introspection"`
+	AdminRequiredScopes []string `envconfig:"SAML_PROVIDER_ADMIN_REQUIRED_SCOPES" default:"saml-provider:admin"`
+	AdminJWTAudience    string   `envconfig:"SAML_PROVIDER_ADMIN_JWT_AUDIENCE" default:""`
+	AdminStaticToken    string   `envconfig:"SAML_PROVIDER_ADMIN_STATIC_TOKEN" default:""`
 
 	// Service Configuration
 	ServiceACS      string `envconfig:"SAML_PROVIDER_SERVICE_ACS" default:"http://localhost:8083/saml/acs"`
@@ -32,7 +45,53 @@ type Config struct {
 	DBUser     string `envconfig:"SAML_PROVIDER_DB_USER" default:"saml_provider"`
 	DBPassword string `envconfig:"SAML_PROVIDER_DB_PASSWORD" default:"saml_provider"`
 
+	// Pending AuthnRequest Configuration
+	PendingRequestTTL           time.Duration `envconfig:"SAML_PROVIDER_PENDING_REQUEST_TTL" default:"10m"`
+	PendingRequestPurgeInterval time.Duration `envconfig:"SAML_PROVIDER_PENDING_REQUEST_PURGE_INTERVAL" default:"5m"`
+
+	// Expired Session Reaper Configuration
+	SessionReapInterval  time.Duration `envconfig:"SAML_PROVIDER_SESSION_REAP_INTERVAL" default:"10m"`
+	SessionReapBatchSize int           `envconfig:"SAML_PROVIDER_SESSION_REAP_BATCH_SIZE" default:"1000"`
+
+	// SP Metadata Refresh Configuration
+	MetadataRefreshCheckInterval time.Duration `envconfig:"SAML_PROVIDER_METADATA_REFRESH_CHECK_INTERVAL" default:"1m"`
+
+	// RequireSignedRequests rejects unsigned AuthnRequests and LogoutRequests
+	// from every service provider and advertises WantAuthnRequestsSigned.
+	RequireSignedRequests bool `envconfig:"SAML_PROVIDER_REQUIRE_SIGNED_REQUESTS" default:"false"`
+
 	// Certificate Configuration
-	SAMLCertPath string `envconfig:"SAML_PROVIDER_CERT_PATH" default:".local/certs/bridge.crt"`
-	SAMLKeyPath  string `envconfig:"SAML_PROVIDER_KEY_PATH" default:".local/certs/bridge.key"`
+	// The key pair is used to sign while the signing keyring has no active key.
+	// The files are checked for changes every CertReloadInterval and on SIGHUP.
+	SAMLCertPath       string        `envconfig:"SAML_PROVIDER_CERT_PATH" default:".local/certs/bridge.crt"`
+	SAMLKeyPath        string        `envconfig:"SAML_PROVIDER_KEY_PATH" default:".local/certs/bridge.key"`
+	CertReloadInterval time.Duration `envconfig:"SAML_PROVIDER_CERT_RELOAD_INTERVAL" default:"30s"`
+
+	// SignatureAlgorithm is the XML Signature method URI messages are signed
+	// with. The ECDSA method with the same digest is used for ECDSA keys.
+	SignatureAlgorithm string `envconfig:"SAML_PROVIDER_SIGNATURE_ALGORITHM" default:"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"`
+
+	// AuthnContextMap maps the AuthnContextClassRefs service providers request
+	// to OIDC acr values, weakest first, e.g.
+	// "urn:oasis:names:tc:SAML:2.0:ac:classes:MobileTwoFactorContract=mfa".
+	AuthnContextMap AuthnContextMap `envconfig:"SAML_PROVIDER_AUTHN_CONTEXT_MAP" default:""`
+
+	// TemplatesDir holds page templates (error.html, post.html,
+	// logged_out.html, logout.html, layout.html) replacing the embedded ones
+	// of the same name.
+	TemplatesDir string `envconfig:"SAML_PROVIDER_TEMPLATES_DIR" default:""`
+
+	// PersistentIDSalt derives the first persistent NameID of a subject at a
+	// service provider with HMAC-SHA256, so the same identifier is issued
+	// again if the persistent_ids table is lost. When empty, persistent
+	// NameIDs are random.
+	PersistentIDSalt string `envconfig:"SAML_PROVIDER_PERSISTENT_ID_SALT" default:""`
+
+	// Signing Keyring Configuration
+	SigningKeyGracePeriod  time.Duration `envconfig:"SAML_PROVIDER_SIGNING_KEY_GRACE_PERIOD" default:"168h"`
+	KeyringRefreshInterval time.Duration `envconfig:"SAML_PROVIDER_KEYRING_REFRESH_INTERVAL" default:"1m"`
+	// SigningKeyEncryptionKey is the secret the private keys of the keyring
+	// are encrypted with in the database. It is required once the keyring
+	// holds a key.
+	SigningKeyEncryptionKey string `envconfig:"SAML_PROVIDER_SIGNING_KEY_ENCRYPTION_KEY" default:""`
 }
@@ -1,8 +1,13 @@
 package provider
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/crewjam/saml"
 	"github.com/lib/pq"
@@ -32,6 +37,11 @@ func (d *Database) GetDB() *sql.DB {
 func (d *Database) SaveSession(session *saml.Session, rawClaims map[string]interface{}) error {
 	d.logger.Infow("Saving session to database", "sessionID", session.ID, "email", session.UserEmail, "expireTime", session.ExpireTime)
 
+	// The OIDC session ID and subject identify the session in back-channel
+	// logout tokens
+	sid, _ := rawClaims["sid"].(string)
+	sub, _ := rawClaims["sub"].(string)
+
 	var claimsArg interface{}
 	if rawClaims != nil {
 		claimsJSON, err := json.Marshal(rawClaims)
@@ -42,8 +52,8 @@ func (d *Database) SaveSession(session *saml.Session, rawClaims map[string]inter
 	}
 
 	query := `
-		INSERT INTO sessions (id, create_time, expire_time, index_val, name_id, user_email, user_common_name, groups, user_name, raw_oidc_claims)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		INSERT INTO sessions (id, create_time, expire_time, index_val, name_id, user_email, user_common_name, groups, user_name, raw_oidc_claims, oidc_sid, oidc_sub)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		ON CONFLICT (id) DO UPDATE SET
 			create_time = EXCLUDED.create_time,
 			expire_time = EXCLUDED.expire_time,
@@ -53,7 +63,9 @@ func (d *Database) SaveSession(session *saml.Session, rawClaims map[string]inter
 			user_common_name = EXCLUDED.user_common_name,
 			groups = EXCLUDED.groups,
 			user_name = EXCLUDED.user_name,
-			raw_oidc_claims = EXCLUDED.raw_oidc_claims
+			raw_oidc_claims = EXCLUDED.raw_oidc_claims,
+			oidc_sid = EXCLUDED.oidc_sid,
+			oidc_sub = EXCLUDED.oidc_sub
 	`
 	_, err := d.db.Exec(query,
 		session.ID,
@@ -66,6 +78,8 @@ func (d *Database) SaveSession(session *saml.Session, rawClaims map[string]inter
 		pq.Array(session.Groups),
 		session.UserName,
 		claimsArg,
+		sid,
+		sub,
 	)
 	if err != nil {
 		d.logger.Errorw("Error saving session to database", "sessionID", session.ID, "error", err)
@@ -127,71 +141,871 @@ func (d *Database) CleanupExpiredSessions() error {
 	return err
 }
 
-// SaveServiceProvider saves a service provider to the database
-func (d *Database) SaveServiceProvider(entityID, acsURL, acsBinding string, attributeMapping *AttributeMapping) error {
-	d.logger.Infow("Saving service provider to database", "entityID", entityID, "acsURL", acsURL)
+// sessionPurgeLock names the advisory lock held while expired sessions are
+// purged, so replicas and the sessions purge command take turns.
+const sessionPurgeLock = "identity-saml-provider:session-purge"
 
-	var mappingArg interface{}
-	if attributeMapping != nil {
-		mappingJSON, err := json.Marshal(attributeMapping)
+// PurgeExpiredSessions removes expired sessions in batches of batchSize, so
+// a large backlog does not hold locks on the table for long. It reports false
+// without deleting anything when another process holds the purge lock.
+func (d *Database) PurgeExpiredSessions(ctx context.Context, batchSize int) (int64, bool, error) {
+	if batchSize <= 0 {
+		return 0, false, fmt.Errorf("invalid batch size %d", batchSize)
+	}
+
+	// Session-level advisory locks belong to a connection, so the lock and
+	// the batches share one
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, sessionPurgeLock).Scan(&locked); err != nil {
+		return 0, false, err
+	}
+	if !locked {
+		return 0, false, nil
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext($1))`, sessionPurgeLock); err != nil {
+			d.logger.Warnw("Failed to release session purge lock", "error", err)
+		}
+	}()
+
+	query := `
+		DELETE FROM sessions WHERE id IN (
+			SELECT id FROM sessions WHERE expire_time < NOW() LIMIT $1
+		)
+	`
+	var purged int64
+	for {
+		result, err := conn.ExecContext(ctx, query, batchSize)
 		if err != nil {
-			return err
+			return purged, true, err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return purged, true, err
+		}
+		purged += deleted
+		if deleted < int64(batchSize) {
+			return purged, true, nil
 		}
-		mappingArg = mappingJSON
 	}
+}
+
+// PendingAuthnRequest is a SAML AuthnRequest that is waiting for the OIDC
+// login to complete so it can be replayed against the SSO endpoint. ID is
+// generated by the bridge and carried in the signed OIDC state, so a service
+// provider cannot choose the row another browser's login resumes.
+type PendingAuthnRequest struct {
+	ID string
+	// AuthnRequestID is the ID of the SAML AuthnRequest, empty for an
+	// IdP-initiated launch.
+	AuthnRequestID string
+	SAMLRequest    string
+	RelayState     string
+	// IdPInitiatedEntityID is set instead of SAMLRequest for an IdP-initiated
+	// launch, which is replayed against the IdP-initiated SSO endpoint.
+	IdPInitiatedEntityID string
+	// SigAlg and Signature are the detached signature of an HTTP-Redirect
+	// SAMLRequest, replayed with it.
+	SigAlg    string
+	Signature string
+	// CodeVerifier and Nonce are the PKCE code verifier and OIDC nonce of
+	// the login started for the request.
+	CodeVerifier string
+	Nonce        string
+	CreateTime   time.Time
+	ExpireTime   time.Time
+}
+
+// SavePendingAuthnRequest stores a pending AuthnRequest so that any replica
+// handling the OIDC callback can replay it. It fails if a request with the
+// same ID already exists.
+func (d *Database) SavePendingAuthnRequest(req *PendingAuthnRequest) error {
+	d.logger.Infow("Saving pending authn request to database", "requestID", req.ID, "expireTime", req.ExpireTime)
 
 	query := `
-		INSERT INTO service_providers (entity_id, acs_url, acs_binding, attribute_mapping)
-		VALUES ($1, $2, $3, $4)
-		ON CONFLICT (entity_id) DO UPDATE SET
-			acs_url = EXCLUDED.acs_url,
-			acs_binding = EXCLUDED.acs_binding,
-			attribute_mapping = EXCLUDED.attribute_mapping
+		INSERT INTO pending_authn_requests (id, authn_request_id, saml_request, relay_state, idp_initiated_entity_id,
+			sig_alg, signature, code_verifier, nonce, create_time, expire_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 	`
-	_, err := d.db.Exec(query, entityID, acsURL, acsBinding, mappingArg)
+	_, err := d.db.Exec(query, req.ID, req.AuthnRequestID, req.SAMLRequest, req.RelayState, req.IdPInitiatedEntityID,
+		req.SigAlg, req.Signature, req.CodeVerifier, req.Nonce, req.CreateTime, req.ExpireTime)
 	if err != nil {
-		d.logger.Errorw("Error saving service provider to database", "entityID", entityID, "error", err)
-	} else {
-		d.logger.Infow("Service provider saved successfully", "entityID", entityID)
+		d.logger.Errorw("Error saving pending authn request to database", "requestID", req.ID, "error", err)
 	}
 	return err
 }
 
-// GetServiceProvider retrieves a service provider from the database by entity ID
-func (d *Database) GetServiceProvider(entityID string) (*saml.EntityDescriptor, error) {
-	d.logger.Infow("Retrieving service provider from database", "entityID", entityID)
+// ConsumePendingAuthnRequest atomically retrieves and deletes a pending
+// AuthnRequest, so each request can be replayed at most once even when
+// several replicas race on the same callback. Returns nil if the request
+// does not exist or has expired.
+func (d *Database) ConsumePendingAuthnRequest(requestID string) (*PendingAuthnRequest, error) {
 	query := `
-		SELECT entity_id, acs_url, acs_binding
-		FROM service_providers
-		WHERE entity_id = $1
+		DELETE FROM pending_authn_requests
+		WHERE id = $1
+		RETURNING id, authn_request_id, saml_request, relay_state, idp_initiated_entity_id, sig_alg, signature,
+			code_verifier, nonce, create_time, expire_time
 	`
-	var acsURL, acsBinding string
-	var retrievedEntityID string
-	err := d.db.QueryRow(query, entityID).Scan(&retrievedEntityID, &acsURL, &acsBinding)
+	var req PendingAuthnRequest
+	err := d.db.QueryRow(query, requestID).Scan(
+		&req.ID,
+		&req.AuthnRequestID,
+		&req.SAMLRequest,
+		&req.RelayState,
+		&req.IdPInitiatedEntityID,
+		&req.SigAlg,
+		&req.Signature,
+		&req.CodeVerifier,
+		&req.Nonce,
+		&req.CreateTime,
+		&req.ExpireTime,
+	)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			d.logger.Infow("Service provider not found in database", "entityID", entityID)
-		} else {
-			d.logger.Errorw("Error retrieving service provider from database", "entityID", entityID, "error", err)
+			d.logger.Infow("Pending authn request not found in database", "requestID", requestID)
+			return nil, nil
 		}
+		d.logger.Errorw("Error consuming pending authn request from database", "requestID", requestID, "error", err)
 		return nil, err
 	}
 
-	d.logger.Infow("Service provider retrieved successfully", "entityID", retrievedEntityID, "acsURL", acsURL)
-	return &saml.EntityDescriptor{
-		EntityID: retrievedEntityID,
+	if !req.ExpireTime.After(time.Now()) {
+		d.logger.Infow("Pending authn request has expired", "requestID", requestID, "expireTime", req.ExpireTime)
+		return nil, nil
+	}
+
+	return &req, nil
+}
+
+// CleanupExpiredPendingAuthnRequests removes expired pending AuthnRequests
+// from the database and returns the number of rows deleted.
+func (d *Database) CleanupExpiredPendingAuthnRequests() (int64, error) {
+	query := `DELETE FROM pending_authn_requests WHERE expire_time < NOW()`
+	result, err := d.db.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteSession removes a session and, through the foreign key, the record of
+// the service providers that took part in it.
+func (d *Database) DeleteSession(sessionID string) error {
+	d.logger.Infow("Deleting session from database", "sessionID", sessionID)
+	if _, err := d.db.Exec(`DELETE FROM sessions WHERE id = $1`, sessionID); err != nil {
+		d.logger.Errorw("Error deleting session from database", "sessionID", sessionID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// SessionParticipant records that an assertion for a session was issued to a
+// service provider, with the subject it was issued for, so the SP can be
+// included in single logout.
+type SessionParticipant struct {
+	SessionID    string `json:"session_id"`
+	EntityID     string `json:"entity_id"`
+	NameID       string `json:"name_id"`
+	NameIDFormat string `json:"name_id_format,omitempty"`
+	SessionIndex string `json:"session_index"`
+}
+
+// SaveSessionParticipant records p, replacing any previous record for the same
+// session and service provider.
+func (d *Database) SaveSessionParticipant(p *SessionParticipant) error {
+	query := `
+		INSERT INTO session_participants (session_id, entity_id, name_id, name_id_format, session_index)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (session_id, entity_id) DO UPDATE SET
+			name_id = EXCLUDED.name_id,
+			name_id_format = EXCLUDED.name_id_format,
+			session_index = EXCLUDED.session_index
+	`
+	_, err := d.db.Exec(query, p.SessionID, p.EntityID, p.NameID, p.NameIDFormat, p.SessionIndex)
+	if err != nil {
+		d.logger.Errorw("Error saving session participant", "sessionID", p.SessionID, "entityID", p.EntityID, "error", err)
+	}
+	return err
+}
+
+// GetSessionParticipants returns the service providers that took part in a
+// session, in the order they joined it.
+func (d *Database) GetSessionParticipants(sessionID string) ([]*SessionParticipant, error) {
+	query := `
+		SELECT session_id, entity_id, name_id, name_id_format, session_index
+		FROM session_participants
+		WHERE session_id = $1
+		ORDER BY create_time, entity_id
+	`
+	rows, err := d.db.Query(query, sessionID)
+	if err != nil {
+		d.logger.Errorw("Error retrieving session participants", "sessionID", sessionID, "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participants []*SessionParticipant
+	for rows.Next() {
+		var p SessionParticipant
+		if err := rows.Scan(&p.SessionID, &p.EntityID, &p.NameID, &p.NameIDFormat, &p.SessionIndex); err != nil {
+			return nil, err
+		}
+		participants = append(participants, &p)
+	}
+	return participants, rows.Err()
+}
+
+// FindParticipantSessionIDs returns the active sessions in which entityID was
+// issued an assertion for nameID. An empty sessionIndex matches every session
+// of the subject.
+func (d *Database) FindParticipantSessionIDs(entityID, nameID, sessionIndex string) ([]string, error) {
+	query := `
+		SELECT p.session_id
+		FROM session_participants p
+		JOIN sessions s ON s.id = p.session_id
+		WHERE p.entity_id = $1 AND p.name_id = $2 AND ($3 = '' OR p.session_index = $3)
+			AND s.expire_time > NOW()
+	`
+	rows, err := d.db.Query(query, entityID, nameID, sessionIndex)
+	if err != nil {
+		d.logger.Errorw("Error finding participant sessions", "entityID", entityID, "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessionIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, id)
+	}
+	return sessionIDs, rows.Err()
+}
+
+// FindOIDCSessionIDs returns the active sessions created from the OIDC session
+// sid or, when sid is empty, every active session of the OIDC subject sub.
+// When both are set, a session must match both.
+func (d *Database) FindOIDCSessionIDs(sid, sub string) ([]string, error) {
+	if sid == "" && sub == "" {
+		return nil, nil
+	}
+	query := `
+		SELECT id
+		FROM sessions
+		WHERE ($1 = '' OR oidc_sid = $1) AND ($2 = '' OR oidc_sub = $2)
+			AND expire_time > NOW()
+	`
+	rows, err := d.db.Query(query, sid, sub)
+	if err != nil {
+		d.logger.Errorw("Error finding OIDC sessions", "sid", sid, "sub", sub, "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessionIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, id)
+	}
+	return sessionIDs, rows.Err()
+}
+
+// PendingLogout tracks a single logout while the browser is sent to each
+// remaining session participant in turn.
+type PendingLogout struct {
+	ID string
+	// InitiatorEntityID and InitiatorRequestID identify the LogoutRequest that
+	// started an SP-initiated logout. Both are empty for IdP-initiated logout.
+	InitiatorEntityID  string
+	InitiatorRequestID string
+	RelayState         string
+	// Participants are the service providers still to be logged out.
+	Participants []*SessionParticipant
+	// CurrentRequestID is the ID of the LogoutRequest awaiting a response
+	// from the service provider CurrentEntityID.
+	CurrentRequestID string
+	CurrentEntityID  string
+	// Partial is set once any participant could not be logged out.
+	Partial    bool
+	CreateTime time.Time
+	ExpireTime time.Time
+}
+
+// SavePendingLogout creates or updates a pending logout.
+func (d *Database) SavePendingLogout(logout *PendingLogout) error {
+	participantsJSON, err := json.Marshal(logout.Participants)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO pending_logouts (id, initiator_entity_id, initiator_request_id, relay_state, participants,
+			current_request_id, current_entity_id, partial, create_time, expire_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET
+			participants = EXCLUDED.participants,
+			current_request_id = EXCLUDED.current_request_id,
+			current_entity_id = EXCLUDED.current_entity_id,
+			partial = EXCLUDED.partial
+	`
+	_, err = d.db.Exec(query, logout.ID, logout.InitiatorEntityID, logout.InitiatorRequestID, logout.RelayState,
+		participantsJSON, logout.CurrentRequestID, logout.CurrentEntityID, logout.Partial, logout.CreateTime, logout.ExpireTime)
+	if err != nil {
+		d.logger.Errorw("Error saving pending logout to database", "logoutID", logout.ID, "error", err)
+	}
+	return err
+}
+
+// GetPendingLogout retrieves a pending logout by ID. Returns nil if it does
+// not exist or has expired.
+func (d *Database) GetPendingLogout(id string) (*PendingLogout, error) {
+	query := `
+		SELECT id, initiator_entity_id, initiator_request_id, relay_state, participants,
+			current_request_id, current_entity_id, partial, create_time, expire_time
+		FROM pending_logouts
+		WHERE id = $1 AND expire_time > NOW()
+	`
+	var logout PendingLogout
+	var participantsJSON []byte
+	err := d.db.QueryRow(query, id).Scan(
+		&logout.ID,
+		&logout.InitiatorEntityID,
+		&logout.InitiatorRequestID,
+		&logout.RelayState,
+		&participantsJSON,
+		&logout.CurrentRequestID,
+		&logout.CurrentEntityID,
+		&logout.Partial,
+		&logout.CreateTime,
+		&logout.ExpireTime,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			d.logger.Infow("Pending logout not found in database", "logoutID", id)
+			return nil, nil
+		}
+		d.logger.Errorw("Error retrieving pending logout from database", "logoutID", id, "error", err)
+		return nil, err
+	}
+	if err := json.Unmarshal(participantsJSON, &logout.Participants); err != nil {
+		return nil, err
+	}
+	return &logout, nil
+}
+
+// DeletePendingLogout removes a completed pending logout.
+func (d *Database) DeletePendingLogout(id string) error {
+	_, err := d.db.Exec(`DELETE FROM pending_logouts WHERE id = $1`, id)
+	return err
+}
+
+// CleanupExpiredPendingLogouts removes abandoned pending logouts and returns
+// the number of rows deleted.
+func (d *Database) CleanupExpiredPendingLogouts() (int64, error) {
+	result, err := d.db.Exec(`DELETE FROM pending_logouts WHERE expire_time < NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ServiceProvider is a SAML service provider registration.
+type ServiceProvider struct {
+	EntityID         string            `json:"entity_id"`
+	ACSURL           string            `json:"acs_url"`
+	ACSBinding       string            `json:"acs_binding"`
+	AttributeMapping *AttributeMapping `json:"attribute_mapping,omitempty"`
+	// AccessPolicy restricts which users may sign in to this SP. When nil,
+	// every authenticated user may.
+	AccessPolicy *AccessPolicy `json:"access_policy,omitempty"`
+	// NameIDFormats are the URNs of the NameID formats this SP may be issued,
+	// intersected with the format it requests. When empty, every format the
+	// IdP supports is allowed.
+	NameIDFormats []string `json:"nameid_formats,omitempty"`
+	// SLOURL and SLOBinding locate the SP's SingleLogoutService. They are
+	// derived from the metadata when a document is imported.
+	SLOURL     string `json:"slo_url,omitempty"`
+	SLOBinding string `json:"slo_binding,omitempty"`
+	// AllowIdPInitiated permits unsolicited responses to this SP from the
+	// IdP-initiated SSO endpoint.
+	AllowIdPInitiated bool `json:"allow_idp_initiated"`
+	// EncryptionCert is a PEM certificate assertions for this SP are encrypted
+	// to. It takes precedence over encryption keys in the metadata.
+	EncryptionCert string `json:"encryption_cert,omitempty"`
+	// EncryptionAlgorithm is the XML Encryption block cipher URI used for
+	// assertions. When empty, the first supported algorithm advertised in the
+	// metadata is used, otherwise AES-128-CBC.
+	EncryptionAlgorithm string `json:"encryption_algorithm,omitempty"`
+	// SignatureAlgorithm is the XML Signature method URI responses and
+	// assertions for this SP are signed with, overriding
+	// SAML_PROVIDER_SIGNATURE_ALGORITHM.
+	SignatureAlgorithm string `json:"signature_algorithm,omitempty"`
+	// SigningMode selects whether the Response, the Assertion or both are
+	// signed for this SP. When empty, both are signed.
+	SigningMode string `json:"signing_mode,omitempty"`
+	// SigningCerts are PEM certificates AuthnRequests and LogoutRequests from
+	// this SP are verified with. When empty, the signing keys in the metadata
+	// are used.
+	SigningCerts []string `json:"signing_certs,omitempty"`
+	// RequireSignedRequests rejects unsigned requests from this SP.
+	RequireSignedRequests bool `json:"require_signed_requests"`
+	// MetadataXML is the SP metadata document exactly as it was imported.
+	// When set, it is the source of the descriptor handed to the IdP.
+	MetadataXML string `json:"metadata_xml,omitempty"`
+	// MetadataURL is the location MetadataXML was fetched from, if any.
+	MetadataURL string `json:"metadata_url,omitempty"`
+	// MetadataRefreshIntervalSeconds is how often MetadataURL is re-fetched.
+	// Zero disables the scheduled refresh.
+	MetadataRefreshIntervalSeconds int `json:"metadata_refresh_interval_seconds,omitempty"`
+	// MetadataSigningCert is a PEM certificate pinned for the metadata. When
+	// set, the metadata document must carry a valid XML signature made with it.
+	MetadataSigningCert string `json:"metadata_signing_cert,omitempty"`
+
+	// Status of the scheduled metadata refresh, maintained by the refresher.
+	MetadataLastRefreshAt *time.Time `json:"metadata_last_refresh_at,omitempty"`
+	MetadataLastSuccessAt *time.Time `json:"metadata_last_success_at,omitempty"`
+	MetadataRefreshError  string     `json:"metadata_refresh_error,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// EntityDescriptor returns the SAML metadata the IdP uses for this service
+// provider: the imported metadata document if there is one, otherwise a
+// descriptor with the single registered ACS endpoint and SLO endpoint, if any.
+func (sp *ServiceProvider) EntityDescriptor() (*saml.EntityDescriptor, error) {
+	if sp.MetadataXML != "" {
+		descriptor, err := parseServiceProviderMetadata([]byte(sp.MetadataXML))
+		if err != nil {
+			return nil, err
+		}
+		if err := sp.applyEncryption(descriptor); err != nil {
+			return nil, err
+		}
+		return descriptor, nil
+	}
+	descriptor := &saml.EntityDescriptor{
+		EntityID: sp.EntityID,
 		SPSSODescriptors: []saml.SPSSODescriptor{
 			{
 				AssertionConsumerServices: []saml.IndexedEndpoint{
 					{
-						Binding:  acsBinding,
-						Location: acsURL,
+						Binding:  sp.ACSBinding,
+						Location: sp.ACSURL,
 						Index:    1,
 					},
 				},
 			},
 		},
-	}, nil
+	}
+	if sp.SLOURL != "" {
+		descriptor.SPSSODescriptors[0].SingleLogoutServices = []saml.Endpoint{
+			{Binding: sp.SLOBinding, Location: sp.SLOURL},
+		}
+	}
+	if err := sp.applyEncryption(descriptor); err != nil {
+		return nil, err
+	}
+	return descriptor, nil
+}
+
+// applyEncryption adds the registered encryption certificate to every
+// SPSSODescriptor of descriptor, replacing the encryption keys from the
+// metadata, and advertises the configured encryption algorithm first.
+func (sp *ServiceProvider) applyEncryption(descriptor *saml.EntityDescriptor) error {
+	var certData string
+	if sp.EncryptionCert != "" {
+		cert, err := parseCertificatePEM(sp.EncryptionCert)
+		if err != nil {
+			return fmt.Errorf("invalid encryption certificate: %w", err)
+		}
+		certData = base64.StdEncoding.EncodeToString(cert.Raw)
+	}
+
+	for i := range descriptor.SPSSODescriptors {
+		spsso := &descriptor.SPSSODescriptors[i]
+		if certData != "" {
+			keys := []saml.KeyDescriptor{{
+				Use: "encryption",
+				KeyInfo: saml.KeyInfo{X509Data: saml.X509Data{
+					X509Certificates: []saml.X509Certificate{{Data: certData}},
+				}},
+			}}
+			for _, key := range spsso.KeyDescriptors {
+				if key.Use == "signing" {
+					keys = append(keys, key)
+				}
+			}
+			spsso.KeyDescriptors = keys
+		}
+		if sp.EncryptionAlgorithm != "" {
+			for j := range spsso.KeyDescriptors {
+				key := &spsso.KeyDescriptors[j]
+				if key.Use != "signing" {
+					key.EncryptionMethods = append([]saml.EncryptionMethod{{Algorithm: sp.EncryptionAlgorithm}}, key.EncryptionMethods...)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ServiceProviderFilter narrows and paginates ListServiceProviders results.
+type ServiceProviderFilter struct {
+	// EntityIDContains matches service providers whose entity ID contains this
+	// substring (case-insensitive).
+	EntityIDContains string
+	// ACSBinding matches service providers using exactly this ACS binding.
+	ACSBinding string
+	Limit      int
+	Offset     int
+}
+
+const serviceProviderColumns = `entity_id, acs_url, acs_binding, attribute_mapping, access_policy, slo_url, slo_binding, allow_idp_initiated,
+	encryption_cert, encryption_algorithm, signature_algorithm, signing_mode, signing_certs, require_signed_requests,
+	nameid_formats, metadata_xml, metadata_url, metadata_refresh_interval_seconds, metadata_signing_cert, metadata_last_refresh_at, metadata_last_success_at,
+	metadata_refresh_error, created_at, updated_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanServiceProvider(row rowScanner) (*ServiceProvider, error) {
+	var sp ServiceProvider
+	var mappingJSON, policyJSON, sloURL, sloBinding, encryptionCert, encryptionAlgorithm, signatureAlgorithm, signingMode, metadataXML, metadataURL, signingCert, refreshError sql.NullString
+	var lastRefreshAt, lastSuccessAt sql.NullTime
+	if err := row.Scan(
+		&sp.EntityID,
+		&sp.ACSURL,
+		&sp.ACSBinding,
+		&mappingJSON,
+		&policyJSON,
+		&sloURL,
+		&sloBinding,
+		&sp.AllowIdPInitiated,
+		&encryptionCert,
+		&encryptionAlgorithm,
+		&signatureAlgorithm,
+		&signingMode,
+		pq.Array(&sp.SigningCerts),
+		&sp.RequireSignedRequests,
+		pq.Array(&sp.NameIDFormats),
+		&metadataXML,
+		&metadataURL,
+		&sp.MetadataRefreshIntervalSeconds,
+		&signingCert,
+		&lastRefreshAt,
+		&lastSuccessAt,
+		&refreshError,
+		&sp.CreatedAt,
+		&sp.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	if mappingJSON.Valid && mappingJSON.String != "" {
+		var mapping AttributeMapping
+		if err := json.Unmarshal([]byte(mappingJSON.String), &mapping); err != nil {
+			return nil, err
+		}
+		sp.AttributeMapping = &mapping
+	}
+	if policyJSON.Valid && policyJSON.String != "" {
+		var policy AccessPolicy
+		if err := json.Unmarshal([]byte(policyJSON.String), &policy); err != nil {
+			return nil, err
+		}
+		sp.AccessPolicy = &policy
+	}
+	sp.SLOURL = sloURL.String
+	sp.SLOBinding = sloBinding.String
+	sp.EncryptionCert = encryptionCert.String
+	sp.EncryptionAlgorithm = encryptionAlgorithm.String
+	sp.SignatureAlgorithm = signatureAlgorithm.String
+	sp.SigningMode = signingMode.String
+	sp.MetadataXML = metadataXML.String
+	sp.MetadataURL = metadataURL.String
+	sp.MetadataSigningCert = signingCert.String
+	sp.MetadataRefreshError = refreshError.String
+	if lastRefreshAt.Valid {
+		sp.MetadataLastRefreshAt = &lastRefreshAt.Time
+	}
+	if lastSuccessAt.Valid {
+		sp.MetadataLastSuccessAt = &lastSuccessAt.Time
+	}
+	return &sp, nil
+}
+
+// SaveServiceProvider creates or replaces a service provider in the database
+func (d *Database) SaveServiceProvider(sp *ServiceProvider) error {
+	d.logger.Infow("Saving service provider to database", "entityID", sp.EntityID, "acsURL", sp.ACSURL)
+
+	var mappingArg interface{}
+	if sp.AttributeMapping != nil {
+		mappingJSON, err := json.Marshal(sp.AttributeMapping)
+		if err != nil {
+			return err
+		}
+		mappingArg = mappingJSON
+	}
+	var policyArg interface{}
+	if sp.AccessPolicy != nil {
+		policyJSON, err := json.Marshal(sp.AccessPolicy)
+		if err != nil {
+			return err
+		}
+		policyArg = policyJSON
+	}
+
+	query := `
+		INSERT INTO service_providers (entity_id, acs_url, acs_binding, attribute_mapping, access_policy, slo_url,
+			slo_binding, allow_idp_initiated, encryption_cert, encryption_algorithm, signature_algorithm, signing_mode,
+			signing_certs, require_signed_requests, metadata_xml, metadata_url, metadata_refresh_interval_seconds,
+			metadata_signing_cert, nameid_formats)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+		ON CONFLICT (entity_id) DO UPDATE SET
+			acs_url = EXCLUDED.acs_url,
+			acs_binding = EXCLUDED.acs_binding,
+			attribute_mapping = EXCLUDED.attribute_mapping,
+			access_policy = EXCLUDED.access_policy,
+			slo_url = EXCLUDED.slo_url,
+			slo_binding = EXCLUDED.slo_binding,
+			allow_idp_initiated = EXCLUDED.allow_idp_initiated,
+			encryption_cert = EXCLUDED.encryption_cert,
+			encryption_algorithm = EXCLUDED.encryption_algorithm,
+			signature_algorithm = EXCLUDED.signature_algorithm,
+			signing_mode = EXCLUDED.signing_mode,
+			signing_certs = EXCLUDED.signing_certs,
+			require_signed_requests = EXCLUDED.require_signed_requests,
+			metadata_xml = EXCLUDED.metadata_xml,
+			metadata_url = EXCLUDED.metadata_url,
+			metadata_refresh_interval_seconds = EXCLUDED.metadata_refresh_interval_seconds,
+			metadata_signing_cert = EXCLUDED.metadata_signing_cert,
+			nameid_formats = EXCLUDED.nameid_formats,
+			updated_at = NOW()
+	`
+	_, err := d.db.Exec(query, sp.EntityID, sp.ACSURL, sp.ACSBinding, mappingArg, policyArg,
+		nullString(sp.SLOURL), nullString(sp.SLOBinding), sp.AllowIdPInitiated,
+		nullString(sp.EncryptionCert), nullString(sp.EncryptionAlgorithm), nullString(sp.SignatureAlgorithm),
+		nullString(sp.SigningMode), pq.Array(nonNilStrings(sp.SigningCerts)), sp.RequireSignedRequests,
+		nullString(sp.MetadataXML), nullString(sp.MetadataURL),
+		sp.MetadataRefreshIntervalSeconds, nullString(sp.MetadataSigningCert), pq.Array(nonNilStrings(sp.NameIDFormats)))
+	if err != nil {
+		d.logger.Errorw("Error saving service provider to database", "entityID", sp.EntityID, "error", err)
+	} else {
+		d.logger.Infow("Service provider saved successfully", "entityID", sp.EntityID)
+	}
+	return err
+}
+
+// GetServiceProviderRecord retrieves a service provider registration by entity ID.
+// Returns sql.ErrNoRows if the service provider does not exist.
+func (d *Database) GetServiceProviderRecord(entityID string) (*ServiceProvider, error) {
+	d.logger.Infow("Retrieving service provider from database", "entityID", entityID)
+	query := `SELECT ` + serviceProviderColumns + ` FROM service_providers WHERE entity_id = $1`
+
+	sp, err := scanServiceProvider(d.db.QueryRow(query, entityID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			d.logger.Infow("Service provider not found in database", "entityID", entityID)
+		} else {
+			d.logger.Errorw("Error retrieving service provider from database", "entityID", entityID, "error", err)
+		}
+		return nil, err
+	}
+
+	d.logger.Infow("Service provider retrieved successfully", "entityID", sp.EntityID, "acsURL", sp.ACSURL)
+	return sp, nil
+}
+
+// GetServiceProvider retrieves a service provider from the database by entity ID
+func (d *Database) GetServiceProvider(entityID string) (*saml.EntityDescriptor, error) {
+	sp, err := d.GetServiceProviderRecord(entityID)
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := sp.EntityDescriptor()
+	if err != nil {
+		d.logger.Errorw("Stored service provider metadata is invalid", "entityID", entityID, "error", err)
+		return nil, err
+	}
+	return descriptor, nil
+}
+
+// ListServiceProviders returns the service providers matching filter, ordered
+// by entity ID, along with the total number of matches ignoring pagination.
+func (d *Database) ListServiceProviders(filter ServiceProviderFilter) ([]*ServiceProvider, int, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.EntityIDContains != "" {
+		args = append(args, "%"+escapeLikePattern(filter.EntityIDContains)+"%")
+		conditions = append(conditions, fmt.Sprintf("entity_id ILIKE $%d", len(args)))
+	}
+	if filter.ACSBinding != "" {
+		args = append(args, filter.ACSBinding)
+		conditions = append(conditions, fmt.Sprintf("acs_binding = $%d", len(args)))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := d.db.QueryRow(`SELECT COUNT(*) FROM service_providers`+where, args...).Scan(&total); err != nil {
+		d.logger.Errorw("Error counting service providers", "error", err)
+		return nil, 0, err
+	}
+
+	query := `SELECT ` + serviceProviderColumns + ` FROM service_providers` + where + ` ORDER BY entity_id`
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if filter.Offset > 0 {
+		args = append(args, filter.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		d.logger.Errorw("Error listing service providers", "error", err)
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	serviceProviders := []*ServiceProvider{}
+	for rows.Next() {
+		sp, err := scanServiceProvider(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		serviceProviders = append(serviceProviders, sp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return serviceProviders, total, nil
+}
+
+// DeleteServiceProvider removes a service provider by entity ID.
+// Returns sql.ErrNoRows if the service provider does not exist.
+func (d *Database) DeleteServiceProvider(entityID string) error {
+	d.logger.Infow("Deleting service provider from database", "entityID", entityID)
+	result, err := d.db.Exec(`DELETE FROM service_providers WHERE entity_id = $1`, entityID)
+	if err != nil {
+		d.logger.Errorw("Error deleting service provider from database", "entityID", entityID, "error", err)
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ClaimServiceProvidersForMetadataRefresh returns up to limit service providers
+// whose metadata URL is due for a refresh, stamping metadata_last_refresh_at so
+// that other replicas do not pick up the same rows.
+func (d *Database) ClaimServiceProvidersForMetadataRefresh(limit int) ([]*ServiceProvider, error) {
+	query := `
+		UPDATE service_providers SET metadata_last_refresh_at = NOW()
+		WHERE entity_id IN (
+			SELECT entity_id FROM service_providers
+			WHERE metadata_url IS NOT NULL
+				AND metadata_refresh_interval_seconds > 0
+				AND (metadata_last_refresh_at IS NULL
+					OR metadata_last_refresh_at + make_interval(secs => metadata_refresh_interval_seconds) <= NOW())
+			ORDER BY metadata_last_refresh_at NULLS FIRST
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + serviceProviderColumns
+
+	rows, err := d.db.Query(query, limit)
+	if err != nil {
+		d.logger.Errorw("Error claiming service providers for metadata refresh", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var serviceProviders []*ServiceProvider
+	for rows.Next() {
+		sp, err := scanServiceProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		serviceProviders = append(serviceProviders, sp)
+	}
+	return serviceProviders, rows.Err()
+}
+
+// SaveRefreshedMetadata stores the re-fetched metadata document of sp, along
+// with the endpoints derived from it, and marks the refresh as successful.
+func (d *Database) SaveRefreshedMetadata(sp *ServiceProvider) error {
+	query := `
+		UPDATE service_providers SET
+			metadata_xml = $2,
+			acs_url = $3,
+			acs_binding = $4,
+			slo_url = $5,
+			slo_binding = $6,
+			metadata_last_success_at = NOW(),
+			metadata_refresh_error = NULL,
+			updated_at = NOW()
+		WHERE entity_id = $1
+	`
+	_, err := d.db.Exec(query, sp.EntityID, sp.MetadataXML, sp.ACSURL, sp.ACSBinding,
+		nullString(sp.SLOURL), nullString(sp.SLOBinding))
+	if err != nil {
+		d.logger.Errorw("Error saving refreshed metadata", "entityID", sp.EntityID, "error", err)
+	}
+	return err
+}
+
+// RecordMetadataRefreshFailure records why a metadata refresh failed. The
+// previously stored document is kept.
+func (d *Database) RecordMetadataRefreshFailure(entityID string, refreshErr error) error {
+	_, err := d.db.Exec(`UPDATE service_providers SET metadata_refresh_error = $2 WHERE entity_id = $1`,
+		entityID, refreshErr.Error())
+	if err != nil {
+		d.logger.Errorw("Error recording metadata refresh failure", "entityID", entityID, "error", err)
+	}
+	return err
+}
+
+// nullString maps an empty string to SQL NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nonNilStrings returns s, or an empty slice when s is nil, so that it is
+// stored as an empty array rather than NULL.
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// escapeLikePattern escapes the LIKE wildcards in s so it is matched literally.
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
 
 // GetAttributeMapping retrieves the attribute mapping for a service provider by entity ID.
@@ -220,3 +1034,245 @@ func (d *Database) GetAttributeMapping(entityID string) (*AttributeMapping, erro
 	}
 	return &mapping, nil
 }
+
+// GetAccessPolicy retrieves the access policy of a service provider by entity ID.
+// Returns nil if no policy is configured for the SP.
+func (d *Database) GetAccessPolicy(entityID string) (*AccessPolicy, error) {
+	query := `
+		SELECT access_policy
+		FROM service_providers
+		WHERE entity_id = $1
+	`
+	var policyJSON sql.NullString
+	err := d.db.QueryRow(query, entityID).Scan(&policyJSON)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !policyJSON.Valid || policyJSON.String == "" {
+		return nil, nil
+	}
+	var policy AccessPolicy
+	if err := json.Unmarshal([]byte(policyJSON.String), &policy); err != nil {
+		d.logger.Errorw("Error parsing access policy JSON", "entityID", entityID, "error", err)
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// SigningKey is an IdP signing key pair in the keyring. Its state is derived
+// from ActivateAt and RetiredAt, see signingKeyState. PrivateKey holds the
+// PEM private key encrypted with EncryptSigningKey.
+type SigningKey struct {
+	ID          string     `json:"id"`
+	Certificate string     `json:"certificate"`
+	PrivateKey  string     `json:"-"`
+	ActivateAt  time.Time  `json:"activate_at"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// SaveSigningKey adds a key to the keyring. Keys are never overwritten; an
+// existing ID is an error.
+func (d *Database) SaveSigningKey(key *SigningKey) error {
+	d.logger.Infow("Saving signing key to database", "keyID", key.ID, "activateAt", key.ActivateAt)
+	query := `
+		INSERT INTO signing_keys (id, certificate, private_key, activate_at, retired_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := d.db.Exec(query, key.ID, key.Certificate, key.PrivateKey, key.ActivateAt, key.RetiredAt)
+	if err != nil {
+		d.logger.Errorw("Error saving signing key to database", "keyID", key.ID, "error", err)
+	}
+	return err
+}
+
+// ListSigningKeys returns every key of the keyring, ordered by activation time.
+func (d *Database) ListSigningKeys() ([]*SigningKey, error) {
+	query := `
+		SELECT id, certificate, private_key, activate_at, retired_at, created_at
+		FROM signing_keys
+		ORDER BY activate_at, id
+	`
+	rows, err := d.db.Query(query)
+	if err != nil {
+		d.logger.Errorw("Error listing signing keys", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		var key SigningKey
+		var retiredAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Certificate, &key.PrivateKey, &key.ActivateAt, &retiredAt, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		if retiredAt.Valid {
+			key.RetiredAt = &retiredAt.Time
+		}
+		keys = append(keys, &key)
+	}
+	return keys, rows.Err()
+}
+
+// UpdateSigningKeySchedule sets when a key becomes active and when it was
+// retired. Returns sql.ErrNoRows if the key does not exist.
+func (d *Database) UpdateSigningKeySchedule(id string, activateAt time.Time, retiredAt *time.Time) error {
+	d.logger.Infow("Updating signing key schedule", "keyID", id, "activateAt", activateAt, "retiredAt", retiredAt)
+	result, err := d.db.Exec(`UPDATE signing_keys SET activate_at = $2, retired_at = $3 WHERE id = $1`, id, activateAt, retiredAt)
+	if err != nil {
+		d.logger.Errorw("Error updating signing key schedule", "keyID", id, "error", err)
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateSigningKeyPrivateKey replaces the stored private key of a key, to
+// encrypt it. Returns sql.ErrNoRows if the key does not exist.
+func (d *Database) UpdateSigningKeyPrivateKey(id, privateKey string) error {
+	d.logger.Infow("Updating signing key private key", "keyID", id)
+	result, err := d.db.Exec(`UPDATE signing_keys SET private_key = $2 WHERE id = $1`, id, privateKey)
+	if err != nil {
+		d.logger.Errorw("Error updating signing key private key", "keyID", id, "error", err)
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteSigningKey removes a key from the keyring. Returns sql.ErrNoRows if
+// the key does not exist.
+func (d *Database) DeleteSigningKey(id string) error {
+	d.logger.Infow("Deleting signing key from database", "keyID", id)
+	result, err := d.db.Exec(`DELETE FROM signing_keys WHERE id = $1`, id)
+	if err != nil {
+		d.logger.Errorw("Error deleting signing key from database", "keyID", id, "error", err)
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PersistentID is a pairwise persistent NameID: the opaque identifier a
+// service provider knows a subject by.
+type PersistentID struct {
+	ID        string     `json:"id"`
+	EntityID  string     `json:"entity_id"`
+	Subject   string     `json:"subject"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// PersistentIDFilter narrows ListPersistentIDs results. Empty fields match
+// every identifier.
+type PersistentIDFilter struct {
+	ID       string
+	EntityID string
+	Subject  string
+}
+
+// GetPersistentID returns the identifier issued to entityID for subject that
+// has not been revoked. Returns sql.ErrNoRows if there is none.
+func (d *Database) GetPersistentID(entityID, subject string) (*PersistentID, error) {
+	query := `
+		SELECT id, entity_id, subject, created_at
+		FROM persistent_ids
+		WHERE entity_id = $1 AND subject = $2 AND revoked_at IS NULL
+	`
+	var p PersistentID
+	err := d.db.QueryRow(query, entityID, subject).Scan(&p.ID, &p.EntityID, &p.Subject, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// CreatePersistentID stores a new identifier. Nothing is stored if the ID was
+// already issued or the subject already has an active identifier for the
+// service provider; callers read the active identifier back with
+// GetPersistentID.
+func (d *Database) CreatePersistentID(p *PersistentID) error {
+	query := `
+		INSERT INTO persistent_ids (id, entity_id, subject)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`
+	_, err := d.db.Exec(query, p.ID, p.EntityID, p.Subject)
+	if err != nil {
+		d.logger.Errorw("Error saving persistent ID", "entityID", p.EntityID, "error", err)
+	}
+	return err
+}
+
+// ListPersistentIDs returns the identifiers matching filter, revoked ones
+// included, ordered by service provider and creation time.
+func (d *Database) ListPersistentIDs(filter PersistentIDFilter) ([]*PersistentID, error) {
+	query := `
+		SELECT id, entity_id, subject, created_at, revoked_at
+		FROM persistent_ids
+		WHERE ($1 = '' OR id = $1) AND ($2 = '' OR entity_id = $2) AND ($3 = '' OR subject = $3)
+		ORDER BY entity_id, created_at, id
+	`
+	rows, err := d.db.Query(query, filter.ID, filter.EntityID, filter.Subject)
+	if err != nil {
+		d.logger.Errorw("Error listing persistent IDs", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []*PersistentID
+	for rows.Next() {
+		var p PersistentID
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&p.ID, &p.EntityID, &p.Subject, &p.CreatedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		if revokedAt.Valid {
+			p.RevokedAt = &revokedAt.Time
+		}
+		ids = append(ids, &p)
+	}
+	return ids, rows.Err()
+}
+
+// RevokePersistentID stops an identifier from being issued. The subject gets
+// a new identifier at their next login to the service provider. Returns
+// sql.ErrNoRows if the identifier does not exist or is already revoked.
+func (d *Database) RevokePersistentID(id string) error {
+	d.logger.Infow("Revoking persistent ID", "persistentID", id)
+	result, err := d.db.Exec(`UPDATE persistent_ids SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		d.logger.Errorw("Error revoking persistent ID", "persistentID", id, "error", err)
+		return err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
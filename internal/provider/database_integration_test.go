@@ -5,6 +5,7 @@ package provider
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"testing"
 	"time"
 
@@ -352,7 +353,7 @@ func TestIntegration_SaveAndGetServiceProvider(t *testing.T) {
 	acsURL := "http://example.com/saml/acs"
 	acsBinding := saml.HTTPPostBinding
 
-	err := database.SaveServiceProvider(entityID, acsURL, acsBinding, nil)
+	err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL, ACSBinding: acsBinding})
 	if err != nil {
 		t.Fatalf("SaveServiceProvider failed: %v", err)
 	}
@@ -418,11 +419,11 @@ func TestIntegration_SaveServiceProvider_Update(t *testing.T) {
 	acsURL2 := "http://example.com/saml/acs2"
 	acsBinding := saml.HTTPPostBinding
 
-	if err := database.SaveServiceProvider(entityID, acsURL1, acsBinding, nil); err != nil {
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL1, ACSBinding: acsBinding}); err != nil {
 		t.Fatalf("SaveServiceProvider failed: %v", err)
 	}
 
-	if err := database.SaveServiceProvider(entityID, acsURL2, acsBinding, nil); err != nil {
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL2, ACSBinding: acsBinding}); err != nil {
 		t.Fatalf("SaveServiceProvider update failed: %v", err)
 	}
 
@@ -464,7 +465,7 @@ func TestIntegration_SaveAndGetAttributeMapping(t *testing.T) {
 		},
 	}
 
-	if err := database.SaveServiceProvider(entityID, acsURL, acsBinding, mapping); err != nil {
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL, ACSBinding: acsBinding, AttributeMapping: mapping}); err != nil {
 		t.Fatalf("SaveServiceProvider with mapping failed: %v", err)
 	}
 
@@ -505,7 +506,7 @@ func TestIntegration_GetAttributeMapping_NoMapping(t *testing.T) {
 	entityID := "http://example.com/saml/metadata"
 	acsURL := "http://example.com/saml/acs"
 
-	if err := database.SaveServiceProvider(entityID, acsURL, saml.HTTPPostBinding, nil); err != nil {
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL, ACSBinding: saml.HTTPPostBinding}); err != nil {
 		t.Fatalf("SaveServiceProvider failed: %v", err)
 	}
 
@@ -537,6 +538,112 @@ func TestIntegration_GetAttributeMapping_NotFound(t *testing.T) {
 	}
 }
 
+func TestIntegration_SaveAndGetAccessPolicy(t *testing.T) {
+	database, _, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	if err := database.InitSchema(); err != nil {
+		t.Fatalf("Failed to initialize schema: %v", err)
+	}
+
+	entityID := "http://example.com/saml/metadata"
+	policy := &AccessPolicy{
+		AllowedGroups:       []string{"engineering"},
+		RequiredClaims:      map[string][]string{"email_verified": {"true"}},
+		AllowedEmailDomains: []string{"example.com"},
+	}
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: "http://example.com/saml/acs",
+		ACSBinding: saml.HTTPPostBinding, AccessPolicy: policy}); err != nil {
+		t.Fatalf("SaveServiceProvider with access policy failed: %v", err)
+	}
+
+	retrieved, err := database.GetAccessPolicy(entityID)
+	if err != nil {
+		t.Fatalf("GetAccessPolicy failed: %v", err)
+	}
+	if retrieved == nil || len(retrieved.AllowedGroups) != 1 || retrieved.RequiredClaims["email_verified"][0] != "true" {
+		t.Errorf("Expected the saved access policy, got %+v", retrieved)
+	}
+
+	sp, err := database.GetServiceProviderRecord(entityID)
+	if err != nil {
+		t.Fatalf("GetServiceProviderRecord failed: %v", err)
+	}
+	if sp.AccessPolicy == nil || sp.AccessPolicy.AllowedEmailDomains[0] != "example.com" {
+		t.Errorf("Expected the access policy in the record, got %+v", sp.AccessPolicy)
+	}
+
+	if policy, err := database.GetAccessPolicy("http://non-existent.com/metadata"); err != nil || policy != nil {
+		t.Errorf("Expected no policy for a non-existent SP, got %+v, %v", policy, err)
+	}
+}
+
+func TestIntegration_ServiceProviderNameIDFormats(t *testing.T) {
+	database, _, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	if err := database.InitSchema(); err != nil {
+		t.Fatalf("Failed to initialize schema: %v", err)
+	}
+
+	entityID := "http://example.com/saml/metadata"
+	formats := []string{string(saml.PersistentNameIDFormat), string(saml.EmailAddressNameIDFormat)}
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: "http://example.com/saml/acs",
+		ACSBinding: saml.HTTPPostBinding, NameIDFormats: formats}); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	sp, err := database.GetServiceProviderRecord(entityID)
+	if err != nil {
+		t.Fatalf("GetServiceProviderRecord failed: %v", err)
+	}
+	if len(sp.NameIDFormats) != 2 || sp.NameIDFormats[1] != formats[1] {
+		t.Errorf("Expected the registered NameID formats, got %v", sp.NameIDFormats)
+	}
+}
+
+func TestIntegration_PersistentIDs(t *testing.T) {
+	database, _, cleanup := setupPostgresContainer(t)
+	defer cleanup()
+
+	if err := database.InitSchema(); err != nil {
+		t.Fatalf("Failed to initialize schema: %v", err)
+	}
+
+	entityID := "http://example.com/saml/metadata"
+	if err := database.CreatePersistentID(&PersistentID{ID: "first", EntityID: entityID, Subject: "user-1"}); err != nil {
+		t.Fatalf("CreatePersistentID failed: %v", err)
+	}
+	// A second identifier for the same subject and SP is not stored
+	if err := database.CreatePersistentID(&PersistentID{ID: "second", EntityID: entityID, Subject: "user-1"}); err != nil {
+		t.Fatalf("CreatePersistentID failed: %v", err)
+	}
+	p, err := database.GetPersistentID(entityID, "user-1")
+	if err != nil || p.ID != "first" {
+		t.Fatalf("Expected the first identifier, got %+v, %v", p, err)
+	}
+
+	if err := database.RevokePersistentID("first"); err != nil {
+		t.Fatalf("RevokePersistentID failed: %v", err)
+	}
+	if err := database.RevokePersistentID("first"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows revoking twice, got %v", err)
+	}
+	if _, err := database.GetPersistentID(entityID, "user-1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected no active identifier after revocation, got %v", err)
+	}
+
+	if err := database.CreatePersistentID(&PersistentID{ID: "second", EntityID: entityID, Subject: "user-1"}); err != nil {
+		t.Fatalf("CreatePersistentID failed: %v", err)
+	}
+	ids, err := database.ListPersistentIDs(PersistentIDFilter{Subject: "user-1"})
+	if err != nil {
+		t.Fatalf("ListPersistentIDs failed: %v", err)
+	}
+	if len(ids) != 2 || ids[0].RevokedAt == nil || ids[1].RevokedAt != nil {
+		t.Errorf("Expected the revoked and the active identifier, got %+v", ids)
+	}
+}
+
 func TestIntegration_InitSchema_Idempotent(t *testing.T) {
 	database, _, cleanup := setupPostgresContainer(t)
 	defer cleanup()
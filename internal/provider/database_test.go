@@ -3,6 +3,8 @@ package provider
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -35,8 +37,11 @@ func setupTestDB(t *testing.T) (*Database, *sql.DB, func()) {
 	database := NewDatabase(db, logger)
 
 	cleanup := func() {
+		db.Exec("DROP TABLE IF EXISTS session_participants")
+		db.Exec("DROP TABLE IF EXISTS pending_logouts")
 		db.Exec("DROP TABLE IF EXISTS sessions")
 		db.Exec("DROP TABLE IF EXISTS service_providers")
+		db.Exec("DROP TABLE IF EXISTS pending_authn_requests")
 		db.Exec("DROP TABLE IF EXISTS goose_db_version")
 		db.Close()
 	}
@@ -311,6 +316,55 @@ func TestCleanupExpiredSessions(t *testing.T) {
 	}
 }
 
+func TestPurgeExpiredSessions(t *testing.T) {
+	database, db, cleanup := setupTestDB(t)
+	if database == nil {
+		return
+	}
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		session := &saml.Session{
+			ID:         fmt.Sprintf("expired-purge-%d", i),
+			CreateTime: time.Now().Add(-20 * time.Minute),
+			ExpireTime: time.Now().Add(-10 * time.Minute),
+			Groups:     []string{},
+		}
+		if err := database.SaveSession(session, nil); err != nil {
+			t.Fatalf("Failed to save expired session: %v", err)
+		}
+	}
+	validSession := &saml.Session{ID: "valid-purge", CreateTime: time.Now(), ExpireTime: time.Now().Add(10 * time.Minute), Groups: []string{}}
+	if err := database.SaveSession(validSession, nil); err != nil {
+		t.Fatalf("Failed to save valid session: %v", err)
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Failed to open connection: %v", err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext($1))`, sessionPurgeLock); err != nil {
+		t.Fatalf("Failed to take the purge lock: %v", err)
+	}
+	if purged, locked, err := database.PurgeExpiredSessions(ctx, 2); err != nil || locked || purged != 0 {
+		t.Errorf("Expected the purge to be skipped while locked, got %d, %v, %v", purged, locked, err)
+	}
+	conn.ExecContext(ctx, `SELECT pg_advisory_unlock(hashtext($1))`, sessionPurgeLock)
+	conn.Close()
+
+	purged, locked, err := database.PurgeExpiredSessions(ctx, 2)
+	if err != nil || !locked {
+		t.Fatalf("PurgeExpiredSessions failed: %v (locked %v)", err, locked)
+	}
+	if purged != 5 {
+		t.Errorf("Expected 5 sessions purged in batches, got %d", purged)
+	}
+	if session, _ := database.GetSession("valid-purge"); session == nil {
+		t.Error("Valid session should still exist")
+	}
+}
+
 func TestSaveAndGetServiceProvider(t *testing.T) {
 	database, _, cleanup := setupTestDB(t)
 	if database == nil {
@@ -322,7 +376,7 @@ func TestSaveAndGetServiceProvider(t *testing.T) {
 	acsURL := "http://example.com/saml/acs"
 	acsBinding := saml.HTTPPostBinding
 
-	err := database.SaveServiceProvider(entityID, acsURL, acsBinding, nil)
+	err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL, ACSBinding: acsBinding})
 	if err != nil {
 		t.Fatalf("SaveServiceProvider failed: %v", err)
 	}
@@ -386,11 +440,11 @@ func TestSaveServiceProvider_Update(t *testing.T) {
 	acsURL2 := "http://example.com/saml/acs2"
 	acsBinding := saml.HTTPPostBinding
 
-	if err := database.SaveServiceProvider(entityID, acsURL1, acsBinding, nil); err != nil {
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL1, ACSBinding: acsBinding}); err != nil {
 		t.Fatalf("SaveServiceProvider failed: %v", err)
 	}
 
-	if err := database.SaveServiceProvider(entityID, acsURL2, acsBinding, nil); err != nil {
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL2, ACSBinding: acsBinding}); err != nil {
 		t.Fatalf("SaveServiceProvider update failed: %v", err)
 	}
 
@@ -404,3 +458,271 @@ func TestSaveServiceProvider_Update(t *testing.T) {
 		t.Errorf("Expected updated ACS URL %s, got %s", acsURL2, acs.Location)
 	}
 }
+
+func TestSaveAndConsumePendingAuthnRequest(t *testing.T) {
+	database, _, cleanup := setupTestDB(t)
+	if database == nil {
+		return
+	}
+	defer cleanup()
+
+	pending := &PendingAuthnRequest{
+		ID:             "test-pending-id",
+		AuthnRequestID: "test-authn-request-id",
+		SAMLRequest:    "encoded-saml-request",
+		RelayState:     "test-relay",
+		CreateTime:     time.Now(),
+		ExpireTime:     time.Now().Add(10 * time.Minute),
+	}
+
+	if err := database.SavePendingAuthnRequest(pending); err != nil {
+		t.Fatalf("SavePendingAuthnRequest failed: %v", err)
+	}
+
+	// A second request with the same ID must not overwrite the first
+	if err := database.SavePendingAuthnRequest(&PendingAuthnRequest{
+		ID:          "test-pending-id",
+		SAMLRequest: "other-saml-request",
+		CreateTime:  time.Now(),
+		ExpireTime:  time.Now().Add(10 * time.Minute),
+	}); err == nil {
+		t.Error("Expected saving a duplicate pending request to fail")
+	}
+
+	retrieved, err := database.ConsumePendingAuthnRequest("test-pending-id")
+	if err != nil {
+		t.Fatalf("ConsumePendingAuthnRequest failed: %v", err)
+	}
+	if retrieved == nil {
+		t.Fatal("Expected pending request, got nil")
+	}
+	if retrieved.SAMLRequest != pending.SAMLRequest {
+		t.Errorf("Expected SAMLRequest %s, got %s", pending.SAMLRequest, retrieved.SAMLRequest)
+	}
+	if retrieved.RelayState != pending.RelayState {
+		t.Errorf("Expected RelayState %s, got %s", pending.RelayState, retrieved.RelayState)
+	}
+	if retrieved.AuthnRequestID != pending.AuthnRequestID {
+		t.Errorf("Expected AuthnRequestID %s, got %s", pending.AuthnRequestID, retrieved.AuthnRequestID)
+	}
+
+	// A pending request can only be consumed once
+	again, err := database.ConsumePendingAuthnRequest("test-pending-id")
+	if err != nil {
+		t.Fatalf("Second ConsumePendingAuthnRequest failed: %v", err)
+	}
+	if again != nil {
+		t.Error("Expected pending request to be consumed only once")
+	}
+}
+
+func TestSaveAndConsumePendingAuthnRequest_IdPInitiated(t *testing.T) {
+	database, _, cleanup := setupTestDB(t)
+	if database == nil {
+		return
+	}
+	defer cleanup()
+
+	pending := &PendingAuthnRequest{
+		ID:                   "test-idp-initiated-id",
+		RelayState:           "/dashboard",
+		IdPInitiatedEntityID: "https://sp.example.com",
+		CreateTime:           time.Now(),
+		ExpireTime:           time.Now().Add(10 * time.Minute),
+	}
+	if err := database.SavePendingAuthnRequest(pending); err != nil {
+		t.Fatalf("SavePendingAuthnRequest failed: %v", err)
+	}
+
+	retrieved, err := database.ConsumePendingAuthnRequest(pending.ID)
+	if err != nil || retrieved == nil {
+		t.Fatalf("ConsumePendingAuthnRequest failed: %v", err)
+	}
+	if retrieved.IdPInitiatedEntityID != pending.IdPInitiatedEntityID || retrieved.SAMLRequest != "" {
+		t.Errorf("Unexpected pending launch %+v", retrieved)
+	}
+}
+
+func TestConsumePendingAuthnRequest_Expired(t *testing.T) {
+	database, _, cleanup := setupTestDB(t)
+	if database == nil {
+		return
+	}
+	defer cleanup()
+
+	pending := &PendingAuthnRequest{
+		ID:          "expired-pending-id",
+		SAMLRequest: "encoded-saml-request",
+		CreateTime:  time.Now().Add(-20 * time.Minute),
+		ExpireTime:  time.Now().Add(-10 * time.Minute),
+	}
+
+	if err := database.SavePendingAuthnRequest(pending); err != nil {
+		t.Fatalf("SavePendingAuthnRequest failed: %v", err)
+	}
+
+	retrieved, err := database.ConsumePendingAuthnRequest("expired-pending-id")
+	if err != nil {
+		t.Fatalf("ConsumePendingAuthnRequest failed: %v", err)
+	}
+	if retrieved != nil {
+		t.Error("Expected nil for expired pending request")
+	}
+}
+
+func TestCleanupExpiredPendingAuthnRequests(t *testing.T) {
+	database, _, cleanup := setupTestDB(t)
+	if database == nil {
+		return
+	}
+	defer cleanup()
+
+	expired := &PendingAuthnRequest{
+		ID:          "expired-cleanup-pending",
+		SAMLRequest: "expired",
+		CreateTime:  time.Now().Add(-20 * time.Minute),
+		ExpireTime:  time.Now().Add(-10 * time.Minute),
+	}
+	valid := &PendingAuthnRequest{
+		ID:          "valid-cleanup-pending",
+		SAMLRequest: "valid",
+		CreateTime:  time.Now(),
+		ExpireTime:  time.Now().Add(10 * time.Minute),
+	}
+
+	if err := database.SavePendingAuthnRequest(expired); err != nil {
+		t.Fatalf("Failed to save expired pending request: %v", err)
+	}
+	if err := database.SavePendingAuthnRequest(valid); err != nil {
+		t.Fatalf("Failed to save valid pending request: %v", err)
+	}
+
+	purged, err := database.CleanupExpiredPendingAuthnRequests()
+	if err != nil {
+		t.Fatalf("CleanupExpiredPendingAuthnRequests failed: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected 1 purged pending request, got %d", purged)
+	}
+
+	if pending, _ := database.ConsumePendingAuthnRequest("valid-cleanup-pending"); pending == nil {
+		t.Error("Valid pending request should still exist")
+	}
+}
+
+func TestListServiceProviders(t *testing.T) {
+	database, _, cleanup := setupTestDB(t)
+	if database == nil {
+		return
+	}
+	defer cleanup()
+
+	for _, sp := range []*ServiceProvider{
+		{EntityID: "https://a.example.com/metadata", ACSURL: "https://a.example.com/acs", ACSBinding: saml.HTTPPostBinding},
+		{EntityID: "https://b.example.com/metadata", ACSURL: "https://b.example.com/acs", ACSBinding: saml.HTTPRedirectBinding},
+		{EntityID: "https://c.example.org/metadata", ACSURL: "https://c.example.org/acs", ACSBinding: saml.HTTPPostBinding},
+	} {
+		if err := database.SaveServiceProvider(sp); err != nil {
+			t.Fatalf("SaveServiceProvider failed: %v", err)
+		}
+	}
+
+	all, total, err := database.ListServiceProviders(ServiceProviderFilter{Limit: 10})
+	if err != nil {
+		t.Fatalf("ListServiceProviders failed: %v", err)
+	}
+	if total != 3 || len(all) != 3 {
+		t.Fatalf("Expected 3 service providers, got total=%d len=%d", total, len(all))
+	}
+	if all[0].EntityID != "https://a.example.com/metadata" {
+		t.Errorf("Expected results ordered by entity ID, got %s first", all[0].EntityID)
+	}
+
+	page, total, err := database.ListServiceProviders(ServiceProviderFilter{Limit: 1, Offset: 1})
+	if err != nil {
+		t.Fatalf("ListServiceProviders failed: %v", err)
+	}
+	if total != 3 || len(page) != 1 || page[0].EntityID != "https://b.example.com/metadata" {
+		t.Errorf("Unexpected page: total=%d results=%v", total, page)
+	}
+
+	filtered, total, err := database.ListServiceProviders(ServiceProviderFilter{EntityIDContains: "EXAMPLE.COM", ACSBinding: saml.HTTPPostBinding, Limit: 10})
+	if err != nil {
+		t.Fatalf("ListServiceProviders failed: %v", err)
+	}
+	if total != 1 || len(filtered) != 1 || filtered[0].EntityID != "https://a.example.com/metadata" {
+		t.Errorf("Unexpected filtered results: total=%d results=%v", total, filtered)
+	}
+
+	none, total, err := database.ListServiceProviders(ServiceProviderFilter{EntityIDContains: "%", Limit: 10})
+	if err != nil {
+		t.Fatalf("ListServiceProviders failed: %v", err)
+	}
+	if total != 0 || len(none) != 0 {
+		t.Errorf("Expected wildcard characters to be matched literally, got total=%d", total)
+	}
+}
+
+func TestDeleteServiceProvider(t *testing.T) {
+	database, _, cleanup := setupTestDB(t)
+	if database == nil {
+		return
+	}
+	defer cleanup()
+
+	entityID := "http://example.com/saml/metadata"
+	if err := database.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: "http://example.com/saml/acs", ACSBinding: saml.HTTPPostBinding}); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+
+	if err := database.DeleteServiceProvider(entityID); err != nil {
+		t.Fatalf("DeleteServiceProvider failed: %v", err)
+	}
+	if _, err := database.GetServiceProviderRecord(entityID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows after delete, got %v", err)
+	}
+	if err := database.DeleteServiceProvider(entityID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected sql.ErrNoRows deleting a missing service provider, got %v", err)
+	}
+}
+
+func TestGetServiceProvider_ImportedMetadata(t *testing.T) {
+	database, _, cleanup := setupTestDB(t)
+	if database == nil {
+		return
+	}
+	defer cleanup()
+
+	sp := &ServiceProvider{
+		EntityID:    "https://sp.example.com/metadata",
+		ACSURL:      "https://sp.example.com/acs/post",
+		ACSBinding:  saml.HTTPPostBinding,
+		MetadataXML: testSPMetadata,
+		MetadataURL: "https://sp.example.com/metadata",
+	}
+	if err := database.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+
+	record, err := database.GetServiceProviderRecord(sp.EntityID)
+	if err != nil {
+		t.Fatalf("GetServiceProviderRecord failed: %v", err)
+	}
+	if record.MetadataXML != testSPMetadata || record.MetadataURL != sp.MetadataURL {
+		t.Error("Expected metadata to be stored verbatim")
+	}
+
+	descriptor, err := database.GetServiceProvider(sp.EntityID)
+	if err != nil {
+		t.Fatalf("GetServiceProvider failed: %v", err)
+	}
+	if len(descriptor.SPSSODescriptors[0].KeyDescriptors) != 2 {
+		t.Errorf("Expected key descriptors from the imported metadata, got %d", len(descriptor.SPSSODescriptors[0].KeyDescriptors))
+	}
+}
+
+func TestEscapeLikePattern(t *testing.T) {
+	if got := escapeLikePattern(`50%_off\`); got != `50\%\_off\\` {
+		t.Errorf("Unexpected escaped pattern: %s", got)
+	}
+}
@@ -0,0 +1,213 @@
+package provider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/xmlenc"
+)
+
+// encryptionAlgorithms are the XML Encryption block ciphers assertions can be
+// encrypted with, keyed by algorithm URI.
+var encryptionAlgorithms = map[string]xmlenc.BlockCipher{
+	xmlenc.AES128CBC.Algorithm(): xmlenc.AES128CBC,
+	xmlenc.AES192CBC.Algorithm(): xmlenc.AES192CBC,
+	xmlenc.AES256CBC.Algorithm(): xmlenc.AES256CBC,
+	aes128GCM.algorithm:          aes128GCM,
+	aes256GCM.algorithm:          aes256GCM,
+}
+
+// The AES-GCM ciphers of crewjam/saml encrypt a zeroed buffer with an empty
+// nonce, so AES-GCM is implemented here.
+var (
+	aes128GCM = gcmCipher{keySize: 16, algorithm: "http://www.w3.org/2009/xmlenc11#aes128-gcm"}
+	aes256GCM = gcmCipher{keySize: 32, algorithm: "http://www.w3.org/2009/xmlenc11#aes256-gcm"}
+)
+
+// defaultEncryptionAlgorithm is used when the service provider advertises no
+// supported algorithm, matching crewjam/saml.
+var defaultEncryptionAlgorithm = xmlenc.AES128CBC.Algorithm()
+
+// validateEncryptionCert checks that certPEM is a certificate assertions can
+// be encrypted to.
+func validateEncryptionCert(certPEM string) error {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return err
+	}
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+		return errors.New("certificate must have an RSA public key")
+	}
+	return nil
+}
+
+// spEncryptionKey returns the certificate of the first encryption key of
+// spsso, or nil when assertions for the service provider are not encrypted.
+// Like crewjam/saml, a key without a use is taken when no key is marked for
+// encryption.
+func spEncryptionKey(spsso *saml.SPSSODescriptor) (*x509.Certificate, []saml.EncryptionMethod, error) {
+	for _, use := range []string{"encryption", ""} {
+		for _, key := range spsso.KeyDescriptors {
+			if key.Use != use || len(key.KeyInfo.X509Data.X509Certificates) == 0 {
+				continue
+			}
+			data, err := base64.StdEncoding.DecodeString(key.KeyInfo.X509Data.X509Certificates[0].Data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid encryption certificate: %w", err)
+			}
+			cert, err := x509.ParseCertificate(data)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid encryption certificate: %w", err)
+			}
+			return cert, key.EncryptionMethods, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// selectEncryptionAlgorithm returns the first supported block cipher of
+// methods, or the default one.
+func selectEncryptionAlgorithm(methods []saml.EncryptionMethod) xmlenc.BlockCipher {
+	for _, method := range methods {
+		if cipher, ok := encryptionAlgorithms[method.Algorithm]; ok {
+			return cipher
+		}
+	}
+	return encryptionAlgorithms[defaultEncryptionAlgorithm]
+}
+
+// encryptAssertion sets req.AssertionEl to req.Assertion encrypted for the
+// service provider, signed first when sign is set, which keeps crewjam/saml
+// from encrypting it with its fixed algorithm. Assertions for service
+// providers without an encryption key are left to the caller.
+func encryptAssertion(req *saml.IdpAuthnRequest, sign bool) error {
+	cert, methods, err := spEncryptionKey(req.SPSSODescriptor)
+	if err != nil || cert == nil {
+		return err
+	}
+
+	assertionEl := req.Assertion.Element()
+	if sign {
+		// Sign with crewjam/saml on a copy of the request that has no
+		// encryption keys, so the signature matches unencrypted assertions
+		spsso := *req.SPSSODescriptor
+		spsso.KeyDescriptors = nil
+		for _, key := range req.SPSSODescriptor.KeyDescriptors {
+			if key.Use == "signing" {
+				spsso.KeyDescriptors = append(spsso.KeyDescriptors, key)
+			}
+		}
+		signing := *req
+		signing.SPSSODescriptor = &spsso
+		if err := signing.MakeAssertionEl(); err != nil {
+			return err
+		}
+		req.Assertion = signing.Assertion
+		assertionEl = signing.AssertionEl
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(assertionEl)
+	assertion, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	encryptor := xmlenc.OAEP()
+	encryptor.BlockCipher = selectEncryptionAlgorithm(methods)
+	encryptor.DigestMethod = &xmlenc.SHA1
+	encryptedDataEl, err := encryptor.Encrypt(cert, assertion, nil)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt assertion: %w", err)
+	}
+	encryptedDataEl.CreateAttr("Type", "http://www.w3.org/2001/04/xmlenc#Element")
+
+	encryptedAssertionEl := etree.NewElement("saml:EncryptedAssertion")
+	encryptedAssertionEl.AddChild(encryptedDataEl)
+	req.AssertionEl = encryptedAssertionEl
+	return nil
+}
+
+// gcmCipher is an XML Encryption 1.1 AES-GCM block cipher. The cipher value is
+// the nonce followed by the ciphertext and the authentication tag.
+type gcmCipher struct {
+	keySize   int
+	algorithm string
+}
+
+func (c gcmCipher) KeySize() int {
+	return c.keySize
+}
+
+func (c gcmCipher) Algorithm() string {
+	return c.algorithm
+}
+
+func (c gcmCipher) aead(key interface{}) (cipher.AEAD, error) {
+	keyBuf, ok := key.([]byte)
+	if !ok {
+		return nil, xmlenc.ErrIncorrectKeyType("[]byte")
+	}
+	if len(keyBuf) != c.keySize {
+		return nil, xmlenc.ErrIncorrectKeyLength(c.keySize)
+	}
+	block, err := aes.NewCipher(keyBuf)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (c gcmCipher) Encrypt(key interface{}, plaintext []byte, _ []byte) (*etree.Element, error) {
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	encryptedDataEl := etree.NewElement("xenc:EncryptedData")
+	encryptedDataEl.CreateAttr("xmlns:xenc", "http://www.w3.org/2001/04/xmlenc#")
+	encryptedDataEl.CreateAttr("Id", newSAMLID())
+	method := encryptedDataEl.CreateElement("xenc:EncryptionMethod")
+	method.CreateAttr("Algorithm", c.algorithm)
+	cipherData := encryptedDataEl.CreateElement("xenc:CipherData")
+	cipherData.CreateElement("xenc:CipherValue").SetText(
+		base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)))
+	return encryptedDataEl, nil
+}
+
+func (c gcmCipher) Decrypt(key interface{}, ciphertextEl *etree.Element) ([]byte, error) {
+	if encryptedKeyEl := ciphertextEl.FindElement("./KeyInfo/EncryptedKey"); encryptedKeyEl != nil {
+		var err error
+		if key, err = xmlenc.Decrypt(key, encryptedKeyEl); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	cipherValue := ciphertextEl.FindElement("./CipherData/CipherValue")
+	if cipherValue == nil {
+		return nil, errors.New("missing CipherValue")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(cipherValue.Text())
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+}
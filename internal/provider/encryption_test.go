@@ -0,0 +1,158 @@
+package provider
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/xmlenc"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// testEncryptionKeyPair returns a new RSA key and its certificate as PEM.
+func testEncryptionKeyPair(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, certDER, err := dsig.RandomKeyStoreForTest().GetKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+}
+
+func TestServiceProviderEntityDescriptor_Encryption(t *testing.T) {
+	_, certPEM := testEncryptionKeyPair(t)
+	cert, _ := parseCertificatePEM(certPEM)
+	certData := base64.StdEncoding.EncodeToString(cert.Raw)
+	gcm := aes256GCM.algorithm
+
+	t.Run("registered", func(t *testing.T) {
+		sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs",
+			ACSBinding: saml.HTTPPostBinding, EncryptionCert: certPEM, EncryptionAlgorithm: gcm}
+		descriptor, err := sp.EntityDescriptor()
+		if err != nil {
+			t.Fatalf("EntityDescriptor failed: %v", err)
+		}
+		keys := descriptor.SPSSODescriptors[0].KeyDescriptors
+		if len(keys) != 1 || keys[0].Use != "encryption" || keys[0].KeyInfo.X509Data.X509Certificates[0].Data != certData {
+			t.Fatalf("Expected the encryption certificate, got %+v", keys)
+		}
+		if len(keys[0].EncryptionMethods) != 1 || keys[0].EncryptionMethods[0].Algorithm != gcm {
+			t.Errorf("Expected the encryption algorithm, got %+v", keys[0].EncryptionMethods)
+		}
+	})
+
+	t.Run("overrides metadata", func(t *testing.T) {
+		sp := &ServiceProvider{EntityID: "https://sp.example.com/metadata", MetadataXML: testSPMetadata, EncryptionCert: certPEM}
+		descriptor, err := sp.EntityDescriptor()
+		if err != nil {
+			t.Fatalf("EntityDescriptor failed: %v", err)
+		}
+		keys := descriptor.SPSSODescriptors[0].KeyDescriptors
+		if len(keys) != 2 || keys[0].KeyInfo.X509Data.X509Certificates[0].Data != certData || keys[1].Use != "signing" {
+			t.Errorf("Expected the registered encryption key and the metadata signing key, got %+v", keys)
+		}
+	})
+}
+
+func TestSelectEncryptionAlgorithm(t *testing.T) {
+	methods := []saml.EncryptionMethod{
+		{Algorithm: "http://www.w3.org/2001/04/xmlenc#tripledes-cbc"},
+		{Algorithm: xmlenc.AES256CBC.Algorithm()},
+	}
+	if got := selectEncryptionAlgorithm(methods).Algorithm(); got != xmlenc.AES256CBC.Algorithm() {
+		t.Errorf("Expected the first supported algorithm, got %s", got)
+	}
+	if got := selectEncryptionAlgorithm(nil).Algorithm(); got != defaultEncryptionAlgorithm {
+		t.Errorf("Expected the default algorithm, got %s", got)
+	}
+}
+
+func TestEncryptAssertion(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	spKey, certPEM := testEncryptionKeyPair(t)
+
+	for _, algorithm := range []string{"", xmlenc.AES256CBC.Algorithm(), aes128GCM.algorithm, aes256GCM.algorithm} {
+		t.Run("algorithm "+algorithm, func(t *testing.T) {
+			sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs",
+				ACSBinding: saml.HTTPPostBinding, EncryptionCert: certPEM, EncryptionAlgorithm: algorithm}
+			descriptor, err := sp.EntityDescriptor()
+			if err != nil {
+				t.Fatalf("EntityDescriptor failed: %v", err)
+			}
+			spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+			req := &saml.IdpAuthnRequest{IDP: server.samlIdp, HTTPRequest: httptest.NewRequest(http.MethodGet, "/saml/sso", nil), Now: saml.TimeNow(),
+				ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs}
+			session := &saml.Session{ID: "session", Index: "session", NameID: "user@example.com", ExpireTime: time.Now().Add(time.Hour)}
+			if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+				t.Fatalf("MakeAssertion failed: %v", err)
+			}
+
+			if err := encryptAssertion(req, true); err != nil {
+				t.Fatalf("encryptAssertion failed: %v", err)
+			}
+			if req.AssertionEl == nil || req.AssertionEl.Tag != "EncryptedAssertion" {
+				t.Fatalf("Expected an EncryptedAssertion, got %v", req.AssertionEl)
+			}
+			encryptedData := req.AssertionEl.FindElement("./EncryptedData")
+			wantAlgorithm := algorithm
+			if wantAlgorithm == "" {
+				wantAlgorithm = defaultEncryptionAlgorithm
+			}
+			if method := encryptedData.FindElement("./EncryptionMethod"); method == nil || method.SelectAttrValue("Algorithm", "") != wantAlgorithm {
+				t.Errorf("Expected encryption with %s", wantAlgorithm)
+			}
+
+			plaintext, err := encryptionAlgorithms[wantAlgorithm].Decrypt(spKey, encryptedData)
+			if err != nil {
+				t.Fatalf("Failed to decrypt assertion: %v", err)
+			}
+			doc := etree.NewDocument()
+			if err := doc.ReadFromBytes(plaintext); err != nil {
+				t.Fatalf("Failed to parse decrypted assertion: %v", err)
+			}
+			if doc.Root().Tag != "Assertion" || doc.Root().FindElement("./Signature") == nil {
+				t.Errorf("Expected a signed assertion, got %s", plaintext)
+			}
+		})
+	}
+
+	t.Run("no encryption key", func(t *testing.T) {
+		req := &saml.IdpAuthnRequest{IDP: server.samlIdp, SPSSODescriptor: &saml.SPSSODescriptor{}}
+		if err := encryptAssertion(req, true); err != nil || req.AssertionEl != nil {
+			t.Errorf("Expected the assertion to be left to crewjam/saml, got %v (error %v)", req.AssertionEl, err)
+		}
+	})
+}
+
+func TestValidateServiceProvider_Encryption(t *testing.T) {
+	_, certPEM := testEncryptionKeyPair(t)
+	base := func() *ServiceProvider {
+		return &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs"}
+	}
+
+	sp := base()
+	sp.EncryptionCert = certPEM
+	sp.EncryptionAlgorithm = aes256GCM.algorithm
+	if err := validateServiceProvider(sp); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	sp = base()
+	sp.EncryptionCert = "not a certificate"
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for an invalid encryption certificate")
+	}
+
+	sp = base()
+	sp.EncryptionAlgorithm = "http://www.w3.org/2001/04/xmlenc#tripledes-cbc"
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for an unsupported encryption algorithm")
+	}
+}
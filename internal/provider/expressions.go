@@ -0,0 +1,164 @@
+package provider
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/crewjam/saml"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/traits"
+	"github.com/google/cel-go/ext"
+)
+
+const (
+	// maxExpressionLength bounds the source of an attribute expression.
+	maxExpressionLength = 2048
+	// expressionCostLimit bounds the work done evaluating an attribute
+	// expression at each login.
+	expressionCostLimit = 100000
+	// maxCachedExpressions bounds the number of compiled expressions kept
+	// between logins.
+	maxCachedExpressions = 1024
+)
+
+// expressionEnv is the CEL environment attribute expressions run in. The ID
+// Token claims are the only input and the standard library plus the string
+// extensions the only functions, so expressions cannot reach anything else.
+var expressionEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		ext.Strings(),
+		cel.ParserExpressionSizeLimit(maxExpressionLength),
+	)
+})
+
+// expressionPrograms caches the compiled expressions evaluated at login.
+var expressionPrograms = newExpressionCache(maxCachedExpressions)
+
+// expressionCache is a least recently used cache of compiled attribute
+// expressions by source. CEL programs are safe for concurrent use.
+type expressionCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type expressionCacheEntry struct {
+	source  string
+	program cel.Program
+}
+
+func newExpressionCache(capacity int) *expressionCache {
+	return &expressionCache{capacity: capacity, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+// get returns the compiled expression for source, compiling and caching it
+// if needed. Expressions that fail to compile are not cached.
+func (c *expressionCache) get(source string) (cel.Program, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[source]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*expressionCacheEntry).program, nil
+	}
+	c.mu.Unlock()
+
+	program, err := compileExpression(source)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[source]; ok {
+		c.order.MoveToFront(el)
+		return el.Value.(*expressionCacheEntry).program, nil
+	}
+	c.entries[source] = c.order.PushFront(&expressionCacheEntry{source: source, program: program})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*expressionCacheEntry).source)
+	}
+	return program, nil
+}
+
+// len returns the number of cached expressions.
+func (c *expressionCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// compileExpression compiles an attribute expression, which must evaluate to
+// a string or a list of strings.
+func compileExpression(source string) (cel.Program, error) {
+	env, err := expressionEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(source)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	switch out := ast.OutputType(); {
+	case out.IsExactType(cel.StringType), out.IsExactType(cel.DynType),
+		out.IsExactType(cel.ListType(cel.StringType)), out.IsExactType(cel.ListType(cel.DynType)):
+	default:
+		return nil, fmt.Errorf("must evaluate to a string or a list of strings, not %s", out)
+	}
+	return env.Program(ast, cel.CostLimit(expressionCostLimit))
+}
+
+// evaluateExpression evaluates an attribute expression against the ID Token
+// claims. A list is returned null-separated, the way the internal model holds
+// multi-valued fields.
+func evaluateExpression(source string, claims map[string]interface{}) (string, error) {
+	program, err := expressionPrograms.get(source)
+	if err != nil {
+		return "", err
+	}
+	out, _, err := program.Eval(map[string]interface{}{"claims": claims})
+	if err != nil {
+		return "", err
+	}
+	switch v := out.(type) {
+	case types.String:
+		return string(v), nil
+	case traits.Lister:
+		values, err := v.ConvertToNative(reflect.TypeOf([]string{}))
+		if err != nil {
+			return "", errors.New("the list must only contain strings")
+		}
+		return strings.Join(values.([]string), "\x00"), nil
+	default:
+		return "", fmt.Errorf("evaluated to %s, not a string or a list of strings", out.Type().TypeName())
+	}
+}
+
+// expressionClaims returns the claims attribute expressions see: the ID Token
+// claims, or the standard claims held by session when they were not stored.
+func expressionClaims(session *saml.Session, rawClaims map[string]interface{}) map[string]interface{} {
+	if len(rawClaims) > 0 {
+		return rawClaims
+	}
+	claims := map[string]interface{}{
+		"sub":   session.UserName,
+		"email": session.UserEmail,
+		"name":  session.UserCommonName,
+	}
+	if len(session.Groups) > 0 {
+		groups := make([]interface{}, len(session.Groups))
+		for i, group := range session.Groups {
+			groups[i] = group
+		}
+		claims["groups"] = groups
+	}
+	return claims
+}
@@ -0,0 +1,137 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/crewjam/saml"
+)
+
+func TestCompileExpression(t *testing.T) {
+	tests := []struct {
+		source  string
+		wantErr bool
+	}{
+		{source: `claims.email.split("@")[0]`},
+		{source: `claims.given_name + " " + claims.family_name`},
+		{source: `claims.groups.map(g, "team-" + g)`},
+		{source: `has(claims.nickname) ? claims.nickname : claims.sub`},
+		{source: `claims.email.`, wantErr: true},
+		{source: `1 + 2`, wantErr: true},
+		{source: `unknown.email`, wantErr: true},
+		{source: `"` + strings.Repeat("a", maxExpressionLength) + `"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := compileExpression(tt.source); (err != nil) != tt.wantErr {
+			t.Errorf("compileExpression(%.40q): expected error: %v, got %v", tt.source, tt.wantErr, err)
+		}
+	}
+}
+
+func TestExpressionCache(t *testing.T) {
+	cache := newExpressionCache(2)
+	for _, source := range []string{`claims.sub`, `claims.email`, `claims.sub`, `claims.name`} {
+		if _, err := cache.get(source); err != nil {
+			t.Fatalf("get(%q) failed: %v", source, err)
+		}
+	}
+	if cache.len() != 2 {
+		t.Errorf("Expected the cache to hold 2 expressions, got %d", cache.len())
+	}
+	if _, ok := cache.entries[`claims.email`]; ok {
+		t.Error("Expected the least recently used expression to be evicted")
+	}
+	if _, ok := cache.entries[`claims.sub`]; !ok {
+		t.Error("Expected a recently used expression to be kept")
+	}
+
+	if _, err := cache.get(`1 + 2`); err == nil {
+		t.Error("Expected an error for an invalid expression")
+	}
+	if _, ok := cache.entries[`1 + 2`]; ok {
+		t.Error("Expected an invalid expression not to be cached")
+	}
+}
+
+func TestApplyAttributeMapping_Expressions(t *testing.T) {
+	session := &saml.Session{
+		ID:        "test-session",
+		NameID:    "user@example.com",
+		UserEmail: "User@Example.com",
+		UserName:  "user-sub-id",
+	}
+	rawClaims := map[string]interface{}{
+		"sub":         "user-sub-id",
+		"email":       "User@Example.com",
+		"given_name":  "Jane",
+		"family_name": "Doe",
+		"groups":      []interface{}{"dev", "ops"},
+	}
+	mapping := &AttributeMapping{
+		SAMLAttributes: map[string]string{"uid": "uid", "display_name": "displayName", "groups": "memberOf", "email": "mail"},
+		Expressions: map[string]string{
+			"uid":          `claims.email.split("@")[0].lowerAscii()`,
+			"display_name": `claims.given_name + " " + claims.family_name`,
+			"groups":       `claims.groups.map(g, "team-" + g)`,
+		},
+		Options: MappingOptions{LowercaseEmail: true},
+	}
+
+	result, err := applyAttributeMapping(session, mapping, rawClaims)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := map[string][]string{
+		"uid":         {"user"},
+		"displayName": {"Jane Doe"},
+		"memberOf":    {"team-dev", "team-ops"},
+		"mail":        {"user@example.com"},
+	}
+	for _, attr := range result.CustomAttributes {
+		var values []string
+		for _, v := range attr.Values {
+			values = append(values, v.Value)
+		}
+		if strings.Join(values, ",") != strings.Join(want[attr.Name], ",") {
+			t.Errorf("Expected %s = %v, got %v", attr.Name, want[attr.Name], values)
+		}
+		delete(want, attr.Name)
+	}
+	if len(want) > 0 {
+		t.Errorf("Missing attributes %v", want)
+	}
+}
+
+func TestApplyAttributeMapping_ExpressionErrors(t *testing.T) {
+	session := &saml.Session{ID: "test-session", UserEmail: "user@example.com", UserName: "user-sub-id"}
+	mapping := &AttributeMapping{
+		SAMLAttributes: map[string]string{"uid": "uid", "department": "department"},
+		OIDCClaims:     map[string]string{"sub": "uid", "department": "department"},
+		Expressions: map[string]string{
+			"uid":        `claims.email.split("@")[0]`,
+			"department": `claims.department.upperAscii()`,
+		},
+	}
+
+	// Without stored ID token claims, expressions see the session fields
+	result, err := applyAttributeMapping(session, mapping, nil)
+	if err == nil || !strings.Contains(err.Error(), `"department"`) {
+		t.Errorf("Expected the department expression to fail, got %v", err)
+	}
+	if len(result.CustomAttributes) != 1 || result.CustomAttributes[0].Name != "uid" || result.CustomAttributes[0].Values[0].Value != "user" {
+		t.Errorf("Expected only the uid attribute, got %+v", result.CustomAttributes)
+	}
+}
+
+func TestValidateServiceProvider_Expressions(t *testing.T) {
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs",
+		AttributeMapping: &AttributeMapping{Expressions: map[string]string{"uid": `claims.email.split("@")[0]`}}}
+	if err := validateServiceProvider(sp); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	sp.AttributeMapping.Expressions["count"] = `size(claims)`
+	if err := validateServiceProvider(sp); err == nil || !strings.Contains(err.Error(), "invalid attribute_mapping") {
+		t.Errorf("Expected an invalid attribute_mapping error, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/crewjam/saml"
+)
+
+// maxRelayStateSize is the RelayState limit of saml-bindings 3.4.3 and 3.5.3.
+const maxRelayStateSize = 80
+
+// handleIdPInitiatedSSO starts SSO from the IdP for portal-style launches:
+// /saml/idp-initiated?sp={entityID}&RelayState=... authenticates the user
+// through Hydra when needed, then posts an unsolicited Response to the default
+// HTTP-POST ACS of the service provider. Only service providers registered
+// with allow_idp_initiated are accepted.
+func (s *Server) handleIdPInitiatedSSO(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_idp_initiated_sso")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	entityID := r.URL.Query().Get("sp")
+	relayState := r.URL.Query().Get("RelayState")
+	if entityID == "" {
+		s.renderError(w, r, "Missing sp parameter", http.StatusBadRequest)
+		return
+	}
+	if len(relayState) > maxRelayStateSize {
+		s.renderError(w, r, "RelayState is too long", http.StatusBadRequest)
+		return
+	}
+
+	sp, err := s.db.GetServiceProviderRecord(entityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.renderError(w, r, "Unknown service provider", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if !sp.AllowIdPInitiated {
+		s.logger.Warnw("Rejected IdP-initiated SSO to a service provider that has not opted in", "entityID", entityID)
+		s.renderError(w, r, "IdP-initiated SSO is not enabled for this service provider", http.StatusForbidden)
+		return
+	}
+
+	descriptor, err := sp.EntityDescriptor()
+	if err != nil {
+		s.logger.Errorw("Stored service provider metadata is invalid", "entityID", entityID, "error", err)
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	if acs == nil {
+		s.logger.Warnw("Service provider has no HTTP-POST AssertionConsumerService for IdP-initiated SSO", "entityID", entityID)
+		s.renderError(w, r, "Service provider has no HTTP-POST AssertionConsumerService", http.StatusBadRequest)
+		return
+	}
+
+	// Without a request ID the Response is unsolicited; the issuer lets
+	// GetSession apply the SP's attribute mapping and resume the launch
+	// after the OIDC login
+	idp := s.identityProvider()
+	req := &saml.IdpAuthnRequest{
+		IDP:                     idp,
+		HTTPRequest:             r,
+		RelayState:              relayState,
+		Now:                     saml.TimeNow(),
+		ServiceProviderMetadata: descriptor,
+		SPSSODescriptor:         spsso,
+		ACSEndpoint:             acs,
+	}
+	req.Request.Issuer = &saml.Issuer{Value: entityID}
+
+	session := idp.SessionProvider.GetSession(w, r, req)
+	if session == nil {
+		return
+	}
+
+	s.logger.Infow("IdP-initiated SSO", "entityID", entityID, "acs", acs.Location)
+	if err := idp.AssertionMaker.MakeAssertion(req, session); err != nil {
+		s.logger.Errorw("Failed to make assertion", "entityID", entityID, "error", err)
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if err := req.WriteResponse(w); err != nil {
+		s.logger.Errorw("Failed to write SAML response", "entityID", entityID, "error", err)
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,171 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/crewjam/saml"
+	"golang.org/x/oauth2"
+)
+
+func TestHandleIdPInitiatedSSO_BadRequest(t *testing.T) {
+	server := setupTestServer(t)
+
+	for name, target := range map[string]string{
+		"missing sp":           "/saml/idp-initiated",
+		"relay state too long": "/saml/idp-initiated?sp=https%3A%2F%2Fsp.example.com&RelayState=" + strings.Repeat("a", maxRelayStateSize+1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.handleIdPInitiatedSSO(rec, httptest.NewRequest(http.MethodGet, target, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, rec.Code)
+			}
+		})
+	}
+}
+
+func TestSelectACS_PostOnly(t *testing.T) {
+	descriptor, err := parseServiceProviderMetadata([]byte(testSPMetadata))
+	if err != nil {
+		t.Fatalf("parseServiceProviderMetadata failed: %v", err)
+	}
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	if spsso == nil || acs == nil || acs.Location != "https://sp.example.com/acs/post" {
+		t.Errorf("Expected the HTTP-POST ACS, got %+v", acs)
+	}
+
+	redirectOnly := &saml.EntityDescriptor{SPSSODescriptors: []saml.SPSSODescriptor{{
+		AssertionConsumerServices: []saml.IndexedEndpoint{{Binding: saml.HTTPRedirectBinding, Location: "https://sp.example.com/acs"}},
+	}}}
+	if _, acs := selectACS(redirectOnly, saml.HTTPPostBinding); acs != nil {
+		t.Errorf("Expected no HTTP-POST ACS, got %+v", acs)
+	}
+}
+
+func setupIdPInitiatedTest(t *testing.T, allow bool) (*Server, *ServiceProvider) {
+	t.Helper()
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	setupTestIdP(t, server)
+
+	sp := &ServiceProvider{
+		EntityID:          "https://portal-sp.example.com",
+		ACSURL:            "https://portal-sp.example.com/acs",
+		ACSBinding:        saml.HTTPPostBinding,
+		AllowIdPInitiated: allow,
+	}
+	if err := server.db.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteServiceProvider(sp.EntityID) })
+	return server, sp
+}
+
+func idpInitiatedRequest(entityID, relayState string) *http.Request {
+	query := url.Values{"sp": {entityID}, "RelayState": {relayState}}
+	return httptest.NewRequest(http.MethodGet, "/saml/idp-initiated?"+query.Encode(), nil)
+}
+
+func TestHandleIdPInitiatedSSO_NotAllowed(t *testing.T) {
+	server, sp := setupIdPInitiatedTest(t, false)
+
+	rec := httptest.NewRecorder()
+	server.handleIdPInitiatedSSO(rec, idpInitiatedRequest(sp.EntityID, ""))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	server.handleIdPInitiatedSSO(rec, idpInitiatedRequest("https://unknown.example.com", ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown SP, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestHandleIdPInitiatedSSO_NoSession(t *testing.T) {
+	server, sp := setupIdPInitiatedTest(t, true)
+	server.oauth2Config = &oauth2.Config{
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost:8082/saml/callback",
+		Endpoint:    oauth2.Endpoint{AuthURL: "https://hydra.example.com/oauth2/auth"},
+	}
+
+	rec := httptest.NewRecorder()
+	server.handleIdPInitiatedSSO(rec, idpInitiatedRequest(sp.EntityID, "/dashboard"))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected redirect to Hydra, got %d", rec.Code)
+	}
+
+	state := oidcStateFromRedirect(t, server, rec)
+	if state.RelayState != "/dashboard" {
+		t.Errorf("Expected RelayState in state, got %q", state.RelayState)
+	}
+	pending, err := server.db.ConsumePendingAuthnRequest(state.RequestID)
+	if err != nil || pending == nil {
+		t.Fatalf("Expected a pending launch, got %v (error %v)", pending, err)
+	}
+	if pending.IdPInitiatedEntityID != sp.EntityID || pending.SAMLRequest != "" || pending.RelayState != "/dashboard" {
+		t.Errorf("Unexpected pending launch %+v", pending)
+	}
+}
+
+func TestHandleIdPInitiatedSSO_PostsUnsolicitedResponse(t *testing.T) {
+	server, sp := setupIdPInitiatedTest(t, true)
+
+	session := &saml.Session{ID: sessionIDFromToken("idp-initiated-session"), CreateTime: time.Now(), ExpireTime: time.Now().Add(time.Hour),
+		Index: "idp-initiated-session", NameID: "user@example.com", UserEmail: "user@example.com"}
+	if err := server.db.SaveSession(session, nil); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteSession(session.ID) })
+
+	req := idpInitiatedRequest(sp.EntityID, "/dashboard")
+	req.AddCookie(&http.Cookie{Name: "saml_session", Value: "idp-initiated-session"})
+	rec := httptest.NewRecorder()
+	server.handleIdPInitiatedSSO(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `action="https://portal-sp.example.com/acs"`) || !strings.Contains(body, `value="/dashboard"`) {
+		t.Fatalf("Expected a form posting to the ACS with the RelayState, got %s", body)
+	}
+
+	match := regexp.MustCompile(`name="SAMLResponse" value="([^"]+)"`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatal("Expected a SAMLResponse field")
+	}
+	data, _ := base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+	var response saml.Response
+	if err := xml.Unmarshal(data, &response); err != nil {
+		t.Fatalf("Failed to parse Response: %v", err)
+	}
+	if response.InResponseTo != "" {
+		t.Errorf("Expected an unsolicited Response, got InResponseTo %q", response.InResponseTo)
+	}
+	if response.Destination != sp.ACSURL {
+		t.Errorf("Expected Destination %s, got %s", sp.ACSURL, response.Destination)
+	}
+
+	participants, err := server.db.GetSessionParticipants(session.ID)
+	if err != nil || len(participants) != 1 || participants[0].EntityID != sp.EntityID {
+		t.Errorf("Expected the SP to be recorded as a session participant, got %v (error %v)", participants, err)
+	}
+}
@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// encryptedSigningKeyPrefix marks a private key stored encrypted with the
+// signing key encryption key: AES-256-GCM, the nonce followed by the
+// ciphertext, base64 encoded.
+const encryptedSigningKeyPrefix = "aes256gcm:"
+
+// errSigningKeyEncryptionKeyMissing is returned when a signing key must be
+// encrypted or decrypted but no key encryption key is configured.
+var errSigningKeyEncryptionKeyMissing = errors.New("SAML_PROVIDER_SIGNING_KEY_ENCRYPTION_KEY is not set")
+
+// signingKeyAEAD returns the cipher private keys are encrypted with, derived
+// from the configured secret.
+func signingKeyAEAD(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, errSigningKeyEncryptionKeyMissing
+	}
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, "identity-saml-provider signing key encryption", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSigningKey encrypts the PEM private key of the signing key id for
+// storage. The ciphertext is bound to id, so it cannot be moved to another
+// key of the keyring.
+func EncryptSigningKey(secret, id string, keyPEM []byte) (string, error) {
+	aead, err := signingKeyAEAD(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, keyPEM, []byte(id))
+	return encryptedSigningKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSigningKey returns the PEM private key of a stored signing key.
+// Private keys stored in plaintext are rejected.
+func DecryptSigningKey(secret string, key *SigningKey) ([]byte, error) {
+	encoded, ok := strings.CutPrefix(key.PrivateKey, encryptedSigningKeyPrefix)
+	if !ok {
+		return nil, errors.New("private key is not encrypted; run identity-saml-provider keys encrypt")
+	}
+	aead, err := signingKeyAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted private key")
+	}
+	keyPEM, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return keyPEM, nil
+}
+
+// IsSigningKeyEncrypted reports whether the private key of key is stored
+// encrypted.
+func IsSigningKeyEncrypted(key *SigningKey) bool {
+	return strings.HasPrefix(key.PrivateKey, encryptedSigningKeyPrefix)
+}
@@ -0,0 +1,281 @@
+package provider
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+// SigningKeyState is the state of a key in the signing keyring at a given
+// time. It is derived from the schedule of the keys, see SigningKeyStates.
+type SigningKeyState string
+
+const (
+	// SigningKeyStateNext keys are published in metadata ahead of their
+	// activation so service providers can pick them up.
+	SigningKeyStateNext SigningKeyState = "next"
+	// SigningKeyStateActive is the key messages are signed with.
+	SigningKeyStateActive SigningKeyState = "active"
+	// SigningKeyStateRetired keys no longer sign but are still published
+	// until the grace period has passed.
+	SigningKeyStateRetired SigningKeyState = "retired"
+	// SigningKeyStateExpired keys are retired for longer than the grace
+	// period and are no longer published.
+	SigningKeyStateExpired SigningKeyState = "expired"
+)
+
+const (
+	defaultSigningKeyGracePeriod  = 7 * 24 * time.Hour
+	defaultKeyringRefreshInterval = time.Minute
+)
+
+// SigningKeyStates returns the state of every key at now, keyed by ID. The
+// active key is the last one activated that has not been retired; the keys
+// activated before it are retired from the activation of their successor.
+func SigningKeyStates(keys []*SigningKey, now time.Time, gracePeriod time.Duration) map[string]SigningKeyState {
+	ordered := make([]*SigningKey, len(keys))
+	copy(ordered, keys)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].ActivateAt.Equal(ordered[j].ActivateAt) {
+			return ordered[i].ID < ordered[j].ID
+		}
+		return ordered[i].ActivateAt.Before(ordered[j].ActivateAt)
+	})
+
+	states := make(map[string]SigningKeyState, len(ordered))
+	var successorActivation *time.Time
+	activeFound := false
+	for i := len(ordered) - 1; i >= 0; i-- {
+		key := ordered[i]
+		retiredAt := key.RetiredAt
+		if retiredAt != nil && retiredAt.After(now) {
+			retiredAt = nil
+		}
+
+		switch {
+		case retiredAt == nil && key.ActivateAt.After(now):
+			states[key.ID] = SigningKeyStateNext
+			continue
+		case retiredAt == nil && !activeFound:
+			states[key.ID] = SigningKeyStateActive
+			activeFound = true
+		default:
+			if retiredAt == nil || (successorActivation != nil && successorActivation.Before(*retiredAt)) {
+				retiredAt = successorActivation
+			}
+			if retiredAt != nil && now.Before(retiredAt.Add(gracePeriod)) {
+				states[key.ID] = SigningKeyStateRetired
+			} else {
+				states[key.ID] = SigningKeyStateExpired
+			}
+		}
+		if !key.ActivateAt.After(now) {
+			activation := key.ActivateAt
+			successorActivation = &activation
+		}
+	}
+	return states
+}
+
+// ParseSigningKeyPair parses a PEM certificate and private key and checks
+// that they belong together and can sign SAML messages.
+func ParseSigningKeyPair(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := validateSigningKey(keyPair.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// signingKeyPair is a parsed key of the keyring. The key pair loaded from
+// SAMLCertPath and SAMLKeyPath has no schedule.
+type signingKeyPair struct {
+	schedule *SigningKey
+	key      crypto.Signer
+	cert     *x509.Certificate
+}
+
+// keyring holds the signing keys stored in the database. The state of each
+// key is evaluated on use, so signing switches over at the scheduled time
+// rather than on the next refresh.
+type keyring struct {
+	gracePeriod time.Duration
+
+	mu       sync.RWMutex
+	keys     []*signingKeyPair
+	fallback *signingKeyPair
+}
+
+func newKeyring(fallback *signingKeyPair, gracePeriod time.Duration) *keyring {
+	if gracePeriod <= 0 {
+		gracePeriod = defaultSigningKeyGracePeriod
+	}
+	return &keyring{fallback: fallback, gracePeriod: gracePeriod}
+}
+
+func (k *keyring) setKeys(keys []*signingKeyPair) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+}
+
+// setFallback replaces the key pair loaded from the configured files.
+func (k *keyring) setFallback(fallback *signingKeyPair) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.fallback = fallback
+}
+
+func (k *keyring) states(now time.Time) ([]*signingKeyPair, map[string]SigningKeyState) {
+	k.mu.RLock()
+	keys := k.keys
+	k.mu.RUnlock()
+
+	schedules := make([]*SigningKey, len(keys))
+	for i, key := range keys {
+		schedules[i] = key.schedule
+	}
+	return keys, SigningKeyStates(schedules, now, k.gracePeriod)
+}
+
+// active returns the key pair to sign with at now. The key pair loaded from
+// the configured files is used while the keyring has no active key.
+func (k *keyring) active(now time.Time) *signingKeyPair {
+	keys, states := k.states(now)
+	for _, key := range keys {
+		if states[key.schedule.ID] == SigningKeyStateActive {
+			return key
+		}
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.fallback
+}
+
+// published returns the certificates of the next and retired keys, which are
+// published in metadata next to the active one.
+func (k *keyring) published(now time.Time) []*x509.Certificate {
+	keys, states := k.states(now)
+	var certs []*x509.Certificate
+	for _, key := range keys {
+		if state := states[key.schedule.ID]; state == SigningKeyStateNext || state == SigningKeyStateRetired {
+			certs = append(certs, key.cert)
+		}
+	}
+	return certs
+}
+
+// loadKeyring reads the signing keys from the database into the keyring,
+// decrypting their private keys. A key that fails to decrypt or parse fails
+// the whole load, so the keyring never signs with an unexpected key.
+func (s *Server) loadKeyring() error {
+	records, err := s.db.ListSigningKeys()
+	if err != nil {
+		return fmt.Errorf("failed to load signing keys: %w", err)
+	}
+	keys := make([]*signingKeyPair, 0, len(records))
+	for _, record := range records {
+		keyPEM, err := DecryptSigningKey(s.config.SigningKeyEncryptionKey, record)
+		if err != nil {
+			return fmt.Errorf("invalid signing key %q: %w", record.ID, err)
+		}
+		cert, key, err := ParseSigningKeyPair([]byte(record.Certificate), keyPEM)
+		if err != nil {
+			return fmt.Errorf("invalid signing key %q: %w", record.ID, err)
+		}
+		keys = append(keys, &signingKeyPair{schedule: record, key: key, cert: cert})
+	}
+	s.keyring.setKeys(keys)
+	return nil
+}
+
+// RunKeyringRefresher periodically reloads the signing keyring so keys
+// managed with the keys subcommand are picked up, until ctx is cancelled.
+func (s *Server) RunKeyringRefresher(ctx context.Context) {
+	interval := s.config.KeyringRefreshInterval
+	if interval <= 0 {
+		interval = defaultKeyringRefreshInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	activeKeyID := s.activeSigningKeyID()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.loadKeyring(); err != nil {
+				s.logger.Errorw("Failed to refresh signing keyring", "error", err)
+				continue
+			}
+			if keyID := s.activeSigningKeyID(); keyID != activeKeyID {
+				s.logger.Infow("Switched SAML signing key", "previousKeyID", activeKeyID, "keyID", keyID)
+				activeKeyID = keyID
+			}
+		}
+	}
+}
+
+// activeSigningKeyID returns the ID of the active key of the keyring, or an
+// empty string while the configured key pair is used.
+func (s *Server) activeSigningKeyID() string {
+	if active := s.keyring.active(time.Now()); active.schedule != nil {
+		return active.schedule.ID
+	}
+	return ""
+}
+
+// identityProvider returns the IdP signing with the active key of the
+// keyring and the configured signature algorithm. crewjam signs with
+// SHA-1 unless a method is set, so one is always set. Responses are posted
+// with the post.html page template.
+func (s *Server) identityProvider() *saml.IdentityProvider {
+	idp := *s.samlIdp
+	if s.keyring != nil {
+		active := s.keyring.active(time.Now())
+		idp.Key = active.key
+		idp.Certificate = active.cert
+	}
+	if signer, ok := idp.Key.(crypto.Signer); ok {
+		idp.Signer = xmlSigner(signer)
+		idp.SignatureMethod = signatureMethodFor(signer.Public(), s.config.SignatureAlgorithm)
+	}
+	idp.ResponseFormTemplate = s.pageTemplates().Lookup(responseFormTemplate)
+	return &idp
+}
+
+// publishedSigningKeys returns the metadata KeyDescriptors of the next and
+// retired signing keys.
+func (s *Server) publishedSigningKeys() []saml.KeyDescriptor {
+	if s.keyring == nil {
+		return nil
+	}
+	var descriptors []saml.KeyDescriptor
+	for _, cert := range s.keyring.published(time.Now()) {
+		descriptors = append(descriptors, saml.KeyDescriptor{
+			Use: "signing",
+			KeyInfo: saml.KeyInfo{X509Data: saml.X509Data{X509Certificates: []saml.X509Certificate{
+				{Data: base64.StdEncoding.EncodeToString(cert.Raw)},
+			}}},
+		})
+	}
+	return descriptors
+}
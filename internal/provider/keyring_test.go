@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"crypto"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigningKeyStates(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	grace := 48 * time.Hour
+	at := func(offset time.Duration) time.Time { return now.Add(offset) }
+	retired := func(offset time.Duration) *time.Time { t := at(offset); return &t }
+
+	tests := []struct {
+		name string
+		keys []*SigningKey
+		want map[string]SigningKeyState
+	}{
+		{
+			name: "active and next",
+			keys: []*SigningKey{
+				{ID: "current", ActivateAt: at(-240 * time.Hour)},
+				{ID: "upcoming", ActivateAt: at(24 * time.Hour)},
+			},
+			want: map[string]SigningKeyState{"current": SigningKeyStateActive, "upcoming": SigningKeyStateNext},
+		},
+		{
+			name: "superseded within and past the grace period",
+			keys: []*SigningKey{
+				{ID: "old", ActivateAt: at(-480 * time.Hour)},
+				{ID: "previous", ActivateAt: at(-240 * time.Hour)},
+				{ID: "current", ActivateAt: at(-time.Hour)},
+			},
+			want: map[string]SigningKeyState{
+				"old":      SigningKeyStateExpired,
+				"previous": SigningKeyStateRetired,
+				"current":  SigningKeyStateActive,
+			},
+		},
+		{
+			name: "retired active key falls back to its predecessor",
+			keys: []*SigningKey{
+				{ID: "previous", ActivateAt: at(-240 * time.Hour)},
+				{ID: "compromised", ActivateAt: at(-2 * time.Hour), RetiredAt: retired(-time.Hour)},
+			},
+			want: map[string]SigningKeyState{"previous": SigningKeyStateActive, "compromised": SigningKeyStateRetired},
+		},
+		{
+			name: "retirement scheduled in the future",
+			keys: []*SigningKey{
+				{ID: "current", ActivateAt: at(-time.Hour), RetiredAt: retired(time.Hour)},
+			},
+			want: map[string]SigningKeyState{"current": SigningKeyStateActive},
+		},
+		{
+			name: "retired long ago",
+			keys: []*SigningKey{
+				{ID: "gone", ActivateAt: at(-480 * time.Hour), RetiredAt: retired(-240 * time.Hour)},
+			},
+			want: map[string]SigningKeyState{"gone": SigningKeyStateExpired},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SigningKeyStates(tt.keys, now, grace)
+			for id, want := range tt.want {
+				if got[id] != want {
+					t.Errorf("Key %s: expected %s, got %s", id, want, got[id])
+				}
+			}
+		})
+	}
+}
+
+func TestKeyring_SwitchesOverAtActivation(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	fallback := &signingKeyPair{key: server.samlIdp.Key.(crypto.Signer), cert: server.samlIdp.Certificate}
+	server.keyring = newKeyring(fallback, time.Hour)
+
+	nextKey, nextCertPEM := testEncryptionKeyPair(t)
+	nextCert, _ := parseCertificatePEM(nextCertPEM)
+	activateAt := time.Now().Add(time.Hour)
+	server.keyring.setKeys([]*signingKeyPair{{
+		schedule: &SigningKey{ID: "next", ActivateAt: activateAt},
+		key:      nextKey,
+		cert:     nextCert,
+	}})
+
+	if got := server.identityProvider().Certificate; !got.Equal(fallback.cert) {
+		t.Error("Expected the configured key pair to sign before the activation")
+	}
+	rec := httptest.NewRecorder()
+	server.handleMetadata(rec, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	for _, cert := range [][]byte{fallback.cert.Raw, nextCert.Raw} {
+		if !strings.Contains(rec.Body.String(), base64.StdEncoding.EncodeToString(cert)) {
+			t.Errorf("Expected metadata to publish the active and next certificates, got %s", rec.Body.String())
+		}
+	}
+
+	if got := server.keyring.active(activateAt.Add(time.Second)); got.cert != nextCert {
+		t.Error("Expected the next key to sign after its activation")
+	}
+	if published := server.keyring.published(activateAt.Add(time.Second)); len(published) != 0 {
+		t.Errorf("Expected no other published certificates, got %d", len(published))
+	}
+}
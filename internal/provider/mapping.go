@@ -1,6 +1,8 @@
 package provider
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 
 	"github.com/crewjam/saml"
@@ -22,6 +24,12 @@ type AttributeMapping struct {
 	// For example: {"sub": "subject", "email": "email", "name": "name", "groups": "groups"}
 	OIDCClaims map[string]string `json:"oidc_claims,omitempty"`
 
+	// Expressions maps internal field names to CEL expressions computing
+	// their value from the OIDC ID token claims, available as claims. They
+	// take precedence over OIDCClaims.
+	// For example: {"uid": "claims.email.split('@')[0]"}
+	Expressions map[string]string `json:"expressions,omitempty"`
+
 	// Options contains optional transform settings.
 	Options MappingOptions `json:"options,omitempty"`
 }
@@ -32,6 +40,19 @@ type MappingOptions struct {
 	LowercaseEmail bool `json:"lowercase_email,omitempty"`
 }
 
+// validate compiles the expressions of the mapping.
+func (m *AttributeMapping) validate() error {
+	for field, source := range m.Expressions {
+		if field == "" {
+			return errors.New("expressions names must not be empty")
+		}
+		if _, err := compileExpression(source); err != nil {
+			return fmt.Errorf("expression for %q: %v", field, err)
+		}
+	}
+	return nil
+}
+
 // nameIDFormatToURN converts a short NameID format name to its full SAML URN.
 func nameIDFormatToURN(format string) string {
 	switch strings.ToLower(format) {
@@ -56,9 +77,11 @@ func nameIDFormatToURN(format string) string {
 // If mapping is nil, the session is returned unmodified.
 // rawClaims contains all claims extracted from the OIDC ID token, allowing
 // the mapping to use claims beyond the standard session fields.
-func applyAttributeMapping(session *saml.Session, mapping *AttributeMapping, rawClaims map[string]interface{}) *saml.Session {
+// The fields of expressions that fail to evaluate are left unset; their
+// errors are returned along with the mapped session.
+func applyAttributeMapping(session *saml.Session, mapping *AttributeMapping, rawClaims map[string]interface{}) (*saml.Session, error) {
 	if mapping == nil {
-		return session
+		return session, nil
 	}
 
 	// Create a copy of the session to avoid modifying the stored version
@@ -79,6 +102,21 @@ func applyAttributeMapping(session *saml.Session, mapping *AttributeMapping, raw
 	// beyond the standard session fields (email, sub, name, groups).
 	internalModel := buildInternalModel(session, mapping.OIDCClaims, rawClaims)
 
+	// Compute the fields that have an expression
+	var errs []error
+	if len(mapping.Expressions) > 0 {
+		claims := expressionClaims(session, rawClaims)
+		for field, source := range mapping.Expressions {
+			value, err := evaluateExpression(source, claims)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("expression for %q: %w", field, err))
+				delete(internalModel, field)
+				continue
+			}
+			internalModel[field] = value
+		}
+	}
+
 	// Apply transforms
 	if mapping.Options.LowercaseEmail {
 		if v, ok := internalModel["email"]; ok {
@@ -148,7 +186,7 @@ func applyAttributeMapping(session *saml.Session, mapping *AttributeMapping, raw
 		mapped.CustomAttributes = append(mapped.CustomAttributes, customAttrs...)
 	}
 
-	return &mapped
+	return &mapped, errors.Join(errs...)
 }
 
 // buildInternalModel constructs a map of internal field names to values
@@ -218,18 +256,31 @@ func buildInternalModel(session *saml.Session, oidcClaims map[string]string, raw
 	return model
 }
 
-// getNameIDValue returns the NameID value based on the configured format
-// and the internal user model.
+// nameIDFormatShortName returns the short name of a NameID format given by
+// its short name or URN, or format itself when it has none.
+func nameIDFormatShortName(format string) string {
+	switch saml.NameIDFormat(format) {
+	case saml.PersistentNameIDFormat:
+		return "persistent"
+	case saml.TransientNameIDFormat:
+		return "transient"
+	case saml.EmailAddressNameIDFormat:
+		return "emailAddress"
+	case saml.UnspecifiedNameIDFormat:
+		return "unspecified"
+	default:
+		return format
+	}
+}
+
+// getNameIDValue returns the NameID value based on the configured format,
+// a short name or URN, and the internal user model. Persistent and transient
+// NameIDs are opaque identifiers issued per service provider by issueNameID,
+// so it returns an empty value for them, as it does for an emailAddress
+// NameID of a user without email.
 func getNameIDValue(model map[string]string, format string) string {
-	switch strings.ToLower(format) {
-	case "persistent":
-		if v, ok := model["subject"]; ok && v != "" {
-			return v
-		}
-		// Fall back to email for persistent if no subject
-		if v, ok := model["email"]; ok && v != "" {
-			return v
-		}
+	switch strings.ToLower(nameIDFormatShortName(format)) {
+	case "persistent", "transient":
 		return ""
 	case "emailaddress", "email":
 		if v, ok := model["email"]; ok && v != "" {
@@ -237,7 +288,7 @@ func getNameIDValue(model map[string]string, format string) string {
 		}
 		return ""
 	default:
-		// For transient/unspecified/unknown formats, use email then subject
+		// For unspecified/unknown formats, use email then subject
 		if v, ok := model["email"]; ok && v != "" {
 			return v
 		}
@@ -42,7 +42,7 @@ func TestApplyAttributeMapping_NilMapping(t *testing.T) {
 		Groups:         []string{"group1", "group2"},
 	}
 
-	result := applyAttributeMapping(session, nil, nil)
+	result, _ := applyAttributeMapping(session, nil, nil)
 
 	// Should return the same session unchanged
 	if result != session {
@@ -58,10 +58,10 @@ func TestApplyAttributeMapping_NameIDFormat(t *testing.T) {
 		expectedNameID string
 	}{
 		{
-			name:           "persistent format uses subject",
+			name:           "persistent format is left to issueNameID",
 			format:         "persistent",
 			expectedFormat: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent",
-			expectedNameID: "user-sub-id",
+			expectedNameID: "",
 		},
 		{
 			name:           "emailAddress format uses email",
@@ -70,10 +70,10 @@ func TestApplyAttributeMapping_NameIDFormat(t *testing.T) {
 			expectedNameID: "user@example.com",
 		},
 		{
-			name:           "transient format uses email as default",
+			name:           "transient format is left to issueNameID",
 			format:         "transient",
 			expectedFormat: "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
-			expectedNameID: "user@example.com",
+			expectedNameID: "",
 		},
 	}
 
@@ -92,7 +92,7 @@ func TestApplyAttributeMapping_NameIDFormat(t *testing.T) {
 				NameIDFormat: tc.format,
 			}
 
-			result := applyAttributeMapping(session, mapping, nil)
+			result, _ := applyAttributeMapping(session, mapping, nil)
 
 			if result.NameIDFormat != tc.expectedFormat {
 				t.Errorf("Expected NameIDFormat %q, got %q", tc.expectedFormat, result.NameIDFormat)
@@ -130,7 +130,7 @@ func TestApplyAttributeMapping_SAMLAttributes(t *testing.T) {
 		},
 	}
 
-	result := applyAttributeMapping(session, mapping, nil)
+	result, _ := applyAttributeMapping(session, mapping, nil)
 
 	// Built-in fields should be cleared
 	if result.UserEmail != "" {
@@ -211,7 +211,7 @@ func TestApplyAttributeMapping_LowercaseEmail(t *testing.T) {
 		},
 	}
 
-	result := applyAttributeMapping(session, mapping, nil)
+	result, _ := applyAttributeMapping(session, mapping, nil)
 
 	// NameID should be lowercased
 	if result.NameID != "user@example.com" {
@@ -248,7 +248,7 @@ func TestApplyAttributeMapping_DoesNotModifyOriginalSession(t *testing.T) {
 		},
 	}
 
-	_ = applyAttributeMapping(session, mapping, nil)
+	_, _ = applyAttributeMapping(session, mapping, nil)
 
 	// Original session should not be modified
 	if session.UserEmail != "user@example.com" {
@@ -276,14 +276,14 @@ func TestApplyAttributeMapping_OnlyNameIDFormat(t *testing.T) {
 		NameIDFormat: "persistent",
 	}
 
-	result := applyAttributeMapping(session, mapping, nil)
+	result, _ := applyAttributeMapping(session, mapping, nil)
 
 	// NameID format and value should be set
 	if result.NameIDFormat != "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent" {
 		t.Errorf("Expected persistent NameIDFormat, got %q", result.NameIDFormat)
 	}
-	if result.NameID != "user-sub-id" {
-		t.Errorf("Expected NameID to be sub (user-sub-id), got %q", result.NameID)
+	if result.NameID != "" {
+		t.Errorf("Expected the persistent NameID to be left to issueNameID, got %q", result.NameID)
 	}
 
 	// Built-in fields should NOT be cleared (no SAMLAttributes configured)
@@ -312,7 +312,7 @@ func TestApplyAttributeMapping_DefaultOIDCMapping(t *testing.T) {
 		},
 	}
 
-	result := applyAttributeMapping(session, mapping, nil)
+	result, _ := applyAttributeMapping(session, mapping, nil)
 
 	// Check that default OIDC mapping (sub→subject, email→email) was used
 	attrMap := make(map[string]string)
@@ -342,7 +342,7 @@ func TestApplyAttributeMapping_EmptySAMLAttributes(t *testing.T) {
 	// Empty mapping (all zero values) should still return a valid session
 	mapping := &AttributeMapping{}
 
-	result := applyAttributeMapping(session, mapping, nil)
+	result, _ := applyAttributeMapping(session, mapping, nil)
 
 	// Session should be essentially unchanged (no SAMLAttributes, no NameIDFormat)
 	if result.UserEmail != "user@example.com" {
@@ -412,11 +412,16 @@ func TestGetNameIDValue(t *testing.T) {
 		format   string
 		expected string
 	}{
-		{"persistent", "user-sub-id"},
+		{"persistent", ""},
 		{"emailAddress", "user@example.com"},
 		{"email", "user@example.com"},
-		{"transient", "user@example.com"}, // defaults to email
-		{"", "user@example.com"},          // defaults to email
+		{"transient", ""},
+		{"unspecified", "user@example.com"}, // defaults to email
+		{"", "user@example.com"},            // defaults to email
+		{string(saml.PersistentNameIDFormat), ""},
+		{string(saml.TransientNameIDFormat), ""},
+		{string(saml.EmailAddressNameIDFormat), "user@example.com"},
+		{string(saml.UnspecifiedNameIDFormat), "user@example.com"},
 	}
 
 	for _, tc := range testCases {
@@ -439,6 +444,10 @@ func TestGetNameIDValue_MissingFields(t *testing.T) {
 	if result != "" {
 		t.Errorf("Expected empty string for emailAddress with no email, got %q", result)
 	}
+	result = getNameIDValue(model, string(saml.EmailAddressNameIDFormat))
+	if result != "" {
+		t.Errorf("Expected empty string for the emailAddress URN with no email, got %q", result)
+	}
 
 	// Default should fall back to subject when email is missing
 	result = getNameIDValue(model, "")
@@ -447,6 +456,20 @@ func TestGetNameIDValue_MissingFields(t *testing.T) {
 	}
 }
 
+func TestApplyAttributeMapping_NegotiatedEmailAddressWithoutEmail(t *testing.T) {
+	// GetSession passes the format negotiated from the NameIDPolicy as a URN
+	session := &saml.Session{ID: "test-session", NameID: "", UserName: "user-sub-id"}
+	mapping := &AttributeMapping{NameIDFormat: string(saml.EmailAddressNameIDFormat)}
+
+	result, err := applyAttributeMapping(session, mapping, map[string]interface{}{"sub": "user-sub-id"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.NameIDFormat != string(saml.EmailAddressNameIDFormat) || result.NameID != "" {
+		t.Errorf("Expected an empty emailAddress NameID, got %q (%s)", result.NameID, result.NameIDFormat)
+	}
+}
+
 func TestBuildInternalModel_WithRawClaims(t *testing.T) {
 	session := &saml.Session{
 		UserName:       "user-sub-id",
@@ -548,7 +571,7 @@ func TestApplyAttributeMapping_WithRawClaims(t *testing.T) {
 		},
 	}
 
-	result := applyAttributeMapping(session, mapping, rawClaims)
+	result, _ := applyAttributeMapping(session, mapping, rawClaims)
 
 	// Check custom attributes include the preferred_username from raw claims
 	attrMap := make(map[string]string)
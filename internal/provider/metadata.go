@@ -0,0 +1,310 @@
+package provider
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	// maxMetadataSize bounds the size of SP metadata documents accepted by
+	// upload or fetched from a metadata URL.
+	maxMetadataSize = 1 << 20
+
+	// minMetadataRefreshInterval is the shortest refresh interval accepted for
+	// a service provider.
+	minMetadataRefreshInterval = time.Minute
+
+	defaultMetadataRefreshCheckInterval = time.Minute
+	metadataRefreshBatchSize            = 10
+)
+
+// parseServiceProviderMetadata parses an SP metadata document. The document may
+// be a single EntityDescriptor or an EntitiesDescriptor holding exactly one
+// entity with an SPSSODescriptor.
+func parseServiceProviderMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid metadata XML: %w", err)
+	}
+
+	var descriptor *saml.EntityDescriptor
+	switch root.XMLName.Local {
+	case "EntityDescriptor":
+		descriptor = &saml.EntityDescriptor{}
+		if err := xml.Unmarshal(data, descriptor); err != nil {
+			return nil, fmt.Errorf("invalid EntityDescriptor: %w", err)
+		}
+	case "EntitiesDescriptor":
+		var entities saml.EntitiesDescriptor
+		if err := xml.Unmarshal(data, &entities); err != nil {
+			return nil, fmt.Errorf("invalid EntitiesDescriptor: %w", err)
+		}
+		var found []*saml.EntityDescriptor
+		for i := range entities.EntityDescriptors {
+			if len(entities.EntityDescriptors[i].SPSSODescriptors) > 0 {
+				found = append(found, &entities.EntityDescriptors[i])
+			}
+		}
+		if len(found) != 1 {
+			return nil, fmt.Errorf("EntitiesDescriptor must contain exactly one service provider, found %d", len(found))
+		}
+		descriptor = found[0]
+	default:
+		return nil, fmt.Errorf("unexpected metadata root element %q", root.XMLName.Local)
+	}
+
+	if descriptor.EntityID == "" {
+		return nil, errors.New("metadata is missing an entityID")
+	}
+	if defaultACS(descriptor) == nil {
+		return nil, errors.New("metadata has no AssertionConsumerService with an HTTP-POST or HTTP-Redirect binding")
+	}
+	return descriptor, nil
+}
+
+// defaultACS returns the endpoint flagged isDefault, otherwise the one with the
+// lowest index, from the first SPSSODescriptor that declares any. Only the
+// HTTP-POST and HTTP-Redirect bindings are considered.
+func defaultACS(descriptor *saml.EntityDescriptor) *saml.IndexedEndpoint {
+	_, acs := selectACS(descriptor, saml.HTTPPostBinding, saml.HTTPRedirectBinding)
+	return acs
+}
+
+// selectACS is defaultACS restricted to the given bindings. It also returns
+// the SPSSODescriptor the endpoint belongs to.
+func selectACS(descriptor *saml.EntityDescriptor, bindings ...string) (*saml.SPSSODescriptor, *saml.IndexedEndpoint) {
+	for i := range descriptor.SPSSODescriptors {
+		spsso := &descriptor.SPSSODescriptors[i]
+		var selected *saml.IndexedEndpoint
+		for j := range spsso.AssertionConsumerServices {
+			acs := &spsso.AssertionConsumerServices[j]
+			if !slices.Contains(bindings, acs.Binding) {
+				continue
+			}
+			if acs.IsDefault != nil && *acs.IsDefault {
+				return spsso, acs
+			}
+			if selected == nil || acs.Index < selected.Index {
+				selected = acs
+			}
+		}
+		if selected != nil {
+			return spsso, selected
+		}
+	}
+	return nil, nil
+}
+
+// defaultSLO returns the first SingleLogoutService with the HTTP-Redirect or
+// HTTP-POST binding, preferring HTTP-Redirect, or nil if there is none.
+func defaultSLO(descriptor *saml.EntityDescriptor) *saml.Endpoint {
+	var post *saml.Endpoint
+	for _, spsso := range descriptor.SPSSODescriptors {
+		for i := range spsso.SingleLogoutServices {
+			slo := &spsso.SingleLogoutServices[i]
+			switch slo.Binding {
+			case saml.HTTPRedirectBinding:
+				return slo
+			case saml.HTTPPostBinding:
+				if post == nil {
+					post = slo
+				}
+			}
+		}
+	}
+	return post
+}
+
+// applyMetadataDescriptor copies the entity ID and the default ACS and SLO
+// endpoints of descriptor into sp.
+func applyMetadataDescriptor(sp *ServiceProvider, descriptor *saml.EntityDescriptor) {
+	acs := defaultACS(descriptor)
+	sp.EntityID = descriptor.EntityID
+	sp.ACSURL = acs.Location
+	sp.ACSBinding = acs.Binding
+	sp.SLOURL, sp.SLOBinding = "", ""
+	if slo := defaultSLO(descriptor); slo != nil {
+		sp.SLOURL = slo.Location
+		sp.SLOBinding = slo.Binding
+	}
+}
+
+// fetchServiceProviderMetadata downloads an SP metadata document.
+func fetchServiceProviderMetadata(ctx context.Context, client *http.Client, metadataURL string) ([]byte, error) {
+	u, err := url.Parse(metadataURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("invalid metadata_url: must be an http or https URL")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata request: %w", err)
+	}
+	req.Header.Set("Accept", "application/samlmetadata+xml, application/xml, text/xml")
+
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch metadata: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch metadata: server returned status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxMetadataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	if len(data) > maxMetadataSize {
+		return nil, fmt.Errorf("metadata exceeds the %d byte limit", maxMetadataSize)
+	}
+	return data, nil
+}
+
+// parseCertificatePEM parses a single PEM encoded X.509 certificate.
+func parseCertificatePEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("expected a PEM encoded CERTIFICATE block")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// verifyMetadataSignature checks that the root element of the metadata
+// document carries a valid enveloped XML signature made with the pinned
+// certificate, and returns the element the signature covers.
+func verifyMetadataSignature(data []byte, certPEM string) (*etree.Element, error) {
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata signing certificate: %w", err)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("invalid metadata XML: %w", err)
+	}
+	if doc.Root() == nil {
+		return nil, errors.New("invalid metadata XML: no root element")
+	}
+
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{cert},
+	})
+	signed, err := validationContext.Validate(doc.Root())
+	if err != nil {
+		return nil, fmt.Errorf("metadata signature verification failed: %w", err)
+	}
+	return signed, nil
+}
+
+// validateMetadataDocument checks a metadata document for sp: the signature
+// when a signing certificate is pinned, the structure, the validUntil date and,
+// if sp already has an entity ID, that the document describes the same entity.
+// It returns the descriptor and the document to store, which is only the
+// signed content when a signing certificate is pinned.
+func validateMetadataDocument(sp *ServiceProvider, data []byte) (*saml.EntityDescriptor, []byte, error) {
+	if sp.MetadataSigningCert != "" {
+		signed, err := verifyMetadataSignature(data, sp.MetadataSigningCert)
+		if err != nil {
+			return nil, nil, err
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(signed)
+		if data, err = doc.WriteToBytes(); err != nil {
+			return nil, nil, fmt.Errorf("failed to serialize signed metadata: %w", err)
+		}
+	}
+
+	descriptor, err := parseServiceProviderMetadata(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !descriptor.ValidUntil.IsZero() && descriptor.ValidUntil.Before(time.Now()) {
+		return nil, nil, fmt.Errorf("metadata expired at %s", descriptor.ValidUntil.Format(time.RFC3339))
+	}
+	if sp.EntityID != "" && sp.EntityID != descriptor.EntityID {
+		return nil, nil, fmt.Errorf("entity_id %q does not match the metadata entityID %q", sp.EntityID, descriptor.EntityID)
+	}
+	return descriptor, data, nil
+}
+
+// RunMetadataRefresher periodically re-fetches the metadata of service
+// providers registered with a metadata URL and refresh interval, until ctx is
+// cancelled. Replicas coordinate through ClaimServiceProvidersForMetadataRefresh.
+func (s *Server) RunMetadataRefresher(ctx context.Context) {
+	interval := s.config.MetadataRefreshCheckInterval
+	if interval <= 0 {
+		interval = defaultMetadataRefreshCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			serviceProviders, err := s.db.ClaimServiceProvidersForMetadataRefresh(metadataRefreshBatchSize)
+			if err != nil {
+				s.logger.Errorw("Failed to load service providers due for metadata refresh", "error", err)
+				continue
+			}
+			for _, sp := range serviceProviders {
+				s.refreshServiceProviderMetadata(ctx, sp)
+			}
+		}
+	}
+}
+
+// refreshServiceProviderMetadata fetches and validates the metadata of a single
+// service provider, storing it on success and recording the outcome.
+func (s *Server) refreshServiceProviderMetadata(ctx context.Context, sp *ServiceProvider) {
+	ctx, span := s.tracer.Start(ctx, "provider.refresh_service_provider_metadata")
+	defer span.End()
+
+	tags := map[string]string{"entity_id": sp.EntityID}
+
+	err := func() error {
+		data, err := fetchServiceProviderMetadata(ctx, nil, sp.MetadataURL)
+		if err != nil {
+			return err
+		}
+		descriptor, validated, err := validateMetadataDocument(sp, data)
+		if err != nil {
+			return err
+		}
+		sp.MetadataXML = string(validated)
+		applyMetadataDescriptor(sp, descriptor)
+		return s.db.SaveRefreshedMetadata(sp)
+	}()
+	if err != nil {
+		s.logger.Errorw("Failed to refresh service provider metadata", "entityID", sp.EntityID, "url", sp.MetadataURL, "error", err)
+		_ = s.db.RecordMetadataRefreshFailure(sp.EntityID, err)
+		_ = s.monitor.SetMetadataRefreshStatus(tags, 0)
+		return
+	}
+
+	s.logger.Infow("Refreshed service provider metadata", "entityID", sp.EntityID, "url", sp.MetadataURL)
+	_ = s.monitor.SetMetadataRefreshStatus(tags, 1)
+	_ = s.monitor.SetMetadataLastSuccess(tags, float64(time.Now().Unix()))
+}
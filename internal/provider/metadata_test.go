@@ -0,0 +1,431 @@
+package provider
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const testSPMetadata = `<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com/metadata">
+  <md:SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol" AuthnRequestsSigned="true">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+        <ds:X509Data><ds:X509Certificate>MIIBsigning</ds:X509Certificate></ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:KeyDescriptor use="encryption">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+        <ds:X509Data><ds:X509Certificate>MIIBencryption</ds:X509Certificate></ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://sp.example.com/slo"/>
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:2.0:nameid-format:persistent</md:NameIDFormat>
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact" Location="https://sp.example.com/acs/artifact" index="0"/>
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://sp.example.com/acs/redirect" index="1"/>
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp.example.com/acs/post" index="2" isDefault="true"/>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>`
+
+func TestParseServiceProviderMetadata(t *testing.T) {
+	descriptor, err := parseServiceProviderMetadata([]byte(testSPMetadata))
+	if err != nil {
+		t.Fatalf("parseServiceProviderMetadata failed: %v", err)
+	}
+
+	if descriptor.EntityID != "https://sp.example.com/metadata" {
+		t.Errorf("Unexpected entity ID %q", descriptor.EntityID)
+	}
+	spsso := descriptor.SPSSODescriptors[0]
+	if len(spsso.AssertionConsumerServices) != 3 {
+		t.Errorf("Expected 3 ACS endpoints, got %d", len(spsso.AssertionConsumerServices))
+	}
+	if len(spsso.KeyDescriptors) != 2 {
+		t.Errorf("Expected 2 key descriptors, got %d", len(spsso.KeyDescriptors))
+	}
+	if len(spsso.SingleLogoutServices) != 1 {
+		t.Errorf("Expected 1 SLO endpoint, got %d", len(spsso.SingleLogoutServices))
+	}
+	if len(spsso.NameIDFormats) != 1 {
+		t.Errorf("Expected 1 NameID format, got %d", len(spsso.NameIDFormats))
+	}
+
+	acs := defaultACS(descriptor)
+	if acs == nil || acs.Location != "https://sp.example.com/acs/post" {
+		t.Errorf("Expected the isDefault ACS to be selected, got %+v", acs)
+	}
+}
+
+func TestParseServiceProviderMetadata_EntitiesDescriptor(t *testing.T) {
+	entity := testSPMetadata[strings.Index(testSPMetadata, "<md:EntityDescriptor"):]
+	doc := `<md:EntitiesDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata">` + entity + `</md:EntitiesDescriptor>`
+
+	descriptor, err := parseServiceProviderMetadata([]byte(doc))
+	if err != nil {
+		t.Fatalf("parseServiceProviderMetadata failed: %v", err)
+	}
+	if descriptor.EntityID != "https://sp.example.com/metadata" {
+		t.Errorf("Unexpected entity ID %q", descriptor.EntityID)
+	}
+
+	doc = `<md:EntitiesDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata">` + entity + entity + `</md:EntitiesDescriptor>`
+	if _, err := parseServiceProviderMetadata([]byte(doc)); err == nil {
+		t.Error("Expected an error for multiple service providers")
+	}
+}
+
+func TestParseServiceProviderMetadata_Invalid(t *testing.T) {
+	testCases := map[string]string{
+		"not xml":      "not xml",
+		"wrong root":   `<md:IDPSSODescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata"/>`,
+		"no entity id": `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata"><md:SPSSODescriptor><md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp/acs" index="0"/></md:SPSSODescriptor></md:EntityDescriptor>`,
+		"no sp":        `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp"/>`,
+		"artifact only": `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp"><md:SPSSODescriptor>` +
+			`<md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact" Location="https://sp/acs" index="0"/>` +
+			`</md:SPSSODescriptor></md:EntityDescriptor>`,
+	}
+
+	for name, doc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseServiceProviderMetadata([]byte(doc)); err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestDefaultACS_LowestIndex(t *testing.T) {
+	descriptor := &saml.EntityDescriptor{
+		SPSSODescriptors: []saml.SPSSODescriptor{{
+			AssertionConsumerServices: []saml.IndexedEndpoint{
+				{Binding: saml.HTTPPostBinding, Location: "https://sp/acs/5", Index: 5},
+				{Binding: saml.HTTPPostBinding, Location: "https://sp/acs/2", Index: 2},
+			},
+		}},
+	}
+
+	if acs := defaultACS(descriptor); acs == nil || acs.Index != 2 {
+		t.Errorf("Expected the lowest index ACS, got %+v", acs)
+	}
+}
+
+func TestFetchServiceProviderMetadata(t *testing.T) {
+	metadataServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata":
+			w.Header().Set("Content-Type", "application/samlmetadata+xml")
+			_, _ = w.Write([]byte(testSPMetadata))
+		case "/large":
+			_, _ = w.Write([]byte(strings.Repeat("a", maxMetadataSize+1)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(metadataServer.Close)
+
+	data, err := fetchServiceProviderMetadata(context.Background(), metadataServer.Client(), metadataServer.URL+"/metadata")
+	if err != nil {
+		t.Fatalf("fetchServiceProviderMetadata failed: %v", err)
+	}
+	if string(data) != testSPMetadata {
+		t.Error("Expected the metadata document to be returned verbatim")
+	}
+
+	for _, path := range []string{"/missing", "/large"} {
+		if _, err := fetchServiceProviderMetadata(context.Background(), metadataServer.Client(), metadataServer.URL+path); err == nil {
+			t.Errorf("Expected an error fetching %s", path)
+		}
+	}
+
+	if _, err := fetchServiceProviderMetadata(context.Background(), nil, "file:///etc/passwd"); err == nil {
+		t.Error("Expected an error for a non-HTTP metadata URL")
+	}
+}
+
+func TestResolveServiceProviderMetadata(t *testing.T) {
+	server := setupTestServer(t)
+
+	sp := &ServiceProvider{MetadataXML: testSPMetadata}
+	if err := server.resolveServiceProviderMetadata(context.Background(), sp); err != nil {
+		t.Fatalf("resolveServiceProviderMetadata failed: %v", err)
+	}
+	if sp.EntityID != "https://sp.example.com/metadata" || sp.ACSURL != "https://sp.example.com/acs/post" || sp.ACSBinding != saml.HTTPPostBinding {
+		t.Errorf("Expected fields derived from metadata, got %+v", sp)
+	}
+	if sp.MetadataXML != testSPMetadata {
+		t.Error("Expected the metadata document to be kept verbatim")
+	}
+
+	mismatched := &ServiceProvider{EntityID: "https://other.example.com", MetadataXML: testSPMetadata}
+	if err := server.resolveServiceProviderMetadata(context.Background(), mismatched); err == nil {
+		t.Error("Expected an error for a mismatched entity ID")
+	}
+
+	plain := &ServiceProvider{EntityID: "https://plain.example.com", ACSURL: "https://plain.example.com/acs"}
+	if err := server.resolveServiceProviderMetadata(context.Background(), plain); err != nil {
+		t.Fatalf("Unexpected error without metadata: %v", err)
+	}
+	if plain.ACSURL != "https://plain.example.com/acs" {
+		t.Errorf("Expected ACS URL to be unchanged, got %q", plain.ACSURL)
+	}
+}
+
+func TestServiceProvider_EntityDescriptor_UsesMetadata(t *testing.T) {
+	sp := &ServiceProvider{
+		EntityID:    "https://sp.example.com/metadata",
+		ACSURL:      "https://sp.example.com/acs/post",
+		ACSBinding:  saml.HTTPPostBinding,
+		MetadataXML: testSPMetadata,
+	}
+
+	descriptor, err := sp.EntityDescriptor()
+	if err != nil {
+		t.Fatalf("EntityDescriptor failed: %v", err)
+	}
+	if len(descriptor.SPSSODescriptors[0].AssertionConsumerServices) != 3 {
+		t.Errorf("Expected the imported descriptor, got %+v", descriptor.SPSSODescriptors[0].AssertionConsumerServices)
+	}
+
+	sp.MetadataXML = ""
+	descriptor, err = sp.EntityDescriptor()
+	if err != nil {
+		t.Fatalf("EntityDescriptor failed: %v", err)
+	}
+	if len(descriptor.SPSSODescriptors[0].AssertionConsumerServices) != 1 {
+		t.Errorf("Expected a single synthetic ACS, got %+v", descriptor.SPSSODescriptors[0].AssertionConsumerServices)
+	}
+}
+
+func TestIsMetadataContentType(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"application/samlmetadata+xml":   true,
+		"application/xml; charset=utf-8": true,
+		"text/xml":                       true,
+		"application/json":               false,
+		"":                               false,
+	} {
+		if got := isMetadataContentType(contentType); got != want {
+			t.Errorf("isMetadataContentType(%q) = %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+// signTestMetadata returns testSPMetadata with an enveloped signature and the
+// PEM certificate that verifies it.
+func signTestMetadata(t *testing.T) (string, string) {
+	t.Helper()
+
+	keyStore := dsig.RandomKeyStoreForTest()
+	_, certDER, err := keyStore.GetKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to get test key pair: %v", err)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromString(testSPMetadata); err != nil {
+		t.Fatalf("Failed to parse metadata: %v", err)
+	}
+	doc.Root().CreateAttr("ID", "_metadata")
+
+	signed, err := dsig.NewDefaultSigningContext(keyStore).SignEnveloped(doc.Root())
+	if err != nil {
+		t.Fatalf("Failed to sign metadata: %v", err)
+	}
+	doc.SetRoot(signed)
+
+	data, err := doc.WriteToString()
+	if err != nil {
+		t.Fatalf("Failed to serialize metadata: %v", err)
+	}
+	return data, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+}
+
+func TestVerifyMetadataSignature(t *testing.T) {
+	signed, certPEM := signTestMetadata(t)
+
+	if _, err := verifyMetadataSignature([]byte(signed), certPEM); err != nil {
+		t.Fatalf("Expected a valid signature, got %v", err)
+	}
+
+	if _, err := verifyMetadataSignature([]byte(testSPMetadata), certPEM); err == nil {
+		t.Error("Expected unsigned metadata to be rejected")
+	}
+
+	tampered := strings.Replace(signed, "https://sp.example.com/acs/post", "https://attacker.example.com/acs", 1)
+	if _, err := verifyMetadataSignature([]byte(tampered), certPEM); err == nil {
+		t.Error("Expected tampered metadata to be rejected")
+	}
+
+	_, otherCert := signTestMetadata(t)
+	if _, err := verifyMetadataSignature([]byte(signed), otherCert); err == nil {
+		t.Error("Expected a signature from a different key to be rejected")
+	}
+}
+
+func TestValidateMetadataDocument(t *testing.T) {
+	signed, certPEM := signTestMetadata(t)
+
+	descriptor, validated, err := validateMetadataDocument(&ServiceProvider{MetadataSigningCert: certPEM}, []byte(signed))
+	if err != nil {
+		t.Fatalf("Expected signed metadata to validate, got %v", err)
+	}
+	// Only the signed content is kept
+	if strings.Contains(string(validated), "Signature") {
+		t.Errorf("Expected the stored document to be the signed content, got %s", validated)
+	}
+	if stored, err := parseServiceProviderMetadata(validated); err != nil || stored.EntityID != descriptor.EntityID ||
+		defaultACS(stored).Location != defaultACS(descriptor).Location {
+		t.Errorf("Expected the stored document to describe the validated entity, got %+v (error %v)", stored, err)
+	}
+	if _, _, err := validateMetadataDocument(&ServiceProvider{MetadataSigningCert: certPEM}, []byte(testSPMetadata)); err == nil {
+		t.Error("Expected unsigned metadata to fail when a signing certificate is pinned")
+	}
+
+	expired := strings.Replace(testSPMetadata, `entityID="https://sp.example.com/metadata"`,
+		`entityID="https://sp.example.com/metadata" validUntil="2000-01-01T00:00:00Z"`, 1)
+	if _, _, err := validateMetadataDocument(&ServiceProvider{}, []byte(expired)); err == nil {
+		t.Error("Expected expired metadata to be rejected")
+	}
+}
+
+func TestValidateServiceProvider_MetadataRefresh(t *testing.T) {
+	base := func() *ServiceProvider {
+		return &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs"}
+	}
+
+	sp := base()
+	sp.MetadataURL = "https://sp.example.com/metadata"
+	sp.MetadataRefreshIntervalSeconds = 3600
+	if err := validateServiceProvider(sp); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	sp = base()
+	sp.MetadataRefreshIntervalSeconds = 3600
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for a refresh interval without a metadata URL")
+	}
+
+	sp = base()
+	sp.MetadataURL = "https://sp.example.com/metadata"
+	sp.MetadataRefreshIntervalSeconds = 5
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for a refresh interval below the minimum")
+	}
+
+	sp = base()
+	sp.MetadataSigningCert = "not a certificate"
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for an invalid signing certificate")
+	}
+}
+
+func TestRunMetadataRefresher_StopsOnCancel(t *testing.T) {
+	server := setupTestServer(t)
+	server.config.MetadataRefreshCheckInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.RunMetadataRefresher(ctx)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunMetadataRefresher did not stop after context cancellation")
+	}
+}
+
+func TestRefreshServiceProviderMetadata(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	monitor := &testMockMonitor{}
+	server.monitor = monitor
+
+	var fail atomic.Bool
+	updated := strings.Replace(testSPMetadata, "https://sp.example.com/acs/post", "https://sp.example.com/acs/rotated", 1)
+	metadataServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(updated))
+	}))
+	t.Cleanup(metadataServer.Close)
+
+	sp := &ServiceProvider{
+		EntityID:                       "https://sp.example.com/metadata",
+		ACSURL:                         "https://sp.example.com/acs/post",
+		ACSBinding:                     saml.HTTPPostBinding,
+		MetadataXML:                    testSPMetadata,
+		MetadataURL:                    metadataServer.URL,
+		MetadataRefreshIntervalSeconds: 3600,
+	}
+	if err := server.db.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteServiceProvider(sp.EntityID) })
+
+	claimed, err := server.db.ClaimServiceProvidersForMetadataRefresh(10)
+	if err != nil {
+		t.Fatalf("ClaimServiceProvidersForMetadataRefresh failed: %v", err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("Expected 1 service provider due for refresh, got %d", len(claimed))
+	}
+	if again, _ := server.db.ClaimServiceProvidersForMetadataRefresh(10); len(again) != 0 {
+		t.Errorf("Expected claimed service providers not to be due again, got %d", len(again))
+	}
+
+	server.refreshServiceProviderMetadata(context.Background(), claimed[0])
+
+	record, err := server.db.GetServiceProviderRecord(sp.EntityID)
+	if err != nil {
+		t.Fatalf("GetServiceProviderRecord failed: %v", err)
+	}
+	if record.ACSURL != "https://sp.example.com/acs/rotated" || record.MetadataXML != updated {
+		t.Errorf("Expected refreshed metadata to be stored, got ACS %q", record.ACSURL)
+	}
+	if record.MetadataLastSuccessAt == nil || record.MetadataRefreshError != "" {
+		t.Errorf("Expected a successful refresh to be recorded, got %+v", record)
+	}
+
+	fail.Store(true)
+	server.refreshServiceProviderMetadata(context.Background(), claimed[0])
+
+	record, err = server.db.GetServiceProviderRecord(sp.EntityID)
+	if err != nil {
+		t.Fatalf("GetServiceProviderRecord failed: %v", err)
+	}
+	if record.MetadataRefreshError == "" || record.MetadataXML != updated {
+		t.Errorf("Expected the failure to be recorded and the document kept, got error %q", record.MetadataRefreshError)
+	}
+
+	var statuses []float64
+	for _, call := range monitor.metadataCalls {
+		if call.Metric == "status" && call.Tags["entity_id"] == sp.EntityID {
+			statuses = append(statuses, call.Value)
+		}
+	}
+	if len(statuses) != 2 || statuses[0] != 1 || statuses[1] != 0 {
+		t.Errorf("Expected refresh status metrics [1 0], got %v", statuses)
+	}
+}
@@ -0,0 +1,182 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/crewjam/saml"
+)
+
+// supportedNameIDFormats are the NameID formats the IdP issues, in the order
+// they are advertised in its metadata.
+var supportedNameIDFormats = []string{
+	string(saml.PersistentNameIDFormat),
+	string(saml.TransientNameIDFormat),
+	string(saml.EmailAddressNameIDFormat),
+	string(saml.UnspecifiedNameIDFormat),
+}
+
+// errInvalidNameIDPolicy is returned when the NameIDPolicy of a request
+// cannot be satisfied; the service provider receives an InvalidNameIDPolicy
+// Response.
+var errInvalidNameIDPolicy = errors.New("the NameID policy cannot be satisfied")
+
+// parseNameIDFormat returns the URN of a NameID format the IdP supports,
+// given by its URN or short name.
+func parseNameIDFormat(format string) (string, error) {
+	urn := nameIDFormatToURN(format)
+	// Unknown short names map to transient
+	if urn != format && urn == string(saml.TransientNameIDFormat) && !strings.EqualFold(format, "transient") {
+		return "", fmt.Errorf("unknown NameID format %q", format)
+	}
+	if !slices.Contains(supportedNameIDFormats, urn) {
+		return "", fmt.Errorf("unsupported NameID format %q", format)
+	}
+	return urn, nil
+}
+
+// negotiateNameIDFormat returns the NameID format of an assertion for a
+// service provider that requested the format requested, may be issued the
+// registered formats and has configured the default format configured in its
+// attribute mapping. A requested format must be both registered, if any are,
+// and supported; otherwise errInvalidNameIDPolicy is returned. When nothing is
+// requested, the configured format or the first registered one is used. It
+// returns an empty format when there is neither.
+func negotiateNameIDFormat(requested string, registered []string, configured string) (string, error) {
+	if requested == "" || requested == string(saml.UnspecifiedNameIDFormat) {
+		if configured != "" {
+			return nameIDFormatToURN(configured), nil
+		}
+		if len(registered) > 0 {
+			return registered[0], nil
+		}
+		return "", nil
+	}
+	if !slices.Contains(supportedNameIDFormats, requested) ||
+		(len(registered) > 0 && !slices.Contains(registered, requested)) {
+		return "", errInvalidNameIDPolicy
+	}
+	return requested, nil
+}
+
+// nameIDFormat negotiates the NameID format of the assertion for req with the
+// registration of the service provider it is for.
+func (s *Server) nameIDFormat(req *saml.IdpAuthnRequest) (string, error) {
+	var requested, configured string
+	var registered []string
+	if policy := req.Request.NameIDPolicy; policy != nil && policy.Format != nil {
+		requested = *policy.Format
+	}
+	if req.Request.Issuer != nil && req.Request.Issuer.Value != "" {
+		sp, err := s.db.GetServiceProviderRecord(req.Request.Issuer.Value)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		if sp != nil {
+			registered = sp.NameIDFormats
+			if sp.AttributeMapping != nil {
+				configured = sp.AttributeMapping.NameIDFormat
+			}
+		}
+	}
+	return negotiateNameIDFormat(requested, registered, configured)
+}
+
+// persistentIDAttempts bounds how often a persistent ID is generated for one
+// assertion, in case it collides with a revoked one or another replica
+// creates one at the same time.
+const persistentIDAttempts = 3
+
+// newOpaqueID returns a random identifier that reveals nothing about the
+// subject.
+func newOpaqueID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// derivePersistentID returns the identifier of subject at entityID keyed by
+// salt.
+func derivePersistentID(salt, entityID, subject string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(entityID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(subject))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// persistentID returns the active persistent NameID of subject at entityID,
+// creating it on first use unless allowCreate is false. The first identifier
+// is derived from the configured salt if there is one; identifiers issued
+// after a revocation are always random.
+func (s *Server) persistentID(entityID, subject string, allowCreate bool) (string, error) {
+	for attempt := 0; attempt < persistentIDAttempts; attempt++ {
+		existing, err := s.db.GetPersistentID(entityID, subject)
+		if err == nil {
+			return existing.ID, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		if !allowCreate {
+			return "", errInvalidNameIDPolicy
+		}
+
+		var id string
+		if attempt == 0 && s.config.PersistentIDSalt != "" {
+			id = derivePersistentID(s.config.PersistentIDSalt, entityID, subject)
+		} else if id, err = newOpaqueID(); err != nil {
+			return "", err
+		}
+		if err := s.db.CreatePersistentID(&PersistentID{ID: id, EntityID: entityID, Subject: subject}); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no persistent ID could be created for %s", entityID)
+}
+
+// issueNameID returns a copy of session with the NameID issued to the service
+// provider req is for, when its format is persistent or transient. subject is
+// the OIDC subject of the session. Other formats keep the NameID of session.
+// A persistent NameID is only created when the NameIDPolicy of req does not
+// set AllowCreate to false. It writes a SAML error Response and returns nil
+// when no NameID can be issued.
+func (s *Server) issueNameID(w http.ResponseWriter, req *saml.IdpAuthnRequest, session *saml.Session, subject string) *saml.Session {
+	issued := *session
+	var err error
+	switch saml.NameIDFormat(session.NameIDFormat) {
+	case saml.PersistentNameIDFormat:
+		if req.Request.Issuer == nil || req.Request.Issuer.Value == "" || subject == "" {
+			err = errors.New("persistent NameIDs need a service provider and an OIDC subject")
+			break
+		}
+		policy := req.Request.NameIDPolicy
+		allowCreate := policy == nil || policy.AllowCreate == nil || *policy.AllowCreate
+		issued.NameID, err = s.persistentID(req.Request.Issuer.Value, subject, allowCreate)
+	case saml.TransientNameIDFormat:
+		issued.NameID, err = newOpaqueID()
+	default:
+		return session
+	}
+	if errors.Is(err, errInvalidNameIDPolicy) {
+		s.logger.Warnw("No persistent NameID exists and the request does not allow creating one", "requestID", req.Request.ID)
+		s.respondSAMLError(w, req, saml.StatusInvalidNameIDPolicy)
+		return nil
+	}
+	if err != nil {
+		s.logger.Errorw("Failed to issue NameID", "requestID", req.Request.ID, "format", session.NameIDFormat, "error", err)
+		s.respondSAMLError(w, req, "")
+		return nil
+	}
+	return &issued
+}
@@ -0,0 +1,294 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/crewjam/saml"
+)
+
+func TestNegotiateNameIDFormat(t *testing.T) {
+	persistent := string(saml.PersistentNameIDFormat)
+	transient := string(saml.TransientNameIDFormat)
+	email := string(saml.EmailAddressNameIDFormat)
+
+	tests := []struct {
+		name       string
+		requested  string
+		registered []string
+		configured string
+		want       string
+		wantErr    bool
+	}{
+		{name: "nothing requested or configured", want: ""},
+		{name: "configured default", configured: "emailAddress", want: email},
+		{name: "first registered format", registered: []string{transient, email}, want: transient},
+		{name: "unspecified uses the default", requested: string(saml.UnspecifiedNameIDFormat), configured: "persistent", want: persistent},
+		{name: "request overrides the default", requested: transient, configured: "emailAddress", want: transient},
+		{name: "request within the registered formats", requested: email, registered: []string{persistent, email}, want: email},
+		{name: "request outside the registered formats", requested: transient, registered: []string{persistent}, wantErr: true},
+		{name: "unsupported request", requested: "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateNameIDFormat(tt.requested, tt.registered, tt.configured)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidNameIDPolicy) {
+					t.Errorf("Expected errInvalidNameIDPolicy, got %q, %v", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Expected %q, got %q, %v", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestValidateServiceProvider_NameIDFormats(t *testing.T) {
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs",
+		NameIDFormats: []string{"persistent", string(saml.EmailAddressNameIDFormat)}}
+	if err := validateServiceProvider(sp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sp.NameIDFormats[0] != string(saml.PersistentNameIDFormat) {
+		t.Errorf("Expected short names to be stored as URNs, got %v", sp.NameIDFormats)
+	}
+
+	for _, formats := range [][]string{{"pairwise"}, {"urn:oasis:names:tc:SAML:2.0:nameid-format:kerberos"}} {
+		sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs", NameIDFormats: formats}
+		if err := validateServiceProvider(sp); err == nil {
+			t.Errorf("Expected an error for %v", formats)
+		}
+	}
+
+	sp = &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs",
+		NameIDFormats: []string{"persistent"}, AttributeMapping: &AttributeMapping{NameIDFormat: "transient"}}
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for a default NameID format that is not registered")
+	}
+}
+
+func TestHandleMetadata_NameIDFormats(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	rec := httptest.NewRecorder()
+	server.handleMetadata(rec, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	for _, format := range supportedNameIDFormats {
+		if !strings.Contains(rec.Body.String(), ">"+format+"</NameIDFormat>") {
+			t.Errorf("Expected %s in the metadata, got %s", format, rec.Body.String())
+		}
+	}
+}
+
+func TestDerivePersistentID(t *testing.T) {
+	id := derivePersistentID("salt", "https://sp1.example.com", "user-1")
+	if id != derivePersistentID("salt", "https://sp1.example.com", "user-1") {
+		t.Error("Expected the same identifier for the same subject and service provider")
+	}
+	for _, other := range []string{
+		derivePersistentID("salt", "https://sp2.example.com", "user-1"),
+		derivePersistentID("salt", "https://sp1.example.com", "user-2"),
+		derivePersistentID("other-salt", "https://sp1.example.com", "user-1"),
+	} {
+		if other == id {
+			t.Errorf("Expected identifiers to differ, got %s twice", id)
+		}
+	}
+}
+
+func TestIssueNameID_Transient(t *testing.T) {
+	server := setupTestServer(t)
+	req := &saml.IdpAuthnRequest{Request: saml.AuthnRequest{ID: "id-transient", Issuer: &saml.Issuer{Value: "https://sp.example.com"}}}
+	session := &saml.Session{NameID: "user@example.com", NameIDFormat: string(saml.TransientNameIDFormat), UserName: "user-sub-id"}
+
+	first := server.issueNameID(httptest.NewRecorder(), req, session, "user-sub-id")
+	second := server.issueNameID(httptest.NewRecorder(), req, session, "user-sub-id")
+	if first == nil || second == nil {
+		t.Fatal("Expected transient NameIDs to be issued")
+	}
+	if first.NameID == "user@example.com" || first.NameID == "" || first.NameID == second.NameID {
+		t.Errorf("Expected a new random NameID per assertion, got %q and %q", first.NameID, second.NameID)
+	}
+	if session.NameID != "user@example.com" {
+		t.Errorf("Expected the original session to be unchanged, got %q", session.NameID)
+	}
+
+	session.NameIDFormat = string(saml.EmailAddressNameIDFormat)
+	if issued := server.issueNameID(httptest.NewRecorder(), req, session, "user-sub-id"); issued != session {
+		t.Errorf("Expected the email NameID to be kept, got %+v", issued)
+	}
+}
+
+func TestIssueNameID_Persistent(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	setupTestIdP(t, server)
+
+	entityID := "https://pairwise-sp.example.com"
+	subject := "persistent-test-" + newSAMLID()
+	session := &saml.Session{NameID: "user@example.com", NameIDFormat: string(saml.PersistentNameIDFormat)}
+	issue := func(entityID string) string {
+		t.Helper()
+		req := &saml.IdpAuthnRequest{IDP: server.identityProvider(), HTTPRequest: httptest.NewRequest(http.MethodGet, "/saml/sso", nil),
+			Request: *testAuthnRequest(server, entityID)}
+		issued := server.issueNameID(httptest.NewRecorder(), req, session, subject)
+		if issued == nil {
+			t.Fatalf("Expected a persistent NameID for %s", entityID)
+		}
+		return issued.NameID
+	}
+
+	first := issue(entityID)
+	if first == subject || first == "user@example.com" {
+		t.Errorf("Expected an opaque NameID, got %q", first)
+	}
+	if again := issue(entityID); again != first {
+		t.Errorf("Expected the NameID to be stable across logins, got %q then %q", first, again)
+	}
+	if other := issue("https://other-sp.example.com"); other == first {
+		t.Errorf("Expected a different NameID for another service provider, got %q", other)
+	}
+
+	if err := server.db.RevokePersistentID(first); err != nil {
+		t.Fatalf("RevokePersistentID failed: %v", err)
+	}
+	if renewed := issue(entityID); renewed == first {
+		t.Errorf("Expected a new NameID after revocation, got %q again", renewed)
+	}
+}
+
+func TestSessionProviderAdapter_GetSession_NameIDPolicy(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	setupTestIdP(t, server)
+
+	sp := &ServiceProvider{EntityID: "https://nameid-sp.example.com", ACSURL: "https://nameid-sp.example.com/acs",
+		ACSBinding: saml.HTTPPostBinding, NameIDFormats: []string{string(saml.PersistentNameIDFormat)}}
+	if err := server.db.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteServiceProvider(sp.EntityID) })
+
+	sessionToken := "nameid-policy-session"
+	session := &saml.Session{
+		ID:         sessionIDFromToken(sessionToken),
+		CreateTime: time.Now(),
+		ExpireTime: time.Now().Add(10 * time.Minute),
+		Index:      newSAMLID(),
+		NameID:     "user@example.com",
+		UserEmail:  "user@example.com",
+		UserName:   "nameid-policy-" + newSAMLID(),
+	}
+	if err := server.db.SaveSession(session, nil); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteSession(session.ID) })
+
+	descriptor, _ := sp.EntityDescriptor()
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	getSession := func(format string, allowCreate bool) (*saml.Session, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodGet, "/saml/sso", nil)
+		r.AddCookie(&http.Cookie{Name: "saml_session", Value: sessionToken})
+		authnRequest := testAuthnRequest(server, sp.EntityID)
+		authnRequest.NameIDPolicy = &saml.NameIDPolicy{Format: &format, AllowCreate: &allowCreate}
+		req := &saml.IdpAuthnRequest{IDP: server.identityProvider(), HTTPRequest: r, Request: *authnRequest,
+			Now: saml.TimeNow(), ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs}
+		rec := httptest.NewRecorder()
+		return (&sessionProviderAdapter{server: server}).GetSession(rec, r, req), rec
+	}
+	expectInvalidNameIDPolicy := func(rec *httptest.ResponseRecorder) {
+		t.Helper()
+		response, _ := postedSAMLResponse(t, rec.Body.String())
+		if status := response.Status.StatusCode; status.StatusCode == nil || status.StatusCode.Value != saml.StatusInvalidNameIDPolicy {
+			t.Errorf("Expected an InvalidNameIDPolicy status, got %+v", status)
+		}
+	}
+
+	issued, rec := getSession(string(saml.TransientNameIDFormat), true)
+	if issued != nil {
+		t.Fatal("Expected a format the SP is not registered for to be refused")
+	}
+	expectInvalidNameIDPolicy(rec)
+
+	issued, rec = getSession(string(saml.PersistentNameIDFormat), false)
+	if issued != nil {
+		t.Fatal("Expected no persistent NameID to be created without AllowCreate")
+	}
+	expectInvalidNameIDPolicy(rec)
+
+	issued, _ = getSession(string(saml.PersistentNameIDFormat), true)
+	if issued == nil || issued.NameIDFormat != string(saml.PersistentNameIDFormat) || issued.NameID == session.NameID {
+		t.Fatalf("Expected a persistent NameID, got %+v", issued)
+	}
+	if again, _ := getSession(string(saml.PersistentNameIDFormat), false); again == nil || again.NameID != issued.NameID {
+		t.Errorf("Expected the existing persistent NameID without AllowCreate, got %+v", again)
+	}
+}
+
+func TestSessionProviderAdapter_GetSession_EmailAddressWithoutEmail(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	setupTestIdP(t, server)
+
+	sp := &ServiceProvider{EntityID: "https://nameid-email-sp.example.com", ACSURL: "https://nameid-email-sp.example.com/acs",
+		ACSBinding: saml.HTTPPostBinding}
+	if err := server.db.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteServiceProvider(sp.EntityID) })
+
+	// A user without an email claim
+	sessionToken := "nameid-email-session"
+	session := &saml.Session{
+		ID:         sessionIDFromToken(sessionToken),
+		CreateTime: time.Now(),
+		ExpireTime: time.Now().Add(10 * time.Minute),
+		Index:      newSAMLID(),
+		UserName:   "nameid-email-" + newSAMLID(),
+	}
+	if err := server.db.SaveSession(session, map[string]interface{}{"sub": session.UserName}); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteSession(session.ID) })
+
+	descriptor, _ := sp.EntityDescriptor()
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	r := httptest.NewRequest(http.MethodGet, "/saml/sso", nil)
+	r.AddCookie(&http.Cookie{Name: "saml_session", Value: sessionToken})
+	authnRequest := testAuthnRequest(server, sp.EntityID)
+	format := string(saml.EmailAddressNameIDFormat)
+	authnRequest.NameIDPolicy = &saml.NameIDPolicy{Format: &format}
+	req := &saml.IdpAuthnRequest{IDP: server.identityProvider(), HTTPRequest: r, Request: *authnRequest,
+		Now: saml.TimeNow(), ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs}
+
+	issued := (&sessionProviderAdapter{server: server}).GetSession(httptest.NewRecorder(), r, req)
+	if issued == nil {
+		t.Fatal("Expected a session")
+	}
+	if issued.NameIDFormat != format || issued.NameID == session.UserName {
+		t.Errorf("Expected no OIDC subject as an emailAddress NameID, got %q (%s)", issued.NameID, issued.NameIDFormat)
+	}
+}
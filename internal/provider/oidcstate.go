@@ -0,0 +1,153 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// oidcStateCookie binds the OAuth2 state to the browser that started the
+// login. Its value is shared by the logins a browser runs in parallel.
+const oidcStateCookie = "saml_oidc_state"
+
+const oidcStateErrorMessage = "The sign-in could not be completed because it expired or was started in another browser. " +
+	"Return to the application and sign in again."
+
+// oidcState is the payload of the OAuth2 state parameter. The state is the
+// base64url payload and its HMAC-SHA256, separated by a dot.
+type oidcState struct {
+	RequestID  string `json:"rid,omitempty"`
+	RelayState string `json:"rs,omitempty"`
+	// Binding is the SHA-256 of the oidcStateCookie value, so the state does
+	// not reveal the cookie.
+	Binding   string `json:"bnd"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// oidcStateError is a rejected OAuth2 state. Reason is the metric label.
+type oidcStateError struct {
+	Reason  string
+	Message string
+}
+
+func (e *oidcStateError) Error() string {
+	return e.Message
+}
+
+// oidcStateKey returns the HMAC key of the OAuth2 state. Without a configured
+// secret it is derived from the OIDC client secret, which every replica
+// shares.
+func (s *Server) oidcStateKey() []byte {
+	if s.config.OIDCStateSecret != "" {
+		return []byte(s.config.OIDCStateSecret)
+	}
+	mac := hmac.New(sha256.New, []byte(s.config.ClientSecret))
+	mac.Write([]byte("identity-saml-provider oidc state"))
+	return mac.Sum(nil)
+}
+
+func (s *Server) signOIDCState(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.oidcStateKey())
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// newOIDCState returns the OAuth2 state for a login resuming requestID, and
+// sets the browser binding cookie if r does not carry one yet.
+func (s *Server) newOIDCState(w http.ResponseWriter, r *http.Request, requestID, relayState string) (string, error) {
+	binding := ""
+	if cookie, err := r.Cookie(oidcStateCookie); err == nil && len(cookie.Value) >= 43 {
+		binding = cookie.Value
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		binding = base64.RawURLEncoding.EncodeToString(b)
+	}
+	// Set on every login so the cookie outlives the newest state
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    binding,
+		Path:     "/",
+		MaxAge:   int(s.pendingRequestTTL().Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	bindingHash := sha256.Sum256([]byte(binding))
+	payload, err := json.Marshal(&oidcState{
+		RequestID:  requestID,
+		RelayState: relayState,
+		Binding:    base64.RawURLEncoding.EncodeToString(bindingHash[:]),
+		ExpiresAt:  time.Now().Add(s.pendingRequestTTL()).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(s.signOIDCState(payload)), nil
+}
+
+// newOIDCNonce returns a random nonce for the ID Token of a login.
+func newOIDCNonce() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// verifyOIDCState checks the OAuth2 state of an OIDC callback: its signature,
+// its expiry and that r comes from the browser the login was started in.
+func (s *Server) verifyOIDCState(r *http.Request) (*oidcState, error) {
+	value := r.URL.Query().Get("state")
+	if value == "" {
+		return nil, &oidcStateError{Reason: "missing", Message: "missing state"}
+	}
+	encodedPayload, encodedMAC, ok := strings.Cut(value, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if !ok || err != nil {
+		return nil, &oidcStateError{Reason: "malformed", Message: "malformed state"}
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, s.signOIDCState(payload)) {
+		return nil, &oidcStateError{Reason: "signature", Message: "invalid state signature"}
+	}
+
+	var state oidcState
+	if err := json.Unmarshal(payload, &state); err != nil {
+		return nil, &oidcStateError{Reason: "malformed", Message: "malformed state"}
+	}
+	if time.Now().Unix() > state.ExpiresAt {
+		return nil, &oidcStateError{Reason: "expired", Message: "state expired"}
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return nil, &oidcStateError{Reason: "cookie", Message: "missing state cookie"}
+	}
+	bindingHash := sha256.Sum256([]byte(cookie.Value))
+	if !hmac.Equal([]byte(base64.RawURLEncoding.EncodeToString(bindingHash[:])), []byte(state.Binding)) {
+		return nil, &oidcStateError{Reason: "cookie", Message: "state does not match the state cookie"}
+	}
+	return &state, nil
+}
+
+// rejectOIDCState records a rejected OAuth2 state and shows the error page.
+func (s *Server) rejectOIDCState(w http.ResponseWriter, r *http.Request, err error) {
+	reason := "invalid"
+	var stateErr *oidcStateError
+	if errors.As(err, &stateErr) {
+		reason = stateErr.Reason
+	}
+	s.logger.Warnw("Rejected OIDC callback state", "reason", reason, "error", err)
+	_ = s.monitor.AddOIDCStateRejection(map[string]string{"reason": reason}, 1)
+	s.renderError(w, r, oidcStateErrorMessage, http.StatusBadRequest)
+}
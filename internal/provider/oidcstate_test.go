@@ -0,0 +1,235 @@
+package provider
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/crewjam/saml"
+	"golang.org/x/oauth2"
+)
+
+// oidcCallbackRequest returns an OIDC callback request for code with a valid
+// state for requestID and the state cookie of the browser.
+func oidcCallbackRequest(t *testing.T, server *Server, code, requestID, relayState string) *http.Request {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	state, err := server.newOIDCState(rec, httptest.NewRequest(http.MethodGet, "/saml/sso", nil), requestID, relayState)
+	if err != nil {
+		t.Fatalf("newOIDCState failed: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/saml/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+// savePendingLogin stores the pending request of a login started by the
+// bridge, as GetSession does before redirecting to Hydra.
+func savePendingLogin(t *testing.T, server *Server) *PendingAuthnRequest {
+	t.Helper()
+	if server.db == nil || server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	pending := &PendingAuthnRequest{
+		ID:           newSAMLID(),
+		CodeVerifier: oauth2.GenerateVerifier(),
+		Nonce:        "test-nonce",
+		CreateTime:   time.Now(),
+		ExpireTime:   time.Now().Add(time.Minute),
+	}
+	if err := server.db.SavePendingAuthnRequest(pending); err != nil {
+		t.Fatalf("SavePendingAuthnRequest failed: %v", err)
+	}
+	return pending
+}
+
+// oidcStateFromRedirect verifies the state of the redirect to Hydra recorded
+// in rec, as the callback would with the cookies set alongside it.
+func oidcStateFromRedirect(t *testing.T, server *Server, rec *httptest.ResponseRecorder) *oidcState {
+	t.Helper()
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect location: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/saml/callback?"+url.Values{"state": {location.Query().Get("state")}}.Encode(), nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	state, err := server.verifyOIDCState(req)
+	if err != nil {
+		t.Fatalf("Expected a valid state, got %v", err)
+	}
+	return state
+}
+
+func TestOIDCState_RoundTrip(t *testing.T) {
+	server := setupTestServer(t)
+	req := oidcCallbackRequest(t, server, "code", "id-123", "/dashboard")
+
+	state, err := server.verifyOIDCState(req)
+	if err != nil {
+		t.Fatalf("verifyOIDCState failed: %v", err)
+	}
+	if state.RequestID != "id-123" || state.RelayState != "/dashboard" {
+		t.Errorf("Unexpected state %+v", state)
+	}
+	if strings.Contains(req.URL.Query().Get("state"), "id-123") {
+		t.Error("Expected the state to be opaque")
+	}
+}
+
+func TestOIDCState_Rejected(t *testing.T) {
+	server := setupTestServer(t)
+
+	tests := map[string]func(req *http.Request) *http.Request{
+		"missing": func(req *http.Request) *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/saml/callback?code=code", nil)
+		},
+		"malformed": func(req *http.Request) *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/saml/callback?code=code&state=id-123:relay", nil)
+		},
+		"signature": func(req *http.Request) *http.Request {
+			other := *server
+			other.config.ClientSecret = "another-secret"
+			forged := oidcCallbackRequest(t, &other, "code", "id-123", "")
+			forged.Header = req.Header
+			return forged
+		},
+		"expired": func(req *http.Request) *http.Request {
+			encoded, _, _ := strings.Cut(req.URL.Query().Get("state"), ".")
+			payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+			var state oidcState
+			_ = json.Unmarshal(payload, &state)
+			state.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+			payload, _ = json.Marshal(&state)
+			expired := base64.RawURLEncoding.EncodeToString(payload) + "." +
+				base64.RawURLEncoding.EncodeToString(server.signOIDCState(payload))
+			req.URL.RawQuery = url.Values{"code": {"code"}, "state": {expired}}.Encode()
+			return req
+		},
+		"cookie": func(req *http.Request) *http.Request {
+			// A state started in another browser
+			req.Header.Del("Cookie")
+			req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: strings.Repeat("a", 43)})
+			return req
+		},
+	}
+	for reason, tamper := range tests {
+		t.Run(reason, func(t *testing.T) {
+			monitor := &testMockMonitor{}
+			server.monitor = monitor
+			req := tamper(oidcCallbackRequest(t, server, "code", "id-123", ""))
+
+			rec := httptest.NewRecorder()
+			server.handleOIDCCallback(rec, req)
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "sign in again") {
+				t.Errorf("Expected the error page, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if len(monitor.stateRejections) != 1 || monitor.stateRejections[0] != reason {
+				t.Errorf("Expected a rejection with reason %q, got %v", reason, monitor.stateRejections)
+			}
+		})
+	}
+}
+
+func TestSessionProviderAdapter_GetSession_PKCEAndNonce(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	server.oauth2Config = &oauth2.Config{
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost:8082/saml/callback",
+		Endpoint:    oauth2.Endpoint{AuthURL: "https://hydra.example.com/oauth2/auth"},
+	}
+
+	rec := httptest.NewRecorder()
+	adapter := &sessionProviderAdapter{server: server}
+	adapter.GetSession(rec, httptest.NewRequest(http.MethodGet, "/saml/sso?SAMLRequest=request", nil),
+		&saml.IdpAuthnRequest{Request: saml.AuthnRequest{ID: "pkce-request"}})
+
+	pending, err := server.db.ConsumePendingAuthnRequest(oidcStateFromRedirect(t, server, rec).RequestID)
+	if err != nil || pending == nil {
+		t.Fatalf("Expected the pending request to be stored, got %v", err)
+	}
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") != oauth2.S256ChallengeFromVerifier(pending.CodeVerifier) {
+		t.Errorf("Expected an S256 challenge of the stored verifier, got %s", location)
+	}
+	if pending.Nonce == "" || query.Get("nonce") != pending.Nonce {
+		t.Errorf("Expected the stored nonce %q, got %q", pending.Nonce, query.Get("nonce"))
+	}
+}
+
+func TestHandleOIDCCallback_PKCEAndNonce(t *testing.T) {
+	server := setupTestServer(t)
+	pending := savePendingLogin(t, server)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	var verifiers []string
+	hydraStub := newHydraStubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		verifiers = append(verifiers, r.FormValue("code_verifier"))
+		idToken := signTestJWT(t, key, map[string]interface{}{
+			"iss":   testOIDCIssuer,
+			"aud":   []string{"test-client"},
+			"sub":   "user-1",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": "another-login",
+			"email": "user@example.com",
+		})
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"access_token":"abc","token_type":"Bearer","id_token":"`+idToken+`"}`)
+	})
+	server.hydraHTTPClient = hydraStub.Client()
+	server.oauth2Config = &oauth2.Config{
+		ClientID: "test-client",
+		Endpoint: oauth2.Endpoint{TokenURL: hydraStub.URL + "/oauth2/token"},
+	}
+	server.oidcVerifier = oidc.NewVerifier(testOIDCIssuer,
+		&oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&key.PublicKey}},
+		&oidc.Config{ClientID: "test-client"})
+
+	req := oidcCallbackRequest(t, server, "code", pending.ID, "")
+	rec := httptest.NewRecorder()
+	server.handleOIDCCallback(rec, req)
+	if len(verifiers) != 1 || verifiers[0] != pending.CodeVerifier {
+		t.Errorf("Expected the token exchange to send the stored verifier, got %v", verifiers)
+	}
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "nonce mismatch") {
+		t.Errorf("Expected the ID Token of another login to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The pending request was consumed, so the callback cannot be replayed
+	monitor := &testMockMonitor{}
+	server.monitor = monitor
+	rec = httptest.NewRecorder()
+	server.handleOIDCCallback(rec, oidcCallbackRequest(t, server, "code", pending.ID, ""))
+	if len(verifiers) != 1 || len(monitor.stateRejections) != 1 || monitor.stateRejections[0] != "replayed" {
+		t.Errorf("Expected the replayed callback to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,170 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+// Page templates. Each one can be replaced by a file of the same name in
+// Config.TemplatesDir; layout.html defines the "head" template the others
+// share, so overriding it alone rebrands every page.
+const (
+	errorPageTemplate     = "error.html"
+	postPageTemplate      = "post.html"
+	loggedOutPageTemplate = "logged_out.html"
+	logoutPageTemplate    = "logout.html"
+	// responseFormTemplate adapts post.html to the data crewjam executes
+	// IdentityProvider.ResponseFormTemplate with
+	responseFormTemplate = "saml_response_form"
+)
+
+// correlationIDHeader carries the correlation ID of a request in its
+// response, so it can be found in the logs.
+const correlationIDHeader = "X-Correlation-ID"
+
+//go:embed templates/*.html
+var embeddedTemplates embed.FS
+
+var defaultTemplates = template.Must(loadTemplates(""))
+
+// pageData is what the page templates are executed with. Fields a page has
+// no use for are empty.
+type pageData struct {
+	Status        int
+	Title         string
+	Message       string
+	CorrelationID string
+
+	// The HTTP-POST binding form of post.html
+	URL          string
+	SAMLRequest  string
+	SAMLResponse string
+	RelayState   string
+}
+
+// loadTemplates parses the embedded page templates, then the *.html files of
+// dir over them.
+func loadTemplates(dir string) (*template.Template, error) {
+	tmpl, err := template.New("pages").Funcs(template.FuncMap{
+		"responseForm": func(form saml.IdpAuthnRequestForm) *pageData {
+			return &pageData{URL: form.URL, SAMLResponse: form.SAMLResponse, RelayState: form.RelayState}
+		},
+	}).ParseFS(embeddedTemplates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmpl.New(responseFormTemplate).Parse(`{{template "post.html" responseForm .}}`); err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return tmpl, nil
+	}
+
+	overrides, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	if len(overrides) == 0 {
+		return nil, fmt.Errorf("no *.html templates found in %s", dir)
+	}
+	return tmpl.ParseFiles(overrides...)
+}
+
+// pageTemplates returns the loaded page templates, or the embedded ones.
+func (s *Server) pageTemplates() *template.Template {
+	if s.templates != nil {
+		return s.templates
+	}
+	return defaultTemplates
+}
+
+// renderPage writes the page name with status. An override that fails to
+// execute is logged and the embedded page is written instead.
+func (s *Server) renderPage(w http.ResponseWriter, status int, name string, data *pageData) error {
+	var buf bytes.Buffer
+	err := s.pageTemplates().ExecuteTemplate(&buf, name, data)
+	if err != nil && s.templates != nil {
+		s.logger.Errorw("Failed to render page template, using the default", "template", name, "error", err)
+		buf.Reset()
+		err = defaultTemplates.ExecuteTemplate(&buf, name, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(status)
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// renderError shows the user the error page with message. The page quotes
+// the correlation ID of r, which is logged with message.
+func (s *Server) renderError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	id := correlationID(r)
+	s.logger.Warnw("Showing error page", "correlationID", id, "method", r.Method, "path", r.URL.Path,
+		"status", status, "message", message)
+
+	err := s.renderPage(w, status, errorPageTemplate, &pageData{
+		Status:        status,
+		Title:         http.StatusText(status),
+		Message:       message,
+		CorrelationID: id,
+	})
+	if err != nil {
+		s.logger.Errorw("Failed to render error page", "correlationID", id, "error", err)
+		http.Error(w, message, status)
+	}
+}
+
+// writePostForm sends the SAML message el to destination with the HTTP-POST
+// binding, as a form the browser submits when the page loads.
+func (s *Server) writePostForm(w http.ResponseWriter, r *http.Request, param string, el *etree.Element, destination, relayState string) error {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	data := &pageData{URL: destination, RelayState: relayState, CorrelationID: correlationID(r)}
+	if param == "SAMLResponse" {
+		data.SAMLResponse = base64.StdEncoding.EncodeToString(buf)
+	} else {
+		data.SAMLRequest = base64.StdEncoding.EncodeToString(buf)
+	}
+	return s.renderPage(w, http.StatusOK, postPageTemplate, data)
+}
+
+type correlationIDKey struct{}
+
+// correlationIDMiddleware gives every request a random correlation ID,
+// returned in the X-Correlation-ID header and shown on error pages.
+func correlationIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := make([]byte, 8)
+		_, _ = rand.Read(b)
+		id := hex.EncodeToString(b)
+		w.Header().Set(correlationIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), correlationIDKey{}, id)))
+	})
+}
+
+// correlationID returns the correlation ID of r, or an empty string outside
+// correlationIDMiddleware.
+func correlationID(r *http.Request) string {
+	id, _ := r.Context().Value(correlationIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crewjam/saml"
+)
+
+func TestLoadTemplates_Overrides(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "error.html"), []byte(`<p class="acme">{{.Message}} ({{.CorrelationID}})</p>`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := loadTemplates(dir)
+	if err != nil {
+		t.Fatalf("loadTemplates failed: %v", err)
+	}
+
+	server := setupTestServer(t)
+	server.templates = templates
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/saml/sso", nil)
+	server.renderError(rec, r, "Invalid SAML message", http.StatusBadRequest)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `<p class="acme">Invalid SAML message`) {
+		t.Errorf("Expected the overridden error page, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	if err := server.renderPage(rec, http.StatusOK, loggedOutPageTemplate, &pageData{}); err != nil {
+		t.Fatalf("renderPage failed: %v", err)
+	}
+	if !strings.Contains(rec.Body.String(), "signed out") {
+		t.Errorf("Expected the embedded logged out page, got %s", rec.Body.String())
+	}
+}
+
+func TestLoadTemplates_Invalid(t *testing.T) {
+	if _, err := loadTemplates(t.TempDir()); err == nil {
+		t.Error("Expected an error for a directory without templates")
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "post.html"), []byte(`{{.URL`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTemplates(dir); err == nil {
+		t.Error("Expected an error for a template that does not parse")
+	}
+}
+
+func TestRenderError_CorrelationID(t *testing.T) {
+	server := setupTestServer(t)
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.renderError(w, r, "Unknown <service> provider", http.StatusNotFound)
+	})
+	handler = correlationIDMiddleware(handler)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/idp-initiated", nil))
+	id := rec.Header().Get(correlationIDHeader)
+	if len(id) != 16 {
+		t.Fatalf("Expected a correlation ID header, got %q", id)
+	}
+	body := rec.Body.String()
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("Expected an HTML 404 page, got %d with %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(body, "<code>"+id+"</code>") {
+		t.Errorf("Expected the page to quote the correlation ID %s, got %s", id, body)
+	}
+	if !strings.Contains(body, "Unknown &lt;service&gt; provider") {
+		t.Errorf("Expected the message to be escaped, got %s", body)
+	}
+}
+
+func TestWritePostForm(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	rec := httptest.NewRecorder()
+	req := testAuthnRequest(server, "https://sp.example.com")
+	if err := server.writePostForm(rec, httptest.NewRequest(http.MethodGet, "/", nil), "SAMLRequest", req.Element(),
+		"https://sp.example.com/slo", "relay"); err != nil {
+		t.Fatalf("writePostForm failed: %v", err)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{`action="https://sp.example.com/slo"`, `name="SAMLRequest"`, `name="RelayState" value="relay"`, "<noscript>", "submit()"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected %s in the auto-submit page, got %s", want, body)
+		}
+	}
+	if strings.Contains(body, `name="SAMLResponse"`) {
+		t.Errorf("Expected no SAMLResponse field, got %s", body)
+	}
+}
+
+func TestIdentityProvider_ResponseFormTemplate(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	rec := httptest.NewRecorder()
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs", ACSBinding: saml.HTTPPostBinding}
+	descriptor, _ := sp.EntityDescriptor()
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	req := &saml.IdpAuthnRequest{IDP: server.identityProvider(), HTTPRequest: httptest.NewRequest(http.MethodGet, "/saml/sso", nil),
+		Now: saml.TimeNow(), ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs, RelayState: "relay"}
+	if err := server.writeSAMLError(rec, req, saml.StatusAuthnFailed); err != nil {
+		t.Fatalf("writeSAMLError failed: %v", err)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "<noscript>") || !strings.Contains(body, `action="https://sp.example.com/acs"`) {
+		t.Errorf("Expected the Response posted with the post.html page, got %s", body)
+	}
+	postedSAMLResponse(t, body)
+}
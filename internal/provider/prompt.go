@@ -0,0 +1,73 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/crewjam/saml"
+	"golang.org/x/oauth2"
+)
+
+// freshLoginCookie marks the session created by the OIDC callback as
+// authenticated for the AuthnRequest it replays, so a ForceAuthn request
+// accepts that session instead of sending the user back to Hydra.
+const freshLoginCookie = "saml_fresh_login"
+
+// passiveLoginErrors are the OIDC error codes Hydra returns when a prompt=none
+// login would need user interaction.
+var passiveLoginErrors = map[string]bool{
+	"login_required":             true,
+	"interaction_required":       true,
+	"consent_required":           true,
+	"account_selection_required": true,
+}
+
+func requestFlag(flag *bool) bool {
+	return flag != nil && *flag
+}
+
+// promptOptions returns the OIDC parameters asking Hydra for a new login, as
+// ForceAuthn does, or for a login without user interaction, as IsPassive
+// does.
+func promptOptions(forceLogin, isPassive bool) []oauth2.AuthCodeOption {
+	switch {
+	case forceLogin:
+		return []oauth2.AuthCodeOption{
+			oauth2.SetAuthURLParam("prompt", "login"),
+			oauth2.SetAuthURLParam("max_age", "0"),
+		}
+	case isPassive:
+		return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("prompt", "none")}
+	default:
+		return nil
+	}
+}
+
+func (s *Server) freshLoginMAC(requestID, sessionID string) string {
+	return base64.RawURLEncoding.EncodeToString(s.signOIDCState([]byte("fresh-login\x00" + requestID + "\x00" + sessionID)))
+}
+
+// setFreshLoginCookie records that sessionID was authenticated for the
+// AuthnRequest requestID. The cookie only has to last until the request is
+// replayed, which crewjam rejects after saml.MaxIssueDelay anyway.
+func (s *Server) setFreshLoginCookie(w http.ResponseWriter, requestID, sessionID string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     freshLoginCookie,
+		Value:    s.freshLoginMAC(requestID, sessionID),
+		Path:     "/",
+		MaxAge:   int(saml.MaxIssueDelay.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// isFreshLogin reports whether sessionID was authenticated for the
+// AuthnRequest requestID.
+func (s *Server) isFreshLogin(r *http.Request, requestID, sessionID string) bool {
+	cookie, err := r.Cookie(freshLoginCookie)
+	if err != nil || requestID == "" {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(s.freshLoginMAC(requestID, sessionID)))
+}
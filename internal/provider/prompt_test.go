@@ -0,0 +1,157 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/crewjam/saml"
+	"golang.org/x/oauth2"
+)
+
+func TestPromptOptions(t *testing.T) {
+	config := &oauth2.Config{ClientID: "test-client", Endpoint: oauth2.Endpoint{AuthURL: "https://hydra.example.com/oauth2/auth"}}
+
+	tests := []struct {
+		name        string
+		forceLogin  bool
+		isPassive   bool
+		wantPrompt  string
+		wantMaxAge  string
+		wantOptions int
+	}{
+		{name: "ForceAuthn", forceLogin: true, wantPrompt: "login", wantMaxAge: "0", wantOptions: 2},
+		{name: "IsPassive", isPassive: true, wantPrompt: "none", wantOptions: 1},
+		{name: "both", forceLogin: true, isPassive: true, wantPrompt: "login", wantMaxAge: "0", wantOptions: 2},
+		{name: "neither"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := promptOptions(tt.forceLogin, tt.isPassive)
+			location, _ := url.Parse(config.AuthCodeURL("state", options...))
+			query := location.Query()
+			if len(options) != tt.wantOptions || query.Get("prompt") != tt.wantPrompt || query.Get("max_age") != tt.wantMaxAge {
+				t.Errorf("Expected prompt %q and max_age %q, got %s", tt.wantPrompt, tt.wantMaxAge, location)
+			}
+		})
+	}
+}
+
+func TestFreshLoginCookie(t *testing.T) {
+	server := setupTestServer(t)
+
+	rec := httptest.NewRecorder()
+	server.setFreshLoginCookie(rec, "id-request", "session")
+	req := httptest.NewRequest(http.MethodGet, "/saml/sso", nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+
+	if !server.isFreshLogin(req, "id-request", "session") {
+		t.Error("Expected the session to be fresh for the request")
+	}
+	if server.isFreshLogin(req, "id-other", "session") || server.isFreshLogin(req, "id-request", "other-session") {
+		t.Error("Expected the cookie to only match its request and session")
+	}
+	if server.isFreshLogin(httptest.NewRequest(http.MethodGet, "/saml/sso", nil), "id-request", "session") {
+		t.Error("Expected no fresh login without the cookie")
+	}
+}
+
+func TestSessionProviderAdapter_GetSession_ForceAuthn(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	server.oauth2Config = &oauth2.Config{
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost:8082/saml/callback",
+		Endpoint:    oauth2.Endpoint{AuthURL: "https://hydra.example.com/oauth2/auth"},
+	}
+
+	sessionToken := "force-authn-session"
+	session := &saml.Session{
+		ID:         sessionIDFromToken(sessionToken),
+		CreateTime: time.Now(),
+		ExpireTime: time.Now().Add(10 * time.Minute),
+		Index:      newSAMLID(),
+		NameID:     "user@example.com",
+		UserEmail:  "user@example.com",
+	}
+	if err := server.db.SaveSession(session, nil); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteSession(session.ID) })
+
+	yes := true
+	authnRequest := &saml.IdpAuthnRequest{Request: saml.AuthnRequest{ID: newSAMLID(), ForceAuthn: &yes}}
+	adapter := &sessionProviderAdapter{server: server}
+	req := httptest.NewRequest(http.MethodGet, "/saml/sso?SAMLRequest=request", nil)
+	req.AddCookie(&http.Cookie{Name: "saml_session", Value: sessionToken})
+
+	rec := httptest.NewRecorder()
+	if adapter.GetSession(rec, req, authnRequest) != nil {
+		t.Fatal("Expected ForceAuthn to ignore the existing session")
+	}
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	if location.Query().Get("prompt") != "login" || location.Query().Get("max_age") != "0" {
+		t.Errorf("Expected a forced login at Hydra, got %s", location)
+	}
+
+	// The replay after the login carries the fresh login cookie
+	rec = httptest.NewRecorder()
+	server.setFreshLoginCookie(rec, authnRequest.Request.ID, session.ID)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	if adapter.GetSession(httptest.NewRecorder(), req, authnRequest) == nil {
+		t.Error("Expected the session created for the request to be accepted")
+	}
+}
+
+func TestHandleOIDCCallback_LoginRequired(t *testing.T) {
+	server, sp := setupIdPInitiatedTest(t, false)
+
+	yes := true
+	authnRequest := testAuthnRequest(server, sp.EntityID)
+	authnRequest.IsPassive = &yes
+	doc := etree.NewDocument()
+	doc.SetRoot(authnRequest.Element())
+	data, _ := doc.WriteToBytes()
+	pending := &PendingAuthnRequest{
+		ID:          authnRequest.ID,
+		SAMLRequest: deflateBase64(t, data),
+		RelayState:  "relay",
+		CreateTime:  time.Now(),
+		ExpireTime:  time.Now().Add(time.Minute),
+	}
+	if err := server.db.SavePendingAuthnRequest(pending); err != nil {
+		t.Fatalf("SavePendingAuthnRequest failed: %v", err)
+	}
+
+	req := oidcCallbackRequest(t, server, "", pending.ID, "relay")
+	query := req.URL.Query()
+	query.Del("code")
+	query.Set("error", "login_required")
+	req.URL.RawQuery = query.Encode()
+
+	rec := httptest.NewRecorder()
+	server.handleOIDCCallback(rec, req)
+	if !strings.Contains(rec.Body.String(), `action="`+sp.ACSURL+`"`) {
+		t.Fatalf("Expected a Response posted to the ACS, got %d: %s", rec.Code, rec.Body.String())
+	}
+	response, _ := postedSAMLResponse(t, rec.Body.String())
+	if response.InResponseTo != authnRequest.ID || response.Status.StatusCode.StatusCode == nil ||
+		response.Status.StatusCode.StatusCode.Value != saml.StatusNoPassive {
+		t.Errorf("Expected a NoPassive Response to the AuthnRequest, got %+v", response.Status.StatusCode)
+	}
+}
@@ -0,0 +1,357 @@
+package provider
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// redirectSignatureHashes are the SigAlg values accepted on HTTP-Redirect
+// requests, with the digest each one signs.
+var redirectSignatureHashes = map[string]crypto.Hash{
+	dsig.RSASHA1SignatureMethod:     crypto.SHA1,
+	dsig.RSASHA256SignatureMethod:   crypto.SHA256,
+	dsig.RSASHA384SignatureMethod:   crypto.SHA384,
+	dsig.RSASHA512SignatureMethod:   crypto.SHA512,
+	dsig.ECDSASHA1SignatureMethod:   crypto.SHA1,
+	dsig.ECDSASHA256SignatureMethod: crypto.SHA256,
+	dsig.ECDSASHA384SignatureMethod: crypto.SHA384,
+	dsig.ECDSASHA512SignatureMethod: crypto.SHA512,
+}
+
+// errUnsignedRequest is returned when a request carries no signature at all.
+var errUnsignedRequest = errors.New("request is not signed")
+
+// handleSSO is the IdP SingleSignOnService. AuthnRequests are checked against
+// the signing policy of their issuer before crewjam handles them.
+func (s *Server) handleSSO(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_sso")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	msg, err := readSAMLMessage(r)
+	if err != nil || msg.IsResponse {
+		s.logger.Warnw("Invalid SAML message on SSO endpoint", "error", err)
+		s.renderError(w, r, "Invalid SAML message", http.StatusBadRequest)
+		return
+	}
+
+	var authnRequest saml.AuthnRequest
+	if err := xml.Unmarshal(msg.Data, &authnRequest); err != nil {
+		s.logger.Warnw("Failed to parse AuthnRequest", "error", err)
+		s.renderError(w, r, "Invalid AuthnRequest", http.StatusBadRequest)
+		return
+	}
+	if authnRequest.Issuer == nil || authnRequest.Issuer.Value == "" {
+		s.logger.Warnw("Rejected AuthnRequest without Issuer", "requestID", authnRequest.ID)
+		s.renderError(w, r, "Invalid AuthnRequest", http.StatusBadRequest)
+		return
+	}
+	signed, err := s.checkRequestSignature(r, msg, authnRequest.Issuer.Value)
+	if err != nil {
+		s.logger.Warnw("Rejected AuthnRequest", "entityID", authnRequest.Issuer.Value, "requestID", authnRequest.ID, "error", err)
+		s.renderError(w, r, "Invalid AuthnRequest signature", http.StatusBadRequest)
+		return
+	}
+
+	// As saml.IdentityProvider.ServeSSO, but the request is built from the
+	// content that was verified rather than read again from r
+	idp := s.identityProvider()
+	req := &saml.IdpAuthnRequest{
+		IDP:           idp,
+		HTTPRequest:   r,
+		RequestBuffer: signed,
+		RelayState:    msg.RelayState,
+		Now:           saml.TimeNow(),
+	}
+	if err := req.Validate(); err != nil {
+		s.logger.Warnw("Failed to validate AuthnRequest", "entityID", authnRequest.Issuer.Value, "requestID", authnRequest.ID, "error", err)
+		s.renderError(w, r, "Invalid AuthnRequest", http.StatusBadRequest)
+		return
+	}
+	if req.Request.Issuer == nil || req.Request.Issuer.Value != authnRequest.Issuer.Value {
+		s.logger.Warnw("Signed AuthnRequest has a different Issuer", "entityID", authnRequest.Issuer.Value, "requestID", authnRequest.ID)
+		s.renderError(w, r, "Invalid AuthnRequest", http.StatusBadRequest)
+		return
+	}
+
+	session := idp.SessionProvider.GetSession(w, r, req)
+	if session == nil {
+		return
+	}
+	if err := idp.AssertionMaker.MakeAssertion(req, session); err != nil {
+		s.logger.Errorw("Failed to make assertion", "entityID", authnRequest.Issuer.Value, "requestID", authnRequest.ID, "error", err)
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if err := req.WriteResponse(w); err != nil {
+		s.logger.Errorw("Failed to write SAML response", "entityID", authnRequest.Issuer.Value, "requestID", authnRequest.ID, "error", err)
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// checkRequestSignature verifies the signature of a request received from
+// entityID: the detached signature of the HTTP-Redirect binding, or the
+// enveloped signature of the HTTP-POST binding. Unsigned requests are
+// rejected when the IdP or the service provider requires signed requests.
+// It returns the content of the message that should be processed, which for
+// an enveloped signature is only the signed element.
+func (s *Server) checkRequestSignature(r *http.Request, msg *samlMessage, entityID string) ([]byte, error) {
+	sp, err := s.db.GetServiceProviderRecord(entityID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Unknown service providers are rejected by the request handlers
+		return msg.Data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	certs, err := requestSigningCerts(sp)
+	if err != nil {
+		return nil, err
+	}
+
+	signed, err := verifyRequestSignature(r, msg, certs)
+	if errors.Is(err, errUnsignedRequest) && !s.config.RequireSignedRequests && !sp.RequireSignedRequests {
+		return msg.Data, nil
+	}
+	return signed, err
+}
+
+// checkLogoutRequestSignature is checkRequestSignature for LogoutRequests,
+// which every service provider with a signing key must sign (saml-profiles
+// 4.4.4.1). It returns errUnsignedRequest for an unsigned request that may
+// only end the session of the browser it came from.
+func (s *Server) checkLogoutRequestSignature(r *http.Request, msg *samlMessage, entityID string) error {
+	sp, err := s.db.GetServiceProviderRecord(entityID)
+	if err != nil {
+		return err
+	}
+	certs, err := requestSigningCerts(sp)
+	if err != nil {
+		return err
+	}
+
+	_, err = verifyRequestSignature(r, msg, certs)
+	if errors.Is(err, errUnsignedRequest) && (len(certs) > 0 || s.config.RequireSignedRequests || sp.RequireSignedRequests) {
+		return errors.New("the service provider must sign its logout messages")
+	}
+	return err
+}
+
+// verifyRequestSignature checks the signature of msg for the binding it was
+// received over and returns the signed content. It returns
+// errUnsignedRequest when msg is not signed.
+func verifyRequestSignature(r *http.Request, msg *samlMessage, certs []*x509.Certificate) ([]byte, error) {
+	if msg.Binding == saml.HTTPRedirectBinding && r.URL.Query().Get("Signature") != "" {
+		// The detached signature covers the whole encoded message
+		if err := verifyRedirectSignature(r.URL.RawQuery, certs); err != nil {
+			return nil, err
+		}
+		return msg.Data, nil
+	}
+
+	signed, err := verifyEnvelopedSignature(msg.Data, certs)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(signed)
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize signed request: %w", err)
+	}
+	return data, nil
+}
+
+// requestSigningCerts returns the certificates requests from sp are verified
+// with: the registered signing certificates, otherwise the signing keys of its
+// metadata.
+func requestSigningCerts(sp *ServiceProvider) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, certPEM := range sp.SigningCerts {
+		cert, err := parseCertificatePEM(certPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) > 0 || sp.MetadataXML == "" {
+		return certs, nil
+	}
+
+	descriptor, err := parseServiceProviderMetadata([]byte(sp.MetadataXML))
+	if err != nil {
+		return nil, err
+	}
+	for _, spsso := range descriptor.SPSSODescriptors {
+		for _, key := range spsso.KeyDescriptors {
+			if key.Use != "signing" && key.Use != "" {
+				continue
+			}
+			for _, x509Cert := range key.KeyInfo.X509Data.X509Certificates {
+				data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(x509Cert.Data), ""))
+				if err != nil {
+					continue
+				}
+				if cert, err := x509.ParseCertificate(data); err == nil {
+					certs = append(certs, cert)
+				}
+			}
+		}
+	}
+	return certs, nil
+}
+
+// verifyRedirectSignature checks the Signature of an HTTP-Redirect query
+// string as described in saml-bindings 3.4.4.1. The signed octets are taken
+// from the query as received; if that fails they are rebuilt with this
+// server's encoding, which is how a replayed request is encoded.
+func verifyRedirectSignature(rawQuery string, certs []*x509.Certificate) error {
+	raw := map[string]string{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		key, value, _ := strings.Cut(pair, "=")
+		if key, err := url.QueryUnescape(key); err == nil {
+			if _, seen := raw[key]; !seen {
+				raw[key] = value
+			}
+		}
+	}
+	param := "SAMLRequest"
+	if _, ok := raw[param]; !ok {
+		param = "SAMLResponse"
+	}
+
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return fmt.Errorf("invalid query string: %w", err)
+	}
+	if values.Get("Signature") == "" {
+		return errUnsignedRequest
+	}
+	sigAlg := values.Get("SigAlg")
+	hash, ok := redirectSignatureHashes[sigAlg]
+	if !ok {
+		return fmt.Errorf("unsupported SigAlg %q", sigAlg)
+	}
+	signature, err := base64.StdEncoding.DecodeString(values.Get("Signature"))
+	if err != nil {
+		return fmt.Errorf("invalid Signature encoding: %w", err)
+	}
+
+	signedQuery := func(encode func(key string) string) string {
+		query := param + "=" + encode(param)
+		if _, ok := raw["RelayState"]; ok {
+			query += "&RelayState=" + encode("RelayState")
+		}
+		return query + "&SigAlg=" + encode("SigAlg")
+	}
+	received := signedQuery(func(key string) string { return raw[key] })
+	reencoded := signedQuery(func(key string) string { return url.QueryEscape(values.Get(key)) })
+
+	for _, cert := range certs {
+		for _, signed := range []string{received, reencoded} {
+			if verifySignedOctets(cert, hash, []byte(signed), signature) == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("signature does not match any signing certificate of the service provider")
+}
+
+// verifySignedOctets checks an RSA PKCS #1 v1.5 or ECDSA signature over data.
+// ECDSA signatures are accepted both in the XML Signature r||s form and ASN.1.
+func verifySignedOctets(cert *x509.Certificate, hash crypto.Hash, data, signature []byte) error {
+	h := hash.New()
+	h.Write(data)
+	digest := h.Sum(nil)
+
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) == 2*size {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		}
+		if ecdsa.VerifyASN1(key, digest, signature) {
+			return nil
+		}
+		return errors.New("invalid ECDSA signature")
+	default:
+		return fmt.Errorf("unsupported public key type %T", cert.PublicKey)
+	}
+}
+
+// verifyEnvelopedSignature checks the enveloped signature over the root
+// element of a SAML message and returns the signed element.
+func verifyEnvelopedSignature(data []byte, certs []*x509.Certificate) (*etree.Element, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("invalid XML: %w", err)
+	}
+	root := doc.Root()
+	if root == nil {
+		return nil, errors.New("invalid XML: no root element")
+	}
+	if root.FindElement("./Signature") == nil {
+		return nil, errUnsignedRequest
+	}
+
+	err := errors.New("no signing certificate is registered for the service provider")
+	for _, cert := range certs {
+		validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+			Roots: []*x509.Certificate{cert},
+		})
+		var signed *etree.Element
+		if signed, err = validationContext.Validate(root); err == nil {
+			return signed, nil
+		}
+		// goxmldsig only verifies ECDSA signature values in ASN.1 form
+		if converted := root.Copy(); ecdsaSignatureValueToASN1(converted, cert) {
+			if signed, asn1Err := validationContext.Validate(converted); asn1Err == nil {
+				return signed, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("signature verification failed: %w", err)
+}
+
+// redirectEncodedRequest converts a base64 SAMLRequest received over the
+// HTTP-POST binding into the DEFLATE encoding of the HTTP-Redirect binding, so
+// it can be replayed against the SSO endpoint. Its enveloped signature, if
+// any, is kept.
+func redirectEncodedRequest(encoded string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	compressor, _ := flate.NewWriter(&buf, flate.BestCompression)
+	if _, err := compressor.Write(data); err != nil {
+		return "", err
+	}
+	if err := compressor.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
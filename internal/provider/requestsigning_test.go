@@ -0,0 +1,314 @@
+package provider
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/crewjam/saml"
+	"golang.org/x/oauth2"
+)
+
+func testAuthnRequest(server *Server, issuer string) *saml.AuthnRequest {
+	return &saml.AuthnRequest{
+		ID:           newSAMLID(),
+		Version:      "2.0",
+		IssueInstant: time.Now(),
+		Destination:  server.samlIdp.SSOURL.String(),
+		Issuer:       &saml.Issuer{Value: issuer},
+	}
+}
+
+func TestVerifyRedirectSignature(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	certs := []*x509.Certificate{server.samlIdp.Certificate}
+
+	location, err := server.signedRedirectURL("SAMLRequest", testAuthnRequest(server, "https://sp.example.com").Element(),
+		"https://idp.example.com/saml/sso", "relay state")
+	if err != nil {
+		t.Fatalf("signedRedirectURL failed: %v", err)
+	}
+	parsed, _ := url.Parse(location)
+	rawQuery := parsed.RawQuery
+
+	if err := verifyRedirectSignature(rawQuery, certs); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+
+	// A replayed request is re-encoded by url.Values
+	values, _ := url.ParseQuery(rawQuery)
+	if err := verifyRedirectSignature(values.Encode(), certs); err != nil {
+		t.Errorf("Expected a re-encoded query to verify, got %v", err)
+	}
+
+	tampered := strings.Replace(rawQuery, "RelayState=relay", "RelayState=other", 1)
+	if err := verifyRedirectSignature(tampered, certs); err == nil {
+		t.Error("Expected an error for a tampered RelayState")
+	}
+
+	otherServer := setupTestServer(t)
+	setupTestIdP(t, otherServer)
+	if err := verifyRedirectSignature(rawQuery, []*x509.Certificate{otherServer.samlIdp.Certificate}); err == nil {
+		t.Error("Expected an error for an unregistered key")
+	}
+
+	unsigned, _, _ := strings.Cut(rawQuery, "&SigAlg=")
+	if err := verifyRedirectSignature(unsigned, certs); !errors.Is(err, errUnsignedRequest) {
+		t.Errorf("Expected errUnsignedRequest, got %v", err)
+	}
+}
+
+func TestVerifySignedOctets_ECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sp"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(certDER)
+
+	data := []byte("SAMLRequest=abc&SigAlg=ecdsa")
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	raw := make([]byte, 64)
+	r.FillBytes(raw[:32])
+	s.FillBytes(raw[32:])
+	asn1, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+
+	hash := redirectSignatureHashes["http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"]
+	for name, signature := range map[string][]byte{"r||s": raw, "ASN.1": asn1} {
+		if err := verifySignedOctets(cert, hash, data, signature); err != nil {
+			t.Errorf("Expected a valid %s signature, got %v", name, err)
+		}
+	}
+	if err := verifySignedOctets(cert, hash, []byte("tampered"), raw); err == nil {
+		t.Error("Expected an error for tampered data")
+	}
+}
+
+func TestVerifyEnvelopedSignature(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	certs := []*x509.Certificate{server.samlIdp.Certificate}
+
+	authnRequest := testAuthnRequest(server, "https://sp.example.com")
+	unsignedDoc := etree.NewDocument()
+	unsignedDoc.SetRoot(authnRequest.Element())
+	unsigned, _ := unsignedDoc.WriteToBytes()
+	if _, err := verifyEnvelopedSignature(unsigned, certs); !errors.Is(err, errUnsignedRequest) {
+		t.Errorf("Expected errUnsignedRequest, got %v", err)
+	}
+
+	signature, err := server.signEnveloped(authnRequest.Element())
+	if err != nil {
+		t.Fatalf("signEnveloped failed: %v", err)
+	}
+	authnRequest.Signature = signature
+	doc := etree.NewDocument()
+	doc.SetRoot(authnRequest.Element())
+	signed, _ := doc.WriteToBytes()
+	if _, err := verifyEnvelopedSignature(signed, certs); err != nil {
+		t.Errorf("Expected a valid signature, got %v", err)
+	}
+
+	// Only the signed element is returned for processing
+	msg := &samlMessage{Binding: saml.HTTPPostBinding, Data: signed}
+	content, err := verifyRequestSignature(httptest.NewRequest(http.MethodPost, "/saml/sso", nil), msg, certs)
+	if err != nil {
+		t.Fatalf("verifyRequestSignature failed: %v", err)
+	}
+	var parsed saml.AuthnRequest
+	if err := xml.Unmarshal(content, &parsed); err != nil {
+		t.Fatalf("Expected the signed content to be an AuthnRequest, got %v", err)
+	}
+	if parsed.ID != authnRequest.ID || parsed.Issuer == nil || parsed.Issuer.Value != "https://sp.example.com" {
+		t.Errorf("Expected the signed AuthnRequest %s, got %+v", authnRequest.ID, parsed)
+	}
+	if parsed.Signature != nil {
+		t.Error("Expected the enveloped signature to be removed from the signed content")
+	}
+
+	tampered := []byte(strings.Replace(string(signed), "https://sp.example.com", "https://evil.example.com", 1))
+	if _, err := verifyEnvelopedSignature(tampered, certs); err == nil {
+		t.Error("Expected an error for a tampered request")
+	}
+	if _, err := verifyEnvelopedSignature(signed, nil); err == nil {
+		t.Error("Expected an error without signing certificates")
+	}
+}
+
+func TestRequestSigningCerts_FromMetadata(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.samlIdp.Certificate.Raw}))
+
+	registered, err := requestSigningCerts(&ServiceProvider{SigningCerts: []string{certPEM}, MetadataXML: testSPMetadata})
+	if err != nil || len(registered) != 1 || !registered[0].Equal(server.samlIdp.Certificate) {
+		t.Errorf("Expected the registered certificate, got %v (error %v)", registered, err)
+	}
+
+	// The signing key of testSPMetadata is not a valid certificate
+	fromMetadata, err := requestSigningCerts(&ServiceProvider{MetadataXML: testSPMetadata})
+	if err != nil || len(fromMetadata) != 0 {
+		t.Errorf("Expected no usable certificate, got %v (error %v)", fromMetadata, err)
+	}
+}
+
+func TestRedirectEncodedRequest(t *testing.T) {
+	encoded, err := redirectEncodedRequest("PHNhbWxwOkF1dGhuUmVxdWVzdC8+")
+	if err != nil {
+		t.Fatalf("redirectEncodedRequest failed: %v", err)
+	}
+	if got := string(inflateBase64(t, encoded)); got != "<samlp:AuthnRequest/>" {
+		t.Errorf("Unexpected request %q", got)
+	}
+}
+
+func TestHandleMetadata_WantAuthnRequestsSigned(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	server.config.RequireSignedRequests = true
+
+	rec := httptest.NewRecorder()
+	server.handleMetadata(rec, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+	if !strings.Contains(rec.Body.String(), `WantAuthnRequestsSigned="true"`) {
+		t.Errorf("Expected WantAuthnRequestsSigned in metadata, got %s", rec.Body.String())
+	}
+}
+
+func TestValidateServiceProvider_RequestSigning(t *testing.T) {
+	_, certPEM := testEncryptionKeyPair(t)
+	base := func() *ServiceProvider {
+		return &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs"}
+	}
+
+	sp := base()
+	sp.SigningCerts = []string{certPEM}
+	sp.RequireSignedRequests = true
+	if err := validateServiceProvider(sp); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	sp = base()
+	sp.SigningCerts = []string{"not a certificate"}
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for an invalid signing certificate")
+	}
+
+	sp = base()
+	sp.RequireSignedRequests = true
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for required signatures without a certificate")
+	}
+}
+
+func TestHandleSSO_SigningPolicy(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	setupTestIdP(t, server)
+	server.oauth2Config = &oauth2.Config{
+		ClientID:    "test-client",
+		RedirectURL: "http://localhost:8082/saml/callback",
+		Endpoint:    oauth2.Endpoint{AuthURL: "https://hydra.example.com/oauth2/auth"},
+	}
+
+	// The SP signs with the same key pair as the test IdP
+	sp := &ServiceProvider{
+		EntityID:              "https://signed-sp.example.com",
+		ACSURL:                "https://signed-sp.example.com/acs",
+		ACSBinding:            saml.HTTPPostBinding,
+		SigningCerts:          []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.samlIdp.Certificate.Raw}))},
+		RequireSignedRequests: true,
+	}
+	if err := server.db.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteServiceProvider(sp.EntityID) })
+
+	unsignedDoc := etree.NewDocument()
+	unsignedDoc.SetRoot(testAuthnRequest(server, sp.EntityID).Element())
+	unsigned, _ := unsignedDoc.WriteToBytes()
+	rec := httptest.NewRecorder()
+	server.handleSSO(rec, httptest.NewRequest(http.MethodGet, "/saml/sso?SAMLRequest="+url.QueryEscape(deflateBase64(t, unsigned)), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unsigned request to be rejected, got %d", rec.Code)
+	}
+
+	location, err := server.signedRedirectURL("SAMLRequest", testAuthnRequest(server, sp.EntityID).Element(), "/saml/sso", "")
+	if err != nil {
+		t.Fatalf("signedRedirectURL failed: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	server.handleSSO(rec, httptest.NewRequest(http.MethodGet, location, nil))
+	if rec.Code != http.StatusFound || !strings.HasPrefix(rec.Header().Get("Location"), "https://hydra.example.com/") {
+		t.Fatalf("Expected a signed request to continue to Hydra, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	pending, err := server.db.ConsumePendingAuthnRequest(oidcStateFromRedirect(t, server, rec).RequestID)
+	if err != nil || pending == nil || pending.Signature == "" || pending.SigAlg == "" {
+		t.Errorf("Expected the detached signature to be kept for replay, got %+v (error %v)", pending, err)
+	}
+}
+
+func TestHandleSSO_MissingIssuer(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	request := testAuthnRequest(server, "")
+	request.Issuer = nil
+	doc := etree.NewDocument()
+	doc.SetRoot(request.Element())
+	data, _ := doc.WriteToBytes()
+
+	rec := httptest.NewRecorder()
+	server.handleSSO(rec, httptest.NewRequest(http.MethodGet, "/saml/sso?SAMLRequest="+url.QueryEscape(deflateBase64(t, data)), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a request without Issuer, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestCheckRequestSignature_DatabaseError(t *testing.T) {
+	server := setupTestServer(t)
+	closedDB, err := sql.Open("postgres", "postgres://localhost/unused?sslmode=disable")
+	if err != nil {
+		t.Fatalf("sql.Open failed: %v", err)
+	}
+	_ = closedDB.Close()
+	server.db = NewDatabase(closedDB, server.logger)
+
+	msg := &samlMessage{Binding: saml.HTTPPostBinding, Data: []byte("<AuthnRequest/>")}
+	_, err = server.checkRequestSignature(httptest.NewRequest(http.MethodPost, "/saml/sso", nil), msg, "https://sp.example.com")
+	if err == nil {
+		t.Error("Expected a database error to reject the request")
+	}
+}
@@ -0,0 +1,124 @@
+package provider
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/crewjam/saml"
+)
+
+// writeSAMLError posts a signed Response to the ACS of req with the Responder
+// status and status, if any, as the second-level status code, telling the
+// service provider why no assertion was issued.
+func (s *Server) writeSAMLError(w http.ResponseWriter, req *saml.IdpAuthnRequest, status string) error {
+	if req.ACSEndpoint == nil {
+		return errors.New("AuthnRequest has no AssertionConsumerService")
+	}
+	resp := &saml.Response{
+		ID:           newSAMLID(),
+		InResponseTo: req.Request.ID,
+		Version:      "2.0",
+		IssueInstant: saml.TimeNow(),
+		Destination:  req.ACSEndpoint.Location,
+		Issuer:       s.idpIssuer(),
+		Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusResponder}},
+	}
+	if status != "" {
+		resp.Status.StatusCode.StatusCode = &saml.StatusCode{Value: status}
+	}
+	signature, err := s.signEnveloped(resp.Element())
+	if err != nil {
+		return err
+	}
+	resp.Signature = signature
+	req.ResponseEl = resp.Element()
+	return req.WriteResponse(w)
+}
+
+// respondSAMLError answers req with writeSAMLError, or with an error page if
+// the Response cannot be sent.
+func (s *Server) respondSAMLError(w http.ResponseWriter, req *saml.IdpAuthnRequest, status string) {
+	if err := s.writeSAMLError(w, req, status); err != nil {
+		s.logger.Errorw("Failed to send SAML error response", "requestID", req.Request.ID, "status", status, "error", err)
+		s.renderError(w, req.HTTPRequest, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+// failLogin reports a login that failed in the OIDC callback to the service
+// provider whose AuthnRequest started it, with a Response carrying status.
+// Without an AuthnRequest to answer, or if the Response cannot be sent, the
+// user is shown message instead.
+func (s *Server) failLogin(w http.ResponseWriter, r *http.Request, pending *PendingAuthnRequest, status string, httpStatus int, message string) {
+	if pending.SAMLRequest != "" {
+		req, err := s.resumedAuthnRequest(r, pending)
+		if err == nil {
+			err = s.writeSAMLError(w, req, status)
+		}
+		if err == nil {
+			return
+		}
+		s.logger.Errorw("Failed to send SAML error response", "requestID", pending.ID, "status", status, "error", err)
+	}
+	s.renderError(w, r, message, httpStatus)
+}
+
+// resumedAuthnRequest rebuilds the AuthnRequest stored in pending so the OIDC
+// callback can answer it. The request was validated before it was stored.
+func (s *Server) resumedAuthnRequest(r *http.Request, pending *PendingAuthnRequest) (*saml.IdpAuthnRequest, error) {
+	msg, err := readSAMLMessage(&http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{RawQuery: url.Values{"SAMLRequest": {pending.SAMLRequest}}.Encode()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var authnRequest saml.AuthnRequest
+	if err := xml.Unmarshal(msg.Data, &authnRequest); err != nil {
+		return nil, err
+	}
+	if authnRequest.Issuer == nil {
+		return nil, errors.New("AuthnRequest has no issuer")
+	}
+
+	descriptor, err := s.db.GetServiceProvider(authnRequest.Issuer.Value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find service provider %s: %w", authnRequest.Issuer.Value, err)
+	}
+	spsso, acs := requestedACS(descriptor, &authnRequest)
+	if acs == nil {
+		return nil, fmt.Errorf("service provider %s has no HTTP-POST AssertionConsumerService", authnRequest.Issuer.Value)
+	}
+	return &saml.IdpAuthnRequest{
+		IDP:                     s.identityProvider(),
+		HTTPRequest:             r,
+		Request:                 authnRequest,
+		RelayState:              pending.RelayState,
+		Now:                     saml.TimeNow(),
+		ServiceProviderMetadata: descriptor,
+		SPSSODescriptor:         spsso,
+		ACSEndpoint:             acs,
+	}, nil
+}
+
+// requestedACS returns the HTTP-POST ACS an AuthnRequest asked for by URL or
+// index, otherwise the default one.
+func requestedACS(descriptor *saml.EntityDescriptor, request *saml.AuthnRequest) (*saml.SPSSODescriptor, *saml.IndexedEndpoint) {
+	for i := range descriptor.SPSSODescriptors {
+		spsso := &descriptor.SPSSODescriptors[i]
+		for j := range spsso.AssertionConsumerServices {
+			acs := &spsso.AssertionConsumerServices[j]
+			if acs.Binding != saml.HTTPPostBinding {
+				continue
+			}
+			if (request.AssertionConsumerServiceURL != "" && acs.Location == request.AssertionConsumerServiceURL) ||
+				(request.AssertionConsumerServiceIndex != "" && strconv.Itoa(acs.Index) == request.AssertionConsumerServiceIndex) {
+				return spsso, acs
+			}
+		}
+	}
+	return selectACS(descriptor, saml.HTTPPostBinding)
+}
@@ -0,0 +1,142 @@
+package provider
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"golang.org/x/oauth2"
+)
+
+// postedSAMLResponse returns the Response of the auto-submit form in body.
+func postedSAMLResponse(t *testing.T, body string) (*saml.Response, []byte) {
+	t.Helper()
+	match := regexp.MustCompile(`name="SAMLResponse" value="([^"]+)"`).FindStringSubmatch(body)
+	if match == nil {
+		t.Fatalf("Expected a SAMLResponse field, got %s", body)
+	}
+	data, _ := base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+	var response saml.Response
+	if err := xml.Unmarshal(data, &response); err != nil {
+		t.Fatalf("Failed to parse Response: %v", err)
+	}
+	return &response, data
+}
+
+func TestWriteSAMLError(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs", ACSBinding: saml.HTTPPostBinding}
+	descriptor, _ := sp.EntityDescriptor()
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	req := &saml.IdpAuthnRequest{IDP: server.identityProvider(), HTTPRequest: httptest.NewRequest(http.MethodGet, "/saml/sso", nil),
+		Request: *testAuthnRequest(server, sp.EntityID), RelayState: "relay", Now: saml.TimeNow(),
+		ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs}
+
+	rec := httptest.NewRecorder()
+	if err := server.writeSAMLError(rec, req, saml.StatusNoPassive); err != nil {
+		t.Fatalf("writeSAMLError failed: %v", err)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `action="https://sp.example.com/acs"`) || !strings.Contains(body, `value="relay"`) {
+		t.Fatalf("Expected a form posting to the ACS with the RelayState, got %s", body)
+	}
+	response, data := postedSAMLResponse(t, body)
+	if response.InResponseTo != req.Request.ID {
+		t.Errorf("Expected InResponseTo %s, got %s", req.Request.ID, response.InResponseTo)
+	}
+	status := response.Status.StatusCode
+	if status.Value != saml.StatusResponder || status.StatusCode == nil || status.StatusCode.Value != saml.StatusNoPassive {
+		t.Errorf("Expected a Responder/NoPassive status, got %+v", status)
+	}
+	if response.Assertion != nil || response.EncryptedAssertion != nil {
+		t.Error("Expected no assertion")
+	}
+	if _, err := verifyEnvelopedSignature(data, []*x509.Certificate{server.samlIdp.Certificate}); err != nil {
+		t.Errorf("Expected a signed Response, got %v", err)
+	}
+}
+
+func TestRequestedACS(t *testing.T) {
+	descriptor := &saml.EntityDescriptor{SPSSODescriptors: []saml.SPSSODescriptor{{
+		AssertionConsumerServices: []saml.IndexedEndpoint{
+			{Binding: saml.HTTPPostBinding, Location: "https://sp.example.com/acs/default", Index: 0},
+			{Binding: saml.HTTPPostBinding, Location: "https://sp.example.com/acs/other", Index: 1},
+			{Binding: saml.HTTPRedirectBinding, Location: "https://sp.example.com/acs/redirect", Index: 2},
+		},
+	}}}
+
+	tests := []struct {
+		name    string
+		request saml.AuthnRequest
+		want    string
+	}{
+		{"by URL", saml.AuthnRequest{AssertionConsumerServiceURL: "https://sp.example.com/acs/other"}, "https://sp.example.com/acs/other"},
+		{"by index", saml.AuthnRequest{AssertionConsumerServiceIndex: "1"}, "https://sp.example.com/acs/other"},
+		{"HTTP-Redirect falls back", saml.AuthnRequest{AssertionConsumerServiceIndex: "2"}, "https://sp.example.com/acs/default"},
+		{"default", saml.AuthnRequest{}, "https://sp.example.com/acs/default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, acs := requestedACS(descriptor, &tt.request)
+			if acs == nil || acs.Location != tt.want {
+				t.Errorf("Expected %s, got %+v", tt.want, acs)
+			}
+		})
+	}
+}
+
+func TestFailLogin_WithoutAuthnRequest(t *testing.T) {
+	server := setupTestServer(t)
+
+	rec := httptest.NewRecorder()
+	server.failLogin(rec, httptest.NewRequest(http.MethodGet, "/saml/callback", nil), &PendingAuthnRequest{ID: "id-1"},
+		saml.StatusAuthnFailed, http.StatusForbidden, "Login failed")
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "Login failed") {
+		t.Errorf("Expected the error page, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleOIDCCallback_SAMLErrorResponse(t *testing.T) {
+	server, sp := setupIdPInitiatedTest(t, false)
+	hydraStub := newHydraStubServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"error":"invalid_grant"}`)
+	})
+	server.hydraHTTPClient = hydraStub.Client()
+	server.oauth2Config = &oauth2.Config{ClientID: "test-client", Endpoint: oauth2.Endpoint{TokenURL: hydraStub.URL + "/oauth2/token"}}
+
+	authnRequest := testAuthnRequest(server, sp.EntityID)
+	doc := etree.NewDocument()
+	doc.SetRoot(authnRequest.Element())
+	data, _ := doc.WriteToBytes()
+	pending := savePendingLogin(t, server)
+	pending.SAMLRequest = deflateBase64(t, data)
+	pending.RelayState = "relay"
+	if err := server.db.SavePendingAuthnRequest(pending); err != nil {
+		t.Fatalf("SavePendingAuthnRequest failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	server.handleOIDCCallback(rec, oidcCallbackRequest(t, server, "rejected-code", pending.ID, "relay"))
+	if !strings.Contains(rec.Body.String(), `action="`+sp.ACSURL+`"`) || !strings.Contains(rec.Body.String(), `value="relay"`) {
+		t.Fatalf("Expected a Response posted to the ACS with the RelayState, got %d: %s", rec.Code, rec.Body.String())
+	}
+	response, _ := postedSAMLResponse(t, rec.Body.String())
+	status := response.Status.StatusCode
+	if response.InResponseTo != authnRequest.ID || status.Value != saml.StatusResponder ||
+		status.StatusCode == nil || status.StatusCode.Value != saml.StatusAuthnFailed {
+		t.Errorf("Expected a Responder/AuthnFailed Response to the AuthnRequest, got %+v", status)
+	}
+}
@@ -2,13 +2,13 @@ package provider
 
 import (
 	"context"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
-	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"os"
@@ -32,18 +32,30 @@ type Server struct {
 	hydraHTTPClient *http.Client
 	oauth2Config    *oauth2.Config
 	oidcVerifier    *oidc.IDTokenVerifier
-	samlIdp         *saml.IdentityProvider
-	db              *Database
-	pendingRequests map[string]pendingAuthnRequest
-	router          chi.Router
-	monitor         monitoring.MonitorInterface
-	tracer          tracing.TracingInterface
+	// logoutTokenVerifier checks back-channel logout tokens against the
+	// same keyset as oidcVerifier
+	logoutTokenVerifier *oidc.IDTokenVerifier
+	samlIdp             *saml.IdentityProvider
+	// keyring holds the scheduled signing keys; samlIdp signs with its
+	// active key through identityProvider
+	keyring *keyring
+	// keyPairFiles is the configured key pair as last read by
+	// RunCertificateReloader
+	keyPairFiles keyPairFiles
+	// templates are the page templates with the overrides of
+	// Config.TemplatesDir
+	templates *template.Template
+	adminAuth adminAuthenticator
+	db        *Database
+	router    chi.Router
+	monitor   monitoring.MonitorInterface
+	tracer    tracing.TracingInterface
 }
 
-type pendingAuthnRequest struct {
-	samlRequest string
-	relayState  string
-}
+const (
+	defaultPendingRequestTTL           = 10 * time.Minute
+	defaultPendingRequestPurgeInterval = 5 * time.Minute
+)
 
 // NewServer creates a new SAML-OIDC bridge server
 func NewServer(cfg Config, logger *zap.SugaredLogger, sqlDB *sql.DB, monitor monitoring.MonitorInterface, tracer tracing.TracingInterface) (*Server, error) {
@@ -54,14 +66,19 @@ func NewServer(cfg Config, logger *zap.SugaredLogger, sqlDB *sql.DB, monitor mon
 		tracer = tracing.NewNoopTracer()
 	}
 
+	templates, err := loadTemplates(cfg.TemplatesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load page templates: %w", err)
+	}
+
 	s := &Server{
-		config:          cfg,
-		logger:          logger,
-		db:              NewDatabase(sqlDB, logger),
-		pendingRequests: make(map[string]pendingAuthnRequest),
-		router:          chi.NewRouter(),
-		monitor:         monitor,
-		tracer:          tracer,
+		config:    cfg,
+		logger:    logger,
+		templates: templates,
+		db:        NewDatabase(sqlDB, logger),
+		router:    chi.NewRouter(),
+		monitor:   monitor,
+		tracer:    tracer,
 	}
 	return s, nil
 }
@@ -88,6 +105,8 @@ func (s *Server) Initialize(ctx context.Context, zapLogger *zap.Logger) error {
 	_ = s.monitor.SetDependencyAvailability(map[string]string{"component": "hydra"}, 1)
 
 	s.oidcVerifier = provider.Verifier(&oidc.Config{ClientID: s.config.ClientID})
+	// exp is optional in logout tokens, so verifyLogoutToken checks the token age itself
+	s.logoutTokenVerifier = provider.Verifier(&oidc.Config{ClientID: s.config.ClientID, SkipExpiryCheck: true})
 
 	s.oauth2Config = &oauth2.Config{
 		ClientID:     s.config.ClientID,
@@ -97,34 +116,59 @@ func (s *Server) Initialize(ctx context.Context, zapLogger *zap.Logger) error {
 		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
 	}
 
+	// Initialize Admin API authentication
+	var adminVerifier *oidc.IDTokenVerifier
+	if s.config.AdminAuthMode == AdminAuthModeJWT {
+		adminVerifier = provider.Verifier(&oidc.Config{
+			ClientID:          s.config.AdminJWTAudience,
+			SkipClientIDCheck: s.config.AdminJWTAudience == "",
+		})
+	}
+	s.adminAuth, err = s.newAdminAuthenticator(adminVerifier)
+	if err != nil {
+		return fmt.Errorf("failed to configure admin API authentication: %w", err)
+	}
+	s.logger.Infow("Admin API authentication configured", "mode", s.config.AdminAuthMode)
+
 	// Initialize SAML Identity Provider
-	s.logger.Info("Loading SAML keys")
-	certPath := s.config.SAMLCertPath
-	keyPath := s.config.SAMLKeyPath
-	if certPath == "" {
-		certPath = ".local/certs/bridge.crt"
+	if s.config.SignatureAlgorithm != "" {
+		if err := validateSignatureMethod(s.config.SignatureAlgorithm); err != nil {
+			return fmt.Errorf("invalid SAML_PROVIDER_SIGNATURE_ALGORITHM: %w", err)
+		}
 	}
-	if keyPath == "" {
-		keyPath = ".local/certs/bridge.key"
+	s.logger.Info("Loading SAML keys")
+	files, err := s.readKeyPairFiles()
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %w", err)
 	}
-	keyPair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	keyPair, err := parseKeyPairFiles(files, time.Now())
 	if err != nil {
 		return fmt.Errorf("failed to load key pair: %w", err)
 	}
+	s.keyPairFiles = files
 
-	x509Cert, _ := x509.ParseCertificate(keyPair.Certificate[0])
+	// Keys stored in the database take over from the configured key pair
+	// once one of them is active
+	s.keyring = newKeyring(keyPair, s.config.SigningKeyGracePeriod)
+	if err := s.loadKeyring(); err != nil {
+		return err
+	}
+	s.logger.Infow("Signing keyring loaded", "activeKeyID", s.activeSigningKeyID())
 
 	// Create the IdP instance
 	s.samlIdp = &saml.IdentityProvider{
-		Key:         keyPair.PrivateKey.(*rsa.PrivateKey),
-		Certificate: x509Cert,
+		Key:         keyPair.key,
+		Certificate: keyPair.cert,
 		Logger:      NewZapStdLogger(zapLogger),
 		SSOURL:      s.parseURL(s.config.BridgeBaseURL + "/saml/sso"),
 		MetadataURL: s.parseURL(s.config.BridgeBaseURL + "/saml/metadata"),
+		LogoutURL:   s.parseURL(s.config.BridgeBaseURL + "/saml/slo"),
 		// This provider handles looking up the SP (Service) details
 		ServiceProviderProvider: &serviceProviderAdapter{db: s.db},
 		// Session provider handles authentication state
 		SessionProvider: &sessionProviderAdapter{server: s},
+		// Records which SPs took part in each session for single logout
+		AssertionMaker: &assertionMaker{server: s},
 	}
 
 	return nil
@@ -170,23 +214,77 @@ func (s *Server) newHydraHTTPClient() (*http.Client, error) {
 func (s *Server) SetupRoutes() {
 	s.router.Use(tracing.NewMiddleware(s.monitor, s.logger).RouteSpanNameMiddleware())
 	s.router.Use(monitoring.NewMiddleware(s.monitor, s.logger).ResponseTime())
+	s.router.Use(correlationIDMiddleware)
 
 	// A. Metadata Endpoint (Service providers need this to configure the connection)
-	s.router.HandleFunc("/saml/metadata", s.samlIdp.ServeMetadata)
+	s.router.HandleFunc("/saml/metadata", s.handleMetadata)
 
-	// B. SSO Entry Point (Service providers redirect users here)
-	s.router.HandleFunc("/saml/sso", s.samlIdp.ServeSSO)
+	// B. SSO Entry Points (Service providers redirect users here; portals launch IdP-initiated SSO)
+	s.router.HandleFunc("/saml/sso", s.handleSSO)
+	s.router.Get("/saml/idp-initiated", s.handleIdPInitiatedSSO)
 
 	// C. OIDC Callback (Hydra redirects users back here)
 	s.router.HandleFunc("/saml/callback", s.handleOIDCCallback)
 
-	// D. Service Provider Registration Endpoint
-	s.router.Post("/admin/service-providers", s.handleServiceProviderRegistration)
+	// D. Single Logout (SP-initiated requests, responses to propagated logouts and OIDC back-channel logout)
+	s.router.HandleFunc("/saml/slo", s.handleSLO)
+	s.router.Get("/saml/logout", s.handleLogoutPage)
+	s.router.Post("/saml/logout", s.sameOriginOnly(s.handleIdPInitiatedLogout))
+	s.router.Post("/saml/backchannel-logout", s.handleBackChannelLogout)
+
+	// E. Service Provider Admin API
+	s.router.Route("/admin/service-providers", func(r chi.Router) {
+		r.Use(s.requireAdminAuth)
+		r.Post("/", s.handleServiceProviderRegistration)
+		r.Get("/", s.handleListServiceProviders)
+		r.Get("/{entityID}", s.handleGetServiceProvider)
+		r.Put("/{entityID}", s.handleReplaceServiceProvider)
+		r.Patch("/{entityID}", s.handleUpdateServiceProvider)
+		r.Delete("/{entityID}", s.handleDeleteServiceProvider)
+	})
 
-	// E. Prometheus Metrics Endpoint
+	// F. Prometheus Metrics Endpoint
 	s.router.Handle("/metrics", promhttp.Handler())
 }
 
+// handleMetadata serves the IdP metadata. crewjam only advertises the
+// HTTP-Redirect SingleLogoutService, so the HTTP-POST one is added here.
+// WantAuthnRequestsSigned is also set here, as crewjam rejects every request
+// when it is set on the IdP itself. crewjam only advertises the transient
+// NameID format; every supported format is listed instead. The certificates
+// of the next and retired signing keys are published next to the active one.
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata := s.identityProvider().Metadata()
+	publishedKeys := s.publishedSigningKeys()
+	for i := range metadata.IDPSSODescriptors {
+		descriptor := &metadata.IDPSSODescriptors[i]
+		descriptor.KeyDescriptors = append(descriptor.KeyDescriptors, publishedKeys...)
+		descriptor.NameIDFormats = nil
+		for _, format := range supportedNameIDFormats {
+			descriptor.NameIDFormats = append(descriptor.NameIDFormats, saml.NameIDFormat(format))
+		}
+		if s.config.RequireSignedRequests {
+			wantSigned := true
+			descriptor.WantAuthnRequestsSigned = &wantSigned
+		}
+		if len(descriptor.SingleLogoutServices) > 0 {
+			descriptor.SingleLogoutServices = append(descriptor.SingleLogoutServices, saml.Endpoint{
+				Binding:  saml.HTTPPostBinding,
+				Location: s.samlIdp.LogoutURL.String(),
+			})
+		}
+	}
+
+	buf, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		s.logger.Errorw("Failed to marshal IdP metadata", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(buf)
+}
+
 // Start starts the HTTP server
 func (s *Server) Start() error {
 	s.logger.Infow("SAML-OIDC Bridge listening", "url", s.config.BridgeBaseURL)
@@ -194,6 +292,51 @@ func (s *Server) Start() error {
 	return http.ListenAndServe(":"+s.config.BridgeBasePort, handler)
 }
 
+// RunPendingRequestPurger periodically removes expired pending AuthnRequests
+// and logouts until ctx is cancelled. Every replica may run it; the DELETEs
+// are idempotent.
+func (s *Server) RunPendingRequestPurger(ctx context.Context) {
+	interval := s.config.PendingRequestPurgeInterval
+	if interval <= 0 {
+		interval = defaultPendingRequestPurgeInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := s.db.CleanupExpiredPendingAuthnRequests()
+			if err != nil {
+				s.logger.Errorw("Failed to purge expired pending authn requests", "error", err)
+				continue
+			}
+			if purged > 0 {
+				s.logger.Infow("Purged expired pending authn requests", "count", purged)
+			}
+
+			purged, err = s.db.CleanupExpiredPendingLogouts()
+			if err != nil {
+				s.logger.Errorw("Failed to purge expired pending logouts", "error", err)
+				continue
+			}
+			if purged > 0 {
+				s.logger.Infow("Purged expired pending logouts", "count", purged)
+			}
+		}
+	}
+}
+
+func (s *Server) pendingRequestTTL() time.Duration {
+	if s.config.PendingRequestTTL <= 0 {
+		return defaultPendingRequestTTL
+	}
+	return s.config.PendingRequestTTL
+}
+
 // -------------------------------------------------------------------------
 // Session Provider Adapter
 // -------------------------------------------------------------------------
@@ -202,6 +345,28 @@ type sessionProviderAdapter struct {
 }
 
 func (sp *sessionProviderAdapter) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	contexts := sp.server.config.AuthnContextMap
+	requestedContext := req.Request.RequestedAuthnContext
+	if !contexts.achievable(requestedContext) {
+		sp.server.logger.Warnw("Requested authentication context cannot be met", "requestID", req.Request.ID,
+			"classRef", requestedContext.AuthnContextClassRef, "comparison", requestedContext.Comparison)
+		sp.server.respondSAMLError(w, req, saml.StatusNoAuthnContext)
+		return nil
+	}
+
+	// Settle the NameID format before the user logs in
+	nameIDFormat, err := sp.server.nameIDFormat(req)
+	if errors.Is(err, errInvalidNameIDPolicy) {
+		sp.server.logger.Warnw("Requested NameID format is not allowed", "requestID", req.Request.ID,
+			"format", *req.Request.NameIDPolicy.Format)
+		sp.server.respondSAMLError(w, req, saml.StatusInvalidNameIDPolicy)
+		return nil
+	} else if err != nil {
+		sp.server.logger.Errorw("Error negotiating the NameID format", "requestID", req.Request.ID, "error", err)
+		sp.server.respondSAMLError(w, req, "")
+		return nil
+	}
+
 	sp.server.logger.Info("Checking for existing SAML session")
 	// Check if we have a session cookie from the OIDC callback
 	sessionCookie, err := r.Cookie("saml_session")
@@ -210,56 +375,199 @@ func (sp *sessionProviderAdapter) GetSession(w http.ResponseWriter, r *http.Requ
 	var session *saml.Session
 	var rawClaims map[string]interface{}
 	if err == nil && sessionCookie.Value != "" {
-		sp.server.logger.Infow("Found session cookie", "sessionID", sessionCookie.Value)
-		session, rawClaims = sp.server.db.GetSession(sessionCookie.Value)
+		sessionID := sessionIDFromToken(sessionCookie.Value)
+		sp.server.logger.Infow("Found session cookie", "sessionID", sessionID)
+		session, rawClaims = sp.server.db.GetSession(sessionID)
 	} else {
 		sp.server.logger.Infow("No session cookie found", "error", err)
 	}
 
+	// ForceAuthn asks for a new login: only the session the OIDC callback
+	// created for this request is accepted. A session that does not meet the
+	// requested context gets a new login too, unless it is that login.
+	forceLogin := requestFlag(req.Request.ForceAuthn)
+	isPassive := requestFlag(req.Request.IsPassive)
+	if session != nil {
+		freshLogin := sp.server.isFreshLogin(r, req.Request.ID, session.ID)
+		switch {
+		case forceLogin && !freshLogin:
+			sp.server.logger.Infow("ForceAuthn requested, not reusing the existing session", "requestID", req.Request.ID)
+			session = nil
+		case len(contexts) > 0 && !contexts.satisfies(requestedContext, contexts.classRefFor(rawClaims)):
+			if freshLogin || isPassive {
+				sp.server.logger.Warnw("Login does not meet the requested authentication context", "requestID", req.Request.ID,
+					"classRef", requestedContext.AuthnContextClassRef, "comparison", requestedContext.Comparison)
+				sp.server.respondSAMLError(w, req, saml.StatusNoAuthnContext)
+				return nil
+			}
+			sp.server.logger.Infow("Session does not meet the requested authentication context, logging in again", "requestID", req.Request.ID)
+			session = nil
+			forceLogin = true
+		}
+	}
+
 	// If no valid session, redirect to Hydra for authentication
 	if session == nil {
-		// Capture the original SAMLRequest so we can replay it after OIDC login
-		samlRequest := r.URL.Query().Get("SAMLRequest")
-		if samlRequest == "" {
-			// Check POST form if not in query string
-			if err := r.ParseForm(); err == nil {
-				samlRequest = r.PostForm.Get("SAMLRequest")
-			}
+		if forceLogin && isPassive {
+			// A new login cannot happen without user interaction
+			sp.server.respondSAMLError(w, req, saml.StatusNoPassive)
+			return nil
+		}
+
+		now := time.Now()
+		nonce, err := newOIDCNonce()
+		if err != nil {
+			sp.server.logger.Errorw("Failed to generate OIDC nonce", "error", err)
+			sp.server.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+			return nil
 		}
-		if samlRequest != "" {
-			sp.server.pendingRequests[req.Request.ID] = pendingAuthnRequest{
-				samlRequest: samlRequest,
-				relayState:  req.RelayState,
+		// The pending request is keyed on an ID of our own rather than the
+		// AuthnRequest ID, which the service provider chooses
+		pending := &PendingAuthnRequest{
+			ID:             newSAMLID(),
+			AuthnRequestID: req.Request.ID,
+			RelayState:     req.RelayState,
+			CodeVerifier:   oauth2.GenerateVerifier(),
+			Nonce:          nonce,
+			CreateTime:     now,
+			ExpireTime:     now.Add(sp.server.pendingRequestTTL()),
+		}
+		if req.Request.ID == "" && req.Request.Issuer != nil {
+			// IdP-initiated SSO: the launch is resumed instead of an AuthnRequest
+			pending.IdPInitiatedEntityID = req.Request.Issuer.Value
+		} else if req.Request.ID != "" {
+			// Capture the original SAMLRequest so we can replay it after OIDC login
+			pending.SAMLRequest = r.URL.Query().Get("SAMLRequest")
+			pending.SigAlg = r.URL.Query().Get("SigAlg")
+			pending.Signature = r.URL.Query().Get("Signature")
+			if pending.SAMLRequest == "" {
+				// Check POST form if not in query string; it is replayed
+				// with the HTTP-Redirect encoding
+				if err := r.ParseForm(); err == nil && r.PostForm.Get("SAMLRequest") != "" {
+					pending.SAMLRequest, err = redirectEncodedRequest(r.PostForm.Get("SAMLRequest"))
+					if err != nil {
+						sp.server.renderError(w, r, "Invalid SAMLRequest", http.StatusBadRequest)
+						return nil
+					}
+				}
 			}
 		}
+		// Saved even without a SAMLRequest to replay, for the PKCE verifier
+		// and nonce of the login
+		if err := sp.server.db.SavePendingAuthnRequest(pending); err != nil {
+			sp.server.logger.Errorw("Failed to save pending authn request", "requestID", pending.ID, "error", err)
+			sp.server.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+			return nil
+		}
 
-		// Build state with request ID and optional relay state
-		state := req.Request.ID
-		if req.RelayState != "" {
-			state += ":" + req.RelayState
+		// The signed state carries the request ID and relay state back to
+		// the callback, bound to this browser
+		state, err := sp.server.newOIDCState(w, r, pending.ID, req.RelayState)
+		if err != nil {
+			sp.server.logger.Errorw("Failed to create OIDC state", "requestID", pending.ID, "error", err)
+			sp.server.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+			return nil
 		}
 
 		sp.server.logger.Info("No valid session found, redirecting to Hydra for authentication")
-		http.Redirect(w, r, sp.server.oauth2Config.AuthCodeURL(state), http.StatusFound)
+		options := append([]oauth2.AuthCodeOption{oauth2.S256ChallengeOption(pending.CodeVerifier), oidc.Nonce(pending.Nonce)},
+			promptOptions(forceLogin, isPassive)...)
+		if acrValues := contexts.acrValues(requestedContext); len(acrValues) > 0 {
+			options = append(options, oauth2.SetAuthURLParam("acr_values", strings.Join(acrValues, " ")))
+		}
+		authCodeURL := sp.server.oauth2Config.AuthCodeURL(state, options...)
+		http.Redirect(w, r, authCodeURL, http.StatusFound)
 		return nil
 	}
 
-	// Apply per-SP attribute mapping if configured
+	if !sp.server.checkAccessPolicy(w, req, session, rawClaims) {
+		return nil
+	}
+
+	// The mapping may clear UserName, which holds the OIDC subject
+	subject := session.UserName
+
+	// Apply per-SP attribute mapping if configured, with the negotiated
+	// NameID format
+	var mapping *AttributeMapping
 	if req.Request.Issuer != nil && req.Request.Issuer.Value != "" {
-		mapping, err := sp.server.db.GetAttributeMapping(req.Request.Issuer.Value)
+		mapping, err = sp.server.db.GetAttributeMapping(req.Request.Issuer.Value)
 		if err != nil {
 			sp.server.logger.Errorw("Error retrieving attribute mapping", "entityID", req.Request.Issuer.Value, "error", err)
+			mapping = nil
 		} else if mapping != nil {
 			sp.server.logger.Infow("Applying per-SP attribute mapping", "entityID", req.Request.Issuer.Value)
-			session = applyAttributeMapping(session, mapping, rawClaims)
+		}
+	}
+	if nameIDFormat != "" {
+		negotiated := AttributeMapping{}
+		if mapping != nil {
+			negotiated = *mapping
+		}
+		negotiated.NameIDFormat = nameIDFormat
+		mapping = &negotiated
+	}
+	if mapping != nil {
+		session, err = applyAttributeMapping(session, mapping, rawClaims)
+		if err != nil {
+			sp.server.logger.Warnw("Attribute expressions failed", "requestID", req.Request.ID, "error", err)
 		}
 	}
 
-	return session
+	return sp.server.issueNameID(w, req, session, subject)
 }
 
 // -------------------------------------------------------------------------
 // OIDC Callback Handler
+
+// resumeOIDCLogin verifies the state of an OIDC callback and consumes the
+// pending request of its login. The pending request holds the PKCE verifier
+// and nonce of the login; consuming it makes the state single-use. It writes
+// the error response and returns false when the callback is rejected.
+func (s *Server) resumeOIDCLogin(w http.ResponseWriter, r *http.Request) (*oidcState, *PendingAuthnRequest, bool) {
+	// Reject forged or replayed callbacks before the code is redeemed
+	state, err := s.verifyOIDCState(r)
+	if err != nil {
+		s.rejectOIDCState(w, r, err)
+		return nil, nil, false
+	}
+	s.logger.Infow("OIDC callback for SAML request", "requestID", state.RequestID)
+
+	pending, err := s.db.ConsumePendingAuthnRequest(state.RequestID)
+	if err != nil {
+		s.logger.Errorw("Failed to retrieve pending authn request", "requestID", state.RequestID, "error", err)
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if pending == nil {
+		s.rejectOIDCState(w, r, &oidcStateError{Reason: "replayed", Message: "no pending login for the state"})
+		return nil, nil, false
+	}
+	return state, pending, true
+}
+
+// handleOIDCError handles a callback where Hydra reports an error instead of
+// a code. A passive login that needs user interaction is answered with a
+// NoPassive Response, a denied login with RequestDenied and any other error
+// with AuthnFailed.
+func (s *Server) handleOIDCError(w http.ResponseWriter, r *http.Request, oidcError string) {
+	_, pending, ok := s.resumeOIDCLogin(w, r)
+	if !ok {
+		return
+	}
+	s.logger.Warnw("Hydra login failed", "requestID", pending.ID, "error", oidcError,
+		"description", r.URL.Query().Get("error_description"))
+
+	status := saml.StatusAuthnFailed
+	switch {
+	case passiveLoginErrors[oidcError]:
+		status = saml.StatusNoPassive
+	case oidcError == "access_denied":
+		status = saml.StatusRequestDenied
+	}
+	s.failLogin(w, r, pending, status, http.StatusUnauthorized, "Login failed. Please try again.")
+}
+
 func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 	ctx, span := s.tracer.Start(r.Context(), "provider.handle_oidc_callback")
 	defer span.End()
@@ -267,15 +575,28 @@ func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 	s.logger.Info("Handling OIDC callback from Hydra")
 	ctx = s.withHydraHTTPClient(ctx)
 
+	if oidcError := r.URL.Query().Get("error"); oidcError != "" {
+		s.handleOIDCError(w, r, oidcError)
+		return
+	}
+
 	// 1. Exchange the Authorization Code for tokens
 	code := r.URL.Query().Get("code")
 	if code == "" {
-		http.Error(w, "No code in callback", http.StatusBadRequest)
+		s.renderError(w, r, "No code in callback", http.StatusBadRequest)
 		return
 	}
 
-	token, err := s.oauth2Config.Exchange(ctx, code)
+	state, pending, ok := s.resumeOIDCLogin(w, r)
+	if !ok {
+		return
+	}
+
+	token, err := s.oauth2Config.Exchange(ctx, code, oauth2.VerifierOption(pending.CodeVerifier))
 	if err != nil {
+		// A rejected code fails the login; an unavailable Hydra is reported
+		// with the Responder status alone
+		samlStatus := ""
 		var retrieveErr *oauth2.RetrieveError
 		switch {
 		case errors.As(err, &retrieveErr):
@@ -287,16 +608,15 @@ func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 			case status >= 400:
 				s.logger.Warnw("Client error from Hydra during token exchange", "status", status, "error", err, "code", retrieveErr.ErrorCode, "description", retrieveErr.ErrorDescription)
 				_ = s.monitor.SetDependencyAvailability(map[string]string{"component": "hydra"}, 1)
+				samlStatus = saml.StatusAuthnFailed
 			default:
 				s.logger.Errorw("Unexpected error from Hydra during token exchange", "status", status, "error", err)
 			}
-			http.Error(w, "Unexpected error. Please try again later.", http.StatusInternalServerError)
-			return
 		default:
 			s.logger.Errorw("Unexpected error during token exchange with Hydra", "error", err)
 			_ = s.monitor.SetDependencyAvailability(map[string]string{"component": "hydra"}, 0)
 		}
-		http.Error(w, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		s.failLogin(w, r, pending, samlStatus, http.StatusInternalServerError, "Unexpected error. Please try again later.")
 		return
 	}
 	_ = s.monitor.SetDependencyAvailability(map[string]string{"component": "hydra"}, 1)
@@ -304,12 +624,18 @@ func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 	// 2. Extract and Verify the ID Token
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
-		http.Error(w, "No id_token field in oauth2 token", http.StatusInternalServerError)
+		s.failLogin(w, r, pending, saml.StatusAuthnFailed, http.StatusInternalServerError, "No id_token field in oauth2 token")
 		return
 	}
 	idToken, err := s.oidcVerifier.Verify(ctx, rawIDToken)
 	if err != nil {
-		http.Error(w, "Failed to verify ID Token: "+err.Error(), http.StatusInternalServerError)
+		s.logger.Warnw("Failed to verify ID Token", "requestID", pending.ID, "error", err)
+		s.failLogin(w, r, pending, saml.StatusAuthnFailed, http.StatusInternalServerError, "Failed to verify ID Token: "+err.Error())
+		return
+	}
+	if idToken.Nonce != pending.Nonce {
+		s.logger.Warnw("ID Token nonce does not match the login", "requestID", pending.ID)
+		s.failLogin(w, r, pending, saml.StatusAuthnFailed, http.StatusBadRequest, "Failed to verify ID Token: nonce mismatch")
 		return
 	}
 
@@ -321,7 +647,7 @@ func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 		Groups []string `json:"groups"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
-		http.Error(w, "Failed to parse claims", http.StatusInternalServerError)
+		s.failLogin(w, r, pending, saml.StatusAuthnFailed, http.StatusInternalServerError, "Failed to parse claims")
 		return
 	}
 
@@ -334,7 +660,8 @@ func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if claims.Email == "" {
-		http.Error(w, "User has no email in ID Token. Cannot authenticate with Service.", http.StatusForbidden)
+		s.logger.Warnw("User has no email in ID Token", "requestID", pending.ID, "sub", claims.Sub)
+		s.failLogin(w, r, pending, saml.StatusRequestDenied, http.StatusForbidden, "User has no email in ID Token. Cannot authenticate with Service.")
 		return
 	}
 
@@ -346,14 +673,21 @@ func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 		displayName = claims.Name
 	}
 
-	// 4. Create a SAML Session
-	sessionID := fmt.Sprintf("_%d", time.Now().UnixNano())
+	// 4. Create a SAML Session. The cookie holds a random token and the
+	// session is stored under its hash; the SessionIndex sent to service
+	// providers is unrelated to either
+	sessionToken, err := newSessionToken()
+	if err != nil {
+		s.logger.Errorw("Failed to generate session token", "error", err)
+		s.failLogin(w, r, pending, "", http.StatusInternalServerError, "Failed to create session")
+		return
+	}
 	samlSession := &saml.Session{
-		ID:             sessionID,
+		ID:             sessionIDFromToken(sessionToken),
 		CreateTime:     time.Now(),
 		ExpireTime:     time.Now().Add(10 * time.Minute),
-		Index:          sessionID,
-		NameID:         claims.Email,  // Service matches users by NameID (Email)
+		Index:          newSAMLID(),
+		NameID:         claims.Email, // Service matches users by NameID (Email)
 		UserEmail:      claims.Email,
 		UserCommonName: displayName,
 		UserName:       claims.Sub, // Store OIDC subject for attribute mapping
@@ -362,53 +696,48 @@ func (s *Server) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
 	// Store the session in database
 	if err := s.db.SaveSession(samlSession, rawClaims); err != nil {
 		s.logger.Errorw("Failed to save session to database", "error", err)
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		s.failLogin(w, r, pending, "", http.StatusInternalServerError, "Failed to create session")
 		return
 	}
 
 	// Set a session cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:     "saml_session",
-		Value:    sessionID,
+		Value:    sessionToken,
 		Path:     "/",
 		MaxAge:   600, // 10 minutes
 		HttpOnly: true,
 		SameSite: http.SameSiteLaxMode,
 	})
-
-	// 5. Parse the state to get SAML request ID and RelayState
-	state := r.URL.Query().Get("state")
-	requestID := ""
-	relayState := ""
-	if state != "" {
-		parts := strings.SplitN(state, ":", 2)
-		requestID = parts[0]
-		if len(parts) > 1 {
-			relayState = parts[1]
-		}
-	}
-
-	if requestID != "" {
-		s.logger.Infow("OIDC callback for SAML request", "requestID", requestID)
+	if pending.SAMLRequest != "" {
+		s.setFreshLoginCookie(w, pending.AuthnRequestID, samlSession.ID)
 	}
 
+	// 5. Replay the original SAMLRequest or IdP-initiated launch of the
+	// pending request
 	redirectURL := fmt.Sprintf("%s/saml/sso", s.config.BridgeBaseURL)
-
-	// Retrieve and replay the original SAMLRequest if available
-	if requestID != "" {
-		if pending, ok := s.pendingRequests[requestID]; ok {
-			delete(s.pendingRequests, requestID)
-			query := url.Values{}
-			query.Set("SAMLRequest", pending.samlRequest)
-			if pending.relayState != "" {
-				query.Set("RelayState", pending.relayState)
-			}
-			redirectURL += "?" + query.Encode()
-		} else if relayState != "" {
-			redirectURL += "?RelayState=" + url.QueryEscape(relayState)
+	switch {
+	case pending.IdPInitiatedEntityID != "":
+		redirectURL = fmt.Sprintf("%s/saml/idp-initiated", s.config.BridgeBaseURL)
+		query := url.Values{}
+		query.Set("sp", pending.IdPInitiatedEntityID)
+		if pending.RelayState != "" {
+			query.Set("RelayState", pending.RelayState)
 		}
-	} else if relayState != "" {
-		redirectURL += "?RelayState=" + url.QueryEscape(relayState)
+		redirectURL += "?" + query.Encode()
+	case pending.SAMLRequest != "":
+		query := url.Values{}
+		query.Set("SAMLRequest", pending.SAMLRequest)
+		if pending.RelayState != "" {
+			query.Set("RelayState", pending.RelayState)
+		}
+		if pending.Signature != "" {
+			query.Set("SigAlg", pending.SigAlg)
+			query.Set("Signature", pending.Signature)
+		}
+		redirectURL += "?" + query.Encode()
+	case state.RelayState != "":
+		redirectURL += "?RelayState=" + url.QueryEscape(state.RelayState)
 	}
 
 	// 6. Redirect back to the SAML SSO handler to continue the flow
@@ -441,93 +770,6 @@ func (sp *serviceProviderAdapter) GetServiceProvider(r *http.Request, servicePro
 	return descriptor, nil
 }
 
-// -------------------------------------------------------------------------
-// Service Provider Registration Handler
-// -------------------------------------------------------------------------
-func (s *Server) handleServiceProviderRegistration(w http.ResponseWriter, r *http.Request) {
-	ctx, span := s.tracer.Start(r.Context(), "provider.handle_service_provider_registration")
-	defer span.End()
-	r = r.WithContext(ctx)
-
-	// Parse the JSON request body
-	var req struct {
-		EntityID         string            `json:"entity_id"`
-		ACSURL           string            `json:"acs_url"`
-		ACSBinding       string            `json:"acs_binding"`
-		AttributeMapping *AttributeMapping `json:"attribute_mapping,omitempty"`
-	}
-
-	contentType := strings.ToLower(r.Header.Get("Content-Type"))
-	if strings.Contains(contentType, "application/json") {
-		// Parse JSON request
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Failed to parse JSON request", http.StatusBadRequest)
-			return
-		}
-	} else if strings.Contains(contentType, "application/x-www-form-urlencoded") || contentType == "" {
-		// Support form-encoded requests (default if no Content-Type)
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, "Failed to parse form request", http.StatusBadRequest)
-			return
-		}
-		req.EntityID = r.FormValue("entity_id")
-		req.ACSURL = r.FormValue("acs_url")
-		req.ACSBinding = r.FormValue("acs_binding")
-		// attribute_mapping is not supported in form-encoded requests
-	} else {
-		http.Error(w, "Unsupported Content-Type", http.StatusBadRequest)
-		return
-	}
-
-	// Validate required fields
-	if req.EntityID == "" || req.ACSURL == "" {
-		http.Error(w, "Missing required fields: entity_id and acs_url are required", http.StatusBadRequest)
-		return
-	}
-
-	// Validate that ACSURL is a valid URL
-	acsURL, err := url.Parse(req.ACSURL)
-	if err != nil || acsURL.Scheme == "" || acsURL.Host == "" {
-		http.Error(w, "Invalid acs_url: must be a valid URL with scheme and host", http.StatusBadRequest)
-		return
-	}
-	if acsURL.Scheme != "http" && acsURL.Scheme != "https" {
-		http.Error(w, "Invalid acs_url: scheme must be http or https", http.StatusBadRequest)
-		return
-	}
-
-	validBindings := map[string]bool{
-		saml.HTTPPostBinding:     true,
-		saml.HTTPRedirectBinding: true,
-	}
-	if req.ACSBinding == "" {
-		// Apply default binding when not provided
-		req.ACSBinding = saml.HTTPPostBinding
-	} else if !validBindings[req.ACSBinding] {
-		http.Error(w, "Invalid acs_binding value", http.StatusBadRequest)
-		return
-	}
-
-	// Save to database
-	if err := s.db.SaveServiceProvider(req.EntityID, req.ACSURL, req.ACSBinding, req.AttributeMapping); err != nil {
-		s.logger.Errorw("Failed to save service provider", "error", err)
-		http.Error(w, "Failed to save service provider", http.StatusInternalServerError)
-		return
-	}
-
-	s.logger.Infow("Service provider registered successfully", "entityID", req.EntityID)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	response := map[string]string{
-		"status":    "success",
-		"message":   "Service provider registered",
-		"entity_id": req.EntityID,
-	}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		s.logger.Errorw("Failed to encode JSON response", "error", err)
-	}
-}
-
 func (s *Server) parseURL(u string) url.URL {
 	parsed, _ := url.Parse(u)
 	return *parsed
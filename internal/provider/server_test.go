@@ -64,21 +64,12 @@ func (m *mockDatabase) GetSession(sessionID string) (*saml.Session, map[string]i
 	return session, m.sessionClaims[sessionID]
 }
 
-func (m *mockDatabase) SaveServiceProvider(entityID, acsURL, acsBinding string, attributeMapping *AttributeMapping) error {
-	m.serviceProviders[entityID] = &saml.EntityDescriptor{
-		EntityID: entityID,
-		SPSSODescriptors: []saml.SPSSODescriptor{
-			{
-				AssertionConsumerServices: []saml.IndexedEndpoint{
-					{
-						Binding:  acsBinding,
-						Location: acsURL,
-						Index:    1,
-					},
-				},
-			},
-		},
+func (m *mockDatabase) SaveServiceProvider(sp *ServiceProvider) error {
+	descriptor, err := sp.EntityDescriptor()
+	if err != nil {
+		return err
 	}
+	m.serviceProviders[sp.EntityID] = descriptor
 	return nil
 }
 
@@ -140,7 +131,6 @@ func setupTestServer(t *testing.T) *Server {
 		},
 		logger:          logger,
 		db:              NewDatabase(testDB, logger),
-		pendingRequests: make(map[string]pendingAuthnRequest),
 		router:          chi.NewRouter(),
 		hydraHTTPClient: hydraStub.Client(),
 		monitor:         monitoring.NewNoopMonitor("identity-saml-provider", logger),
@@ -180,10 +170,6 @@ func TestNewServer(t *testing.T) {
 	if server.router == nil {
 		t.Error("Expected router to be initialized")
 	}
-
-	if server.pendingRequests == nil {
-		t.Error("Expected pendingRequests map to be initialized")
-	}
 }
 
 func TestSetupRoutes(t *testing.T) {
@@ -306,6 +292,40 @@ func TestHandleServiceProviderRegistration_FormData(t *testing.T) {
 	}
 }
 
+func TestHandleServiceProviderRegistration_FormMetadataFields(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetupRoutes()
+
+	testCases := []struct {
+		name    string
+		field   string
+		value   string
+		message string
+	}{
+		{"non-numeric refresh interval", "metadata_refresh_interval_seconds", "hourly", "invalid metadata_refresh_interval_seconds value"},
+		{"refresh interval without URL", "metadata_refresh_interval_seconds", "3600", "requires metadata_url"},
+		{"invalid signing certificate", "metadata_signing_cert", "not a certificate", "invalid metadata_signing_cert"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			formData := url.Values{}
+			formData.Set("entity_id", "http://example.com/saml/metadata")
+			formData.Set("acs_url", "http://example.com/saml/acs")
+			formData.Set(tc.field, tc.value)
+
+			req := httptest.NewRequest(http.MethodPost, "/admin/service-providers", strings.NewReader(formData.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			server.handleServiceProviderRegistration(rec, req)
+
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), tc.message) {
+				t.Errorf("Expected status %d mentioning %q, got %d: %s", http.StatusBadRequest, tc.message, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
 func TestHandleServiceProviderRegistration_MissingFields(t *testing.T) {
 	server := setupTestServer(t)
 	server.SetupRoutes()
@@ -523,7 +543,7 @@ func TestServiceProviderAdapter_GetServiceProvider(t *testing.T) {
 	acsURL := "http://example.com/acs"
 
 	// Save a service provider
-	err = db.SaveServiceProvider(entityID, acsURL, saml.HTTPPostBinding, nil)
+	err = db.SaveServiceProvider(&ServiceProvider{EntityID: entityID, ACSURL: acsURL, ACSBinding: saml.HTTPPostBinding})
 	if err != nil {
 		t.Skipf("Skipping test: cannot initialize test data: %v", err)
 	}
@@ -560,7 +580,8 @@ func TestSessionProviderAdapter_GetSession_WithValidCookie(t *testing.T) {
 	}
 
 	// Create a mock session in the database
-	sessionID := "test-session-123"
+	sessionToken := "test-session-123"
+	sessionID := sessionIDFromToken(sessionToken)
 
 	// Create and save a real session in the test database
 	session := &saml.Session{
@@ -578,18 +599,13 @@ func TestSessionProviderAdapter_GetSession_WithValidCookie(t *testing.T) {
 		t.Skipf("Cannot save test session: %v", err)
 	}
 
-	server.pendingRequests["test-request-id"] = pendingAuthnRequest{
-		samlRequest: "test-saml-request",
-		relayState:  "test-relay-state",
-	}
-
 	adapter := &sessionProviderAdapter{server: server}
 
 	// Create a request with session cookie
 	req := httptest.NewRequest(http.MethodGet, "/saml/sso?SAMLRequest=test", nil)
 	req.AddCookie(&http.Cookie{
 		Name:  "saml_session",
-		Value: sessionID,
+		Value: sessionToken,
 	})
 
 	rec := httptest.NewRecorder()
@@ -625,6 +641,14 @@ func TestSessionProviderAdapter_GetSession_WithValidCookie(t *testing.T) {
 
 func TestSessionProviderAdapter_GetSession_NoValidSession(t *testing.T) {
 	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+
 	server.oauth2Config = &oauth2.Config{
 		ClientID:     "test-client",
 		ClientSecret: "test-secret",
@@ -659,14 +683,21 @@ func TestSessionProviderAdapter_GetSession_NoValidSession(t *testing.T) {
 	}
 
 	// Verify pending request was stored
-	if pending, ok := server.pendingRequests["test-auth-request"]; !ok {
+	pending, err := server.db.ConsumePendingAuthnRequest(oidcStateFromRedirect(t, server, rec).RequestID)
+	if err != nil {
+		t.Fatalf("ConsumePendingAuthnRequest failed: %v", err)
+	}
+	if pending == nil {
 		t.Error("Expected pending request to be stored")
 	} else {
-		if pending.samlRequest != "test-request" {
-			t.Errorf("Expected SAMLRequest 'test-request', got '%s'", pending.samlRequest)
+		if pending.ID == "test-auth-request" || pending.AuthnRequestID != "test-auth-request" {
+			t.Errorf("Expected a generated ID for AuthnRequest 'test-auth-request', got '%s' for '%s'", pending.ID, pending.AuthnRequestID)
+		}
+		if pending.SAMLRequest != "test-request" {
+			t.Errorf("Expected SAMLRequest 'test-request', got '%s'", pending.SAMLRequest)
 		}
-		if pending.relayState != "test-relay-state" {
-			t.Errorf("Expected RelayState 'test-relay-state', got '%s'", pending.relayState)
+		if pending.RelayState != "test-relay-state" {
+			t.Errorf("Expected RelayState 'test-relay-state', got '%s'", pending.RelayState)
 		}
 	}
 }
@@ -688,38 +719,35 @@ func TestParseURL(t *testing.T) {
 	}
 }
 
-func TestPendingRequestsManagement(t *testing.T) {
+func TestPendingRequestTTL_Default(t *testing.T) {
 	server := setupTestServer(t)
 
-	requestID := "test-request-123"
-	pending := pendingAuthnRequest{
-		samlRequest: "encoded-saml-request",
-		relayState:  "test-relay",
+	if ttl := server.pendingRequestTTL(); ttl != defaultPendingRequestTTL {
+		t.Errorf("Expected default TTL %s, got %s", defaultPendingRequestTTL, ttl)
 	}
 
-	// Store pending request
-	server.pendingRequests[requestID] = pending
-
-	// Retrieve it
-	retrieved, ok := server.pendingRequests[requestID]
-	if !ok {
-		t.Fatal("Expected to find pending request")
+	server.config.PendingRequestTTL = 2 * time.Minute
+	if ttl := server.pendingRequestTTL(); ttl != 2*time.Minute {
+		t.Errorf("Expected configured TTL 2m, got %s", ttl)
 	}
+}
 
-	if retrieved.samlRequest != pending.samlRequest {
-		t.Errorf("Expected SAMLRequest '%s', got '%s'", pending.samlRequest, retrieved.samlRequest)
-	}
+func TestRunPendingRequestPurger_StopsOnCancel(t *testing.T) {
+	server := setupTestServer(t)
 
-	if retrieved.relayState != pending.relayState {
-		t.Errorf("Expected RelayState '%s', got '%s'", pending.relayState, retrieved.relayState)
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.RunPendingRequestPurger(ctx)
+		close(done)
+	}()
 
-	// Delete it
-	delete(server.pendingRequests, requestID)
+	cancel()
 
-	// Verify deletion
-	if _, ok := server.pendingRequests[requestID]; ok {
-		t.Error("Expected pending request to be deleted")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected purger to stop after context cancellation")
 	}
 }
 
@@ -878,7 +906,8 @@ func TestHandleOIDCCallback_InvalidCode(t *testing.T) {
 	}
 
 	// Request with invalid code
-	req := httptest.NewRequest(http.MethodGet, "/saml/callback?code=invalid-code&state=test", nil)
+	pending := savePendingLogin(t, server)
+	req := oidcCallbackRequest(t, server, "invalid-code", pending.ID, "")
 	rec := httptest.NewRecorder()
 
 	server.handleOIDCCallback(rec, req)
@@ -911,7 +940,8 @@ func TestSessionProviderAdapter_GetSession_WithExpiredSession(t *testing.T) {
 	}
 
 	// Create an expired session
-	sessionID := "expired-session-123"
+	sessionToken := "expired-session-123"
+	sessionID := sessionIDFromToken(sessionToken)
 	expiredSession := &saml.Session{
 		ID:             sessionID,
 		CreateTime:     time.Now().Add(-20 * time.Minute),
@@ -933,7 +963,7 @@ func TestSessionProviderAdapter_GetSession_WithExpiredSession(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/saml/sso?SAMLRequest=test", nil)
 	req.AddCookie(&http.Cookie{
 		Name:  "saml_session",
-		Value: sessionID,
+		Value: sessionToken,
 	})
 
 	rec := httptest.NewRecorder()
@@ -953,13 +983,21 @@ func TestSessionProviderAdapter_GetSession_WithExpiredSession(t *testing.T) {
 	}
 
 	// Should have stored pending request
-	if _, ok := server.pendingRequests["test-auth-request"]; !ok {
+	if pending, _ := server.db.ConsumePendingAuthnRequest(oidcStateFromRedirect(t, server, rec).RequestID); pending == nil {
 		t.Error("Expected pending request to be stored")
 	}
 }
 
 func TestSessionProviderAdapter_GetSession_WithRelayState(t *testing.T) {
 	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+
 	server.oauth2Config = &oauth2.Config{
 		ClientID:     "test-client",
 		ClientSecret: "test-secret",
@@ -988,12 +1026,14 @@ func TestSessionProviderAdapter_GetSession_WithRelayState(t *testing.T) {
 	}
 
 	// Should preserve RelayState in pending requests
-	if pending, ok := server.pendingRequests["test-request-with-relay"]; !ok {
+	pending, err := server.db.ConsumePendingAuthnRequest(oidcStateFromRedirect(t, server, rec).RequestID)
+	if err != nil {
+		t.Fatalf("ConsumePendingAuthnRequest failed: %v", err)
+	}
+	if pending == nil {
 		t.Error("Expected pending request to be stored")
-	} else {
-		if pending.relayState != "my-relay-state" {
-			t.Errorf("Expected RelayState 'my-relay-state', got '%s'", pending.relayState)
-		}
+	} else if pending.RelayState != "my-relay-state" {
+		t.Errorf("Expected RelayState 'my-relay-state', got '%s'", pending.RelayState)
 	}
 }
 
@@ -1399,11 +1439,10 @@ func TestResponseTimeMiddlewareRecordsMetrics(t *testing.T) {
 			BridgeBaseURL:  "http://localhost:8082",
 			BridgeBasePort: "8082",
 		},
-		logger:          logger,
-		monitor:         mockMonitor,
-		tracer:          tracing.NewNoopTracer(),
-		pendingRequests: make(map[string]pendingAuthnRequest),
-		router:          chi.NewRouter(),
+		logger:  logger,
+		monitor: mockMonitor,
+		tracer:  tracing.NewNoopTracer(),
+		router:  chi.NewRouter(),
 	}
 
 	server.samlIdp = &saml.IdentityProvider{
@@ -1457,11 +1496,10 @@ func TestResponseTimeMiddlewareIncludesRouteAndStatus(t *testing.T) {
 			BridgeBaseURL:  "http://localhost:8082",
 			BridgeBasePort: "8082",
 		},
-		logger:          logger,
-		monitor:         mockMonitor,
-		tracer:          tracing.NewNoopTracer(),
-		pendingRequests: make(map[string]pendingAuthnRequest),
-		router:          chi.NewRouter(),
+		logger:  logger,
+		monitor: mockMonitor,
+		tracer:  tracing.NewNoopTracer(),
+		router:  chi.NewRouter(),
 	}
 
 	server.samlIdp = &saml.IdentityProvider{
@@ -1527,7 +1565,6 @@ func TestDependencyAvailabilityOnHydraInitialize(t *testing.T) {
 		logger:          logger,
 		monitor:         mockMonitor,
 		tracer:          tracing.NewNoopTracer(),
-		pendingRequests: make(map[string]pendingAuthnRequest),
 		router:          chi.NewRouter(),
 		hydraHTTPClient: hydraStub.Client(),
 	}
@@ -1581,11 +1618,10 @@ func TestDependencyAvailabilityOnHydraTokenExchange(t *testing.T) {
 			ClientID:      "test-client",
 			ClientSecret:  "test-secret",
 		},
-		logger:          logger,
-		monitor:         mockMonitor,
-		tracer:          tracing.NewNoopTracer(),
-		pendingRequests: make(map[string]pendingAuthnRequest),
-		router:          chi.NewRouter(),
+		logger:  logger,
+		monitor: mockMonitor,
+		tracer:  tracing.NewNoopTracer(),
+		router:  chi.NewRouter(),
 		oauth2Config: &oauth2.Config{
 			ClientID:     "test-client",
 			ClientSecret: "test-secret",
@@ -1600,9 +1636,11 @@ func TestDependencyAvailabilityOnHydraTokenExchange(t *testing.T) {
 	}
 
 	server.SetupRoutes()
+	server.db = setupTestServer(t).db
 
 	// Make request to OIDC callback with invalid code
-	req := httptest.NewRequest(http.MethodGet, "/saml/callback?code=invalid&state=test", nil)
+	pending := savePendingLogin(t, server)
+	req := oidcCallbackRequest(t, server, "invalid", pending.ID, "")
 	rec := httptest.NewRecorder()
 
 	server.handleOIDCCallback(rec, req)
@@ -1643,11 +1681,10 @@ func TestMetricsEndpointWithCustomServiceName(t *testing.T) {
 			BridgeBaseURL:  "http://localhost:8082",
 			BridgeBasePort: "8082",
 		},
-		logger:          logger,
-		monitor:         mockMonitor,
-		tracer:          tracing.NewNoopTracer(),
-		pendingRequests: make(map[string]pendingAuthnRequest),
-		router:          chi.NewRouter(),
+		logger:  logger,
+		monitor: mockMonitor,
+		tracer:  tracing.NewNoopTracer(),
+		router:  chi.NewRouter(),
 	}
 
 	server.samlIdp = &saml.IdentityProvider{
@@ -1736,12 +1773,11 @@ func TestHandleOIDCCallback_MissingIDToken(t *testing.T) {
 			ClientID:      "test-client",
 			ClientSecret:  "test-secret",
 		},
-		logger:          logger,
-		db:              NewDatabase(nil, logger),
-		pendingRequests: map[string]pendingAuthnRequest{},
-		router:          chi.NewRouter(),
-		monitor:         monitoring.NewNoopMonitor("identity-saml-provider", logger),
-		tracer:          tracing.NewNoopTracer(),
+		logger:  logger,
+		db:      setupTestServer(t).db,
+		router:  chi.NewRouter(),
+		monitor: monitoring.NewNoopMonitor("identity-saml-provider", logger),
+		tracer:  tracing.NewNoopTracer(),
 		oauth2Config: &oauth2.Config{
 			ClientID:     "test-client",
 			ClientSecret: "test-secret",
@@ -1754,7 +1790,8 @@ func TestHandleOIDCCallback_MissingIDToken(t *testing.T) {
 		hydraHTTPClient: hydraStub.Client(),
 	}
 
-	req := httptest.NewRequest(http.MethodGet, "/saml/callback?code=test-code&state=abc", nil)
+	pending := savePendingLogin(t, s)
+	req := oidcCallbackRequest(t, s, "test-code", pending.ID, "")
 	rec := httptest.NewRecorder()
 
 	s.handleOIDCCallback(rec, req)
@@ -1776,6 +1813,27 @@ type testMockMonitor struct {
 	serviceName       string
 	responseTimeCalls []responseTimeMetricCall
 	dependencyCalls   []dependencyAvailabilityCall
+	metadataCalls     []metadataRefreshCall
+	keyPairReloads    []keyPairReloadCall
+	sessionReaps      []sessionReapCall
+	stateRejections   []string
+	accessDenials     []string
+}
+
+type sessionReapCall struct {
+	Metric string
+	Value  float64
+}
+
+type keyPairReloadCall struct {
+	Tags  map[string]string
+	Value float64
+}
+
+type metadataRefreshCall struct {
+	Metric string
+	Tags   map[string]string
+	Value  float64
 }
 
 type responseTimeMetricCall struct {
@@ -1834,3 +1892,38 @@ func (m *testMockMonitor) SetDependencyAvailability(tags map[string]string, valu
 	m.metrics[key]["availability"] = value
 	return nil
 }
+
+func (m *testMockMonitor) SetMetadataRefreshStatus(tags map[string]string, value float64) error {
+	m.metadataCalls = append(m.metadataCalls, metadataRefreshCall{Metric: "status", Tags: tags, Value: value})
+	return nil
+}
+
+func (m *testMockMonitor) SetMetadataLastSuccess(tags map[string]string, value float64) error {
+	m.metadataCalls = append(m.metadataCalls, metadataRefreshCall{Metric: "last_success", Tags: tags, Value: value})
+	return nil
+}
+
+func (m *testMockMonitor) SetKeyPairReloadStatus(tags map[string]string, value float64) error {
+	m.keyPairReloads = append(m.keyPairReloads, keyPairReloadCall{Tags: tags, Value: value})
+	return nil
+}
+
+func (m *testMockMonitor) SetSessionReapDuration(tags map[string]string, value float64) error {
+	m.sessionReaps = append(m.sessionReaps, sessionReapCall{Metric: "duration", Value: value})
+	return nil
+}
+
+func (m *testMockMonitor) AddSessionsReaped(tags map[string]string, value float64) error {
+	m.sessionReaps = append(m.sessionReaps, sessionReapCall{Metric: "reaped", Value: value})
+	return nil
+}
+
+func (m *testMockMonitor) AddOIDCStateRejection(tags map[string]string, value float64) error {
+	m.stateRejections = append(m.stateRejections, tags["reason"])
+	return nil
+}
+
+func (m *testMockMonitor) AddAccessDenial(tags map[string]string, value float64) error {
+	m.accessDenials = append(m.accessDenials, tags["entity_id"])
+	return nil
+}
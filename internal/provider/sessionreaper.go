@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultSessionReapInterval = 10 * time.Minute
+	// DefaultSessionReapBatchSize is the number of expired sessions deleted
+	// per statement when no batch size is configured.
+	DefaultSessionReapBatchSize = 1000
+)
+
+// RunSessionReaper periodically deletes expired sessions until ctx is
+// cancelled. Every replica may run it; an advisory lock makes them take
+// turns.
+func (s *Server) RunSessionReaper(ctx context.Context) {
+	interval := s.config.SessionReapInterval
+	if interval <= 0 {
+		interval = defaultSessionReapInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.reapExpiredSessions(ctx)
+		}
+	}
+}
+
+// reapExpiredSessions runs one purge of expired sessions and records the
+// rows deleted and its duration.
+func (s *Server) reapExpiredSessions(ctx context.Context) {
+	batchSize := s.config.SessionReapBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultSessionReapBatchSize
+	}
+
+	start := time.Now()
+	purged, locked, err := s.db.PurgeExpiredSessions(ctx, batchSize)
+	if err == nil && !locked {
+		s.logger.Debugw("Skipped expired session purge, another replica holds the lock")
+		return
+	}
+	_ = s.monitor.SetSessionReapDuration(nil, time.Since(start).Seconds())
+	_ = s.monitor.AddSessionsReaped(nil, float64(purged))
+
+	if err != nil {
+		s.logger.Errorw("Failed to purge expired sessions", "purged", purged, "error", err)
+		return
+	}
+	if purged > 0 {
+		s.logger.Infow("Purged expired sessions", "count", purged, "duration", time.Since(start))
+	}
+}
@@ -0,0 +1,30 @@
+package provider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// sessionTokenBytes is the entropy of the session tokens set in the
+// saml_session cookie.
+const sessionTokenBytes = 32
+
+// newSessionToken returns a random token for the saml_session cookie. The
+// token itself is never stored; see sessionIDFromToken.
+func newSessionToken() (string, error) {
+	b := make([]byte, sessionTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// sessionIDFromToken returns the ID the session of a saml_session cookie is
+// stored under: the SHA-256 of the token, so the sessions table cannot be used
+// to impersonate its users.
+func sessionIDFromToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,22 @@
+package provider
+
+import "testing"
+
+func TestSessionToken(t *testing.T) {
+	first, err := newSessionToken()
+	if err != nil {
+		t.Fatalf("newSessionToken failed: %v", err)
+	}
+	second, _ := newSessionToken()
+	if first == second || len(first) < 43 {
+		t.Errorf("Expected distinct 256-bit tokens, got %q and %q", first, second)
+	}
+
+	id := sessionIDFromToken(first)
+	if id == first || len(id) != 64 {
+		t.Errorf("Expected a hex SHA-256 of the token, got %q", id)
+	}
+	if sessionIDFromToken(first) != id {
+		t.Error("Expected the session ID to be stable for a token")
+	}
+}
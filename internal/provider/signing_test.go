@@ -0,0 +1,209 @@
+package provider
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// testECDSAKeyPair returns a new ECDSA key on curve and its certificate.
+func testECDSAKeyPair(t *testing.T, curve elliptic.Curve) (*ecdsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "idp"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(certDER)
+	return key, cert
+}
+
+func TestSignatureMethodFor(t *testing.T) {
+	rsaKey, _ := testEncryptionKeyPair(t)
+	ecKey, _ := testECDSAKeyPair(t, elliptic.P256())
+
+	tests := []struct {
+		name   string
+		key    interface{}
+		method string
+		want   string
+	}{
+		{"default RSA", &rsaKey.PublicKey, "", dsig.RSASHA256SignatureMethod},
+		{"default ECDSA", &ecKey.PublicKey, "", dsig.ECDSASHA256SignatureMethod},
+		{"legacy SHA-1", &rsaKey.PublicKey, dsig.RSASHA1SignatureMethod, dsig.RSASHA1SignatureMethod},
+		{"RSA method on ECDSA key", &ecKey.PublicKey, dsig.RSASHA384SignatureMethod, dsig.ECDSASHA384SignatureMethod},
+		{"ECDSA method on RSA key", &rsaKey.PublicKey, dsig.ECDSASHA512SignatureMethod, dsig.RSASHA512SignatureMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signatureMethodFor(tt.key, tt.method); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestValidateSigningKey(t *testing.T) {
+	rsaKey, _ := testEncryptionKeyPair(t)
+	p256, _ := testECDSAKeyPair(t, elliptic.P256())
+	p384, _ := testECDSAKeyPair(t, elliptic.P384())
+	p521, _ := testECDSAKeyPair(t, elliptic.P521())
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	for name, key := range map[string]interface{}{"RSA": rsaKey, "P-256": p256, "P-384": p384} {
+		if _, err := validateSigningKey(key); err != nil {
+			t.Errorf("Expected a %s key to be accepted, got %v", name, err)
+		}
+	}
+	for name, key := range map[string]interface{}{"P-521": p521, "Ed25519": edKey} {
+		if _, err := validateSigningKey(key); err == nil {
+			t.Errorf("Expected a %s key to be rejected", name)
+		}
+	}
+}
+
+func TestSigning_ECDSA(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	key, cert := testECDSAKeyPair(t, elliptic.P384())
+	server.samlIdp.Key = key
+	server.samlIdp.Certificate = cert
+	server.config.SignatureAlgorithm = dsig.RSASHA384SignatureMethod
+
+	authnRequest := testAuthnRequest(server, "https://sp.example.com")
+	signature, err := server.signEnveloped(authnRequest.Element())
+	if err != nil {
+		t.Fatalf("signEnveloped failed: %v", err)
+	}
+	if method := signature.FindElement("./SignedInfo/SignatureMethod"); method.SelectAttrValue("Algorithm", "") != dsig.ECDSASHA384SignatureMethod {
+		t.Errorf("Expected the ECDSA method with the configured digest, got %s", method.SelectAttrValue("Algorithm", ""))
+	}
+	value, _ := base64.StdEncoding.DecodeString(signature.FindElement("./SignatureValue").Text())
+	if len(value) != 96 {
+		t.Errorf("Expected an r||s signature value of 96 bytes, got %d", len(value))
+	}
+	authnRequest.Signature = signature
+	doc := etree.NewDocument()
+	doc.SetRoot(authnRequest.Element())
+	signed, _ := doc.WriteToBytes()
+	if _, err := verifyEnvelopedSignature(signed, []*x509.Certificate{cert}); err != nil {
+		t.Errorf("Expected a valid enveloped signature, got %v", err)
+	}
+
+	location, err := server.signedRedirectURL("SAMLRequest", testAuthnRequest(server, "https://sp.example.com").Element(),
+		"https://sp.example.com/slo", "")
+	if err != nil {
+		t.Fatalf("signedRedirectURL failed: %v", err)
+	}
+	parsed, _ := url.Parse(location)
+	if err := verifyRedirectSignature(parsed.RawQuery, []*x509.Certificate{cert}); err != nil {
+		t.Errorf("Expected a valid redirect signature, got %v", err)
+	}
+}
+
+func TestIdentityProvider_SignatureAlgorithm(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+	server.config.SignatureAlgorithm = dsig.RSASHA1SignatureMethod
+
+	idp := server.identityProvider()
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs", ACSBinding: saml.HTTPPostBinding}
+	descriptor, _ := sp.EntityDescriptor()
+	spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+	req := &saml.IdpAuthnRequest{IDP: idp, HTTPRequest: httptest.NewRequest(http.MethodGet, "/saml/sso", nil), Now: saml.TimeNow(),
+		ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs}
+	session := &saml.Session{ID: "session", Index: "session", NameID: "user@example.com", ExpireTime: time.Now().Add(time.Hour)}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		t.Fatalf("MakeAssertion failed: %v", err)
+	}
+	if err := req.MakeAssertionEl(); err != nil {
+		t.Fatalf("MakeAssertionEl failed: %v", err)
+	}
+
+	method := req.AssertionEl.FindElement("./Signature/SignedInfo/SignatureMethod").SelectAttrValue("Algorithm", "")
+	digest := req.AssertionEl.FindElement("./Signature/SignedInfo/Reference/DigestMethod").SelectAttrValue("Algorithm", "")
+	if method != dsig.RSASHA1SignatureMethod || digest != "http://www.w3.org/2000/09/xmldsig#sha1" {
+		t.Errorf("Expected an RSA-SHA1 signature with a SHA-1 digest, got %s and %s", method, digest)
+	}
+}
+
+func TestValidateServiceProvider_SignatureAlgorithm(t *testing.T) {
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs",
+		SignatureAlgorithm: dsig.RSASHA512SignatureMethod}
+	if err := validateServiceProvider(sp); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	sp.SignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#dsa-sha1"
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for an unsupported signature algorithm")
+	}
+}
+
+func TestMakeResponse_SigningMode(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	tests := []struct {
+		mode                        string
+		wantResponse, wantAssertion bool
+	}{
+		{SigningModeBoth, true, true},
+		{SigningModeResponse, true, false},
+		{SigningModeAssertion, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs", ACSBinding: saml.HTTPPostBinding}
+			descriptor, _ := sp.EntityDescriptor()
+			spsso, acs := selectACS(descriptor, saml.HTTPPostBinding)
+			req := &saml.IdpAuthnRequest{IDP: server.identityProvider(), HTTPRequest: httptest.NewRequest(http.MethodGet, "/saml/sso", nil),
+				Now: saml.TimeNow(), ServiceProviderMetadata: descriptor, SPSSODescriptor: spsso, ACSEndpoint: acs}
+			session := &saml.Session{ID: "session", Index: "session", NameID: "user@example.com", ExpireTime: time.Now().Add(time.Hour)}
+			if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+				t.Fatalf("MakeAssertion failed: %v", err)
+			}
+
+			if err := makeResponse(req, tt.mode); err != nil {
+				t.Fatalf("makeResponse failed: %v", err)
+			}
+			if got := req.ResponseEl.FindElement("./Signature") != nil; got != tt.wantResponse {
+				t.Errorf("Expected a signed response: %v, got %v", tt.wantResponse, got)
+			}
+			if got := req.ResponseEl.FindElement("./Assertion/Signature") != nil; got != tt.wantAssertion {
+				t.Errorf("Expected a signed assertion: %v, got %v", tt.wantAssertion, got)
+			}
+		})
+	}
+}
+
+func TestValidateServiceProvider_SigningMode(t *testing.T) {
+	sp := &ServiceProvider{EntityID: "https://sp.example.com", ACSURL: "https://sp.example.com/acs", SigningMode: SigningModeAssertion}
+	if err := validateServiceProvider(sp); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	sp.SigningMode = "none"
+	if err := validateServiceProvider(sp); err == nil {
+		t.Error("Expected an error for an unknown signing mode")
+	}
+}
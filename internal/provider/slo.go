@@ -0,0 +1,618 @@
+package provider
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	// maxSAMLMessageSize bounds the decoded size of SAML protocol messages
+	// received on the SLO endpoint.
+	maxSAMLMessageSize = 256 << 10
+
+	// pendingLogoutTTL is how long the browser has to complete the round
+	// trips to every session participant.
+	pendingLogoutTTL = 10 * time.Minute
+
+	// statusPartialLogout is the second-level status returned to the
+	// initiating SP when another participant could not be logged out.
+	statusPartialLogout = "urn:oasis:names:tc:SAML:2.0:status:PartialLogout"
+)
+
+// samlMessage is a SAML protocol message received over the HTTP-Redirect or
+// HTTP-POST binding.
+type samlMessage struct {
+	Binding    string
+	IsResponse bool
+	Data       []byte
+	RelayState string
+}
+
+// readSAMLMessage decodes the SAMLRequest or SAMLResponse parameter of r.
+func readSAMLMessage(r *http.Request) (*samlMessage, error) {
+	msg := &samlMessage{Binding: saml.HTTPRedirectBinding}
+	values := r.URL.Query()
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("failed to parse form: %w", err)
+		}
+		msg.Binding = saml.HTTPPostBinding
+		values = r.PostForm
+	}
+
+	encoded := values.Get("SAMLRequest")
+	if encoded == "" {
+		encoded = values.Get("SAMLResponse")
+		msg.IsResponse = true
+	}
+	if encoded == "" {
+		return nil, errors.New("missing SAMLRequest or SAMLResponse parameter")
+	}
+	msg.RelayState = values.Get("RelayState")
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 encoding: %w", err)
+	}
+	if msg.Binding == saml.HTTPRedirectBinding {
+		data, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), maxSAMLMessageSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DEFLATE encoding: %w", err)
+		}
+	}
+	if len(data) > maxSAMLMessageSize {
+		return nil, fmt.Errorf("message exceeds the %d byte limit", maxSAMLMessageSize)
+	}
+	if err := xrv.Validate(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("invalid XML: %w", err)
+	}
+
+	msg.Data = data
+	return msg, nil
+}
+
+// newSAMLID returns a random identifier usable as a SAML ID attribute.
+func newSAMLID() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return "id-" + hex.EncodeToString(b)
+}
+
+// -------------------------------------------------------------------------
+// Single Logout Handlers
+// -------------------------------------------------------------------------
+
+// handleSLO is the IdP SingleLogoutService. It accepts LogoutRequests from
+// session participants and the LogoutResponses of participants the IdP has
+// propagated a logout to.
+func (s *Server) handleSLO(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_slo")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	msg, err := readSAMLMessage(r)
+	if err != nil {
+		s.logger.Warnw("Invalid SAML message on SLO endpoint", "error", err)
+		s.renderError(w, r, "Invalid SAML message", http.StatusBadRequest)
+		return
+	}
+
+	if msg.IsResponse {
+		s.handleLogoutResponse(w, r, msg)
+		return
+	}
+	s.handleLogoutRequest(w, r, msg)
+}
+
+// handleLogoutPage asks the user to confirm an IdP-initiated logout, which
+// is only started by a same-origin POST so other sites cannot log the
+// browser out.
+func (s *Server) handleLogoutPage(w http.ResponseWriter, r *http.Request) {
+	data := &pageData{URL: s.config.BridgeBaseURL + "/saml/logout", CorrelationID: correlationID(r)}
+	if err := s.renderPage(w, http.StatusOK, logoutPageTemplate, data); err != nil {
+		s.logger.Errorw("Failed to render logout page", "error", err)
+	}
+}
+
+// sameOriginOnly rejects cross-origin browser requests to next, as reported
+// by the Sec-Fetch-Site or Origin header.
+func (s *Server) sameOriginOnly(next http.HandlerFunc) http.HandlerFunc {
+	protection := http.NewCrossOriginProtection()
+	protection.SetDenyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.renderError(w, r, "Cross-origin request rejected", http.StatusForbidden)
+	}))
+	return protection.Handler(next).ServeHTTP
+}
+
+// handleIdPInitiatedLogout ends the browser's session and logs it out of
+// every service provider that took part in it.
+func (s *Server) handleIdPInitiatedLogout(w http.ResponseWriter, r *http.Request) {
+	ctx, span := s.tracer.Start(r.Context(), "provider.handle_idp_initiated_logout")
+	defer span.End()
+	r = r.WithContext(ctx)
+
+	var sessionIDs []string
+	if cookie, err := r.Cookie("saml_session"); err == nil && cookie.Value != "" {
+		sessionIDs = append(sessionIDs, sessionIDFromToken(cookie.Value))
+	}
+
+	participants, err := s.endSessions(w, sessionIDs, "")
+	if err != nil {
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Infow("IdP-initiated logout", "participants", len(participants))
+	now := time.Now()
+	s.continueLogout(w, r, &PendingLogout{
+		ID:           newSAMLID(),
+		Participants: participants,
+		CreateTime:   now,
+		ExpireTime:   now.Add(pendingLogoutTTL),
+	})
+}
+
+func (s *Server) handleLogoutRequest(w http.ResponseWriter, r *http.Request, msg *samlMessage) {
+	var req saml.LogoutRequest
+	if err := xml.Unmarshal(msg.Data, &req); err != nil {
+		s.logger.Warnw("Failed to parse LogoutRequest", "error", err)
+		s.renderError(w, r, "Invalid LogoutRequest", http.StatusBadRequest)
+		return
+	}
+	if err := s.validateLogoutRequest(&req); err != nil {
+		s.logger.Warnw("Rejected LogoutRequest", "requestID", req.ID, "error", err)
+		s.renderError(w, r, "Invalid LogoutRequest", http.StatusBadRequest)
+		return
+	}
+	sigErr := s.checkLogoutRequestSignature(r, msg, req.Issuer.Value)
+	if sigErr != nil && !errors.Is(sigErr, errUnsignedRequest) {
+		s.logger.Warnw("Rejected LogoutRequest", "entityID", req.Issuer.Value, "requestID", req.ID, "error", sigErr)
+		s.renderError(w, r, "Invalid LogoutRequest signature", http.StatusBadRequest)
+		return
+	}
+
+	entityID := req.Issuer.Value
+	sessionIndex := ""
+	if req.SessionIndex != nil {
+		sessionIndex = req.SessionIndex.Value
+	}
+
+	// Anyone can send an unsigned request, so it only ends the session of
+	// the browser it came from
+	var sessionIDs []string
+	var err error
+	if sigErr == nil {
+		sessionIDs, err = s.db.FindParticipantSessionIDs(entityID, req.NameID.Value, sessionIndex)
+	} else {
+		sessionIDs, err = s.browserParticipantSessionIDs(r, entityID, req.NameID.Value, sessionIndex)
+	}
+	if err != nil {
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	participants, err := s.endSessions(w, sessionIDs, entityID)
+	if err != nil {
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Infow("SP-initiated logout", "entityID", entityID, "requestID", req.ID,
+		"sessions", len(sessionIDs), "participants", len(participants))
+	now := time.Now()
+	s.continueLogout(w, r, &PendingLogout{
+		ID:                 newSAMLID(),
+		InitiatorEntityID:  entityID,
+		InitiatorRequestID: req.ID,
+		RelayState:         msg.RelayState,
+		Participants:       participants,
+		CreateTime:         now,
+		ExpireTime:         now.Add(pendingLogoutTTL),
+	})
+}
+
+// browserParticipantSessionIDs returns the session of the saml_session cookie
+// of r if entityID took part in it with nameID and sessionIndex.
+func (s *Server) browserParticipantSessionIDs(r *http.Request, entityID, nameID, sessionIndex string) ([]string, error) {
+	cookie, err := r.Cookie("saml_session")
+	if err != nil || cookie.Value == "" || sessionIndex == "" {
+		return nil, nil
+	}
+	sessionID := sessionIDFromToken(cookie.Value)
+	participants, err := s.db.GetSessionParticipants(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range participants {
+		if p.EntityID == entityID && p.NameID == nameID && p.SessionIndex == sessionIndex {
+			return []string{sessionID}, nil
+		}
+	}
+	return nil, nil
+}
+
+// validateLogoutRequest checks that req comes from a registered service
+// provider, is addressed to this IdP and is still current.
+func (s *Server) validateLogoutRequest(req *saml.LogoutRequest) error {
+	if req.Issuer == nil || req.Issuer.Value == "" {
+		return errors.New("missing Issuer")
+	}
+	if req.NameID == nil || req.NameID.Value == "" {
+		return errors.New("missing NameID")
+	}
+	if _, err := s.db.GetServiceProvider(req.Issuer.Value); err != nil {
+		return fmt.Errorf("unknown service provider %q", req.Issuer.Value)
+	}
+	if req.Destination != "" && req.Destination != s.samlIdp.LogoutURL.String() {
+		return fmt.Errorf("wrong Destination %q", req.Destination)
+	}
+
+	now := saml.TimeNow()
+	if req.IssueInstant.Add(saml.MaxIssueDelay).Before(now) {
+		return errors.New("request expired")
+	}
+	if req.NotOnOrAfter != nil && !now.Before(*req.NotOnOrAfter) {
+		return errors.New("request expired")
+	}
+	return nil
+}
+
+func (s *Server) handleLogoutResponse(w http.ResponseWriter, r *http.Request, msg *samlMessage) {
+	var resp saml.LogoutResponse
+	if err := xml.Unmarshal(msg.Data, &resp); err != nil {
+		s.logger.Warnw("Failed to parse LogoutResponse", "error", err)
+		s.renderError(w, r, "Invalid LogoutResponse", http.StatusBadRequest)
+		return
+	}
+
+	logout, err := s.db.GetPendingLogout(msg.RelayState)
+	if err != nil {
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		return
+	}
+	if logout == nil || resp.InResponseTo == "" || resp.InResponseTo != logout.CurrentRequestID {
+		s.logger.Warnw("LogoutResponse does not match a pending logout", "inResponseTo", resp.InResponseTo)
+		s.renderError(w, r, "Unknown or expired logout", http.StatusBadRequest)
+		return
+	}
+	issuer := ""
+	if resp.Issuer != nil {
+		issuer = resp.Issuer.Value
+	}
+	if issuer != logout.CurrentEntityID {
+		s.logger.Warnw("LogoutResponse from the wrong service provider", "entityID", issuer,
+			"expectedEntityID", logout.CurrentEntityID, "inResponseTo", resp.InResponseTo)
+		s.renderError(w, r, "Invalid LogoutResponse", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.checkRequestSignature(r, msg, issuer); err != nil {
+		s.logger.Warnw("Rejected LogoutResponse", "entityID", issuer, "inResponseTo", resp.InResponseTo, "error", err)
+		s.renderError(w, r, "Invalid LogoutResponse signature", http.StatusBadRequest)
+		return
+	}
+
+	if resp.Status.StatusCode.Value != saml.StatusSuccess {
+		s.logger.Warnw("Service provider failed to log out", "entityID", issuer, "status", resp.Status.StatusCode.Value)
+		logout.Partial = true
+	}
+	s.continueLogout(w, r, logout)
+}
+
+// endSessions deletes the given sessions and clears the session cookie. It
+// returns the participants of those sessions other than excludeEntityID, one
+// per service provider.
+func (s *Server) endSessions(w http.ResponseWriter, sessionIDs []string, excludeEntityID string) ([]*SessionParticipant, error) {
+	participants, err := s.deleteSessions(sessionIDs, excludeEntityID)
+	if err != nil {
+		return nil, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "saml_session",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return participants, nil
+}
+
+// deleteSessions deletes the given sessions and returns their participants
+// other than excludeEntityID, one per service provider.
+func (s *Server) deleteSessions(sessionIDs []string, excludeEntityID string) ([]*SessionParticipant, error) {
+	var participants []*SessionParticipant
+	seen := map[string]bool{excludeEntityID: true}
+	for _, sessionID := range sessionIDs {
+		sessionParticipants, err := s.db.GetSessionParticipants(sessionID)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range sessionParticipants {
+			if !seen[p.EntityID] {
+				seen[p.EntityID] = true
+				participants = append(participants, p)
+			}
+		}
+		if err := s.db.DeleteSession(sessionID); err != nil {
+			return nil, err
+		}
+	}
+	return participants, nil
+}
+
+// continueLogout sends a LogoutRequest to the next participant of logout that
+// has an SLO endpoint. Once none are left, it answers the initiating service
+// provider, or shows the signed out page for IdP-initiated logout.
+func (s *Server) continueLogout(w http.ResponseWriter, r *http.Request, logout *PendingLogout) {
+	for len(logout.Participants) > 0 {
+		participant := logout.Participants[0]
+		logout.Participants = logout.Participants[1:]
+
+		descriptor, err := s.db.GetServiceProvider(participant.EntityID)
+		if err != nil {
+			s.logger.Warnw("Cannot propagate logout to unknown service provider", "entityID", participant.EntityID, "error", err)
+			logout.Partial = true
+			continue
+		}
+		slo := defaultSLO(descriptor)
+		if slo == nil {
+			s.logger.Infow("Service provider has no SLO endpoint, skipping", "entityID", participant.EntityID)
+			logout.Partial = true
+			continue
+		}
+
+		req := s.newLogoutRequest(participant, slo.Location)
+		logout.CurrentRequestID = req.ID
+		logout.CurrentEntityID = participant.EntityID
+		if err := s.db.SavePendingLogout(logout); err != nil {
+			s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+			return
+		}
+
+		s.logger.Infow("Propagating logout", "entityID", participant.EntityID, "requestID", req.ID)
+		if err := s.sendLogoutRequest(w, r, req, slo.Binding, logout.ID); err != nil {
+			s.logger.Errorw("Failed to send LogoutRequest", "entityID", participant.EntityID, "error", err)
+			s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := s.db.DeletePendingLogout(logout.ID); err != nil {
+		s.logger.Warnw("Failed to delete pending logout", "logoutID", logout.ID, "error", err)
+	}
+	s.finishLogout(w, r, logout)
+}
+
+func (s *Server) finishLogout(w http.ResponseWriter, r *http.Request, logout *PendingLogout) {
+	var slo *saml.Endpoint
+	if logout.InitiatorEntityID != "" {
+		if descriptor, err := s.db.GetServiceProvider(logout.InitiatorEntityID); err == nil {
+			slo = defaultSLO(descriptor)
+		}
+	}
+	if slo == nil {
+		if err := s.renderPage(w, http.StatusOK, loggedOutPageTemplate, &pageData{CorrelationID: correlationID(r)}); err != nil {
+			s.logger.Errorw("Failed to render logged out page", "error", err)
+		}
+		return
+	}
+
+	location := slo.Location
+	if slo.ResponseLocation != "" {
+		location = slo.ResponseLocation
+	}
+	resp := &saml.LogoutResponse{
+		ID:           newSAMLID(),
+		InResponseTo: logout.InitiatorRequestID,
+		Version:      "2.0",
+		IssueInstant: saml.TimeNow(),
+		Destination:  location,
+		Issuer:       s.idpIssuer(),
+		Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+	if logout.Partial {
+		resp.Status.StatusCode.StatusCode = &saml.StatusCode{Value: statusPartialLogout}
+	}
+
+	s.logger.Infow("Logout complete", "entityID", logout.InitiatorEntityID, "partial", logout.Partial)
+	if err := s.sendLogoutResponse(w, r, resp, slo.Binding, logout.RelayState); err != nil {
+		s.logger.Errorw("Failed to send LogoutResponse", "entityID", logout.InitiatorEntityID, "error", err)
+		s.renderError(w, r, "Unexpected error. Please try again later.", http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) idpIssuer() *saml.Issuer {
+	return &saml.Issuer{
+		Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+		Value:  s.samlIdp.MetadataURL.String(),
+	}
+}
+
+// newLogoutRequest builds the LogoutRequest propagated to a participant.
+func (s *Server) newLogoutRequest(participant *SessionParticipant, destination string) *saml.LogoutRequest {
+	notOnOrAfter := saml.TimeNow().Add(saml.MaxIssueDelay)
+	return &saml.LogoutRequest{
+		ID:           newSAMLID(),
+		Version:      "2.0",
+		IssueInstant: saml.TimeNow(),
+		NotOnOrAfter: &notOnOrAfter,
+		Destination:  destination,
+		Issuer:       s.idpIssuer(),
+		NameID: &saml.NameID{
+			Format:          participant.NameIDFormat,
+			NameQualifier:   s.samlIdp.MetadataURL.String(),
+			SPNameQualifier: participant.EntityID,
+			Value:           participant.NameID,
+		},
+		SessionIndex: &saml.SessionIndex{Value: participant.SessionIndex},
+	}
+}
+
+// -------------------------------------------------------------------------
+// Sending Logout Messages
+// -------------------------------------------------------------------------
+
+func (s *Server) sendLogoutRequest(w http.ResponseWriter, r *http.Request, req *saml.LogoutRequest, binding, relayState string) error {
+	if binding == saml.HTTPPostBinding {
+		signature, err := s.signEnveloped(req.Element())
+		if err != nil {
+			return err
+		}
+		req.Signature = signature
+		return s.writePostForm(w, r, "SAMLRequest", req.Element(), req.Destination, relayState)
+	}
+	return s.redirectSigned(w, r, "SAMLRequest", req.Element(), req.Destination, relayState)
+}
+
+func (s *Server) sendLogoutResponse(w http.ResponseWriter, r *http.Request, resp *saml.LogoutResponse, binding, relayState string) error {
+	if binding == saml.HTTPPostBinding {
+		signature, err := s.signEnveloped(resp.Element())
+		if err != nil {
+			return err
+		}
+		resp.Signature = signature
+		return s.writePostForm(w, r, "SAMLResponse", resp.Element(), resp.Destination, relayState)
+	}
+	return s.redirectSigned(w, r, "SAMLResponse", resp.Element(), resp.Destination, relayState)
+}
+
+// signingContext returns an XML signing context for the active IdP key pair
+// and signature algorithm.
+func (s *Server) signingContext() (*dsig.SigningContext, error) {
+	idp := s.identityProvider()
+	if idp.Signer == nil {
+		return nil, errors.New("IdP key cannot be used for signing")
+	}
+	signingContext, err := dsig.NewSigningContext(idp.Signer, [][]byte{idp.Certificate.Raw})
+	if err != nil {
+		return nil, err
+	}
+	signingContext.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	if err := signingContext.SetSignatureMethod(idp.SignatureMethod); err != nil {
+		return nil, err
+	}
+	return signingContext, nil
+}
+
+// signEnveloped returns an enveloped signature over el, to be placed in the
+// Signature field of the message el was built from.
+func (s *Server) signEnveloped(el *etree.Element) (*etree.Element, error) {
+	signingContext, err := s.signingContext()
+	if err != nil {
+		return nil, err
+	}
+	signed, err := signingContext.SignEnveloped(el)
+	if err != nil {
+		return nil, err
+	}
+	return signed.Child[len(signed.Child)-1].(*etree.Element), nil
+}
+
+// redirectSigned sends el to destination using the HTTP-Redirect binding.
+func (s *Server) redirectSigned(w http.ResponseWriter, r *http.Request, param string, el *etree.Element, destination, relayState string) error {
+	location, err := s.signedRedirectURL(param, el, destination, relayState)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+	return nil
+}
+
+// signedRedirectURL returns the HTTP-Redirect binding URL carrying el to
+// destination, with the query string signed as described in saml-bindings
+// 3.4.4.1.
+func (s *Server) signedRedirectURL(param string, el *etree.Element, destination, relayState string) (string, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	var buf bytes.Buffer
+	encoder := base64.NewEncoder(base64.StdEncoding, &buf)
+	compressor, _ := flate.NewWriter(encoder, flate.BestCompression)
+	if _, err := doc.WriteTo(compressor); err != nil {
+		return "", err
+	}
+	if err := compressor.Close(); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+
+	signingContext, err := s.signingContext()
+	if err != nil {
+		return "", err
+	}
+	query := param + "=" + url.QueryEscape(buf.String())
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(signingContext.GetSignatureMethodIdentifier())
+	signature, err := signingContext.SignString(query)
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+
+	separator := "?"
+	if strings.Contains(destination, "?") {
+		separator = "&"
+	}
+	return destination + separator + query, nil
+}
+
+// -------------------------------------------------------------------------
+// Session Participant Tracking
+// -------------------------------------------------------------------------
+
+// assertionMaker wraps crewjam's default assertion maker to set the
+// authentication context of the login, to sign and encrypt the response with
+// the algorithms and signing mode chosen for the service provider and to
+// record each service provider an assertion is issued to as a participant of
+// the session.
+type assertionMaker struct {
+	server *Server
+}
+
+func (m *assertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	signingMode := m.server.applyServiceProviderSigning(req)
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		return err
+	}
+	if contexts := m.server.config.AuthnContextMap; len(contexts) > 0 {
+		// The context of the login comes from the acr and amr claims
+		_, rawClaims := m.server.db.GetSession(session.ID)
+		req.Assertion.AuthnStatements[0].AuthnContext.AuthnContextClassRef.Value = contexts.classRefFor(rawClaims)
+	}
+	if err := makeResponse(req, signingMode); err != nil {
+		return err
+	}
+
+	nameID := req.Assertion.Subject.NameID
+	participant := &SessionParticipant{
+		SessionID:    session.ID,
+		EntityID:     req.ServiceProviderMetadata.EntityID,
+		NameID:       nameID.Value,
+		NameIDFormat: nameID.Format,
+		SessionIndex: session.Index,
+	}
+	if err := m.server.db.SaveSessionParticipant(participant); err != nil {
+		// Not fatal: the user is signed in, but this SP will miss single logout
+		m.server.logger.Errorw("Failed to record session participant", "sessionID", session.ID, "entityID", participant.EntityID, "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,488 @@
+package provider
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"html"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/canonical/identity-saml-provider/migrations"
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// setupTestIdP gives server a SAML IdP with a freshly generated key pair.
+func setupTestIdP(t *testing.T, server *Server) {
+	t.Helper()
+
+	key, certDER, err := dsig.RandomKeyStoreForTest().GetKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate IdP key pair: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf("Failed to parse IdP certificate: %v", err)
+	}
+
+	server.samlIdp = &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             cert,
+		MetadataURL:             server.parseURL(server.config.BridgeBaseURL + "/saml/metadata"),
+		SSOURL:                  server.parseURL(server.config.BridgeBaseURL + "/saml/sso"),
+		LogoutURL:               server.parseURL(server.config.BridgeBaseURL + "/saml/slo"),
+		ServiceProviderProvider: &serviceProviderAdapter{db: server.db},
+		SessionProvider:         &sessionProviderAdapter{server: server},
+		AssertionMaker:          &assertionMaker{server: server},
+	}
+}
+
+func deflateBase64(t *testing.T, data []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Failed to deflate: %v", err)
+	}
+	_ = w.Close()
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func inflateBase64(t *testing.T, encoded string) []byte {
+	t.Helper()
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("Invalid base64: %v", err)
+	}
+	inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("Failed to inflate: %v", err)
+	}
+	return inflated
+}
+
+func TestReadSAMLMessage(t *testing.T) {
+	const request = `<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0"/>`
+
+	t.Run("redirect", func(t *testing.T) {
+		query := url.Values{"SAMLRequest": {deflateBase64(t, []byte(request))}, "RelayState": {"state"}}
+		r := httptest.NewRequest(http.MethodGet, "/saml/slo?"+query.Encode(), nil)
+		msg, err := readSAMLMessage(r)
+		if err != nil {
+			t.Fatalf("readSAMLMessage failed: %v", err)
+		}
+		if msg.Binding != saml.HTTPRedirectBinding || msg.IsResponse || msg.RelayState != "state" || string(msg.Data) != request {
+			t.Errorf("Unexpected message: %+v", msg)
+		}
+	})
+
+	t.Run("post", func(t *testing.T) {
+		form := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(request))}}
+		r := httptest.NewRequest(http.MethodPost, "/saml/slo", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		msg, err := readSAMLMessage(r)
+		if err != nil {
+			t.Fatalf("readSAMLMessage failed: %v", err)
+		}
+		if msg.Binding != saml.HTTPPostBinding || !msg.IsResponse || string(msg.Data) != request {
+			t.Errorf("Unexpected message: %+v", msg)
+		}
+	})
+
+	for name, target := range map[string]string{
+		"missing":      "/saml/slo",
+		"not base64":   "/saml/slo?SAMLRequest=%%%",
+		"not deflated": "/saml/slo?SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString([]byte(request))),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readSAMLMessage(httptest.NewRequest(http.MethodGet, target, nil)); err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestRedirectSigned(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	resp := &saml.LogoutResponse{
+		ID:           "id-response",
+		InResponseTo: "id-request",
+		Version:      "2.0",
+		IssueInstant: time.Now(),
+		Destination:  "https://sp.example.com/slo?tenant=a",
+		Issuer:       server.idpIssuer(),
+		Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+
+	rec := httptest.NewRecorder()
+	if err := server.redirectSigned(rec, httptest.NewRequest(http.MethodGet, "/", nil), "SAMLResponse", resp.Element(), resp.Destination, "relay"); err != nil {
+		t.Fatalf("redirectSigned failed: %v", err)
+	}
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusFound, rec.Code)
+	}
+
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, "https://sp.example.com/slo?tenant=a&SAMLResponse=") {
+		t.Fatalf("Unexpected redirect location %q", location)
+	}
+	rawQuery := location[strings.Index(location, "SAMLResponse="):]
+	signed, signature, _ := strings.Cut(rawQuery, "&Signature=")
+
+	query, _ := url.ParseQuery(rawQuery)
+	if query.Get("SigAlg") != dsig.RSASHA256SignatureMethod || query.Get("RelayState") != "relay" {
+		t.Errorf("Unexpected query parameters: %v", query)
+	}
+	if !strings.Contains(string(inflateBase64(t, query.Get("SAMLResponse"))), `InResponseTo="id-request"`) {
+		t.Error("Expected the LogoutResponse in the SAMLResponse parameter")
+	}
+
+	signatureValue, _ := url.QueryUnescape(signature)
+	signatureBytes, _ := base64.StdEncoding.DecodeString(signatureValue)
+	digest := sha256.Sum256([]byte(signed))
+	publicKey := server.samlIdp.Certificate.PublicKey.(*rsa.PublicKey)
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signatureBytes); err != nil {
+		t.Errorf("Query string signature does not verify: %v", err)
+	}
+}
+
+func TestSendLogoutRequest_PostIsSigned(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	participant := &SessionParticipant{EntityID: "https://sp.example.com", NameID: "user@example.com", SessionIndex: "idx"}
+	req := server.newLogoutRequest(participant, "https://sp.example.com/slo")
+
+	rec := httptest.NewRecorder()
+	if err := server.sendLogoutRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil), req, saml.HTTPPostBinding, "relay"); err != nil {
+		t.Fatalf("sendLogoutRequest failed: %v", err)
+	}
+
+	match := regexp.MustCompile(`name="SAMLRequest" value="([^"]+)"`).FindStringSubmatch(rec.Body.String())
+	if match == nil {
+		t.Fatalf("Expected an auto-submit form, got %s", rec.Body.String())
+	}
+	data, _ := base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		t.Fatalf("Invalid LogoutRequest XML: %v", err)
+	}
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{server.samlIdp.Certificate},
+	})
+	if _, err := validationContext.Validate(doc.Root()); err != nil {
+		t.Errorf("LogoutRequest signature does not verify: %v", err)
+	}
+
+	var parsed saml.LogoutRequest
+	if err := xml.Unmarshal(data, &parsed); err != nil {
+		t.Fatalf("Failed to parse LogoutRequest: %v", err)
+	}
+	if parsed.NameID.Value != "user@example.com" || parsed.SessionIndex.Value != "idx" || parsed.Destination != "https://sp.example.com/slo" {
+		t.Errorf("Unexpected LogoutRequest: %+v", parsed)
+	}
+}
+
+func TestHandleMetadata_AdvertisesSLOBindings(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	rec := httptest.NewRecorder()
+	server.handleMetadata(rec, httptest.NewRequest(http.MethodGet, "/saml/metadata", nil))
+
+	var metadata saml.EntityDescriptor
+	if err := xml.Unmarshal(rec.Body.Bytes(), &metadata); err != nil {
+		t.Fatalf("Failed to parse metadata: %v", err)
+	}
+	bindings := map[string]string{}
+	for _, slo := range metadata.IDPSSODescriptors[0].SingleLogoutServices {
+		bindings[slo.Binding] = slo.Location
+	}
+	for _, binding := range []string{saml.HTTPRedirectBinding, saml.HTTPPostBinding} {
+		if bindings[binding] != "http://localhost:8082/saml/slo" {
+			t.Errorf("Expected %s SLO endpoint, got %v", binding, bindings)
+		}
+	}
+}
+
+func TestValidateLogoutRequest_MissingFields(t *testing.T) {
+	server := setupTestServer(t)
+	setupTestIdP(t, server)
+
+	for name, req := range map[string]*saml.LogoutRequest{
+		"no issuer":  {NameID: &saml.NameID{Value: "user"}},
+		"no name id": {Issuer: &saml.Issuer{Value: "https://sp.example.com"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := server.validateLogoutRequest(req); err == nil {
+				t.Error("Expected an error, got nil")
+			}
+		})
+	}
+}
+
+func TestDefaultSLO(t *testing.T) {
+	descriptor, err := parseServiceProviderMetadata([]byte(testSPMetadata))
+	if err != nil {
+		t.Fatalf("parseServiceProviderMetadata failed: %v", err)
+	}
+	if slo := defaultSLO(descriptor); slo == nil || slo.Location != "https://sp.example.com/slo" {
+		t.Errorf("Unexpected SLO endpoint %+v", slo)
+	}
+
+	sp := &ServiceProvider{}
+	applyMetadataDescriptor(sp, descriptor)
+	if sp.SLOURL != "https://sp.example.com/slo" || sp.SLOBinding != saml.HTTPRedirectBinding {
+		t.Errorf("Expected SLO fields derived from metadata, got %+v", sp)
+	}
+
+	if slo := defaultSLO(&saml.EntityDescriptor{}); slo != nil {
+		t.Errorf("Expected no SLO endpoint, got %+v", slo)
+	}
+}
+
+func TestSingleLogout_SPInitiated(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	setupTestIdP(t, server)
+	server.router.HandleFunc("/saml/slo", server.handleSLO)
+
+	initiator := &ServiceProvider{EntityID: "https://slo-a.example.com", ACSURL: "https://slo-a.example.com/acs",
+		ACSBinding: saml.HTTPPostBinding, SLOURL: "https://slo-a.example.com/slo", SLOBinding: saml.HTTPRedirectBinding}
+	other := &ServiceProvider{EntityID: "https://slo-b.example.com", ACSURL: "https://slo-b.example.com/acs",
+		ACSBinding: saml.HTTPPostBinding, SLOURL: "https://slo-b.example.com/slo", SLOBinding: saml.HTTPRedirectBinding}
+	for _, sp := range []*ServiceProvider{initiator, other} {
+		if err := server.db.SaveServiceProvider(sp); err != nil {
+			t.Fatalf("SaveServiceProvider failed: %v", err)
+		}
+		entityID := sp.EntityID
+		t.Cleanup(func() { _ = server.db.DeleteServiceProvider(entityID) })
+	}
+
+	sessionToken := "slo-session-token"
+	session := &saml.Session{ID: sessionIDFromToken(sessionToken), CreateTime: time.Now(), ExpireTime: time.Now().Add(time.Hour),
+		Index: "slo-session", NameID: "user@example.com", UserEmail: "user@example.com"}
+	if err := server.db.SaveSession(session, nil); err != nil {
+		t.Fatalf("SaveSession failed: %v", err)
+	}
+	for _, sp := range []*ServiceProvider{initiator, other} {
+		if err := server.db.SaveSessionParticipant(&SessionParticipant{SessionID: session.ID, EntityID: sp.EntityID,
+			NameID: session.NameID, SessionIndex: session.Index}); err != nil {
+			t.Fatalf("SaveSessionParticipant failed: %v", err)
+		}
+	}
+
+	// 1. The initiating SP sends a LogoutRequest; the IdP propagates it to the other SP
+	logoutRequest := &saml.LogoutRequest{
+		ID:           "id-sp-logout",
+		Version:      "2.0",
+		IssueInstant: time.Now(),
+		Destination:  "http://localhost:8082/saml/slo",
+		Issuer:       &saml.Issuer{Value: initiator.EntityID},
+		NameID:       &saml.NameID{Value: session.NameID},
+		SessionIndex: &saml.SessionIndex{Value: session.Index},
+	}
+	data, _ := logoutRequest.Bytes()
+	query := url.Values{"SAMLRequest": {deflateBase64(t, data)}, "RelayState": {"sp-state"}}
+
+	// Unsigned, the request only ends the session of the browser it came from
+	rec := httptest.NewRecorder()
+	server.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/slo?"+query.Encode(), nil))
+	if s, _ := server.db.GetSession(session.ID); s == nil {
+		t.Fatal("Expected an unsigned request without the session cookie to keep the session")
+	}
+
+	rec = httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/saml/slo?"+query.Encode(), nil)
+	request.AddCookie(&http.Cookie{Name: "saml_session", Value: sessionToken})
+	server.router.ServeHTTP(rec, request)
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected redirect to the other SP, got %d: %s", rec.Code, rec.Body.String())
+	}
+	location, _ := url.Parse(rec.Header().Get("Location"))
+	if location.Host != "slo-b.example.com" {
+		t.Fatalf("Expected redirect to %s, got %s", other.SLOURL, location)
+	}
+	var propagated saml.LogoutRequest
+	if err := xml.Unmarshal(inflateBase64(t, location.Query().Get("SAMLRequest")), &propagated); err != nil {
+		t.Fatalf("Failed to parse propagated LogoutRequest: %v", err)
+	}
+	if s, _ := server.db.GetSession(session.ID); s != nil {
+		t.Error("Expected the session to be deleted")
+	}
+
+	// 2. The other SP answers; the IdP responds to the initiator
+	logoutResponse := &saml.LogoutResponse{
+		ID:           "id-sp-response",
+		InResponseTo: propagated.ID,
+		Version:      "2.0",
+		IssueInstant: time.Now(),
+		Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+	encodeResponse := func() url.Values {
+		doc := etree.NewDocument()
+		doc.SetRoot(logoutResponse.Element())
+		data, _ := doc.WriteToBytes()
+		return url.Values{"SAMLResponse": {deflateBase64(t, data)}, "RelayState": {location.Query().Get("RelayState")}}
+	}
+
+	// Only the participant the request was sent to can answer it
+	logoutResponse.Issuer = &saml.Issuer{Value: initiator.EntityID}
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/slo?"+encodeResponse().Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status %d for a response from another SP, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	logoutResponse.Issuer = &saml.Issuer{Value: other.EntityID}
+	query = encodeResponse()
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/slo?"+query.Encode(), nil))
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected redirect to the initiator, got %d: %s", rec.Code, rec.Body.String())
+	}
+	location, _ = url.Parse(rec.Header().Get("Location"))
+	if location.Host != "slo-a.example.com" || location.Query().Get("RelayState") != "sp-state" {
+		t.Fatalf("Unexpected redirect %s", location)
+	}
+	var final saml.LogoutResponse
+	if err := xml.Unmarshal(inflateBase64(t, location.Query().Get("SAMLResponse")), &final); err != nil {
+		t.Fatalf("Failed to parse LogoutResponse: %v", err)
+	}
+	if final.InResponseTo != logoutRequest.ID || final.Status.StatusCode.Value != saml.StatusSuccess || final.Status.StatusCode.StatusCode != nil {
+		t.Errorf("Unexpected LogoutResponse: %+v", final)
+	}
+
+	// A replayed response no longer matches a pending logout
+	rec = httptest.NewRecorder()
+	server.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/slo?"+query.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a replayed response, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestIdPInitiatedLogout_NoSession(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	setupTestIdP(t, server)
+
+	rec := httptest.NewRecorder()
+	server.handleIdPInitiatedLogout(rec, httptest.NewRequest(http.MethodPost, "/saml/logout", nil))
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "signed out") {
+		t.Errorf("Expected the signed out page, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var cleared bool
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "saml_session" && cookie.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("Expected the session cookie to be cleared")
+	}
+}
+
+func TestIdPInitiatedLogout_SameOriginPostOnly(t *testing.T) {
+	server := setupTestServer(t)
+	server.SetupRoutes()
+
+	rec := httptest.NewRecorder()
+	server.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/saml/logout", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `action="`+server.config.BridgeBaseURL+`/saml/logout"`) {
+		t.Errorf("Expected the logout confirmation page, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for name, header := range map[string][2]string{
+		"Sec-Fetch-Site": {"Sec-Fetch-Site", "cross-site"},
+		"Origin":         {"Origin", "https://evil.example.com"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/saml/logout", nil)
+			req.Header.Set(header[0], header[1])
+			req.AddCookie(&http.Cookie{Name: "saml_session", Value: "token"})
+			rec := httptest.NewRecorder()
+			server.router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusForbidden {
+				t.Errorf("Expected status %d for a cross-origin logout, got %d", http.StatusForbidden, rec.Code)
+			}
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == "saml_session" {
+					t.Error("Expected the session cookie to be kept")
+				}
+			}
+		})
+	}
+}
+
+func TestSingleLogout_SignedSPRequiresSignature(t *testing.T) {
+	server := setupTestServer(t)
+	if server.db.db == nil {
+		t.Skip("Skipping test: database not available")
+	}
+	if err := migrations.RunMigrationsUp(context.Background(), server.db.GetDB()); err != nil {
+		t.Skipf("Cannot initialize schema: %v", err)
+	}
+	setupTestIdP(t, server)
+
+	// The SP signs with the same key pair as the test IdP
+	sp := &ServiceProvider{EntityID: "https://slo-signed.example.com", ACSURL: "https://slo-signed.example.com/acs",
+		ACSBinding: saml.HTTPPostBinding, SLOURL: "https://slo-signed.example.com/slo", SLOBinding: saml.HTTPRedirectBinding,
+		SigningCerts: []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.samlIdp.Certificate.Raw}))}}
+	if err := server.db.SaveServiceProvider(sp); err != nil {
+		t.Fatalf("SaveServiceProvider failed: %v", err)
+	}
+	t.Cleanup(func() { _ = server.db.DeleteServiceProvider(sp.EntityID) })
+
+	logoutRequest := &saml.LogoutRequest{
+		ID:           newSAMLID(),
+		Version:      "2.0",
+		IssueInstant: time.Now(),
+		Issuer:       &saml.Issuer{Value: sp.EntityID},
+		NameID:       &saml.NameID{Value: "user@example.com"},
+	}
+	data, _ := logoutRequest.Bytes()
+	rec := httptest.NewRecorder()
+	server.handleSLO(rec, httptest.NewRequest(http.MethodGet, "/saml/slo?SAMLRequest="+url.QueryEscape(deflateBase64(t, data)), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unsigned request, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	location, err := server.signedRedirectURL("SAMLRequest", logoutRequest.Element(), "/saml/slo", "")
+	if err != nil {
+		t.Fatalf("signedRedirectURL failed: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	server.handleSLO(rec, httptest.NewRequest(http.MethodGet, location, nil))
+	if rec.Code != http.StatusOK && rec.Code != http.StatusFound {
+		t.Errorf("Expected a signed request to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+
+CREATE TABLE IF NOT EXISTS pending_authn_requests (
+    id TEXT PRIMARY KEY,
+    saml_request TEXT NOT NULL,
+    relay_state TEXT NOT NULL DEFAULT '',
+    create_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expire_time TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_pending_authn_requests_expire_time ON pending_authn_requests(expire_time);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_pending_authn_requests_expire_time;
+DROP TABLE IF EXISTS pending_authn_requests;
+
+-- +goose StatementEnd
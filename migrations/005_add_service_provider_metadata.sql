@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    ADD COLUMN IF NOT EXISTS metadata_xml TEXT,
+    ADD COLUMN IF NOT EXISTS metadata_url TEXT;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    DROP COLUMN IF EXISTS metadata_url,
+    DROP COLUMN IF EXISTS metadata_xml;
+
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    ADD COLUMN IF NOT EXISTS metadata_refresh_interval_seconds INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS metadata_signing_cert TEXT,
+    ADD COLUMN IF NOT EXISTS metadata_last_refresh_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS metadata_last_success_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS metadata_refresh_error TEXT;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    DROP COLUMN IF EXISTS metadata_refresh_error,
+    DROP COLUMN IF EXISTS metadata_last_success_at,
+    DROP COLUMN IF EXISTS metadata_last_refresh_at,
+    DROP COLUMN IF EXISTS metadata_signing_cert,
+    DROP COLUMN IF EXISTS metadata_refresh_interval_seconds;
+
+-- +goose StatementEnd
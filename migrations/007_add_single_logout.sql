@@ -0,0 +1,48 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    ADD COLUMN IF NOT EXISTS slo_url TEXT,
+    ADD COLUMN IF NOT EXISTS slo_binding TEXT;
+
+CREATE TABLE IF NOT EXISTS session_participants (
+    session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    entity_id TEXT NOT NULL,
+    name_id TEXT NOT NULL,
+    name_id_format TEXT NOT NULL DEFAULT '',
+    session_index TEXT NOT NULL,
+    create_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (session_id, entity_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_session_participants_entity_name_id ON session_participants(entity_id, name_id);
+
+CREATE TABLE IF NOT EXISTS pending_logouts (
+    id TEXT PRIMARY KEY,
+    initiator_entity_id TEXT NOT NULL DEFAULT '',
+    initiator_request_id TEXT NOT NULL DEFAULT '',
+    relay_state TEXT NOT NULL DEFAULT '',
+    participants JSONB NOT NULL DEFAULT '[]',
+    current_request_id TEXT NOT NULL DEFAULT '',
+    partial BOOLEAN NOT NULL DEFAULT FALSE,
+    create_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expire_time TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_pending_logouts_expire_time ON pending_logouts(expire_time);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_pending_logouts_expire_time;
+DROP TABLE IF EXISTS pending_logouts;
+DROP INDEX IF EXISTS idx_session_participants_entity_name_id;
+DROP TABLE IF EXISTS session_participants;
+
+ALTER TABLE service_providers
+    DROP COLUMN IF EXISTS slo_binding,
+    DROP COLUMN IF EXISTS slo_url;
+
+-- +goose StatementEnd
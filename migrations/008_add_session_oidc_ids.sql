@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE sessions
+    ADD COLUMN IF NOT EXISTS oidc_sid TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS oidc_sub TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS idx_sessions_oidc_sid ON sessions(oidc_sid) WHERE oidc_sid <> '';
+CREATE INDEX IF NOT EXISTS idx_sessions_oidc_sub ON sessions(oidc_sub) WHERE oidc_sub <> '';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP INDEX IF EXISTS idx_sessions_oidc_sub;
+DROP INDEX IF EXISTS idx_sessions_oidc_sid;
+
+ALTER TABLE sessions
+    DROP COLUMN IF EXISTS oidc_sub,
+    DROP COLUMN IF EXISTS oidc_sid;
+
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    ADD COLUMN IF NOT EXISTS allow_idp_initiated BOOLEAN NOT NULL DEFAULT FALSE;
+
+ALTER TABLE pending_authn_requests
+    ALTER COLUMN saml_request SET DEFAULT '',
+    ADD COLUMN IF NOT EXISTS idp_initiated_entity_id TEXT NOT NULL DEFAULT '';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE pending_authn_requests
+    DROP COLUMN IF EXISTS idp_initiated_entity_id,
+    ALTER COLUMN saml_request DROP DEFAULT;
+
+ALTER TABLE service_providers
+    DROP COLUMN IF EXISTS allow_idp_initiated;
+
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    ADD COLUMN IF NOT EXISTS encryption_cert TEXT,
+    ADD COLUMN IF NOT EXISTS encryption_algorithm TEXT;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    DROP COLUMN IF EXISTS encryption_algorithm,
+    DROP COLUMN IF EXISTS encryption_cert;
+
+-- +goose StatementEnd
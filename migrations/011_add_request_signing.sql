@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    ADD COLUMN IF NOT EXISTS signing_certs TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS require_signed_requests BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- The detached signature of an HTTP-Redirect AuthnRequest is replayed with it
+ALTER TABLE pending_authn_requests
+    ADD COLUMN IF NOT EXISTS sig_alg TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS signature TEXT NOT NULL DEFAULT '';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE pending_authn_requests
+    DROP COLUMN IF EXISTS signature,
+    DROP COLUMN IF EXISTS sig_alg;
+
+ALTER TABLE service_providers
+    DROP COLUMN IF EXISTS require_signed_requests,
+    DROP COLUMN IF EXISTS signing_certs;
+
+-- +goose StatementEnd
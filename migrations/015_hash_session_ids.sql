@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- Sessions are now stored under the SHA-256 of a random cookie token. The
+-- existing rows are keyed by the predictable cookie values themselves, so they
+-- are dropped; users sign in again through the OIDC provider.
+DELETE FROM sessions;
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+-- Sessions keyed by hashed tokens are no longer found by their cookies.
+DELETE FROM sessions;
+
+-- +goose StatementEnd
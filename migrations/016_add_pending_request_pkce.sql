@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- The PKCE code verifier and OIDC nonce of the login started for the request
+ALTER TABLE pending_authn_requests
+    ADD COLUMN IF NOT EXISTS code_verifier TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS nonce TEXT NOT NULL DEFAULT '';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE pending_authn_requests
+    DROP COLUMN IF EXISTS nonce,
+    DROP COLUMN IF EXISTS code_verifier;
+
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- Pairwise persistent NameIDs: one opaque identifier per subject and service
+-- provider. Revoked identifiers are kept so they are never issued again.
+CREATE TABLE IF NOT EXISTS persistent_ids (
+    id TEXT PRIMARY KEY,
+    entity_id TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_persistent_ids_active
+    ON persistent_ids (entity_id, subject) WHERE revoked_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_persistent_ids_subject ON persistent_ids (subject);
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+DROP TABLE IF EXISTS persistent_ids;
+
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- The NameID formats a service provider may be issued, as URNs. An empty
+-- list allows every format the IdP supports.
+ALTER TABLE service_providers
+    ADD COLUMN IF NOT EXISTS nameid_formats TEXT[] NOT NULL DEFAULT '{}';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE service_providers
+    DROP COLUMN IF EXISTS nameid_formats;
+
+-- +goose StatementEnd
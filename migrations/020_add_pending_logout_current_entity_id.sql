@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- The service provider the pending LogoutRequest was sent to; only its
+-- LogoutResponse continues the logout.
+ALTER TABLE pending_logouts
+    ADD COLUMN IF NOT EXISTS current_entity_id TEXT NOT NULL DEFAULT '';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE pending_logouts
+    DROP COLUMN IF EXISTS current_entity_id;
+
+-- +goose StatementEnd
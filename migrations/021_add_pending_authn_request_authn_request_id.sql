@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+
+-- The ID of the SAML AuthnRequest, now that rows are keyed on an ID chosen by
+-- the IdP rather than by the service provider
+ALTER TABLE pending_authn_requests
+    ADD COLUMN IF NOT EXISTS authn_request_id TEXT NOT NULL DEFAULT '';
+
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+
+ALTER TABLE pending_authn_requests
+    DROP COLUMN IF EXISTS authn_request_id;
+
+-- +goose StatementEnd